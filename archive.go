@@ -0,0 +1,430 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// アーカイブ形式のスナップショット
+// =============================================================================
+
+// archiveCodec はアーカイブの圧縮形式（archive_format）です。
+type archiveCodec interface {
+	// Name は archive_format に指定する名前を返します。
+	Name() string
+	// Ext はスナップショット名の拡張子を返します。
+	Ext() string
+	// MaxLevel は compression_level に指定できる最大値を返します。
+	MaxLevel() int
+	// NewWriter は w に書き込むアーカイブを作成します（level が 0 の場合は既定の圧縮率）。
+	NewWriter(w io.Writer, level int) (archiveWriter, error)
+	// Open はサイズ size のアーカイブ r を読み込み用に開きます。
+	Open(r io.ReaderAt, size int64) (snapshotReader, error)
+}
+
+// archiveWriter はアーカイブへのファイルの書き込みです。
+type archiveWriter interface {
+	// Add は name（スラッシュ区切りの相対パス）としてファイルの内容を書き込みます。
+	Add(name string, info os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// defaultArchiveFormat は archive_format 省略時の圧縮形式です。
+const defaultArchiveFormat = "zip"
+
+// archiveCodecs は利用できる圧縮形式の一覧です。
+var archiveCodecs = []archiveCodec{
+	zipCodec{},
+	tarZstdCodec{},
+}
+
+// archiveCodecNames は archive_format に指定できる名前の一覧を返します。
+func archiveCodecNames() []string {
+	var names []string
+	for _, c := range archiveCodecs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// findArchiveCodec は名前に対応する圧縮形式を返します。
+func findArchiveCodec(name string) (archiveCodec, bool) {
+	for _, c := range archiveCodecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// archiveCodec は設定された圧縮形式を返します。
+// 不明な名前は設定検査で検出されるため、ここでは既定の形式として扱います。
+func (cfg *BackupConfig) archiveCodec() archiveCodec {
+	if c, ok := findArchiveCodec(defaultString(cfg.ArchiveFormat, defaultArchiveFormat)); ok {
+		return c
+	}
+	c, _ := findArchiveCodec(defaultArchiveFormat)
+	return c
+}
+
+// writeArchive は work_dir を コピーと同じ規則で絞り込んだファイルを、
+// 一時ファイルを作らずにアーカイブ dst へ書き込み、格納したファイル数を返します。
+// 暗号化が有効な場合は暗号化しながら書き込みます。
+// 失敗した場合は作成途中の dst を削除します。
+func writeArchive(cfg *BackupConfig, codec archiveCodec, dst string) (files int, err error) {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+	defer out.Close()
+
+	buf := bufio.NewWriterSize(out, 1<<20)
+	var w io.Writer = buf
+	key, err := snapshotKey(cfg)
+	if err != nil {
+		return 0, err
+	}
+	var ew *encryptWriter
+	if key != nil {
+		if ew, err = newEncryptWriter(buf, key); err != nil {
+			return 0, err
+		}
+		w = ew
+	}
+	aw, err := codec.NewWriter(w, cfg.CompressionLevel)
+	if err != nil {
+		return 0, err
+	}
+	p := startProgress(cfg, "アーカイブ作成")
+	if p != nil {
+		bytes, n := filteredTreeSize(cfg, cfg.WorkDir)
+		p.SetTotal(bytes, n, false)
+	}
+	defer p.Finish()
+	limiter := cfg.Throttle.newLimiter()
+	err = newCopyFilter(cfg).walkFiles(cfg.WorkDir, func(path, rel string, info os.FileInfo) error {
+		in, err := os.Open(path)
+		if err != nil {
+			if isAccessDenied(err) {
+				return nil
+			}
+			return err
+		}
+		defer in.Close()
+		if err := aw.Add(rel, info, limiter.Reader(p.Reader(in))); err != nil {
+			return pkgerrors.Errorf("%s: %v", rel, err)
+		}
+		p.AddFile()
+		files++
+		return nil
+	})
+	if err != nil {
+		aw.Close()
+		return 0, err
+	}
+	if err := aw.Close(); err != nil {
+		return 0, err
+	}
+	if ew != nil {
+		if err := ew.Close(); err != nil {
+			return 0, err
+		}
+	}
+	if err := buf.Flush(); err != nil {
+		return 0, err
+	}
+	if err := out.Sync(); err != nil {
+		return 0, err
+	}
+	return files, out.Close()
+}
+
+// -----------------------------------------------------------------------------
+// zip
+// -----------------------------------------------------------------------------
+
+// zipCodec は zip（Deflate）形式です。目次を持つため、一部のファイルのみ高速に読み出せます。
+type zipCodec struct{}
+
+func (zipCodec) Name() string  { return "zip" }
+func (zipCodec) Ext() string   { return ".zip" }
+func (zipCodec) MaxLevel() int { return flate.BestCompression }
+
+func (zipCodec) NewWriter(w io.Writer, level int) (archiveWriter, error) {
+	zw := zip.NewWriter(w)
+	if level > 0 {
+		zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+	return zipArchiveWriter{zw}, nil
+}
+
+type zipArchiveWriter struct{ zw *zip.Writer }
+
+func (w zipArchiveWriter) Add(name string, info os.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	fw, err := w.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (w zipArchiveWriter) Close() error { return w.zw.Close() }
+
+func (zipCodec) Open(r io.ReaderAt, size int64) (snapshotReader, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return zipSnapshotReader{zr}, nil
+}
+
+type zipSnapshotReader struct{ zr *zip.Reader }
+
+func (r zipSnapshotReader) Walk(fn func(f snapshotFile) error) error {
+	for _, zf := range r.zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		f := snapshotFile{
+			Name:    zf.Name,
+			Size:    int64(zf.UncompressedSize64),
+			ModTime: zf.Modified,
+			Mode:    zf.Mode(),
+			Open:    zf.Open,
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (zipSnapshotReader) Close() error { return nil }
+
+// -----------------------------------------------------------------------------
+// tar.zst
+// -----------------------------------------------------------------------------
+
+// tarZstdCodec は tar を zstd で圧縮した形式です。zip より高速・高圧縮ですが、
+// 目次を持たないため一覧・復元はアーカイブ全体を先頭から展開しながら読み進めます（ディスクには書き出しません）。
+type tarZstdCodec struct{}
+
+func (tarZstdCodec) Name() string  { return "tar.zst" }
+func (tarZstdCodec) Ext() string   { return ".tar.zst" }
+func (tarZstdCodec) MaxLevel() int { return 22 }
+
+func (tarZstdCodec) NewWriter(w io.Writer, level int) (archiveWriter, error) {
+	var opts []zstd.EOption
+	if level > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	zw, err := zstd.NewWriter(w, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &tarArchiveWriter{zw: zw, tw: tar.NewWriter(zw)}, nil
+}
+
+type tarArchiveWriter struct {
+	zw *zstd.Encoder
+	tw *tar.Writer
+}
+
+func (w *tarArchiveWriter) Add(name string, info os.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// 所有者情報は復元に使用しないため記録しない
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	// tar はヘッダーのサイズ分を正確に書き込む必要があるため、走査後に変更されたファイルは
+	// 大きくなった場合は切り詰め、小さくなった場合は0で埋めて格納する
+	n, err := io.CopyN(w.tw, r, header.Size)
+	if err == io.EOF {
+		log.Printf("警告: %s はアーカイブへの書き込み中に小さくなったため、不足分 (%d バイト) を0で埋めて格納します", name, header.Size-n)
+		_, err = io.CopyN(w.tw, zeroReader{}, header.Size-n)
+	} else if err == nil {
+		if m, _ := r.Read(make([]byte, 1)); m > 0 {
+			log.Printf("警告: %s はアーカイブへの書き込み中に大きくなったため、先頭 %d バイトのみ格納します", name, header.Size)
+		}
+	}
+	return err
+}
+
+// zeroReader は0を返し続ける Reader です。
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (w *tarArchiveWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		w.zw.Close()
+		return err
+	}
+	return w.zw.Close()
+}
+
+func (tarZstdCodec) Open(r io.ReaderAt, size int64) (snapshotReader, error) {
+	zr, err := zstd.NewReader(bufio.NewReader(io.NewSectionReader(r, 0, size)))
+	if err != nil {
+		return nil, err
+	}
+	return &tarSnapshotReader{zr: zr}, nil
+}
+
+type tarSnapshotReader struct{ zr *zstd.Decoder }
+
+func (r *tarSnapshotReader) Walk(fn func(f snapshotFile) error) error {
+	tr := tar.NewReader(r.zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		f := snapshotFile{
+			Name:    header.Name,
+			Size:    header.Size,
+			ModTime: header.ModTime,
+			Mode:    header.FileInfo().Mode(),
+			// 内容はアーカイブの現在位置からのみ読み出せる
+			Open: func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *tarSnapshotReader) Close() error {
+	r.zr.Close()
+	return nil
+}
+
+// =============================================================================
+// スナップショットの読み込み
+// =============================================================================
+
+// snapshotFile はスナップショットに格納されたファイルです。
+type snapshotFile struct {
+	Name    string // スラッシュ区切りの相対パス
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	// Open は内容を読み出します。Walk のコールバック内でのみ有効です。
+	Open func() (io.ReadCloser, error)
+}
+
+// snapshotReader はスナップショットの内容を読み込みます。
+type snapshotReader interface {
+	// Walk は格納されたファイルを順に fn に渡します。
+	Walk(fn func(f snapshotFile) error) error
+	Close() error
+}
+
+// openSnapshot はスナップショットを形式に応じて読み込み用に開きます。
+// 暗号化されたスナップショットは復号しながら読み込みます。
+func openSnapshot(cfg *BackupConfig, path string) (snapshotReader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return dirSnapshotReader(path), nil
+	}
+	name := strings.TrimSuffix(path, encryptedExt)
+	for _, c := range archiveCodecs {
+		if !strings.HasSuffix(name, c.Ext()) {
+			continue
+		}
+		data, err := openSnapshotData(cfg, path)
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.Open(data, data.Size())
+		if err != nil {
+			data.Close()
+			return nil, err
+		}
+		return closingSnapshotReader{r, data}, nil
+	}
+	if strings.HasSuffix(name, ".vhdx") {
+		return nil, fmt.Errorf("VHDX のスナップショットは一覧・復元できません（VHDX をマウントして参照してください）: %s", path)
+	}
+	return nil, fmt.Errorf("スナップショットの形式を判別できません: %s", path)
+}
+
+// closingSnapshotReader は読み込みの終了時に元のファイルも閉じます。
+type closingSnapshotReader struct {
+	snapshotReader
+	data io.Closer
+}
+
+func (r closingSnapshotReader) Close() error {
+	r.snapshotReader.Close()
+	return r.data.Close()
+}
+
+// dirSnapshotReader はディレクトリのスナップショットを読み込みます。
+type dirSnapshotReader string
+
+func (r dirSnapshotReader) Walk(fn func(f snapshotFile) error) error {
+	root := string(r)
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return fn(snapshotFile{
+			Name:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			Mode:    info.Mode(),
+			Open:    func() (io.ReadCloser, error) { return os.Open(path) },
+		})
+	})
+}
+
+func (dirSnapshotReader) Close() error { return nil }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// アーカイブ形式のテスト
+// =============================================================================
+
+// readArchiveFiles はスナップショットを開き、ファイル名→内容を返します。
+func readArchiveFiles(t *testing.T, cfg *BackupConfig, path string) map[string]string {
+	r, err := openSnapshot(cfg, path)
+	if err != nil {
+		t.Fatalf("スナップショットを開けません: %v", err)
+	}
+	defer r.Close()
+	files := make(map[string]string)
+	err = r.Walk(func(f snapshotFile) error {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		files[f.Name] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("スナップショットの読み込みに失敗: %v", err)
+	}
+	return files
+}
+
+func TestArchiveCodecsRoundTrip(t *testing.T) {
+	for _, codec := range archiveCodecs {
+		for _, level := range []int{0, 1, codec.MaxLevel()} {
+			t.Run(fmt.Sprintf("%s_level%d", codec.Name(), level), func(t *testing.T) {
+				cfg := newValidTestConfig(t)
+				cfg.Extensions = []string{".go"}
+				cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "vendor")}
+				cfg.CompressionLevel = level
+				writeTestFiles(t, cfg.WorkDir, map[string]string{
+					"main.go":       strings.Repeat("package main\n", 100),
+					"sub/util.go":   "package sub",
+					"notes.txt":     "除外",
+					"vendor/lib.go": "除外",
+				})
+				stamp := time.Date(2025, 7, 1, 9, 0, 0, 0, time.Local)
+				os.Chtimes(filepath.Join(cfg.WorkDir, "main.go"), stamp, stamp)
+
+				dst := filepath.Join(t.TempDir(), "000001_20250701_0900"+codec.Ext())
+				files, err := writeArchive(cfg, codec, dst)
+				if err != nil || files != 2 {
+					t.Fatalf("アーカイブの作成に失敗 (level=%d): %d, %v", level, files, err)
+				}
+
+				got := readArchiveFiles(t, cfg, dst)
+				var names []string
+				for name := range got {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				if strings.Join(names, ",") != "main.go,sub/util.go" || got["sub/util.go"] != "package sub" {
+					t.Errorf("アーカイブの内容が違います (level=%d): %v", level, names)
+				}
+
+				r, _ := openSnapshot(cfg, dst)
+				defer r.Close()
+				r.Walk(func(f snapshotFile) error {
+					if f.Name == "main.go" && !f.ModTime.Equal(stamp) {
+						t.Errorf("更新日時が保存されていません: %v", f.ModTime)
+					}
+					return nil
+				})
+			})
+		}
+	}
+}
+
+func TestTarArchiveWriterSizeChanged(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{"grow.txt": "12345", "shrink.txt": "12345", "next.txt": "next"})
+	info := func(name string) os.FileInfo {
+		fi, _ := os.Stat(filepath.Join(root, name))
+		return fi
+	}
+	dst := filepath.Join(root, "000001_20250701_0900.tar.zst")
+	f, _ := os.Create(dst)
+	aw, err := tarZstdCodec{}.NewWriter(f, 0)
+	if err != nil {
+		t.Fatalf("アーカイブの作成に失敗: %v", err)
+	}
+	// 走査後に大きくなった・小さくなったファイルでも後続のファイルを書き込める
+	adds := []struct{ name, content string }{
+		{"grow.txt", "1234567890"},
+		{"shrink.txt", "12"},
+		{"next.txt", "next"},
+	}
+	for _, a := range adds {
+		if err := aw.Add(a.name, info(a.name), strings.NewReader(a.content)); err != nil {
+			t.Fatalf("%s の書き込みに失敗: %v", a.name, err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("アーカイブの書き込みに失敗: %v", err)
+	}
+	f.Close()
+
+	got := readArchiveFiles(t, newValidTestConfig(t), dst)
+	want := map[string]string{"grow.txt": "12345", "shrink.txt": "12\x00\x00\x00", "next.txt": "next"}
+	for name, content := range want {
+		if got[name] != content {
+			t.Errorf("%s の内容 = %q, want %q", name, got[name], content)
+		}
+	}
+}
+
+func TestWriteArchiveRemovesPartialOnError(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	dst := filepath.Join(t.TempDir(), "000001_20250701_0900.tar.zst")
+	// work_dir が存在しない
+	if _, err := writeArchive(cfg, tarZstdCodec{}, dst); err == nil {
+		t.Fatalf("存在しない work_dir でエラーになりません")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("作成途中のアーカイブが残っています")
+	}
+}
+
+func TestValidateArchiveSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		level  int
+		key    string
+	}{
+		{"不明な圧縮形式", "rar", 0, "archive_format"},
+		{"zip の範囲外", "zip", 10, "compression_level"},
+		{"負の圧縮レベル", "tar.zst", -1, "compression_level"},
+		{"tar.zst の範囲内", "tar.zst", 19, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newValidTestConfig(t)
+			cfg.SnapshotFormat = "archive"
+			cfg.ArchiveFormat = tt.format
+			cfg.CompressionLevel = tt.level
+			problems := validateConfig(cfg)
+			if tt.key == "" {
+				if len(problems) != 0 {
+					t.Errorf("正常な設定で問題が検出されました: %v", problems)
+				}
+				return
+			}
+			if findProblem(problems, tt.key) == nil {
+				t.Errorf("%s の問題が検出されていません: %v", tt.key, problems)
+			}
+		})
+	}
+
+	cfg := &BackupConfig{SnapshotFormat: "archive", ArchiveFormat: "tar.zst"}
+	if name := snapshotName(cfg.snapshotFormat(), 7, "20250701_0900"); name != "000007_20250701_0900.tar.zst" {
+		t.Errorf("スナップショット名が違います: %s", name)
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hjson/hjson-go"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// 設定ファイルの形式のバージョンを記録するキー
+const configVersionKey = "config_version"
+
+// 現在の設定ファイルの形式のバージョン
+// config_version のない設定ファイルはバージョン 1 として扱います。
+const currentConfigVersion = 2
+
+// 移行で補った値の出所表示
+const configMigrationOrigin = "(旧形式からの移行)"
+
+// configMigration はバージョン from の設定を from+1 の形式に変換する移行処理です。
+type configMigration struct {
+	from        int
+	description string
+	apply       func(doc *configDocument)
+}
+
+// configMigrations は移行処理の一覧です（from の昇順に連続していること）。
+var configMigrations = []configMigration{
+	{from: 1, description: "暗黙の既定値（通知先・ロック競合時の動作）を明示（動作の変更なし）", apply: migrateConfigV1},
+}
+
+// migrateConfigV1 はバージョン 1 の設定を変換します。
+// バージョン 1 と 2 の間に名前や意味の変わったキーはなく、この移行は notifiers・on_lock_conflict の
+// 未設定時の既定値を設定ファイルに書き出すのみです（移行の前後で動作は変わりません）。
+func migrateConfigV1(doc *configDocument) {
+	if list, _ := doc.get("notifiers").([]interface{}); len(list) == 0 {
+		doc.set("notifiers", []interface{}{map[string]interface{}{"type": "toast"}},
+			"未設定時の既定値だったトースト通知を明示")
+	}
+	if mode, _ := doc.get("on_lock_conflict").(string); mode == "" {
+		doc.set("on_lock_conflict", "notify-exit", "未設定時の既定値だった notify-exit を明示")
+	}
+}
+
+// configVersionOf は設定ツリーの形式のバージョンを返します。
+func configVersionOf(tree map[string]interface{}) (int, error) {
+	value, ok := tree[configVersionKey]
+	if !ok || value == nil {
+		return 1, nil
+	}
+	f, ok := value.(float64)
+	if !ok || f < 1 || f != math.Trunc(f) {
+		return 0, pkgerrors.Errorf("1以上の整数で指定してください")
+	}
+	return int(f), nil
+}
+
+// configDocument は移行処理で変更する設定です。
+// テキストがある場合はコメントを保持したまま該当行のみを書き換えます。
+type configDocument struct {
+	tree    map[string]interface{} // 変更する設定ツリー
+	view    map[string]interface{} // 移行の判断に使用する設定（include 適用後）
+	origins map[string]valueOrigin // 変更した値の出所の記録先（nil の場合は記録しない）
+	source  *configSource          // 設定ファイルのテキスト（nil の場合は編集しない）
+	rewrite bool                   // 行単位で書き換えられない変更があった
+	changes []string               // 変更内容の説明
+}
+
+// migrate は from から現在の形式までの移行処理を順に適用します。
+func (d *configDocument) migrate(from int) {
+	for _, m := range configMigrations {
+		if m.from >= from {
+			m.apply(d)
+		}
+	}
+}
+
+// get は移行の判断に使用する設定の値を返します。
+func (d *configDocument) get(key string) interface{} {
+	return lookupConfigTree(d.view, key)
+}
+
+// set は値を設定し、テキストの該当行を書き換えます。
+func (d *configDocument) set(key string, value interface{}, note string) {
+	d.changes = append(d.changes, fmt.Sprintf("%s: %s", key, note))
+	existed := hasConfigKey(d.tree, key)
+	setConfigTree(d.tree, key, value)
+	setConfigTree(d.view, key, value)
+	if d.origins != nil {
+		d.origins[key] = valueOrigin{File: configMigrationOrigin}
+	}
+	if d.source != nil {
+		d.editLine(key, value, existed)
+	}
+}
+
+// hasConfigKey は "a.b" 形式のキーが定義されているか判定します。
+func hasConfigKey(tree map[string]interface{}, key string) bool {
+	parent := tree
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		obj, ok := lookupConfigTree(tree, key[:i]).(map[string]interface{})
+		if !ok {
+			return false
+		}
+		parent, key = obj, key[i+1:]
+	}
+	_, ok := parent[key]
+	return ok
+}
+
+// editLine はキーの行の値を書き換えるか、最上位に行を追加します。
+func (d *configDocument) editLine(key string, value interface{}, exists bool) {
+	text := formatHJSONValue(value)
+	if exists {
+		i := d.source.lineOf(key) - 1
+		if i < 0 {
+			d.rewrite = true
+			return
+		}
+		if end := d.valueEnd(i); end > i {
+			d.replaceBlock(i, end, key[strings.LastIndex(key, ".")+1:], value)
+			return
+		}
+		if !replaceLineValue(&d.source.lines[i], key[strings.LastIndex(key, ".")+1:], text) {
+			d.rewrite = true
+		}
+		return
+	}
+	if strings.Contains(key, ".") {
+		d.rewrite = true
+		return
+	}
+
+	open, close := d.rootBraces()
+	indent := d.keyIndent(open)
+	if key == configVersionKey {
+		d.insertLines(open+1,
+			indent+"// config_version: 設定ファイルの形式のバージョン（rotate_backup config upgrade で更新）",
+			indent+key+": "+text)
+		return
+	}
+	if close < 0 {
+		close = len(d.source.lines)
+	}
+	d.insertLines(close, indent+key+": "+text)
+}
+
+// valueEnd は i 行目のキーの値が終わる行を返します（値が1行の場合は i）。
+func (d *configDocument) valueEnd(i int) int {
+	depth := 0
+	for j := i; j < len(d.source.lines); j++ {
+		text := d.source.lines[j]
+		if j == i {
+			text = text[strings.Index(text, ":")+1:]
+		}
+		code, _ := splitHJSONLineComment(text)
+		depth += strings.Count(code, "{") + strings.Count(code, "[") - strings.Count(code, "}") - strings.Count(code, "]")
+		if depth <= 0 {
+			return j
+		}
+	}
+	return i
+}
+
+// replaceBlock は i 行目から end 行目にわたる値を複数行の表記で置き換えます。
+// 値の中のコメントは失われますが、値の後のカンマとコメントは保持します。
+func (d *configDocument) replaceBlock(i, end int, name string, value interface{}) {
+	pattern := regexp.MustCompile(`^(\s*)["']?` + regexp.QuoteMeta(name) + `["']?\s*:\s*`)
+	m := pattern.FindStringSubmatchIndex(d.source.lines[i])
+	if m == nil {
+		d.rewrite = true
+		return
+	}
+	prefix, indent := d.source.lines[i][:m[1]], d.source.lines[i][m[2]:m[3]]
+	code, comment := splitHJSONLineComment(d.source.lines[end])
+	trailer := code[strings.LastIndexAny(code, "]}")+1:] + comment
+
+	lines := strings.Split(prefix+formatHJSONBlock(value, indent)+trailer, "\n")
+	result := append([]string{}, d.source.lines[:i]...)
+	result = append(result, lines...)
+	d.source.lines = append(result, d.source.lines[end+1:]...)
+}
+
+// splitHJSONLineComment は行を値の部分と文字列外の // または # から始まるコメントに分けます。
+func splitHJSONLineComment(line string) (string, string) {
+	inString := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if inString {
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if c == '"' {
+			inString = true
+		} else if c == '#' || (c == '/' && i+1 < len(line) && line[i+1] == '/') {
+			return line[:i], line[i:]
+		}
+	}
+	return line, ""
+}
+
+// rootBraces は最上位の { と } の行を返します（括弧を省略した形式では -1）。
+func (d *configDocument) rootBraces() (int, int) {
+	open, close := -1, -1
+	for i, line := range d.source.lines {
+		if strings.HasPrefix(strings.TrimSpace(stripHJSONComment(line)), "{") {
+			open = i
+			break
+		}
+	}
+	if open < 0 {
+		return -1, -1
+	}
+	for i := len(d.source.lines) - 1; i > open; i-- {
+		if strings.HasPrefix(strings.TrimSpace(stripHJSONComment(d.source.lines[i])), "}") {
+			close = i
+			break
+		}
+	}
+	return open, close
+}
+
+// 行頭のキー（インデントの判定用）
+var configKeyLinePattern = regexp.MustCompile(`^(\s*)["']?[A-Za-z_][A-Za-z0-9_]*["']?\s*:`)
+
+// keyIndent は最上位のキーのインデントを返します。
+func (d *configDocument) keyIndent(open int) string {
+	for _, line := range d.source.lines[open+1:] {
+		if m := configKeyLinePattern.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+	}
+	if open < 0 {
+		return ""
+	}
+	return "\t"
+}
+
+func (d *configDocument) insertLines(at int, lines ...string) {
+	result := append([]string{}, d.source.lines[:at]...)
+	result = append(result, lines...)
+	d.source.lines = append(result, d.source.lines[at:]...)
+}
+
+// replaceLineValue は "name: 値 // コメント" 形式の行の値を置き換えます。
+// 行末のカンマとコメントは保持します。
+func replaceLineValue(line *string, name, value string) bool {
+	pattern := regexp.MustCompile(`^\s*["']?` + regexp.QuoteMeta(name) + `["']?\s*:\s*`)
+	loc := pattern.FindStringIndex(*line)
+	if loc == nil {
+		return false
+	}
+	prefix, rest := (*line)[:loc[1]], (*line)[loc[1]:]
+	code, comment := splitHJSONLineComment(rest)
+	old := strings.TrimRight(code, " \t")
+	spacing := code[len(old):]
+	if strings.HasSuffix(old, ",") {
+		value += ","
+	}
+	*line = prefix + value + spacing + comment
+	return true
+}
+
+// formatHJSONValue は値を1行の HJSON 表記に変換します。
+func formatHJSONValue(value interface{}) string {
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 0 {
+			return "[]"
+		}
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = formatHJSONValue(item)
+		}
+		return "[ " + strings.Join(items, ", ") + " ]"
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return "{}"
+		}
+		keys := orderedConfigKeys(v)
+		items := make([]string, len(keys))
+		for i, k := range keys {
+			items[i] = formatHJSONKey(k) + ": " + formatHJSONValue(v[k])
+		}
+		return "{ " + strings.Join(items, ", ") + " }"
+	default:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(v)
+		return strings.TrimSpace(buf.String())
+	}
+}
+
+// formatHJSONBlock はオブジェクト・配列を1要素1行の HJSON 表記に変換します（indent はキーの行のインデント）。
+func formatHJSONBlock(value interface{}, indent string) string {
+	var items []string
+	open, close := "[", "]"
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			items = append(items, formatHJSONValue(item))
+		}
+	case map[string]interface{}:
+		open, close = "{", "}"
+		for _, k := range orderedConfigKeys(v) {
+			items = append(items, formatHJSONKey(k)+": "+formatHJSONValue(v[k]))
+		}
+	default:
+		return formatHJSONValue(value)
+	}
+	if len(items) == 0 {
+		return open + close
+	}
+	return open + "\n" + indent + "\t" + strings.Join(items, "\n"+indent+"\t") + "\n" + indent + close
+}
+
+// formatHJSONKey はキーを HJSON 表記に変換します（識別子以外は引用符で囲む）。
+func formatHJSONKey(key string) string {
+	if configKeyLinePattern.MatchString(key + ":") {
+		return key
+	}
+	return formatHJSONValue(key)
+}
+
+// orderedConfigKeys はオブジェクトのキーを返します。
+// バックアップレベルはスケジュールの順（30m, 3h, ...）、それ以外は名前順に並べます。
+func orderedConfigKeys(obj map[string]interface{}) []string {
+	rank := func(key string) int {
+		for i, level := range scheduledLevels {
+			if level == key {
+				return i
+			}
+		}
+		return len(scheduledLevels)
+	}
+	var keys []string
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if ri, rj := rank(keys[i]), rank(keys[j]); ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// render は変更後の設定ファイルの内容を返します。
+// 行単位の書き換え結果が設定ツリーと一致しない場合は、コメントを保持せずに全体を再生成します。
+func (d *configDocument) render() (string, bool, error) {
+	if d.source != nil && !d.rewrite {
+		text := strings.Join(d.source.lines, "\n")
+		if sameConfigTree(text, d.tree) {
+			return text, true, nil
+		}
+	}
+	data, err := hjson.Marshal(d.tree)
+	if err != nil {
+		return "", false, pkgerrors.Errorf("HJSON marshal error: %v", err)
+	}
+	return string(data) + "\n", false, nil
+}
+
+// sameConfigTree は HJSON テキストの内容が設定ツリーと一致するか判定します。
+func sameConfigTree(text string, tree map[string]interface{}) bool {
+	var parsed interface{}
+	if err := hjson.Unmarshal([]byte(text), &parsed); err != nil {
+		return false
+	}
+	a, err1 := json.Marshal(parsed)
+	b, err2 := json.Marshal(tree)
+	return err1 == nil && err2 == nil && bytes.Equal(a, b)
+}
+
+// migrate は旧形式の設定ツリーを現在の形式として読み替えます（ファイルは変更しません）。
+func (r *resolvedConfig) migrate() error {
+	version, err := configVersionOf(r.tree)
+	if err != nil {
+		return &ConfigValidationError{Path: r.path, Problems: []ConfigProblem{
+			r.problem(SeverityError, configVersionKey, err.Error()),
+		}}
+	}
+	if version > currentConfigVersion {
+		return &ConfigValidationError{Path: r.path, Problems: []ConfigProblem{
+			r.problem(SeverityError, configVersionKey, fmt.Sprintf(
+				"新しい形式 (%d) の設定ファイルです。このバージョンは形式 %d まで対応しています。rotate_backup を更新してください",
+				version, currentConfigVersion)),
+		}}
+	}
+	if version < currentConfigVersion {
+		doc := &configDocument{tree: r.tree, view: r.tree, origins: r.origins}
+		doc.migrate(version)
+		r.migratedFrom = version
+	}
+	return nil
+}
+
+// runConfigUpgrade は設定ファイルを現在の形式に更新します。
+// dryRun の場合は差分を表示するのみでファイルを変更しません。
+func runConfigUpgrade(configPath string, dryRun bool) error {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return wrapFailure(FailureConfig, err)
+	}
+	var raw interface{}
+	if err := hjson.Unmarshal(data, &raw); err != nil {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("HJSON parse error (%s): %v", configPath, err))
+	}
+	tree, ok := raw.(map[string]interface{})
+	if !ok {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("設定ファイルの最上位はオブジェクトである必要があります: %s", configPath))
+	}
+
+	version, err := configVersionOf(tree)
+	if err != nil {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("%s: %v", configVersionKey, err))
+	}
+	if version > currentConfigVersion {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("新しい形式 (%d) の設定ファイルです。このバージョンは形式 %d まで対応しています", version, currentConfigVersion))
+	}
+	if version == currentConfigVersion {
+		fmt.Printf("設定ファイルは最新の形式です (config_version: %d): %s\n", version, configPath)
+		return nil
+	}
+
+	// 移行の判断は include を適用した設定で行い、変更は指定したファイルにのみ書き込む
+	r := &resolvedConfig{path: configPath, sources: make(map[string]*configSource)}
+	view, _, err := r.loadFile(configPath, nil)
+	if err != nil {
+		return wrapFailure(FailureConfig, err)
+	}
+
+	doc := &configDocument{tree: tree, view: view, source: newConfigSource(configPath, data)}
+	doc.migrate(version)
+	doc.set(configVersionKey, currentConfigVersion, fmt.Sprintf("%d → %d", version, currentConfigVersion))
+	text, preserved, err := doc.render()
+	if err != nil {
+		return wrapFailure(FailureConfig, err)
+	}
+	if bytes.Contains(data, []byte("\r\n")) {
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	}
+
+	fmt.Printf("設定ファイルを形式 %d から %d に更新します: %s\n", version, currentConfigVersion, configPath)
+	for _, m := range configMigrations {
+		if m.from >= version {
+			fmt.Printf("  %d → %d: %s\n", m.from, m.from+1, m.description)
+		}
+	}
+	for _, change := range doc.changes {
+		fmt.Printf("    - %s\n", change)
+	}
+	if !preserved {
+		fmt.Println("注意: コメントを保持したまま書き換えられないため、設定ファイル全体を再生成します（コメントは失われます）")
+	}
+	if len(r.files) > 1 {
+		fmt.Println("注意: include 先のファイルは更新しません。必要に応じて個別に config upgrade を実行してください")
+	}
+
+	if dryRun {
+		fmt.Println()
+		fmt.Print(unifiedDiff(configPath, configPath+" (更新後)", splitTextLines(string(data)), splitTextLines(text)))
+		fmt.Println()
+		fmt.Println("[DRY-RUN] 設定ファイルは変更していません")
+		return nil
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d.bak", configPath, version)
+	if err := ioutil.WriteFile(backupPath, data, 0644); err != nil {
+		return pkgerrors.Errorf("元の設定ファイルの退避に失敗: %v", err)
+	}
+	if err := ioutil.WriteFile(configPath, []byte(text), 0644); err != nil {
+		return pkgerrors.Errorf("設定ファイルの書き込みに失敗: %v", err)
+	}
+	fmt.Printf("更新しました（元のファイル: %s）\n", backupPath)
+	return nil
+}
+
+// splitTextLines はテキストを行に分割します（改行コードの違いと末尾の改行は無視）。
+func splitTextLines(text string) []string {
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	return strings.Split(text, "\n")
+}
+
+// 差分の前後に表示する行数
+const diffContextLines = 3
+
+// unifiedDiff は2つのテキストの差分を unified 形式で返します。
+func unifiedDiff(oldName, newName string, a, b []string) string {
+	// 最長共通部分列で編集手順を求める
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type diffOp struct {
+		kind       byte // ' ' / '-' / '+'
+		text       string
+		aPos, bPos int // この行の前までの行数
+	}
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i], i, j})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", oldName, newName)
+	for start := 0; start < len(ops); {
+		// 次の変更行を探す
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		// 変更間の共通行が前後の表示行数以下であれば同じ塊にまとめる
+		last := first
+		for k := first; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				last = k
+			} else if k-last > 2*diffContextLines {
+				break
+			}
+		}
+		from := max(first-diffContextLines, start)
+		to := min(last+diffContextLines+1, len(ops))
+
+		aCount, bCount := 0, 0
+		for _, op := range ops[from:to] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+		}
+		aStart, bStart := ops[from].aPos, ops[from].bPos
+		if aCount > 0 {
+			aStart++
+		}
+		if bCount > 0 {
+			bStart++
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", aStart, aCount, bStart, bCount)
+		for _, op := range ops[from:to] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.text)
+		}
+		start = to
+	}
+	return out.String()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// 設定ファイルの形式の移行のテスト
+// =============================================================================
+
+func TestConfigMigrationsAreConsecutive(t *testing.T) {
+	for i, m := range configMigrations {
+		if m.from != i+1 {
+			t.Errorf("移行処理が連続していません: %d 番目の from=%d", i, m.from)
+		}
+	}
+	if len(configMigrations)+1 != currentConfigVersion {
+		t.Errorf("移行処理が現在の形式 (%d) まで揃っていません: %d 件", currentConfigVersion, len(configMigrations))
+	}
+}
+
+func TestLoadConfigMigratesOldVersion(t *testing.T) {
+	path := writeTestConfig(t, `{
+	dry_run: true
+	enable_lock: true
+}`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("旧形式の設定の読み込みに失敗: %v", err)
+	}
+	if len(cfg.Notifiers) != 1 || cfg.Notifiers[0].Type != "toast" || cfg.OnLockConflict != "notify-exit" {
+		t.Errorf("旧形式の既定値が補われていません: notifiers=%v, on_lock_conflict=%q", cfg.Notifiers, cfg.OnLockConflict)
+	}
+	p := findProblem(validateConfig(cfg), configVersionKey)
+	if p == nil || p.Severity != SeverityWarning || !strings.Contains(p.Message, "config upgrade") {
+		t.Errorf("旧形式の警告がありません: %v", p)
+	}
+
+	tests := []struct {
+		name    string
+		version string
+	}{
+		{"新しい形式", "99"},
+		{"整数以外", "1.5"},
+		{"文字列", `"2"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, "{\n\tconfig_version: "+tt.version+"\n}")
+			_, err := loadConfig(path)
+			verr, ok := err.(*ConfigValidationError)
+			if !ok || findProblem(verr.Problems, configVersionKey) == nil {
+				t.Errorf("config_version の問題が検出されていません: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunConfigUpgradePreservesComments(t *testing.T) {
+	original := `{
+  // 実行モード
+  dry_run: true,
+  enable_lock: true,
+  on_lock_conflict: "",   // 競合時の動作
+  keep_versions: { "30m": 5 }
+}
+`
+	path := writeTestConfig(t, original)
+
+	// dry-run は差分の表示のみ
+	output := captureStdout(t, func() {
+		if err := runConfigUpgrade(path, true); err != nil {
+			t.Errorf("config upgrade (dry-run) エラー: %v", err)
+		}
+	})
+	for _, want := range []string{
+		`-  on_lock_conflict: "",   // 競合時の動作`,
+		`+  on_lock_conflict: "notify-exit",   // 競合時の動作`,
+		"+  config_version: 2",
+		`+  notifiers: [ { type: "toast" } ]`,
+		"[DRY-RUN]",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("差分に %q が含まれていません:\n%s", want, output)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != original {
+		t.Fatalf("dry-run で設定ファイルが変更されています:\n%s", data)
+	}
+
+	captureStdout(t, func() {
+		if err := runConfigUpgrade(path, false); err != nil {
+			t.Errorf("config upgrade エラー: %v", err)
+		}
+	})
+	data, _ := os.ReadFile(path)
+	for _, want := range []string{"// 実行モード", "// 競合時の動作", "config_version: 2"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("更新後の設定ファイルに %q が含まれていません:\n%s", want, data)
+		}
+	}
+	if backup, err := os.ReadFile(path + ".v1.bak"); err != nil || string(backup) != original {
+		t.Errorf("元の設定ファイルが退避されていません: %v", err)
+	}
+
+	// 更新後は警告なしで読み込める
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("更新後の設定の読み込みに失敗: %v", err)
+	}
+	if cfg.ConfigVersion != currentConfigVersion || findProblem(validateConfig(cfg), configVersionKey) != nil {
+		t.Errorf("更新後も旧形式として扱われています: config_version=%d", cfg.ConfigVersion)
+	}
+	output = captureStdout(t, func() { runConfigUpgrade(path, false) })
+	if !strings.Contains(output, "最新の形式") {
+		t.Errorf("最新の形式の設定ファイルが再度更新されました:\n%s", output)
+	}
+}
+
+func TestRunConfigUpgradeUsesIncludedValues(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"common.hjson": `{
+	notifiers: [ { type: "webhook", url: "http://example.com" } ]
+}`,
+		"config.hjson": `{
+	include: ["common.hjson"]
+	on_lock_conflict: "notify-exit"
+}`,
+	})
+	path := filepath.Join(dir, "config.hjson")
+	captureStdout(t, func() {
+		if err := runConfigUpgrade(path, false); err != nil {
+			t.Errorf("config upgrade エラー: %v", err)
+		}
+	})
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "toast") {
+		t.Errorf("include 先で設定済みの通知先が上書きされています:\n%s", data)
+	}
+}
+
+func TestRunConfigUpgradeMultilineAndRegenerate(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		regenerate bool
+	}{
+		// 複数行の値は値の部分のみ置き換え
+		{"複数行の値", "{\n\t// 通知先\n\tdry_run: true\n\tnotifiers: [\n\t]\n}\n", false},
+		// 1行に書かれた設定は行単位で書き換えられないため再生成
+		{"1行の設定", "{ dry_run: true }\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, tt.content)
+			output := captureStdout(t, func() {
+				if err := runConfigUpgrade(path, false); err != nil {
+					t.Errorf("config upgrade エラー: %v", err)
+				}
+			})
+			if strings.Contains(output, "再生成") != tt.regenerate {
+				t.Errorf("再生成の有無が違います（期待=%v）:\n%s", tt.regenerate, output)
+			}
+			if data, _ := os.ReadFile(path); !tt.regenerate && !strings.Contains(string(data), "// 通知先") {
+				t.Errorf("コメントが保持されていません:\n%s", data)
+			}
+			cfg, err := loadConfig(path)
+			if err != nil {
+				t.Fatalf("更新した設定の読み込みに失敗: %v", err)
+			}
+			if !cfg.DryRun || len(cfg.Notifiers) != 1 || cfg.ConfigVersion != currentConfigVersion {
+				t.Errorf("更新した設定の内容が違います: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	a := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12"}
+	b := []string{"1", "2", "X", "4", "5", "6", "7", "8", "9", "10", "11", "12", "13"}
+	expected := `--- a
++++ b
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++X
+ 4
+ 5
+ 6
+@@ -10,3 +10,4 @@
+ 10
+ 11
+ 12
++13
+`
+	if got := unifiedDiff("a", "b", a, b); got != expected {
+		t.Errorf("差分が違います:\n%s", got)
+	}
+}
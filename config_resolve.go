@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hjson/hjson-go"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// 設定ファイルの取り込みを指定する最上位キー
+const configIncludeKey = "include"
+
+// --set による上書きの出所表示
+const configOverrideOrigin = "--set"
+
+// ${VAR} / ${VAR:-default} / $${（エスケープ）に一致するパターン
+var configEnvPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_()]*)(:-([^}]*))?\}`)
+
+// valueOrigin は設定値の出所（ファイルと行番号）です。
+type valueOrigin struct {
+	File     string
+	Line     int
+	Key      string // ファイル内でのキーのパス（ジョブの値は jobs[0].work_dir 等）
+	Expanded bool   // 環境変数を展開した値
+}
+
+// String は "ファイル:行番号" 形式の出所を返します。
+func (o valueOrigin) String() string {
+	s := o.File
+	if o.Line > 0 {
+		s = fmt.Sprintf("%s:%d", o.File, o.Line)
+	}
+	if o.Expanded {
+		s += " (環境変数展開)"
+	}
+	return s
+}
+
+// resolvedConfig は include・--set・環境変数展開を適用した設定ツリーです。
+//
+// 適用順（後のものが優先）:
+//  0. 旧形式 (config_version) の設定は現在の形式に読み替え
+//  1. include に列挙したファイル（列挙順。include 先の include も同じ規則で先に適用）
+//  2. include を記述したファイル自身の値
+//  3. --set key=value（指定順）
+//  4. 文字列値中の ${VAR} / ${VAR:-default} を展開
+//
+// オブジェクトはキーごとにマージし、配列と値は丸ごと置き換えます。
+type resolvedConfig struct {
+	path         string                   // 起点の設定ファイル
+	files        []string                 // 読み込んだファイル（適用順）
+	tree         map[string]interface{}   // マージ済みの設定
+	origins      map[string]valueOrigin   // キーのパスごとの出所
+	sources      map[string]*configSource // ファイルごとの内容（行番号の特定用）
+	envProblems  []ConfigProblem          // 未定義の環境変数
+	migratedFrom int                      // 旧形式から読み替えた場合の元のバージョン（0 は読み替えなし）
+}
+
+// resolveConfig は設定ファイルを読み込み、include・上書き・環境変数展開を適用します。
+// 起点ファイルの読み込みエラーはそのまま返します（os.IsNotExist で判定可能）。
+func resolveConfig(path string, overrides []string) (*resolvedConfig, error) {
+	r := &resolvedConfig{
+		path:    path,
+		sources: make(map[string]*configSource),
+	}
+	tree, origins, err := r.loadFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.tree, r.origins = tree, origins
+	if err := r.migrate(); err != nil {
+		return nil, err
+	}
+
+	for _, expr := range overrides {
+		if err := r.applyOverride(expr); err != nil {
+			return nil, err
+		}
+	}
+	r.expandEnv(r.tree, "")
+	return r, nil
+}
+
+// loadFile は1ファイルを読み込み、include 先をマージした上に自身の値を重ねたツリーと各値の出所を返します。
+func (r *resolvedConfig) loadFile(path string, stack []string) (map[string]interface{}, map[string]valueOrigin, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	for _, p := range stack {
+		if p == abs {
+			return nil, nil, pkgerrors.Errorf("include が循環しています: %s", strings.Join(append(stack, abs), " → "))
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	src := newConfigSource(path, data)
+	r.sources[path] = src
+
+	var raw interface{}
+	if err := hjson.Unmarshal(data, &raw); err != nil {
+		return nil, nil, pkgerrors.Errorf("HJSON parse error (%s): %v", path, err)
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, nil, pkgerrors.Errorf("設定ファイルの最上位はオブジェクトである必要があります: %s", path)
+	}
+
+	includes, err := parseIncludeList(obj[configIncludeKey])
+	if err != nil {
+		return nil, nil, pkgerrors.Errorf("%s: %v", path, err)
+	}
+	delete(obj, configIncludeKey)
+
+	merged := make(map[string]interface{})
+	origins := make(map[string]valueOrigin)
+	for _, inc := range includes {
+		expanded, missing := expandEnvString(inc)
+		if len(missing) > 0 {
+			return nil, nil, pkgerrors.Errorf("%s: include %s の環境変数 %s が未定義です", path, inc, strings.Join(missing, ", "))
+		}
+		if !filepath.IsAbs(expanded) {
+			expanded = filepath.Join(filepath.Dir(path), expanded)
+		}
+		sub, subOrigins, err := r.loadFile(expanded, append(stack, abs))
+		if err != nil {
+			return nil, nil, pkgerrors.Errorf("include %s の読み込みエラー: %v", expanded, err)
+		}
+		mergeConfigTree(merged, sub, "", origins, subOrigins)
+	}
+
+	own := make(map[string]valueOrigin)
+	recordConfigOrigins(obj, "", "", src, own)
+	mergeConfigTree(merged, obj, "", origins, own)
+	r.files = append(r.files, path)
+	return merged, origins, nil
+}
+
+// parseIncludeList は include の値（文字列または文字列の配列）を解析します。
+func parseIncludeList(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("include にはファイルパスの配列を指定してください")
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("include にはファイルパスの配列を指定してください")
+}
+
+// recordConfigOrigins はファイル内の全キー（オブジェクトを含む）の出所を記録します。
+// srcPrefix はファイル内でのオブジェクトの位置です（ジョブの場合は jobs[0] 等）。
+func recordConfigOrigins(obj map[string]interface{}, prefix, srcPrefix string, src *configSource, origins map[string]valueOrigin) {
+	for k, v := range obj {
+		p := joinConfigKey(prefix, k)
+		key := joinConfigKey(srcPrefix, p)
+		origins[p] = valueOrigin{File: src.path, Line: src.lineOf(key), Key: key}
+		if child, ok := v.(map[string]interface{}); ok {
+			recordConfigOrigins(child, p, srcPrefix, src, origins)
+		}
+	}
+}
+
+// mergeConfigTree は src を dst に出所ごとマージします。
+// 両方がオブジェクトのキーは再帰的にマージし、それ以外は src の値で置き換えます。
+func mergeConfigTree(dst, src map[string]interface{}, prefix string, dstOrigins, srcOrigins map[string]valueOrigin) {
+	for k, v := range src {
+		p := joinConfigKey(prefix, k)
+		if o, ok := srcOrigins[p]; ok {
+			dstOrigins[p] = o
+		}
+
+		srcObj, srcIsObj := v.(map[string]interface{})
+		dstObj, dstIsObj := dst[k].(map[string]interface{})
+		if srcIsObj && dstIsObj {
+			mergeConfigTree(dstObj, srcObj, p, dstOrigins, srcOrigins)
+			continue
+		}
+
+		// 置き換えた値の配下の出所を入れ替える
+		dropConfigOrigins(dstOrigins, p)
+		for key, o := range srcOrigins {
+			if isConfigKeyUnder(key, p) {
+				dstOrigins[key] = o
+			}
+		}
+		dst[k] = v
+	}
+}
+
+// dropConfigOrigins は prefix の配下にある出所を削除します。
+func dropConfigOrigins(origins map[string]valueOrigin, prefix string) {
+	for k := range origins {
+		if isConfigKeyUnder(k, prefix) {
+			delete(origins, k)
+		}
+	}
+}
+
+// isConfigKeyUnder は key が prefix の配下のキーか判定します。
+func isConfigKeyUnder(key, prefix string) bool {
+	return strings.HasPrefix(key, prefix+".") || strings.HasPrefix(key, prefix+"[")
+}
+
+// applyOverride は "key.sub=value" 形式の上書きを適用します。
+// value は JSON として解釈できれば数値・真偽値・配列として、それ以外は文字列として扱います。
+func (r *resolvedConfig) applyOverride(expr string) error {
+	key, raw, ok := strings.Cut(expr, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return pkgerrors.Errorf("--set の形式が不正です（key=value で指定してください）: %s", expr)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		value = raw
+	}
+
+	parts := strings.Split(key, ".")
+	node := r.tree
+	for i, part := range parts[:len(parts)-1] {
+		p := strings.Join(parts[:i+1], ".")
+		next, exists := node[part]
+		if !exists {
+			next = make(map[string]interface{})
+			node[part] = next
+			r.origins[p] = valueOrigin{File: configOverrideOrigin}
+		}
+		obj, isObj := next.(map[string]interface{})
+		if !isObj {
+			return pkgerrors.Errorf("--set %s: %s はオブジェクトではありません", key, p)
+		}
+		node = obj
+	}
+
+	node[parts[len(parts)-1]] = value
+	dropConfigOrigins(r.origins, key)
+	r.origins[key] = valueOrigin{File: configOverrideOrigin}
+	return nil
+}
+
+// expandEnv はツリー内の文字列値の環境変数を展開します。
+// 既定値のない未定義の環境変数は空文字に置き換え、問題として記録します。
+func (r *resolvedConfig) expandEnv(value interface{}, prefix string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = r.expandEnv(child, joinConfigKey(prefix, k))
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = r.expandEnv(child, fmt.Sprintf("%s[%d]", prefix, i))
+		}
+	case string:
+		expanded, missing := expandEnvString(v)
+		for _, name := range missing {
+			r.envProblems = append(r.envProblems, r.problem(SeverityError, prefix,
+				fmt.Sprintf("環境変数 %s が未定義です（${%s:-既定値} で既定値を指定できます）", name, name)))
+		}
+		if expanded != v {
+			if k, ok := r.originKey(prefix); ok {
+				o := r.origins[k]
+				o.Expanded = true
+				r.origins[k] = o
+			}
+		}
+		return expanded
+	}
+	return value
+}
+
+// expandEnvString は ${VAR} と ${VAR:-default} を展開し、未定義の変数名を返します。
+// ${VAR:-default} は変数が未定義または空の場合に default を使用します。$${ は展開せず ${ として残します。
+func expandEnvString(s string) (string, []string) {
+	var missing []string
+	expanded := configEnvPattern.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$${" {
+			return "${"
+		}
+		sub := configEnvPattern.FindStringSubmatch(m)
+		name, hasDefault, def := sub[1], sub[2] != "", sub[3]
+		value, ok := os.LookupEnv(name)
+		if hasDefault && value == "" {
+			return def
+		}
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	return expanded, missing
+}
+
+// originKey は key 自身または最も近い親で出所が記録されているキーを返します。
+func (r *resolvedConfig) originKey(key string) (string, bool) {
+	for k := key; k != ""; k = parentConfigKey(k) {
+		if _, ok := r.origins[k]; ok {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// parentConfigKey は "a.b[1].c" → "a.b[1]" → "a.b" → "a" の順に親のキーを返します。
+func parentConfigKey(key string) string {
+	i := strings.LastIndexAny(key, ".[")
+	if i < 0 {
+		return ""
+	}
+	return key[:i]
+}
+
+// locate はキーが定義されているファイル・ファイル内でのキーのパス・行番号を返します。
+// 設定されていないキーは、最も近い親が定義されている場所を返します。
+func (r *resolvedConfig) locate(key string) (string, string, int) {
+	if r == nil {
+		return "", key, 0
+	}
+	if k, ok := r.originKey(key); ok {
+		o := r.origins[k]
+		srcKey := key
+		if o.Key != "" {
+			srcKey = o.Key + key[len(k):]
+		}
+		if line := r.sources[o.File].lineOf(srcKey); line > 0 {
+			return o.File, srcKey, line
+		}
+		return o.File, srcKey, o.Line
+	}
+	return r.path, key, r.sources[r.path].lineOf(key)
+}
+
+// problem はキーの場所を付けた設定の問題を作成します。
+func (r *resolvedConfig) problem(severity, key, message string) ConfigProblem {
+	file, srcKey, line := r.locate(key)
+	return ConfigProblem{Severity: severity, File: file, Key: srcKey, Line: line, Message: message}
+}
+
+// flattenConfigTree は値（配列を含む）をキーのパスごとに展開します。
+func flattenConfigTree(value interface{}, prefix string, out map[string]interface{}) {
+	if obj, ok := value.(map[string]interface{}); ok && (prefix == "" || len(obj) > 0) {
+		for k, v := range obj {
+			flattenConfigTree(v, joinConfigKey(prefix, k), out)
+		}
+		return
+	}
+	out[prefix] = value
+}
+
+// runConfigShow は設定ファイルを表示します。
+// resolved が true の場合は include・--set・環境変数展開を適用した実効値を出所付きで表示します。
+func runConfigShow(configPath string, resolved bool, overrides []string) error {
+	if !resolved {
+		data, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return wrapFailure(FailureConfig, err)
+		}
+		fmt.Print(string(data))
+		return nil
+	}
+
+	r, err := resolveConfig(configPath, overrides)
+	if err != nil {
+		return wrapFailure(FailureConfig, err)
+	}
+
+	order := append([]string{}, r.files...)
+	if len(overrides) > 0 {
+		order = append(order, configOverrideOrigin)
+	}
+	fmt.Printf("// 適用順（後が優先）: %s\n", strings.Join(order, " → "))
+
+	// --job 指定時はトップレベルを継承したジョブの実効値を表示
+	if len(args.Jobs) > 0 {
+		jobs, err := buildJobConfigs(r)
+		if err != nil {
+			return wrapFailure(FailureConfig, err)
+		}
+		selected, err := selectJobs(&BackupConfig{jobs: jobs}, args.Jobs)
+		if err != nil {
+			return err
+		}
+		for _, job := range selected {
+			fmt.Printf("\n// ジョブ: %s\n", job.jobName)
+			printResolvedTree(job.source)
+		}
+	} else {
+		printResolvedTree(r)
+	}
+
+	for _, p := range r.envProblems {
+		fmt.Fprintf(os.Stderr, "警告: %s\n", p)
+	}
+	return nil
+}
+
+// printResolvedTree は設定ツリーの値を出所とともに表示します。
+func printResolvedTree(r *resolvedConfig) {
+	leaves := make(map[string]interface{})
+	flattenConfigTree(r.tree, "", leaves)
+	var keys []string
+	for k := range leaves {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, k := range keys {
+		value := maskConfigSecrets(leaves[k])
+		if isSecretConfigKey(k) {
+			value = "********"
+		}
+		encoded, _ := json.Marshal(value)
+		origin := ""
+		if ok, found := r.originKey(k); found {
+			origin = r.origins[ok].String()
+		}
+		fmt.Fprintf(w, "%s: %s\t// %s\n", k, encoded, origin)
+	}
+	w.Flush()
+}
+
+// isSecretConfigKey は表示時に伏せる値のキーか判定します。
+func isSecretConfigKey(key string) bool {
+	return key[strings.LastIndexAny(key, ".")+1:] == "password"
+}
+
+// maskConfigSecrets は配列内のオブジェクトに含まれるパスワードを伏せた値を返します。
+func maskConfigSecrets(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		masked := make([]interface{}, len(v))
+		for i, item := range v {
+			masked[i] = maskConfigSecrets(item)
+		}
+		return masked
+	case map[string]interface{}:
+		masked := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			if k == "password" {
+				masked[k] = "********"
+			} else {
+				masked[k] = maskConfigSecrets(item)
+			}
+		}
+		return masked
+	}
+	return value
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// 設定ファイルの include・環境変数展開・上書きのテスト
+// =============================================================================
+
+// writeConfigFiles は一時ディレクトリに複数の設定ファイルを作成し、ディレクトリを返します。
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("テスト設定ファイルの作成に失敗: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestExpandEnvString(t *testing.T) {
+	t.Setenv("RB_DRIVE", "D:")
+	t.Setenv("RB_EMPTY", "")
+
+	tests := []struct {
+		input    string
+		expected string
+		missing  []string
+	}{
+		{"${RB_DRIVE}/Backups", "D:/Backups", nil},
+		{"${RB_UNDEFINED:-E:}/Backups", "E:/Backups", nil},
+		{"${RB_EMPTY:-既定}", "既定", nil},
+		{"${RB_DRIVE:-E:}", "D:", nil},
+		{"$${RB_DRIVE}", "${RB_DRIVE}", nil},
+		{`\\server\C$\share`, `\\server\C$\share`, nil},
+		{"${RB_UNDEFINED}/x", "/x", []string{"RB_UNDEFINED"}},
+	}
+	for _, tt := range tests {
+		got, missing := expandEnvString(tt.input)
+		if got != tt.expected {
+			t.Errorf("%q の展開結果が違います: 期待=%q, 実際=%q", tt.input, tt.expected, got)
+		}
+		if strings.Join(missing, ",") != strings.Join(tt.missing, ",") {
+			t.Errorf("%q の未定義変数が違います: 期待=%v, 実際=%v", tt.input, tt.missing, missing)
+		}
+	}
+}
+
+func TestResolveConfigIncludeMergeOrder(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"common.hjson": `{
+	dry_run: false
+	keep_versions: { "30m": 5, "3h": 2 }
+	extensions: [".cpp", ".h"]
+}`,
+		"shared/drive.hjson": `{
+	keep_versions: { "3h": 4 }
+	work_dir: "P:/"
+}`,
+		"config.hjson": `{
+	include: ["common.hjson", "shared/drive.hjson"]
+	dry_run: true
+	extensions: [".go"]
+}`,
+	})
+
+	r, err := resolveConfig(filepath.Join(dir, "config.hjson"), nil)
+	if err != nil {
+		t.Fatalf("設定の解決に失敗: %v", err)
+	}
+
+	leaves := make(map[string]interface{})
+	flattenConfigTree(r.tree, "", leaves)
+	checks := []struct {
+		key   string
+		value interface{}
+		file  string
+	}{
+		{"dry_run", true, "config.hjson"},                 // 自身の値が include より優先
+		{"keep_versions.30m", float64(5), "common.hjson"}, // オブジェクトはキーごとにマージ
+		{"keep_versions.3h", float64(4), "drive.hjson"},   // 後の include が優先
+		{"work_dir", "P:/", "drive.hjson"},
+	}
+	for _, c := range checks {
+		if leaves[c.key] != c.value {
+			t.Errorf("%s の値が違います: 期待=%v, 実際=%v", c.key, c.value, leaves[c.key])
+		}
+		if origin := r.origins[c.key]; filepath.Base(origin.File) != c.file {
+			t.Errorf("%s の出所が違います: 期待=%s, 実際=%s", c.key, c.file, origin)
+		}
+	}
+	// 配列は丸ごと置き換え
+	if exts, _ := leaves["extensions"].([]interface{}); len(exts) != 1 || exts[0] != ".go" {
+		t.Errorf("配列が置き換えられていません: %v", leaves["extensions"])
+	}
+	if r.origins["keep_versions.3h"].Line != 2 {
+		t.Errorf("出所の行番号が違います: %s", r.origins["keep_versions.3h"])
+	}
+}
+
+func TestResolveConfigIncludeCycle(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"a.hjson": `{ include: ["b.hjson"] }`,
+		"b.hjson": `{ include: ["a.hjson"] }`,
+	})
+	_, err := resolveConfig(filepath.Join(dir, "a.hjson"), nil)
+	if err == nil || !strings.Contains(err.Error(), "循環") {
+		t.Errorf("循環 include が検出されていません: %v", err)
+	}
+}
+
+func TestResolveConfigMissingInclude(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"config.hjson": `{ include: ["missing.hjson"] }`,
+	})
+	_, err := resolveConfig(filepath.Join(dir, "config.hjson"), nil)
+	if err == nil || os.IsNotExist(err) {
+		t.Errorf("include 先がない場合は起点ファイルの未作成と区別されるべきです: %v", err)
+	}
+}
+
+func TestResolveConfigOverridesAndEnv(t *testing.T) {
+	t.Setenv("RB_BACKUP_DRIVE", "E:")
+	dir := writeConfigFiles(t, map[string]string{
+		"config.hjson": `{
+	dry_run: true
+	backup_dirs: { "30m": "${RB_BACKUP_DRIVE}/Backups/30m" }
+	keep_versions: { "30m": 5 }
+}`,
+	})
+
+	r, err := resolveConfig(filepath.Join(dir, "config.hjson"), []string{
+		"keep_versions.30m=3",
+		"dry_run=false",
+		"notification_policy.daily_digest.time=09:30",
+		"work_dir=${RB_BACKUP_DRIVE}/work",
+	})
+	if err != nil {
+		t.Fatalf("設定の解決に失敗: %v", err)
+	}
+
+	leaves := make(map[string]interface{})
+	flattenConfigTree(r.tree, "", leaves)
+	expected := map[string]interface{}{
+		"keep_versions.30m":                     float64(3),
+		"dry_run":                               false,
+		"notification_policy.daily_digest.time": "09:30",
+		"work_dir":                              "E:/work",
+		"backup_dirs.30m":                       "E:/Backups/30m",
+	}
+	for key, value := range expected {
+		if leaves[key] != value {
+			t.Errorf("%s の値が違います: 期待=%v, 実際=%v", key, value, leaves[key])
+		}
+	}
+	if r.origins["keep_versions.30m"].File != configOverrideOrigin {
+		t.Errorf("--set の出所が記録されていません: %s", r.origins["keep_versions.30m"])
+	}
+	if !r.origins["backup_dirs.30m"].Expanded {
+		t.Errorf("環境変数展開が記録されていません")
+	}
+
+	if _, err := resolveConfig(filepath.Join(dir, "config.hjson"), []string{"keep_versions.30m.x=1"}); err == nil {
+		t.Errorf("値の配下への --set がエラーになりません")
+	}
+	if _, err := resolveConfig(filepath.Join(dir, "config.hjson"), []string{"dry_run"}); err == nil {
+		t.Errorf("= のない --set がエラーになりません")
+	}
+}
+
+func TestLoadConfigReportsProblemsInIncludedFile(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"common.hjson": `{
+	dry_run: true
+	work_dri: "P:/"
+	backup_dir: "${RB_UNDEFINED_DRIVE}/mirror"
+}`,
+		"config.hjson": `{
+	include: ["common.hjson"]
+}`,
+	})
+
+	_, err := loadConfig(filepath.Join(dir, "config.hjson"))
+	verr, ok := err.(*ConfigValidationError)
+	if !ok {
+		t.Fatalf("ConfigValidationError が返されていません: %v", err)
+	}
+	unknown := findProblem(verr.Problems, "work_dri")
+	if unknown == nil || filepath.Base(unknown.File) != "common.hjson" || unknown.Line != 3 {
+		t.Errorf("include 先の不明なキーの場所が違います: %+v", unknown)
+	}
+	env := findProblem(verr.Problems, "backup_dir")
+	if env == nil || !strings.Contains(env.Message, "RB_UNDEFINED_DRIVE") || env.Line != 4 {
+		t.Errorf("未定義の環境変数が検出されていません: %+v", env)
+	}
+}
+
+func TestRunConfigShowResolved(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"common.hjson": `{
+	keep_versions: { "30m": 5 }
+	notifiers: [ { type: "email", password: "secret" } ]
+}`,
+		"config.hjson": `{
+	include: ["common.hjson"]
+	dry_run: true
+}`,
+	})
+
+	output := captureStdout(t, func() {
+		if err := runConfigShow(filepath.Join(dir, "config.hjson"), true, []string{"dry_run=false"}); err != nil {
+			t.Errorf("config show エラー: %v", err)
+		}
+	})
+
+	for _, want := range []string{"common.hjson → ", "→ --set", "dry_run: false", "// --set", "keep_versions.30m: 5", "common.hjson:2"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("出力に %q が含まれていません:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "secret") {
+		t.Errorf("パスワードが表示されています:\n%s", output)
+	}
+}
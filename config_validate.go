@@ -0,0 +1,970 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode"
+)
+
+// 設定の問題の重大度
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// スケジューラが選択するバックアップレベル（昇格順）
+var scheduledLevels = []string{"30m", "3h", "6h", "12h", "1d"}
+
+// ConfigProblem は設定ファイルの問題1件です。
+type ConfigProblem struct {
+	Severity string // "error" または "warning"
+	File     string // 問題のある設定ファイル（include 先を含む）
+	Key      string // 問題のあるキー（例: keep_versions.3h）
+	Line     int    // 設定ファイル上の行番号（不明な場合は0）
+	Message  string
+}
+
+// String は "ファイル: 行番号: [重大度] キー: メッセージ" 形式の文字列を返します。
+func (p ConfigProblem) String() string {
+	var b strings.Builder
+	if p.File != "" {
+		b.WriteString(p.File + ": ")
+	}
+	if p.Line > 0 {
+		fmt.Fprintf(&b, "%d行目: ", p.Line)
+	}
+	fmt.Fprintf(&b, "[%s] ", p.Severity)
+	if p.Key != "" {
+		b.WriteString(p.Key + ": ")
+	}
+	b.WriteString(p.Message)
+	return b.String()
+}
+
+// ConfigValidationError は設定ファイルの問題をまとめたエラーです。
+type ConfigValidationError struct {
+	Path     string
+	Problems []ConfigProblem
+}
+
+func (e *ConfigValidationError) Error() string {
+	lines := []string{fmt.Sprintf("設定ファイルに問題があります (%s): %d 件", e.Path, len(e.Problems))}
+	for _, p := range e.Problems {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configSource は行番号の特定に使用する設定ファイル1件分の内容です。
+type configSource struct {
+	path  string
+	lines []string
+}
+
+func newConfigSource(path string, data []byte) *configSource {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	return &configSource{path: path, lines: strings.Split(text, "\n")}
+}
+
+// lineOf はキーのパス（例: notification_policy.daily_digest.time、notifiers[1].url）が定義されている行番号を返します。
+// パスの各要素を先頭から順に探し、見つかった最も深い要素の行を返します。
+// 各要素は親の値の中（入れ子の深さが1段深い行）のみを探すため、別のオブジェクト内の同名のキーには一致しません。
+func (s *configSource) lineOf(key string) int {
+	if s == nil || key == "" {
+		return 0
+	}
+	depths := s.lineDepths()
+	line, from, want, nested := 0, 0, s.rootDepth(), false
+	for _, part := range strings.Split(key, ".") {
+		name, index := splitConfigIndex(part)
+		if name == "" {
+			continue
+		}
+		pattern := regexp.MustCompile(`(^|[\s{,])["']?` + regexp.QuoteMeta(name) + `["']?\s*:`)
+		found := false
+		for i := from; i < len(s.lines); i++ {
+			sameLine := nested && i == from
+			if nested && !sameLine && depths[i] < want {
+				break // 親の値の外に出た
+			}
+			if (sameLine || depths[i] == want) && pattern.MatchString(stripHJSONComment(s.lines[i])) {
+				line, from, found = i+1, i, true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+		if index >= 0 {
+			i, ok := s.elementLine(from, index)
+			if !ok {
+				break
+			}
+			line, from = i+1, i
+		}
+		// 子のキーは値が次の行以降に続く場合はその深さ、1行で閉じる場合は同じ行のみ
+		want, nested = -1, true
+		if depths[from+1] > depths[from] {
+			want = depths[from+1]
+		}
+	}
+	return line
+}
+
+// lineDepths は各行の先頭の時点の括弧（{ と [）の入れ子の深さを返します（末尾の要素はファイル末尾の深さ）。
+func (s *configSource) lineDepths() []int {
+	depths := make([]int, len(s.lines)+1)
+	depth := 0
+	for i, text := range s.lines {
+		depths[i] = depth
+		inString := false
+		for j := 0; j < len(text); j++ {
+			c := text[j]
+			if inString {
+				if c == '\\' {
+					j++
+				} else if c == '"' {
+					inString = false
+				}
+				continue
+			}
+			switch {
+			case c == '"':
+				inString = true
+			case c == '#' || (c == '/' && j+1 < len(text) && text[j+1] == '/'):
+				j = len(text)
+			case c == '{' || c == '[':
+				depth++
+			case c == '}' || c == ']':
+				depth--
+			}
+		}
+	}
+	depths[len(s.lines)] = depth
+	return depths
+}
+
+// rootDepth は最上位のキーの入れ子の深さを返します（全体を { } で囲んだ場合は 1、省略した場合は 0）。
+func (s *configSource) rootDepth() int {
+	for _, text := range s.lines {
+		trimmed := strings.TrimSpace(stripHJSONComment(text))
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "{") {
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
+
+// splitConfigIndex は "notifiers[1]" を名前と添字に分けます。添字がない場合は -1 を返します。
+func splitConfigIndex(part string) (string, int) {
+	i := strings.Index(part, "[")
+	if i < 0 || !strings.HasSuffix(part, "]") {
+		return part, -1
+	}
+	index, err := strconv.Atoi(part[i+1 : len(part)-1])
+	if err != nil {
+		return part[:i], -1
+	}
+	return part[:i], index
+}
+
+// elementLine は start 行のキーの値（オブジェクトの配列）から index 番目の要素が始まる行を返します。
+func (s *configSource) elementLine(start, index int) (int, bool) {
+	depth, count := 0, 0
+	for i := start; i < len(s.lines); i++ {
+		text := s.lines[i]
+		if i == start {
+			text = text[strings.Index(text, ":")+1:]
+		}
+		inString := false
+		for j := 0; j < len(text); j++ {
+			c := text[j]
+			if inString {
+				if c == '\\' {
+					j++
+				} else if c == '"' {
+					inString = false
+				}
+				continue
+			}
+			switch {
+			case c == '"':
+				inString = true
+			case c == '#' || (c == '/' && j+1 < len(text) && text[j+1] == '/'):
+				j = len(text)
+			case c == '[' || c == '{':
+				depth++
+				if c == '{' && depth == 2 {
+					if count == index {
+						return i, true
+					}
+					count++
+				}
+			case c == ']' || c == '}':
+				depth--
+				if depth <= 0 {
+					return 0, false
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// stripHJSONComment は行末の // および # コメントを取り除きます（文字列内は考慮しない簡易版）。
+func stripHJSONComment(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "//") || strings.HasPrefix(trimmed, "#") {
+		return ""
+	}
+	return line
+}
+
+// checkUnknownKeys は設定構造体に存在しないキーをすべて検出します。
+func checkUnknownKeys(data interface{}, src *resolvedConfig) []ConfigProblem {
+	var keys []string
+	collectUnknownKeys(data, reflect.TypeOf(BackupConfig{}), "", &keys)
+	sort.Strings(keys)
+
+	var problems []ConfigProblem
+	for _, key := range keys {
+		problems = append(problems, src.problem(SeverityError, key, "不明なキーです（綴りを確認してください）"))
+	}
+	return problems
+}
+
+// collectUnknownKeys は値を json タグに沿って辿り、未定義のキーを keys に追加します。
+func collectUnknownKeys(value interface{}, t reflect.Type, prefix string, keys *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+		fields := make(map[string]reflect.Type)
+		collectJSONFields(t, fields)
+		for k, v := range obj {
+			ft, ok := fields[k]
+			if !ok {
+				*keys = append(*keys, joinConfigKey(prefix, k))
+				continue
+			}
+			collectUnknownKeys(v, ft, joinConfigKey(prefix, k), keys)
+		}
+	case reflect.Map:
+		if obj, ok := value.(map[string]interface{}); ok {
+			for k, v := range obj {
+				collectUnknownKeys(v, t.Elem(), joinConfigKey(prefix, k), keys)
+			}
+		}
+	case reflect.Slice:
+		if arr, ok := value.([]interface{}); ok {
+			for i, v := range arr {
+				collectUnknownKeys(v, t.Elem(), fmt.Sprintf("%s[%d]", prefix, i), keys)
+			}
+		}
+	}
+}
+
+// collectJSONFields は構造体の json タグ名と型を集めます（埋め込み構造体のフィールドを含む）。
+func collectJSONFields(t reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && tag == "" && f.Type.Kind() == reflect.Struct {
+			collectJSONFields(f.Type, fields)
+			continue
+		}
+		if tag == "" || tag == "-" || f.PkgPath != "" {
+			continue
+		}
+		fields[tag] = f.Type
+	}
+}
+
+func joinConfigKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// typeErrorProblem は JSON の型不一致エラーを設定の問題に変換します。
+func typeErrorProblem(err *json.UnmarshalTypeError, src *resolvedConfig) ConfigProblem {
+	return src.problem(SeverityError, err.Field,
+		fmt.Sprintf("型が違います（%s が必要ですが %s が指定されています）", err.Type, err.Value))
+}
+
+// validateConfig は設定値の意味的な整合性を検査し、問題をすべて返します。
+// jobs を使用する設定では各ジョブの実効設定とジョブ間の整合性を検査します。
+func validateConfig(cfg *BackupConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	if cfg.source != nil && cfg.source.migratedFrom > 0 {
+		problems = append(problems, cfg.source.problem(SeverityWarning, configVersionKey, fmt.Sprintf(
+			"旧形式 (%d) の設定ファイルです。rotate_backup config upgrade で現在の形式 (%d) に更新できます",
+			cfg.source.migratedFrom, currentConfigVersion)))
+	}
+	if len(cfg.jobs) > 0 {
+		return append(problems, validateJobs(cfg)...)
+	}
+	return append(problems, validateSingleConfig(cfg)...)
+}
+
+// validateSingleConfig は1つのジョブ分の設定を検査します。
+func validateSingleConfig(cfg *BackupConfig) []ConfigProblem {
+	v := &configValidator{cfg: cfg}
+	v.checkRequired()
+	v.checkSnapshotFormat()
+	v.checkEncryption()
+	v.checkRemote()
+	v.checkWatch()
+	v.checkProgress()
+	v.checkThrottle()
+	v.checkDiskSpace()
+	v.checkSourceSnapshot()
+	v.checkLevels()
+	v.checkOverlaps()
+	v.checkParentDirs()
+	v.checkCopyMethods()
+	v.checkLock()
+	v.checkLogRotation()
+	v.checkNotifications()
+	v.checkHooks()
+	return v.problems
+}
+
+// configValidator は検査中の設定と検出した問題を保持します。
+type configValidator struct {
+	cfg      *BackupConfig
+	problems []ConfigProblem
+}
+
+func (v *configValidator) add(severity, key, format string, a ...interface{}) {
+	v.problems = append(v.problems, v.cfg.source.problem(severity, key, fmt.Sprintf(format, a...)))
+}
+
+// checkRequired は必須のパス設定を検査します。
+func (v *configValidator) checkRequired() {
+	required := []struct {
+		key   string
+		value string
+	}{
+		{"work_dir", v.cfg.WorkDir},
+		{"backup_dir", v.cfg.BackupDir},
+		{"last_id_file", v.cfg.LastIDFile},
+	}
+	for _, r := range required {
+		if strings.TrimSpace(r.value) == "" {
+			v.add(SeverityError, r.key, "設定されていません")
+		}
+	}
+	for i, ext := range v.cfg.Extensions {
+		if !strings.HasPrefix(ext, ".") {
+			v.add(SeverityWarning, fmt.Sprintf("extensions[%d]", i), "拡張子 %q は \".\" で始めてください", ext)
+		}
+	}
+}
+
+// checkSnapshotFormat はスナップショット形式と形式ごとに必要な設定を検査します。
+func (v *configValidator) checkSnapshotFormat() {
+	name := defaultString(v.cfg.SnapshotFormat, defaultSnapshotFormat)
+	if _, ok := findSnapshotFormat(name); !ok {
+		v.add(SeverityError, "snapshot_format", "不明なスナップショット形式 %q です（有効な形式: %s）",
+			name, strings.Join(snapshotFormatNames(), ", "))
+		return
+	}
+	if c := v.cfg.HardlinkCompare; c != "" && !slices.Contains(hardlinkCompareMethods, c) {
+		v.add(SeverityError, "hardlink_compare", "不明な判定方法 %q です（有効な値: %s）", c, strings.Join(hardlinkCompareMethods, ", "))
+	}
+	if f := v.cfg.ArchiveFormat; f != "" {
+		if _, ok := findArchiveCodec(f); !ok {
+			v.add(SeverityError, "archive_format", "不明な圧縮形式 %q です（有効な形式: %s）", f, strings.Join(archiveCodecNames(), ", "))
+		}
+	}
+	if max := v.cfg.archiveCodec().MaxLevel(); v.cfg.CompressionLevel < 0 || v.cfg.CompressionLevel > max {
+		v.add(SeverityError, "compression_level", "圧縮レベルは 0〜%d で指定してください（%s の場合）", max, v.cfg.archiveCodec().Name())
+	}
+	if name != "vhdx" {
+		// VHDX 以外の形式ではマウントを行わない
+		if v.cfg.MountIfMissing {
+			v.add(SeverityWarning, "mount_vhdx_if_missing", "snapshot_format が %s のため VHDX はマウントされません", name)
+		}
+		if v.cfg.VHDXReadOnlySnapshot {
+			v.add(SeverityWarning, "vhdx_read_only_snapshot", "snapshot_format が %s のため使用されません", name)
+		}
+		return
+	}
+	if strings.TrimSpace(v.cfg.SourceVHDX) == "" {
+		v.add(SeverityError, "source_vhdx", "設定されていません（VHDX を使用しない場合は snapshot_format を指定してください）")
+	}
+	if v.cfg.MountIfMissing && v.cfg.VHDXMountDrive == "" {
+		v.add(SeverityError, "vhdx_mount_drive", "mount_vhdx_if_missing が有効ですがドライブが設定されていません")
+	}
+	if v.cfg.VHDXReadOnlySnapshot && v.cfg.VHDXMountDrive == "" {
+		v.add(SeverityError, "vhdx_mount_drive", "vhdx_read_only_snapshot が有効ですがドライブが設定されていません")
+	}
+	if d := strings.TrimRight(v.cfg.VHDXMountDrive, `:\/`); v.cfg.VHDXMountDrive != "" && (len(d) != 1 || !unicode.IsLetter(rune(d[0]))) {
+		v.add(SeverityError, "vhdx_mount_drive", "ドライブレターを指定してください（例: \"Q:\"）: %s", v.cfg.VHDXMountDrive)
+	}
+}
+
+// checkEncryption はスナップショットの暗号化の設定と鍵を検査します。
+func (v *configValidator) checkEncryption() {
+	if !v.cfg.Encryption.Enabled {
+		return
+	}
+	if f := v.cfg.snapshotFormat(); f.IsDir() {
+		v.add(SeverityError, "encryption.enabled", "snapshot_format が %s の場合は暗号化できません（vhdx または archive を指定してください）", f.Name())
+	}
+	if _, err := readEncryptionKey(v.cfg); err != nil {
+		v.add(SeverityError, "encryption.key_file", "%v", err)
+	}
+}
+
+// checkRemote は保存先（remote）への複製の設定を検査します。
+func (v *configValidator) checkRemote() {
+	r := v.cfg.Remote
+	if r.Type == "" {
+		return
+	}
+	if !slices.Contains(remoteTypes, r.Type) {
+		v.add(SeverityError, "remote.type", "不明な保存先の種類 %q です（有効な値: %s）", r.Type, strings.Join(remoteTypes, ", "))
+		return
+	}
+	if f := v.cfg.snapshotFormat(); f.IsDir() {
+		v.add(SeverityError, "remote.type", "snapshot_format が %s の場合は複製できません（vhdx または archive を指定してください）", f.Name())
+	}
+	switch r.Type {
+	case "local":
+		if r.Path == "" {
+			v.add(SeverityError, "remote.path", "保存先のディレクトリが設定されていません")
+		}
+	case "sftp":
+		if r.Host == "" {
+			v.add(SeverityError, "remote.host", "SFTP サーバが設定されていません")
+		}
+		if r.User == "" {
+			v.add(SeverityError, "remote.user", "SFTP のユーザー名が設定されていません")
+		}
+	case "s3":
+		if r.Bucket == "" {
+			v.add(SeverityError, "remote.bucket", "バケットが設定されていません")
+		}
+		if r.Endpoint != "" && !strings.HasPrefix(r.Endpoint, "http://") && !strings.HasPrefix(r.Endpoint, "https://") {
+			v.add(SeverityError, "remote.endpoint", "http:// または https:// で始まる URL を指定してください: %s", r.Endpoint)
+		}
+	}
+
+	if len(r.Levels) == 0 {
+		v.add(SeverityWarning, "remote.levels", "複製するレベルが設定されていないため複製されません")
+	}
+	for _, level := range r.Levels {
+		if _, ok := v.cfg.BackupDirs[level]; !ok {
+			v.add(SeverityError, "remote.levels", "レベル %s は backup_dirs に設定されていません", level)
+		}
+	}
+	for level, keep := range r.KeepVersions {
+		if keep < 0 {
+			v.add(SeverityError, "remote.keep_versions."+level, "保持数は0以上を指定してください")
+		}
+		if !slices.Contains(r.Levels, level) {
+			v.add(SeverityWarning, "remote.keep_versions."+level, "レベル %s は remote.levels に含まれていないため使用されません", level)
+		}
+	}
+	if r.MaxBytesPerSec < 0 {
+		v.add(SeverityError, "remote.max_bytes_per_sec", "0以上を指定してください（0で無制限）")
+	}
+}
+
+// checkWatch は watch の待ち時間・照合間隔の期間を検査します。
+func (v *configValidator) checkWatch() {
+	for _, f := range []struct{ key, value string }{
+		{"watch.debounce", v.cfg.Watch.Debounce},
+		{"watch.reconcile_interval", v.cfg.Watch.ReconcileInterval},
+	} {
+		key, value := f.key, f.value
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil {
+			v.add(SeverityError, key, "期間の形式が不正です: %v", err)
+		} else if d <= 0 {
+			v.add(SeverityError, key, "0より大きい期間を指定してください")
+		}
+	}
+}
+
+// checkProgress は進捗の表示方法と出力間隔を検査します。
+func (v *configValidator) checkProgress() {
+	if mode := v.cfg.Progress.Mode; mode != "" && !slices.Contains(progressModes, mode) {
+		v.add(SeverityError, "progress.mode", "不明な表示方法です: %s（%s のいずれかを指定してください）", mode, strings.Join(progressModes, ", "))
+	}
+	if value := v.cfg.Progress.LogInterval; value != "" {
+		if d, err := time.ParseDuration(value); err != nil {
+			v.add(SeverityError, "progress.log_interval", "期間の形式が不正です: %v", err)
+		} else if d <= 0 {
+			v.add(SeverityError, "progress.log_interval", "0より大きい期間を指定してください")
+		}
+	}
+}
+
+// checkThrottle は帯域の上限と業務時間帯・曜日の指定を検査します。
+func (v *configValidator) checkThrottle() {
+	t := v.cfg.Throttle
+	if t.MaxBytesPerSec < 0 {
+		v.add(SeverityError, "throttle.max_bytes_per_sec", "0以上の値を指定してください（0で無制限）")
+	}
+	if t.WorkHoursMaxBytesPerSec < 0 {
+		v.add(SeverityError, "throttle.work_hours_max_bytes_per_sec", "0以上の値を指定してください（0で max_bytes_per_sec と同じ）")
+	}
+	if t.WorkHours != "" {
+		if _, _, err := parseWorkHours(t.WorkHours); err != nil {
+			v.add(SeverityError, "throttle.work_hours", "%v", err)
+		}
+	} else if t.WorkHoursMaxBytesPerSec > 0 {
+		v.add(SeverityWarning, "throttle.work_hours_max_bytes_per_sec", "throttle.work_hours が未設定のため使用されません")
+	}
+	for _, day := range t.WorkDays {
+		if !slices.Contains(weekdayNames, day) {
+			v.add(SeverityError, "throttle.work_days", "不明な曜日です: %s（%s のいずれかを指定してください）", day, strings.Join(weekdayNames, ", "))
+		}
+	}
+}
+
+// checkDiskSpace は空き容量の下限・不足時の動作・最低保持数を検査します。
+func (v *configValidator) checkDiskSpace() {
+	d := v.cfg.DiskSpace
+	if d.MinFreeSpaceMB < 0 {
+		v.add(SeverityError, "disk_space.min_free_space_mb", "0以上の値を指定してください")
+	}
+	if d.OnLowSpace != "" && !slices.Contains(lowSpacePolicies, d.OnLowSpace) {
+		v.add(SeverityError, "disk_space.on_low_space", "不明な動作です: %s（%s のいずれかを指定してください）", d.OnLowSpace, strings.Join(lowSpacePolicies, ", "))
+	}
+	levels := make([]string, 0, len(d.MinKeepVersions))
+	for level := range d.MinKeepVersions {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	for _, level := range levels {
+		n := d.MinKeepVersions[level]
+		key := "disk_space.min_keep_versions." + level
+		if _, ok := v.cfg.BackupDirs[level]; !ok {
+			v.add(SeverityWarning, key, "backup_dirs にないレベルです")
+		} else if n < 0 {
+			v.add(SeverityError, key, "0以上の値を指定してください")
+		} else if keep := v.cfg.KeepVersions[level]; n > keep {
+			v.add(SeverityWarning, key, "keep_versions (%d) より大きいため、空き容量確保のための削除は行われません", keep)
+		}
+	}
+}
+
+// checkSourceSnapshot は work_dir を固定する方法・再試行回数・失敗時の動作・スナップショットの作成先を検査します。
+func (v *configValidator) checkSourceSnapshot() {
+	s := v.cfg.SourceSnapshot
+	method := defaultString(s.Method, sourceSnapshotNone)
+	if !slices.Contains(sourceSnapshotMethods, method) {
+		v.add(SeverityError, "source_snapshot.method", "不明な方法です: %s（%s のいずれかを指定してください）", method, strings.Join(sourceSnapshotMethods, ", "))
+	} else if _, ok := findSourceSnapshotter(method); method != sourceSnapshotNone && !ok {
+		v.add(SeverityError, "source_snapshot.method", "この OS では利用できない方法です: %s", method)
+	}
+	if s.MaxRetries < 0 {
+		v.add(SeverityError, "source_snapshot.max_retries", "0以上の値を指定してください")
+	}
+	if s.OnFailure != "" && !strings.EqualFold(s.OnFailure, "abort") && !strings.EqualFold(s.OnFailure, "warn") {
+		v.add(SeverityError, "source_snapshot.on_failure", "abort または warn を指定してください: %s", s.OnFailure)
+	}
+	if s.SnapshotDir != "" && v.cfg.WorkDir != "" && method != "btrfs" && pathsOverlap(v.cfg.WorkDir, s.SnapshotDir) {
+		v.add(SeverityError, "source_snapshot.snapshot_dir", "work_dir の配下は指定できません")
+	}
+}
+
+// checkLevels は keep_versions と backup_dirs のレベルが揃っているかを検査します。
+func (v *configValidator) checkLevels() {
+	levels := make(map[string]bool)
+	for level := range v.cfg.KeepVersions {
+		levels[level] = true
+	}
+	for level := range v.cfg.BackupDirs {
+		levels[level] = true
+	}
+	for _, level := range scheduledLevels {
+		levels[level] = true
+	}
+
+	var sorted []string
+	for level := range levels {
+		sorted = append(sorted, level)
+	}
+	sort.Strings(sorted)
+
+	dirOwner := make(map[string]string)
+	for _, level := range sorted {
+		keep, hasKeep := v.cfg.KeepVersions[level]
+		dir, hasDir := v.cfg.BackupDirs[level]
+
+		if !isScheduledLevel(level) {
+			v.add(SeverityWarning, "keep_versions."+level, "レベル %s はスケジュールされません（有効なレベル: %s）",
+				level, strings.Join(scheduledLevels, ", "))
+		}
+
+		switch {
+		case !hasKeep && !hasDir:
+			v.add(SeverityError, "keep_versions", "レベル %s の keep_versions と backup_dirs が設定されていません", level)
+			continue
+		case !hasKeep:
+			v.add(SeverityError, "backup_dirs."+level, "keep_versions.%s が設定されていません", level)
+		case !hasDir:
+			v.add(SeverityError, "keep_versions."+level, "backup_dirs.%s が設定されていません", level)
+		}
+
+		if hasKeep && keep < 1 {
+			v.add(SeverityError, "keep_versions."+level, "保持数は1以上にしてください（%d の場合すべてのバックアップが削除されます）", keep)
+		}
+		if hasDir {
+			if strings.TrimSpace(dir) == "" {
+				v.add(SeverityError, "backup_dirs."+level, "ディレクトリが空です")
+				continue
+			}
+			norm := normalizeConfigPath(dir)
+			if other, ok := dirOwner[norm]; ok {
+				v.add(SeverityError, "backup_dirs."+level, "レベル %s と同じディレクトリです: %s", other, dir)
+			}
+			dirOwner[norm] = level
+		}
+	}
+}
+
+func isScheduledLevel(level string) bool {
+	for _, l := range scheduledLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOverlaps はコピー元とコピー先・保存先が重なっていないかを検査します。
+func (v *configValidator) checkOverlaps() {
+	cfg := v.cfg
+	if cfg.WorkDir != "" && cfg.BackupDir != "" && pathsOverlap(cfg.WorkDir, cfg.BackupDir) {
+		v.add(SeverityError, "backup_dir", "コピー元 work_dir (%s) と重なっています", cfg.WorkDir)
+	}
+
+	var levels []string
+	for level := range cfg.BackupDirs {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	for _, level := range levels {
+		dir := cfg.BackupDirs[level]
+		if dir == "" {
+			continue
+		}
+		if cfg.WorkDir != "" && pathsOverlap(cfg.WorkDir, dir) {
+			v.add(SeverityError, "backup_dirs."+level, "コピー元 work_dir (%s) と重なっています", cfg.WorkDir)
+		}
+		// backup_dir はミラーリングで不要ファイルが削除されるため、世代保存先と重なってはいけない
+		if cfg.BackupDir != "" && pathsOverlap(cfg.BackupDir, dir) {
+			v.add(SeverityError, "backup_dirs."+level, "コピー先 backup_dir (%s) と重なっています", cfg.BackupDir)
+		}
+	}
+}
+
+// normalizeConfigPath は比較用にパスを正規化します。
+// Windows 形式のパスは大文字小文字を区別しません。
+func normalizeConfigPath(p string) string {
+	p = path.Clean(filepath.ToSlash(p))
+	p = strings.TrimSuffix(p, "/")
+	if runtime.GOOS == "windows" || (len(p) >= 2 && p[1] == ':') {
+		p = strings.ToLower(p)
+	}
+	return p
+}
+
+// pathsOverlap は2つのパスが同一または一方が他方の配下にある場合に true を返します。
+func pathsOverlap(a, b string) bool {
+	na, nb := normalizeConfigPath(a), normalizeConfigPath(b)
+	return na == nb || strings.HasPrefix(nb, na+"/") || strings.HasPrefix(na, nb+"/")
+}
+
+// checkParentDirs は自動作成されないファイルの親ディレクトリが存在するかを検査します。
+// dry_run 中は実ファイルを作成しないため警告にとどめます。
+func (v *configValidator) checkParentDirs() {
+	severity := SeverityError
+	if v.cfg.DryRun {
+		severity = SeverityWarning
+	}
+
+	files := []struct {
+		key     string
+		path    string
+		enabled bool
+	}{
+		{"last_id_file", v.cfg.LastIDFile, true},
+		{"lock_file_path", v.cfg.LockFilePath, v.cfg.EnableLock},
+		{"perf_log_path", v.cfg.PerfLogPath, true},
+	}
+	for _, f := range files {
+		if !f.enabled || f.path == "" {
+			continue
+		}
+		dir := filepath.Dir(f.path)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			v.add(severity, f.key, "親ディレクトリが存在しません: %s", dir)
+		}
+	}
+
+	if v.cfg.SourceVHDX != "" && v.cfg.snapshotFormat().Name() == "vhdx" {
+		if _, err := os.Stat(v.cfg.SourceVHDX); err != nil {
+			v.add(severity, "source_vhdx", "ファイルが存在しません: %s", v.cfg.SourceVHDX)
+		}
+	}
+}
+
+// checkCopyMethods はコピー方式名を検査します。
+func (v *configValidator) checkCopyMethods() {
+	for i, method := range v.cfg.CopyMethodPriority {
+		if _, ok := findCopier(method); !ok {
+			v.add(SeverityError, fmt.Sprintf("copy_method_priority[%d]", i), "不明なコピー方式 %q です（有効な方式: %s）",
+				method, strings.Join(copierNames(), ", "))
+		}
+	}
+	var methods []string
+	for method := range v.cfg.CopyArgs {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		if _, ok := findCopier(method); !ok {
+			v.add(SeverityWarning, "copy_args."+method, "不明なコピー方式のため使用されません")
+		}
+	}
+}
+
+// checkLock は多重実行防止の設定を検査します。
+func (v *configValidator) checkLock() {
+	if v.cfg.EnableLock && v.cfg.LockFilePath == "" {
+		v.add(SeverityError, "lock_file_path", "enable_lock が有効ですがロックファイルが設定されていません")
+	}
+	if v.cfg.OnLockConflict != "" && v.cfg.OnLockConflict != "notify-exit" {
+		v.add(SeverityError, "on_lock_conflict", "不明な動作 %q です（\"notify-exit\" のみサポート）", v.cfg.OnLockConflict)
+	}
+}
+
+// checkLogRotation はログローテーション設定を検査します。
+func (v *configValidator) checkLogRotation() {
+	if v.cfg.LogMaxSizeMB < 0 {
+		v.add(SeverityError, "log_max_size_mb", "0以上にしてください")
+	}
+	if v.cfg.MaxLogFiles < 0 {
+		v.add(SeverityError, "max_log_files", "0以上にしてください")
+	}
+}
+
+// checkNotifications は通知先と通知ポリシーを検査します。
+func (v *configValidator) checkNotifications() {
+	for i, nc := range v.cfg.Notifiers {
+		key := fmt.Sprintf("notifiers[%d]", i)
+		if _, err := newNotifier(nc); err != nil {
+			v.add(SeverityError, key, "%v", err)
+		}
+		for _, name := range nc.Events {
+			if _, ok := parseNotificationType(name); !ok {
+				v.add(SeverityError, key+".events", "不明な通知種別 %q です", name)
+			}
+		}
+	}
+
+	policy := &v.cfg.NotificationPolicy
+	var types []string
+	for name := range policy.RateLimits {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	for _, name := range types {
+		key := "notification_policy.rate_limits." + name
+		if _, ok := parseNotificationType(name); !ok {
+			v.add(SeverityError, key, "不明な通知種別です")
+		}
+		if _, err := time.ParseDuration(policy.RateLimits[name]); err != nil {
+			v.add(SeverityError, key, "期間の形式が不正です: %v", err)
+		}
+	}
+	if policy.DedupWindow != "" {
+		if _, err := time.ParseDuration(policy.DedupWindow); err != nil {
+			v.add(SeverityError, "notification_policy.dedup_window", "期間の形式が不正です: %v", err)
+		}
+	}
+	if policy.DailyDigest.Time != "" {
+		if _, err := time.Parse("15:04", policy.DailyDigest.Time); err != nil {
+			v.add(SeverityError, "notification_policy.daily_digest.time", "時刻は HH:MM 形式で指定してください")
+		}
+	}
+
+	if policy.StateFile == "" && (len(policy.RateLimits) > 0 || policy.DedupWindow != "" || policy.Recovery || policy.DailyDigest.Enabled) {
+		v.add(SeverityWarning, "notification_policy.state_file", "設定されていません。定期起動モードでは実行ごとに状態が失われ、抑制・集約・復旧通知・日次ダイジェストが働きません")
+	}
+
+	types = types[:0]
+	for name := range policy.Templates {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	for _, name := range types {
+		key := "notification_policy.templates." + name
+		if _, ok := parseNotificationType(name); !ok {
+			v.add(SeverityError, key, "不明な通知種別です")
+		}
+		if _, err := template.New(name).Parse(policy.Templates[name]); err != nil {
+			v.add(SeverityError, key, "テンプレートの構文エラー: %v", err)
+		}
+	}
+}
+
+// checkHooks はフック設定を検査します。
+func (v *configValidator) checkHooks() {
+	phases := []string{HookPreBackup, HookPostCopy, HookPostSnapshot, HookPostRotate, HookOnError}
+	for _, phase := range phases {
+		for i, hook := range v.cfg.Hooks.hooksFor(phase) {
+			key := fmt.Sprintf("hooks.%s[%d]", phase, i)
+			if strings.TrimSpace(hook.Command) == "" {
+				v.add(SeverityError, key+".command", "設定されていません")
+			}
+			if hook.Timeout != "" {
+				if d, err := time.ParseDuration(hook.Timeout); err != nil || d <= 0 {
+					v.add(SeverityError, key+".timeout", "期間の形式が不正です: %q", hook.Timeout)
+				}
+			}
+			switch strings.ToLower(hook.OnFailure) {
+			case "", "abort", "warn":
+			default:
+				v.add(SeverityError, key+".on_failure", "\"abort\" または \"warn\" を指定してください")
+			}
+		}
+	}
+}
+
+// splitProblems は問題をエラーと警告に分けます。
+func splitProblems(problems []ConfigProblem) (errs, warnings []ConfigProblem) {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			errs = append(errs, p)
+		} else {
+			warnings = append(warnings, p)
+		}
+	}
+	return errs, warnings
+}
+
+// prepareJobs は --job で指定されたジョブに絞り込み、実行前の設定検査を行います。
+func prepareJobs(cfg *BackupConfig) ([]*BackupConfig, error) {
+	jobs, err := selectJobs(cfg, args.Jobs)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.jobs) > 0 {
+		cfg.jobs = jobs
+	}
+	if err := checkConfig(cfg); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// checkConfig は実行前に設定を検査します。警告はログに記録し、エラーがあれば設定エラーを返します。
+func checkConfig(cfg *BackupConfig) error {
+	errs, warnings := splitProblems(validateConfig(cfg))
+	for _, w := range warnings {
+		log.Printf("設定の警告: %s", w)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	path := ""
+	if cfg.source != nil {
+		path = cfg.source.path
+	}
+	return wrapFailure(FailureConfig, &ConfigValidationError{Path: path, Problems: errs})
+}
+
+// runConfigValidate は設定ファイルを検査し、すべての問題を表示します。
+// エラーがある場合は設定エラーを返します。
+func runConfigValidate(configPath string) error {
+	cfg, err := loadConfigLenient(configPath)
+	if err != nil {
+		// 型の不一致は構造体に読み込めないため、その時点の問題のみ表示
+		if verr, ok := err.(*ConfigValidationError); ok {
+			return printConfigProblems(configPath, verr.Problems)
+		}
+		return wrapFailure(FailureConfig, err)
+	}
+
+	var problems []ConfigProblem
+	if _, err := loadConfig(configPath); err != nil {
+		if verr, ok := err.(*ConfigValidationError); ok {
+			problems = append(problems, verr.Problems...)
+		}
+	}
+
+	// --job 指定時は指定したジョブのみ検査
+	jobs, err := selectJobs(cfg, args.Jobs)
+	if err != nil {
+		return err
+	}
+	if len(cfg.jobs) > 0 {
+		cfg.jobs = jobs
+	}
+	problems = append(problems, validateConfig(cfg)...)
+	return printConfigProblems(configPath, problems)
+}
+
+// printConfigProblems は問題を行番号順に表示し、エラーがあれば設定エラーを返します。
+func printConfigProblems(configPath string, problems []ConfigProblem) error {
+	if len(problems) == 0 {
+		fmt.Printf("設定に問題はありません: %s\n", configPath)
+		return nil
+	}
+
+	// ファイルごとに行番号順（行番号不明のものは末尾）
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].File != problems[j].File {
+			return problems[i].File < problems[j].File
+		}
+		li, lj := problems[i].Line, problems[j].Line
+		if li == 0 || lj == 0 {
+			return li != 0 && lj == 0
+		}
+		return li < lj
+	})
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+
+	errs, warnings := splitProblems(problems)
+	fmt.Printf("\nエラー %d 件、警告 %d 件\n", len(errs), len(warnings))
+	if len(errs) > 0 {
+		return wrapFailure(FailureConfig, fmt.Errorf("設定ファイルに %d 件のエラーがあります", len(errs)))
+	}
+	return nil
+}
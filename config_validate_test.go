@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// 設定ファイル検査のテスト
+// =============================================================================
+
+// writeTestConfig は一時ディレクトリに設定ファイルを作成し、そのパスを返します。
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.hjson")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("テスト設定ファイルの作成に失敗: %v", err)
+	}
+	return path
+}
+
+// captureStdout は fn 実行中の標準出力を返します。
+func captureStdout(t *testing.T, fn func()) string {
+	oldStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("パイプの作成に失敗: %v", err)
+	}
+	os.Stdout = w
+	fn()
+	w.Close()
+	os.Stdout = oldStdout
+	var out bytes.Buffer
+	io.Copy(&out, r)
+	return out.String()
+}
+
+// newValidTestConfig は検査エラーのないテスト用設定を作成します。
+func newValidTestConfig(t *testing.T) *BackupConfig {
+	tempDir := t.TempDir()
+	source := filepath.Join(tempDir, "source.vhdx")
+	os.WriteFile(source, []byte("vhdx"), 0644)
+
+	cfg := &BackupConfig{
+		WorkDir:            filepath.Join(tempDir, "work"),
+		BackupDir:          filepath.Join(tempDir, "mirror"),
+		SourceVHDX:         source,
+		LastIDFile:         filepath.Join(tempDir, "last_id.txt"),
+		CopyMethodPriority: []string{"robocopy", "native"},
+		KeepVersions:       map[string]int{},
+		BackupDirs:         map[string]string{},
+	}
+	for _, level := range scheduledLevels {
+		cfg.KeepVersions[level] = 2
+		cfg.BackupDirs[level] = filepath.Join(tempDir, "backups", level)
+	}
+	return cfg
+}
+
+// findProblem は指定キーの問題を返します。
+func findProblem(problems []ConfigProblem, key string) *ConfigProblem {
+	for i := range problems {
+		if problems[i].Key == key {
+			return &problems[i]
+		}
+	}
+	return nil
+}
+
+func TestLoadConfigRejectsUnknownKeys(t *testing.T) {
+	path := writeTestConfig(t, `{
+	dry_run: true
+	work_dir: "/test/work"
+	keep_version: { "30m": 5 }
+	notification_policy: {
+		dedup_window: "1h"
+		daily_digest: {
+			enabled: true
+			tiem: "09:00"
+		}
+	}
+	notifiers: [
+		{ type: "toast" }
+		{ type: "webhook", ulr: "http://example.com" }
+	]
+}`)
+
+	_, err := loadConfig(path)
+	verr, ok := err.(*ConfigValidationError)
+	if !ok {
+		t.Fatalf("ConfigValidationError が返されていません: %v", err)
+	}
+
+	expected := map[string]int{
+		"keep_version":                          4,
+		"notification_policy.daily_digest.tiem": 9,
+		"notifiers[1].ulr":                      14,
+	}
+	if len(verr.Problems) != len(expected) {
+		t.Fatalf("問題数が違います: 期待=%d, 実際=%d (%v)", len(expected), len(verr.Problems), verr.Problems)
+	}
+	for key, line := range expected {
+		p := findProblem(verr.Problems, key)
+		if p == nil {
+			t.Errorf("不明なキー %s が検出されていません", key)
+			continue
+		}
+		if p.Line != line {
+			t.Errorf("%s の行番号が違います: 期待=%d, 実際=%d", key, line, p.Line)
+		}
+	}
+
+	// 不明なキーを無視する読み込みは成功する
+	cfg, err := loadConfigLenient(path)
+	if err != nil || !cfg.DryRun {
+		t.Errorf("不明なキーを無視した読み込みに失敗: %v", err)
+	}
+}
+
+func TestLoadConfigTypeMismatchHasLine(t *testing.T) {
+	path := writeTestConfig(t, `{
+	dry_run: true
+	keep_versions: {
+		"30m": "five"
+	}
+}`)
+	_, err := loadConfig(path)
+	verr, ok := err.(*ConfigValidationError)
+	if !ok || len(verr.Problems) != 1 {
+		t.Fatalf("型の不一致が検出されていません: %v", err)
+	}
+	if verr.Problems[0].Line != 4 {
+		t.Errorf("行番号が違います: 期待=4, 実際=%d (%s)", verr.Problems[0].Line, verr.Problems[0])
+	}
+}
+
+func TestConfigSourceLineOfNestedKeys(t *testing.T) {
+	src := newConfigSource("config.hjson", []byte(`{
+	remote: {
+		keep_versions: { "1d": 3 }
+		levels: ["1d"]
+	}
+	keep_versions: {
+		"30m": 5
+	}
+	notifiers: [{
+		type: "toast"
+	}, { type: "webhook", url: "https://example.com" }]
+	encryption: { key_file: "a" }
+}`))
+	tests := []struct {
+		key  string
+		line int
+	}{
+		{"keep_versions", 6},
+		{"keep_versions.30m", 7},
+		{"remote.keep_versions", 3},
+		{"remote.levels", 4},
+		{"notifiers[0].type", 10},
+		{"notifiers[1].url", 11},
+		{"encryption.key_file", 12},
+		{"encryption.enabled", 12},
+	}
+	for _, tt := range tests {
+		if got := src.lineOf(tt.key); got != tt.line {
+			t.Errorf("%s の行番号が違います: 期待=%d, 実際=%d", tt.key, tt.line, got)
+		}
+	}
+}
+
+func TestGeneratedTemplateHasNoUnknownKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.hjson")
+	if err := generateTemplate(path); err != nil {
+		t.Fatalf("テンプレート生成エラー: %v", err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("テンプレートの読み込みエラー: %v", err)
+	}
+	// 環境に依存しない検査のみエラーがないこと（親ディレクトリは dry_run のため警告）
+	errs, _ := splitProblems(validateConfig(cfg))
+	if len(errs) > 0 {
+		t.Errorf("テンプレートに設定エラーがあります: %v", errs)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(cfg *BackupConfig)
+		key      string
+		severity string
+	}{
+		{"保持数0", func(cfg *BackupConfig) { cfg.KeepVersions["3h"] = 0 }, "keep_versions.3h", SeverityError},
+		{"backup_dirs 未設定", func(cfg *BackupConfig) { delete(cfg.BackupDirs, "3h") }, "keep_versions.3h", SeverityError},
+		{"keep_versions 未設定", func(cfg *BackupConfig) { delete(cfg.KeepVersions, "6h") }, "backup_dirs.6h", SeverityError},
+		{"スケジュールされないレベル", func(cfg *BackupConfig) {
+			cfg.KeepVersions["1w"] = 2
+			cfg.BackupDirs["1w"] = filepath.Join(t.TempDir(), "1w")
+		}, "keep_versions.1w", SeverityWarning},
+		{"保存先の重複", func(cfg *BackupConfig) { cfg.BackupDirs["6h"] = cfg.BackupDirs["3h"] + "/" }, "backup_dirs.6h", SeverityError},
+		{"保存先がコピー元の配下", func(cfg *BackupConfig) { cfg.BackupDirs["1d"] = filepath.Join(cfg.WorkDir, "1d") }, "backup_dirs.1d", SeverityError},
+		{"コピー先とコピー元が同一", func(cfg *BackupConfig) { cfg.BackupDir = cfg.WorkDir }, "backup_dir", SeverityError},
+		{"不明なコピー方式", func(cfg *BackupConfig) { cfg.CopyMethodPriority = []string{"native", "fastcopy"} }, "copy_method_priority[1]", SeverityError},
+		{"親ディレクトリなし", func(cfg *BackupConfig) { cfg.LastIDFile = filepath.Join(t.TempDir(), "missing", "last_id.txt") }, "last_id_file", SeverityError},
+		{"親ディレクトリなし (dry_run)", func(cfg *BackupConfig) {
+			cfg.DryRun = true
+			cfg.PerfLogPath = filepath.Join(t.TempDir(), "missing", "perf.tsv")
+		}, "perf_log_path", SeverityWarning},
+		{"不明なロック競合動作", func(cfg *BackupConfig) { cfg.OnLockConflict = "wait" }, "on_lock_conflict", SeverityError},
+		{"不正な通知先", func(cfg *BackupConfig) { cfg.Notifiers = []NotifierConfig{{Type: "webhook"}} }, "notifiers[0]", SeverityError},
+		{"不正なフック", func(cfg *BackupConfig) { cfg.Hooks.PostRotate = []HookConfig{{Command: "x", OnFailure: "ignore"}} }, "hooks.post_rotate[0].on_failure", SeverityError},
+		{"不正なダイジェスト時刻", func(cfg *BackupConfig) { cfg.NotificationPolicy.DailyDigest.Time = "9時" }, "notification_policy.daily_digest.time", SeverityError},
+		{"状態ファイルなしの通知ポリシー", func(cfg *BackupConfig) { cfg.NotificationPolicy.DedupWindow = "1h" }, "notification_policy.state_file", SeverityWarning},
+	}
+
+	if problems := validateConfig(newValidTestConfig(t)); len(problems) != 0 {
+		t.Fatalf("正常な設定で問題が検出されました: %v", problems)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newValidTestConfig(t)
+			tt.modify(cfg)
+			p := findProblem(validateConfig(cfg), tt.key)
+			if p == nil {
+				t.Fatalf("%s の問題が検出されていません: %v", tt.key, validateConfig(cfg))
+			}
+			if p.Severity != tt.severity {
+				t.Errorf("重大度が違います: 期待=%s, 実際=%s (%s)", tt.severity, p.Severity, p)
+			}
+		})
+	}
+}
+
+func TestRunConfigValidateReportsAllProblems(t *testing.T) {
+	path := writeTestConfig(t, `{
+	dry_run: true
+	work_dir: "/test/work"
+	backup_dir: "/test/work/mirror"
+	keep_versions: { "30m": 0 }
+	copy_method_priority: ["native", "fastcopy"]
+	unknown_option: 1
+}`)
+
+	output := captureStdout(t, func() {
+		err := runConfigValidate(path)
+		if classifyFailure(err) != FailureConfig {
+			t.Errorf("設定エラーとして返されていません: %v", err)
+		}
+	})
+
+	for _, want := range []string{
+		"4行目: [error] backup_dir:",
+		"5行目: [error] keep_versions.30m:",
+		"6行目: [error] copy_method_priority[1]:",
+		"7行目: [error] unknown_option:",
+		"backup_dirs.30m が設定されていません",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("出力に %q が含まれていません:\n%s", want, output)
+		}
+	}
+	// 行番号順に表示される
+	if strings.Index(output, "4行目") > strings.Index(output, "7行目") {
+		t.Errorf("行番号順に表示されていません:\n%s", output)
+	}
+}
+
+func TestCheckConfigFailsWithConfigKind(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.KeepVersions["30m"] = 0
+	if err := checkConfig(cfg); classifyFailure(err) != FailureConfig {
+		t.Errorf("設定エラーとして分類されていません: %v", err)
+	}
+	if err := checkConfig(newValidTestConfig(t)); err != nil {
+		t.Errorf("正常な設定でエラー: %v", err)
+	}
+}
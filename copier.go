@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// =============================================================================
+// コピー方式
+// =============================================================================
+
+// Copier は work_dir から backup_dir へのコピー方式です。
+// tryCopy は copy_method_priority の順に利用可能な方式を試し、最初に成功した時点で終了します。
+type Copier interface {
+	// Name は copy_method_priority・copy_args に指定する名前を返します。
+	Name() string
+	// Available はこの環境で利用できる（コマンドがある）場合に true を返します。
+	Available() bool
+	// DryRunPlan はドライランで表示する実行内容を返します。
+	DryRunPlan(job copyJob) []string
+	// Copy はコピーを実行します。失敗した場合は結果の Err を設定します（次の方式を試します）。
+	Copy(job copyJob) copyResult
+}
+
+// copiers は利用できるコピー方式の一覧です（copy_method_priority に不足している方式はこの順で補完します）。
+var copiers = []Copier{
+	robocopyCopier{},
+	xcopyCopier{},
+	copyItemCopier{},
+	rsyncCopier{},
+	nativeCopier{},
+}
+
+// copierNames はコピー方式の名前の一覧を返します。
+func copierNames() []string {
+	var names []string
+	for _, c := range copiers {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// findCopier は名前に対応するコピー方式を返します。
+func findCopier(name string) (Copier, bool) {
+	for _, c := range copiers {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// copyJob はコピー方式に渡すコピーの内容です。
+type copyJob struct {
+	Cfg    *BackupConfig
+	Src    string
+	Dst    string
+	Args   string     // copy_args のこの方式の値
+	Filter copyFilter // コピー対象の絞り込み
+}
+
+// copyResult はコピーの結果です。
+type copyResult struct {
+	Copied    int      // コピーしたファイル数（コマンドから分からない場合は 0）
+	Unchanged int      // 変更がないためコピーしなかったファイル数
+	Skipped   int      // 除外・アクセス拒否によりスキップしたファイル・ディレクトリ数
+	Deleted   int      // ミラーリングにより削除したファイル数（コマンドから分からない場合は 0）
+	Errors    []string // 発生したが処理を継続したエラー
+	Err       error    // コピーの失敗（次の方式を試します）
+}
+
+// logErrors は処理を継続したエラーをログに記録します（最初の5つのみ表示）。
+func (r copyResult) logErrors() {
+	if len(r.Errors) == 0 {
+		return
+	}
+	log.Printf("コピー中に %d個のエラーが発生しましたが、処理を継続しました", len(r.Errors))
+	for i, errMsg := range r.Errors {
+		if i == 5 {
+			log.Printf("  ... 他に %d個のエラー", len(r.Errors)-5)
+			break
+		}
+		log.Printf("  エラー: %s", errMsg)
+	}
+}
+
+// isCommandAvailable はコピー方式が利用可能かチェックします。
+func isCommandAvailable(method string) bool {
+	c, ok := findCopier(method)
+	return ok && c.Available()
+}
+
+// ensureAllCopyMethods は設定されていないコピー方式を末尾に追加します。
+// native を最後の手段として末尾に設定している場合（既定の設定ファイルの形式）は、
+// native は常に利用できて以降の方式が使われないため、native の前に追加します（後から追加された rsync 等）。
+func ensureAllCopyMethods(priority []string) []string {
+	// 既に設定されている方式を記録
+	existing := make(map[string]bool)
+	for _, method := range priority {
+		existing[method] = true
+	}
+	var missing []string
+	for _, method := range copierNames() {
+		if !existing[method] {
+			missing = append(missing, method)
+		}
+	}
+
+	result := append([]string{}, priority...)
+	if n := len(priority); n > 1 && priority[n-1] == "native" {
+		result = append(result[:n-1], missing...)
+		return append(result, "native")
+	}
+	// 設定されていない方式を末尾に追加
+	return append(result, missing...)
+}
+
+// tryCopy は設定の優先順で最初に利用可能なコマンドを使用してコピーします。
+func tryCopy(cfg *BackupConfig, src, dst string, dryRun bool) error {
+	if dryRun {
+		fmt.Printf("コピー処理: %s → %s\n", src, dst)
+	} else {
+		log.Printf("コピー処理開始: %s → %s", src, dst)
+	}
+
+	// コピー方式の優先順位を補完
+	copyMethods := ensureAllCopyMethods(cfg.CopyMethodPriority)
+	if len(cfg.CopyMethodPriority) != len(copyMethods) {
+		log.Printf("コピー方式を補完しました: %v → %v", cfg.CopyMethodPriority, copyMethods)
+	}
+
+	filter := newCopyFilter(cfg)
+	var lastErr error
+	availableCount := 0
+
+	for _, method := range copyMethods {
+		c, ok := findCopier(method)
+		if !ok || !c.Available() {
+			if dryRun {
+				fmt.Printf("  %s: コマンドが利用できません\n", method)
+			} else {
+				log.Printf("コピー方法 %s: コマンドが利用できません", method)
+			}
+			continue
+		}
+		availableCount++
+		job := copyJob{Cfg: cfg, Src: src, Dst: dst, Args: cfg.CopyArgs[method], Filter: filter}
+
+		if dryRun {
+			for _, line := range c.DryRunPlan(job) {
+				fmt.Printf("  %s\n", line)
+			}
+			fmt.Println("  → 成功と仮定")
+			return nil
+		}
+
+		log.Printf("コピー方法 %s を試行中...", method)
+		result := c.Copy(job)
+		result.logErrors()
+		if result.Err == nil {
+			return nil
+		}
+		lastErr = result.Err
+	}
+
+	if availableCount == 0 {
+		err := errors.New("利用可能なコピー方法がありません")
+		log.Printf("コピー失敗: %v", err)
+		return err
+	}
+
+	err := fmt.Errorf("すべてのコピー方法に失敗しました。最後のエラー: %v", lastErr)
+	log.Printf("コピー失敗: %v", err)
+	return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// =============================================================================
+// PowerShell の Copy-Item によるコピー
+// =============================================================================
+
+// copyItemCopier は PowerShell の Copy-Item でコピーします。
+type copyItemCopier struct{}
+
+func (copyItemCopier) Name() string { return "copy-item" }
+
+func (copyItemCopier) Available() bool {
+	_, err := exec.LookPath("powershell")
+	return err == nil
+}
+
+// copyItemExcludeScript は除外する名前を PowerShell の配列の要素として返します。
+func copyItemExcludeScript(f copyFilter) string {
+	var excludePaths []string
+	for _, name := range f.excludeNames() {
+		excludePaths = append(excludePaths, "'"+name+"'")
+	}
+	return strings.Join(excludePaths, ",")
+}
+
+// copyItemScript は除外処理と拡張子フィルタリングを含む PowerShell スクリプトを作成します。
+func copyItemScript(job copyJob) string {
+	excludeScript := copyItemExcludeScript(job.Filter)
+
+	// PowerShell の引数を処理 (-Force が重複しないように)
+	psArgs := job.Args
+	if !strings.Contains(psArgs, "-Force") {
+		psArgs = psArgs + " -Force"
+	}
+
+	if len(job.Filter.extensions()) == 0 {
+		// 拡張子フィルタリングがない場合
+		return fmt.Sprintf(`
+$excludePaths = @(%s)
+Get-ChildItem -Path '%s' -Recurse | Where-Object {
+	$excluded = $false
+	foreach ($exclude in $excludePaths) {
+		if ($_.Name -eq $exclude -or $_.FullName -like "*\$exclude\*") {
+			$excluded = $true
+			break
+		}
+	}
+	-not $excluded
+} | Copy-Item -Destination '%s' %s
+`, excludeScript, job.Src, job.Dst, psArgs)
+	}
+
+	// 拡張子フィルタリングがある場合
+	var extConditions []string
+	for _, ext := range job.Filter.extensions() {
+		extConditions = append(extConditions, fmt.Sprintf("$_.Extension -eq '%s'", ext))
+	}
+	extensionFilter := strings.Join(extConditions, " -or ")
+
+	return fmt.Sprintf(`
+$excludePaths = @(%s)
+$includeFiles = @(%s)
+Get-ChildItem -Path '%s' -Recurse -File | Where-Object {
+	# 除外パスチェック
+	$excluded = $false
+	foreach ($exclude in $excludePaths) {
+		if ($_.Name -eq $exclude -or $_.FullName -like "*\$exclude\*") {
+			$excluded = $true
+			break
+		}
+	}
+	# 拡張子フィルタリング（include_files は拡張子に関係なく対象）
+	$extensionMatch = (%s) -or ($includeFiles -contains $_.FullName)
+
+	(-not $excluded) -and $extensionMatch
+} | ForEach-Object {
+	$relativePath = $_.FullName.Substring('%s'.Length).TrimStart('\')
+	$destPath = Join-Path '%s' $relativePath
+	$destDir = Split-Path $destPath -Parent
+	if ($destDir -and -not (Test-Path $destDir)) {
+		New-Item -ItemType Directory -Path $destDir -Force | Out-Null
+	}
+	Copy-Item $_.FullName $destPath %s
+}
+`, excludeScript, copyItemIncludeScript(job), job.Src, extensionFilter, job.Src, job.Dst, psArgs)
+}
+
+// copyItemIncludeScript は extensions の対象外の include_files のフルパスを PowerShell の配列の要素として返します。
+func copyItemIncludeScript(job copyJob) string {
+	var files []string
+	for _, rel := range job.Filter.includedFiles(job.Src) {
+		files = append(files, "'"+strings.ReplaceAll(filepath.Join(job.Src, rel), "'", "''")+"'")
+	}
+	return strings.Join(files, ",")
+}
+
+func (copyItemCopier) DryRunPlan(job copyJob) []string {
+	plan := []string{
+		"使用: powershell で除外処理付きコピー",
+		"  除外パス: " + copyItemExcludeScript(job.Filter),
+	}
+	if len(job.Filter.extensions()) > 0 {
+		plan = append(plan, fmt.Sprintf("  対象拡張子: %v", job.Filter.extensions()))
+	}
+	if files := job.Filter.includedFiles(job.Src); len(files) > 0 {
+		plan = append(plan, fmt.Sprintf("  include_files: %v", files))
+	}
+	return plan
+}
+
+func (copyItemCopier) Copy(job copyJob) copyResult {
+	ps := copyItemScript(job)
+	cmd := exec.Command("powershell", "-Command", ps)
+	log.Printf("実行コマンド: powershell -Command %s", ps)
+	out, err := cmd.CombinedOutput()
+
+	// PowerShellの出力もShift_JISの可能性があるため変換
+	outStr := convertShiftJISToUTF8(out)
+	if err != nil {
+		log.Printf("PowerShell Copy-Item 失敗: %v", err)
+		if len(outStr) > 0 {
+			log.Printf("PowerShell エラー出力:\n%s", outStr)
+		}
+		return copyResult{Err: err}
+	}
+	log.Printf("PowerShell Copy-Item でコピー完了")
+	if len(outStr) > 0 {
+		log.Printf("PowerShell 出力:\n%s", outStr)
+	}
+	return copyResult{}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// =============================================================================
+// robocopy によるコピー
+// =============================================================================
+
+// robocopyCopier は robocopy でコピーします。
+// extensions を指定した場合は、指定拡張子のファイルのコピーと対象外ファイルの削除の2段階で実行します。
+type robocopyCopier struct{}
+
+func (robocopyCopier) Name() string { return "robocopy" }
+
+func (robocopyCopier) Available() bool {
+	_, err := exec.LookPath("robocopy")
+	return err == nil
+}
+
+// robocopyParts は robocopy の引数を組み立てます。
+// robocopy の基本構文: robocopy <source> <destination> [files] [options]
+func robocopyParts(job copyJob, files []string, args []string) []string {
+	parts := []string{job.Src, job.Dst}
+	parts = append(parts, files...)
+	parts = append(parts, args...)
+	// 除外ディレクトリ（システムフォルダとユーザー定義の除外ディレクトリ）
+	parts = append(parts, "/XD")
+	parts = append(parts, job.Filter.excludeDirs()...)
+	// 除外ファイル属性（システム・隠しファイル）
+	parts = append(parts, "/XA:SH")
+	// 転送速度の上限
+	return append(parts, job.Cfg.Throttle.robocopyArgs(parts, time.Now())...)
+}
+
+func (robocopyCopier) DryRunPlan(job copyJob) []string {
+	if len(job.Filter.extensions()) > 0 {
+		plan := []string{
+			"robocopy: 拡張子フィルタ付き2段階実行",
+			fmt.Sprintf("  対象拡張子: %v", job.Filter.extensions()),
+		}
+		if files := job.Filter.includedFiles(job.Src); len(files) > 0 {
+			plan = append(plan, fmt.Sprintf("  include_files: %v", files))
+		}
+		return append(plan,
+			"  1. 指定拡張子ファイル（と include_files）のコピー",
+			"  2. 不要ファイルの削除",
+		)
+	}
+	return []string{"使用: robocopy " + strings.Join(robocopyParts(job, nil, strings.Fields(job.Args)), " ")}
+}
+
+func (c robocopyCopier) Copy(job copyJob) copyResult {
+	// 拡張子フィルタリングが指定されている場合は、2段階実行
+	if len(job.Filter.extensions()) > 0 {
+		return c.copyWithExtensions(job)
+	}
+
+	args := strings.Fields(job.Args)
+	parts := robocopyParts(job, nil, args)
+	log.Printf("実行コマンド: robocopy %s", strings.Join(parts, " "))
+	r, err := runRobocopyParts(job, parts)
+	result := r.copyResult(robocopyMirrors(args))
+	if err != nil {
+		log.Printf("robocopy 失敗: %v", err)
+		if len(r.Output) > 0 {
+			log.Printf("robocopy エラー出力:\n%s", r.Output)
+		}
+		result.Err = err
+		return result
+	}
+	r.log()
+	log.Printf("robocopy でコピー完了")
+	return result
+}
+
+// robocopyMirrors は robocopy の引数にコピー元にないファイルを削除する指定（/MIR・/PURGE）がある場合に true を返します。
+func robocopyMirrors(args []string) bool {
+	for _, arg := range args {
+		if strings.EqualFold(arg, "/MIR") || strings.EqualFold(arg, "/PURGE") {
+			return true
+		}
+	}
+	return false
+}
+
+// runRobocopyParts は進捗を表示しながら robocopy を実行し、出力（UTF-8 に変換）と終了コードを解析した結果を返します。
+// robocopy を実行できない場合と、終了コードが失敗（8以上）の場合はエラーを返します。
+func runRobocopyParts(job copyJob, parts []string) (robocopyResult, error) {
+	p := startCopyProgress(job.Cfg, job.Src, job.Dst, true)
+	out, err := runRobocopy(parts, p)
+	p.Finish()
+
+	// Shift_JISからUTF-8に変換
+	outStr := convertShiftJISToUTF8(out)
+	exitCode := 0
+	if err != nil {
+		var exitError *exec.ExitError
+		if !errors.As(err, &exitError) {
+			return robocopyResult{Output: outStr}, err
+		}
+		exitCode = exitError.ExitCode()
+	}
+	r := parseRobocopyResult(outStr, exitCode)
+	if !r.ExitCode.Succeeded() {
+		return r, fmt.Errorf("robocopy 失敗 (終了コード %s)", r.ExitCode)
+	}
+	return r, nil
+}
+
+// copyWithExtensions は拡張子フィルタリング付きの2段階robocopyを実行します。
+func (robocopyCopier) copyWithExtensions(job copyJob) copyResult {
+	log.Printf("robocopy 2段階実行開始: 拡張子フィルタリング + ミラーリング")
+
+	// 段階1: 指定拡張子のファイルをコピー
+	log.Printf("段階1: 指定拡張子ファイルのコピー")
+	args := strings.Fields(job.Args)
+	// /MIRではなく/Eを使用（削除なし）
+	for i, arg := range args {
+		if arg == "/MIR" {
+			args[i] = "/E"
+		}
+	}
+	parts := robocopyParts(job, job.Filter.extensionPatterns(), args)
+	log.Printf("実行コマンド(段階1): robocopy %s", strings.Join(parts, " "))
+	r, err := runRobocopyParts(job, parts)
+	result := r.copyResult(false)
+	if err != nil {
+		log.Printf("段階1失敗: %v", err)
+		if len(r.Output) > 0 {
+			log.Printf("robocopy エラー出力:\n%s", r.Output)
+		}
+		log.Printf("robocopy 拡張子フィルタリング失敗、次の方法を試行")
+		result.Err = errors.New("robocopy拡張子フィルタリング失敗")
+		return result
+	}
+	log.Printf("段階1完了: 指定拡張子ファイルのコピー成功")
+	r.log()
+
+	// include_files は拡張子に関係なく1ファイルずつコピー
+	if err := copyIncludedFilesRobocopy(job, args, &result); err != nil {
+		log.Printf("include_files のコピー失敗: %v", err)
+		log.Printf("robocopy 拡張子フィルタリング失敗、次の方法を試行")
+		result.Err = errors.New("robocopy拡張子フィルタリング失敗")
+		return result
+	}
+
+	// 段階2: 対象外ファイルの削除（カスタムクリーンアップ）
+	log.Printf("段階2: 対象外ファイルの削除")
+	if !cleanupUnwantedFiles(job.Filter, job.Src, job.Dst) {
+		log.Printf("段階2失敗: 対象外ファイルの削除に失敗")
+		log.Printf("robocopy 拡張子フィルタリング失敗、次の方法を試行")
+		result.Err = errors.New("robocopy拡張子フィルタリング失敗")
+		return result
+	}
+	log.Printf("段階2完了: 対象外ファイルの削除成功")
+	log.Printf("robocopy 2段階実行完了: 拡張子フィルタリング + ミラーリング成功")
+	return result
+}
+
+// copyIncludedFilesRobocopy は extensions の対象外の include_files を、ファイルのあるディレクトリを指定して
+// 1ファイルずつ robocopy でコピーします（サブディレクトリを辿る・削除する指定は外します）。
+func copyIncludedFilesRobocopy(job copyJob, args []string, result *copyResult) error {
+	var fileArgs []string
+	for _, arg := range args {
+		switch strings.ToUpper(arg) {
+		case "/E", "/S", "/MIR", "/PURGE":
+			continue
+		}
+		fileArgs = append(fileArgs, arg)
+	}
+	for _, rel := range job.Filter.includedFiles(job.Src) {
+		fileJob := job
+		fileJob.Src = filepath.Dir(filepath.Join(job.Src, rel))
+		fileJob.Dst = filepath.Dir(filepath.Join(job.Dst, rel))
+		parts := robocopyParts(fileJob, []string{filepath.Base(rel)}, fileArgs)
+		log.Printf("実行コマンド(include_files): robocopy %s", strings.Join(parts, " "))
+		out, err := runRobocopy(parts, nil)
+		exitCode := 0
+		if err != nil {
+			var exitError *exec.ExitError
+			if !errors.As(err, &exitError) {
+				return err
+			}
+			exitCode = exitError.ExitCode()
+		}
+		r := parseRobocopyResult(convertShiftJISToUTF8(out), exitCode)
+		if !r.ExitCode.Succeeded() {
+			return fmt.Errorf("%s: robocopy 失敗 (終了コード %s)", rel, r.ExitCode)
+		}
+		fileResult := r.copyResult(false)
+		result.Copied += fileResult.Copied
+		result.Unchanged += fileResult.Unchanged
+		result.Skipped += fileResult.Skipped
+		result.Errors = append(result.Errors, fileResult.Errors...)
+	}
+	return nil
+}
+
+// cleanupUnwantedFiles はバックアップ先の対象外ファイル（extensions の対象外で include_files でもないもの）を削除します。
+func cleanupUnwantedFiles(f copyFilter, src, dst string) bool {
+	log.Printf("対象外ファイルのクリーンアップを開始: %s", dst)
+
+	deletedFiles := 0
+	deletedDirs := 0
+	skippedFiles := 0
+	errors := 0
+
+	// バックアップ先ディレクトリを走査
+	err := filepath.Walk(dst, func(dstPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("ファイル走査エラー: %s, %v", dstPath, err)
+			errors++
+			return nil
+		}
+
+		// ルートディレクトリはスキップ
+		if dstPath == dst {
+			return nil
+		}
+
+		// バックアップ先のパスから相対パスを取得
+		relPath, err := filepath.Rel(dst, dstPath)
+		if err != nil {
+			log.Printf("相対パス計算エラー: %s, %v", dstPath, err)
+			errors++
+			return nil
+		}
+
+		// ソース側の対応するパス
+		srcPath := filepath.Join(src, relPath)
+
+		if info.IsDir() {
+			// ディレクトリの場合：ソース側に存在しない場合は削除
+			if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+				log.Printf("対象外ディレクトリを削除: %s", dstPath)
+				if err := os.RemoveAll(dstPath); err != nil {
+					log.Printf("ディレクトリ削除エラー: %s, %v", dstPath, err)
+					errors++
+				} else {
+					deletedDirs++
+				}
+				return filepath.SkipDir // サブディレクトリもスキップ
+			}
+			return nil
+		}
+
+		// ファイルの場合
+		shouldDelete := false
+		if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+			// ソース側に対応するファイルが存在しない場合は削除
+			shouldDelete = true
+			log.Printf("ソース側に存在しないファイルを削除: %s", dstPath)
+		} else if !hasExtensionSuffix(f.cfg, dstPath) && !f.isIncludedFile(srcPath) {
+			// ソース側にファイルが存在する場合、拡張子をチェック
+			log.Printf("対象外拡張子のファイルを削除: %s (拡張子: %s)", dstPath, strings.ToLower(filepath.Ext(dstPath)))
+			shouldDelete = true
+		}
+
+		if shouldDelete {
+			if err := os.Remove(dstPath); err != nil {
+				log.Printf("ファイル削除エラー: %s, %v", dstPath, err)
+				errors++
+			} else {
+				deletedFiles++
+			}
+		} else {
+			skippedFiles++
+		}
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("ディレクトリ走査でエラー: %v", err)
+		return false
+	}
+
+	log.Printf("クリーンアップ完了: 削除ファイル数=%d, 削除ディレクトリ数=%d, スキップ=%d, エラー=%d",
+		deletedFiles, deletedDirs, skippedFiles, errors)
+
+	// エラーがあっても部分的に成功していれば成功とみなす
+	return errors < (deletedFiles + deletedDirs + skippedFiles)
+}
+
+// hasExtensionSuffix はファイル名が extensions のいずれかで終わる場合に true を返します（未設定の場合はすべて対象）。
+// 段階1の "*.tar.gz" のようなパターンでコピーしたファイルを残すため、末尾の一致で判定します。
+func hasExtensionSuffix(cfg *BackupConfig, path string) bool {
+	if len(cfg.Extensions) == 0 {
+		return true
+	}
+	fileName := strings.ToLower(filepath.Base(path))
+	for _, allowedExt := range cfg.Extensions {
+		if strings.HasSuffix(fileName, strings.ToLower(allowedExt)) {
+			return true
+		}
+	}
+	return false
+}
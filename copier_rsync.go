@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// =============================================================================
+// rsync によるコピー
+// =============================================================================
+
+// defaultRsyncArgs は copy_args に rsync の引数がない場合に使用する引数です（ミラーリング）。
+const defaultRsyncArgs = "-a --delete"
+
+// rsyncCopier は rsync でコピーします（Linux・WSL 向け）。
+// 変更のあったファイルのみを転送し、--delete でコピー元にないファイルを削除します。
+type rsyncCopier struct{}
+
+func (rsyncCopier) Name() string { return "rsync" }
+
+// Available は rsync がある場合に true を返します。
+// Windows の rsync（cwRsync 等）は "P:/" をリモートホストとして扱うため使用しません。
+func (rsyncCopier) Available() bool {
+	if runtime.GOOS == "windows" {
+		return false
+	}
+	_, err := exec.LookPath("rsync")
+	return err == nil
+}
+
+// runRsyncCommand は rsync を実行して出力（標準出力・標準エラー）と終了コードを返します。
+// onLine が nil でない場合は出力を1行ずつ渡します。err は rsync を実行できなかった場合のみ返します。
+// テストで置き換えます。
+var runRsyncCommand = func(args []string, onLine func(line string)) ([]byte, int, error) {
+	cmd := exec.Command("rsync", args...)
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(io.TeeReader(pr, &out))
+		for scanner.Scan() {
+			if onLine != nil {
+				onLine(scanner.Text())
+			}
+		}
+		io.Copy(&out, pr) // 長すぎる行で読み取りを中断した場合の残り
+	}()
+	err := cmd.Run()
+	pw.Close()
+	<-done
+
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		return out.Bytes(), exitError.ExitCode(), nil
+	}
+	return out.Bytes(), 0, err
+}
+
+// rsyncCommandArgs は rsync の引数を組み立てます。dryRun の場合は -n（変更内容の確認のみ）を付けます。
+func rsyncCommandArgs(job copyJob, dryRun bool) []string {
+	args := strings.Fields(job.Args)
+	if len(args) == 0 {
+		args = strings.Fields(defaultRsyncArgs)
+	}
+	if dryRun {
+		args = append(args, "-n")
+	}
+	// 結果の集計に使用
+	args = append(args, "--itemize-changes", "--stats")
+	for _, rule := range rsyncFilterRules(job.Filter, job.Src) {
+		args = append(args, "--filter="+rule)
+	}
+	// 転送速度の上限
+	args = append(args, job.Cfg.Throttle.rsyncArgs(args, time.Now())...)
+	// コピー元の末尾の "/" でディレクトリの中身をコピーする
+	return append(args, strings.TrimRight(filepath.ToSlash(job.Src), "/")+"/", job.Dst)
+}
+
+// rsyncFilterRules は除外ディレクトリ・include_files・extensions を rsync のフィルタ規則に変換します。
+// 規則は先に一致したものが適用されるため、除外 → include_files → 拡張子の順に並べます。
+func rsyncFilterRules(f copyFilter, src string) []string {
+	var rules []string
+	for _, name := range systemExcludeDirs {
+		rules = append(rules, "- "+name+"/")
+	}
+	for _, dir := range f.cfg.ExcludeDirs {
+		if rel, ok := rsyncAnchoredPath(src, dir); ok {
+			rules = append(rules, "- "+rel)
+		}
+	}
+	if len(f.extensions()) == 0 {
+		return rules
+	}
+
+	// include_files は拡張子に関係なくコピーする
+	for _, rel := range f.includedFiles(src) {
+		rules = append(rules, "+ /"+filepath.ToSlash(rel))
+	}
+	// ディレクトリはすべて辿り、指定拡張子以外のファイルを除外する
+	rules = append(rules, "+ */")
+	for _, ext := range f.extensions() {
+		rules = append(rules, "+ *"+rsyncCaseInsensitive(ext))
+	}
+	return append(rules, "- *")
+}
+
+// rsyncAnchoredPath は src 配下の path を src を基準とした rsync のパターン（"/sub/dir"）に変換します。
+// src 配下でない場合は false を返します。
+func rsyncAnchoredPath(src, path string) (string, bool) {
+	rel, err := filepath.Rel(src, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return "/" + filepath.ToSlash(rel), true
+}
+
+// rsyncCaseInsensitive は拡張子を大文字・小文字を区別しないパターンに変換します（".txt" → ".[tT][xX][tT]"）。
+// 他のコピー方式と同じく拡張子の大文字・小文字を区別しないためです。
+func rsyncCaseInsensitive(ext string) string {
+	var b strings.Builder
+	for _, r := range ext {
+		lower, upper := unicode.ToLower(r), unicode.ToUpper(r)
+		if lower == upper {
+			b.WriteRune(r)
+			continue
+		}
+		fmt.Fprintf(&b, "[%c%c]", lower, upper)
+	}
+	return b.String()
+}
+
+// rsyncStats は rsync の --itemize-changes・--stats の出力から集計した結果です。
+type rsyncStats struct {
+	Files       int      // 対象の通常ファイル数
+	Transferred int      // 転送した通常ファイル数
+	Deleted     int      // 削除したファイル数
+	Bytes       int64    // 転送したファイルの合計サイズ
+	Changes     []string // 変更のあったファイル・ディレクトリ（--itemize-changes の行）
+}
+
+var (
+	// rsyncItemPattern は --itemize-changes の行です（例: ">f+++++++++ sub/a.txt"・"*deleting   b.txt"）。
+	rsyncItemPattern = regexp.MustCompile(`^(\*deleting|[<>ch.][fdLDS][^ ]*)\s+(.+)$`)
+
+	rsyncFilesPattern       = regexp.MustCompile(`^Number of files: ([\d,.]+)(?: \(reg: ([\d,.]+))?`)
+	rsyncTransferredPattern = regexp.MustCompile(`^Number of (?:regular )?files transferred: ([\d,.]+)`)
+	rsyncDeletedPattern     = regexp.MustCompile(`^Number of deleted files: ([\d,.]+)`)
+	rsyncBytesPattern       = regexp.MustCompile(`^Total transferred file size: ([\d,.]+) bytes`)
+)
+
+// parseRsyncItem は --itemize-changes の行から変更の種類とパスを返します。
+func parseRsyncItem(line string) (item, name string, ok bool) {
+	m := rsyncItemPattern.FindStringSubmatch(strings.TrimRight(line, "\r"))
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// rsyncTransferredFile は転送した通常ファイルの行の場合にパスを返します。
+func rsyncTransferredFile(line string) (string, bool) {
+	item, name, ok := parseRsyncItem(line)
+	if !ok || item[1] != 'f' || !strings.ContainsRune("<>c", rune(item[0])) {
+		return "", false
+	}
+	return name, true
+}
+
+// parseRsyncNumber は桁区切り（ロケールにより "," または "."）を含む数値を変換します。
+func parseRsyncNumber(s string) int64 {
+	n, _ := strconv.ParseInt(strings.NewReplacer(",", "", ".", "").Replace(s), 10, 64)
+	return n
+}
+
+// parseRsyncOutput は rsync の出力を集計します。
+// --stats の値を優先し、ない場合（古い rsync・途中で失敗した場合）は --itemize-changes の行数を使用します。
+func parseRsyncOutput(out string) rsyncStats {
+	var s rsyncStats
+	transferred, deleted := -1, -1
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if item, _, ok := parseRsyncItem(line); ok {
+			if item[0] != '.' {
+				s.Changes = append(s.Changes, line)
+			}
+			if item == "*deleting" {
+				s.Deleted++
+			} else if _, ok := rsyncTransferredFile(line); ok {
+				s.Transferred++
+			}
+			continue
+		}
+		if m := rsyncFilesPattern.FindStringSubmatch(line); m != nil {
+			s.Files = int(parseRsyncNumber(m[1]))
+			if m[2] != "" {
+				s.Files = int(parseRsyncNumber(m[2]))
+			}
+		} else if m := rsyncTransferredPattern.FindStringSubmatch(line); m != nil {
+			transferred = int(parseRsyncNumber(m[1]))
+		} else if m := rsyncDeletedPattern.FindStringSubmatch(line); m != nil {
+			deleted = int(parseRsyncNumber(m[1]))
+		} else if m := rsyncBytesPattern.FindStringSubmatch(line); m != nil {
+			s.Bytes = parseRsyncNumber(m[1])
+		}
+	}
+	if transferred >= 0 {
+		s.Transferred = transferred
+	}
+	if deleted >= 0 {
+		s.Deleted = deleted
+	}
+	return s
+}
+
+// rsyncErrorLines は rsync のエラーメッセージの行を返します。
+func rsyncErrorLines(out string) []string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "rsync: ") || strings.HasPrefix(line, "rsync error: ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// rsyncDryRunChanges はドライランで表示する変更内容の最大件数です。
+const rsyncDryRunChanges = 20
+
+// DryRunPlan は rsync -n を実行し、実行するコマンドと変更予定の内容を返します。
+func (rsyncCopier) DryRunPlan(job copyJob) []string {
+	args := rsyncCommandArgs(job, true)
+	plan := []string{"使用: rsync " + strings.Join(args, " ")}
+	out, code, err := runRsyncCommand(args, nil)
+	if err == nil && code != 0 {
+		err = fmt.Errorf("終了コード %d: %s", code, strings.Join(rsyncErrorLines(string(out)), "; "))
+	}
+	if err != nil {
+		return append(plan, fmt.Sprintf("  rsync -n に失敗: %v", err))
+	}
+
+	stats := parseRsyncOutput(string(out))
+	plan = append(plan, fmt.Sprintf("  変更予定: %d個のファイルをコピー、%d個を削除 (%s)", stats.Transferred, stats.Deleted, formatBytes(stats.Bytes)))
+	for i, change := range stats.Changes {
+		if i == rsyncDryRunChanges {
+			plan = append(plan, fmt.Sprintf("    ... 他に %d件", len(stats.Changes)-rsyncDryRunChanges))
+			break
+		}
+		plan = append(plan, "    "+change)
+	}
+	return plan
+}
+
+func (rsyncCopier) Copy(job copyJob) copyResult {
+	var result copyResult
+
+	// ソースディレクトリの存在確認（rsync はコピー先の親ディレクトリを作成しないため事前に作成）
+	if _, err := os.Stat(job.Src); err != nil {
+		log.Printf("rsync 失敗: ソースディレクトリが存在しません: %v", err)
+		result.Err = err
+		return result
+	}
+	if err := os.MkdirAll(job.Dst, 0755); err != nil {
+		log.Printf("rsync 失敗: %v", err)
+		result.Err = err
+		return result
+	}
+
+	args := rsyncCommandArgs(job, false)
+	log.Printf("実行コマンド: rsync %s", strings.Join(args, " "))
+	p := startCopyProgress(job.Cfg, job.Src, job.Dst, true)
+	out, code, err := runRsyncCommand(args, func(line string) {
+		if name, ok := rsyncTransferredFile(line); ok {
+			if info, err := os.Stat(filepath.Join(job.Src, filepath.FromSlash(name))); err == nil {
+				p.Add(info.Size())
+			}
+			p.AddFile()
+		}
+	})
+	p.Finish()
+	outStr := string(out)
+
+	// rsync の終了コード: 0 成功、23 一部のファイルを転送できない、24 転送中にコピー元のファイルが消えた
+	switch {
+	case err != nil:
+		log.Printf("rsync 失敗: %v", err)
+		result.Err = err
+		return result
+	case code == 0:
+	case code == 23:
+		result.Errors = append(result.Errors, rsyncErrorLines(outStr)...)
+		log.Printf("rsync: 一部のファイルを転送できませんでした (終了コード: %d)", code)
+	case code == 24:
+		log.Printf("rsync: 転送中にコピー元のファイルが消えました (終了コード: %d)", code)
+	default:
+		result.Err = fmt.Errorf("rsync 失敗 (終了コード: %d)", code)
+		log.Printf("%v", result.Err)
+		if len(outStr) > 0 {
+			log.Printf("rsync エラー出力:\n%s", strings.Join(rsyncErrorLines(outStr), "\n"))
+		}
+		return result
+	}
+
+	stats := parseRsyncOutput(outStr)
+	result.Copied = stats.Transferred
+	result.Unchanged = max(stats.Files-stats.Transferred, 0)
+	result.Deleted = stats.Deleted
+	log.Printf("rsync 結果: %d個のファイルをコピー (%s)、%d個は変更なし、%d個を削除",
+		result.Copied, formatBytes(stats.Bytes), result.Unchanged, result.Deleted)
+	log.Printf("rsync でコピー完了")
+	return result
+}
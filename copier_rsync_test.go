@@ -0,0 +1,212 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeRsync は rsync を実行せずに out と終了コードを返し、実行した引数を記録します。
+func fakeRsync(t *testing.T, out string, code int) *[][]string {
+	var calls [][]string
+	old := runRsyncCommand
+	runRsyncCommand = func(args []string, onLine func(string)) ([]byte, int, error) {
+		calls = append(calls, args)
+		if onLine != nil {
+			for _, line := range strings.Split(out, "\n") {
+				onLine(line)
+			}
+		}
+		return []byte(out), code, nil
+	}
+	t.Cleanup(func() { runRsyncCommand = old })
+	return &calls
+}
+
+const rsyncTestOutput = `*deleting   old.txt
+>f+++++++++ a.txt
+cd+++++++++ sub/
+>f+++++++++ sub/b.txt
+>f.st...... c.txt
+.d..t...... ./
+
+Number of files: 6 (reg: 4, dir: 2)
+Number of created files: 3 (reg: 2, dir: 1)
+Number of deleted files: 1 (reg: 1)
+Number of regular files transferred: 3
+Total file size: 1,234,567 bytes
+Total transferred file size: 12,345 bytes
+`
+
+func TestParseRsyncOutput(t *testing.T) {
+	tests := []struct {
+		name        string
+		out         string
+		want        rsyncStats
+		wantChanges int
+	}{
+		{"rsync 3.1 以降", rsyncTestOutput, rsyncStats{Files: 4, Transferred: 3, Deleted: 1, Bytes: 12345}, 5},
+		{"rsync 3.0", ">f+++++++++ a.txt\nNumber of files: 3\nNumber of files transferred: 1\nTotal transferred file size: 10 bytes\n",
+			rsyncStats{Files: 3, Transferred: 1, Bytes: 10}, 1},
+		{"統計なし", "*deleting   old.txt\n>f+++++++++ a.txt\r\n>f..t...... b.txt\nrsync error: some files/attrs were not transferred (code 23)\n",
+			rsyncStats{Transferred: 2, Deleted: 1}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRsyncOutput(tt.out)
+			if len(got.Changes) != tt.wantChanges {
+				t.Errorf("Changes = %q, want %d件", got.Changes, tt.wantChanges)
+			}
+			got.Changes = nil
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRsyncOutput = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRsyncFilterRules(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "node_modules"), filepath.Join(cfg.WorkDir, "sub", ".git"), "/elsewhere"}
+	f := newCopyFilter(cfg)
+
+	rules := rsyncFilterRules(f, cfg.WorkDir)
+	for _, want := range []string{"- System Volume Information/", "- $Recycle.Bin/", "- /node_modules", "- /sub/.git"} {
+		if !slices.Contains(rules, want) {
+			t.Errorf("規則 %q がありません: %q", want, rules)
+		}
+	}
+	if slices.ContainsFunc(rules, func(r string) bool { return strings.Contains(r, "elsewhere") || strings.HasPrefix(r, "+") }) {
+		t.Errorf("不要な規則があります: %q", rules)
+	}
+
+	// extensions を指定した場合は include_files を優先し、対象外のファイルを除外する
+	cfg.Extensions = []string{".cpp", ".H"}
+	cfg.IncludeFiles = []string{filepath.Join(cfg.WorkDir, "docs", "README.txt"), "/elsewhere/a.txt"}
+	rules = rsyncFilterRules(f, cfg.WorkDir)
+	want := []string{"- /sub/.git", "+ /docs/README.txt", "+ */", "+ *.[cC][pP][pP]", "+ *.[hH]", "- *"}
+	if i := slices.Index(rules, want[0]); i < 0 || !slices.Equal(rules[i:], want) {
+		t.Errorf("規則 = %q, want 末尾が %q", rules, want)
+	}
+}
+
+func TestRsyncCommandArgs(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.Throttle.MaxBytesPerSec = 2048
+	job := copyJob{Cfg: cfg, Src: cfg.WorkDir + "/", Dst: cfg.BackupDir, Filter: newCopyFilter(cfg)}
+
+	args := rsyncCommandArgs(job, true)
+	if !slices.Equal(args[:5], []string{"-a", "--delete", "-n", "--itemize-changes", "--stats"}) {
+		t.Errorf("既定の引数が違います: %q", args)
+	}
+	if !slices.Contains(args, "--bwlimit=2") {
+		t.Errorf("--bwlimit がありません: %q", args)
+	}
+	// コピー元は末尾に "/" を1つ付けて中身をコピーする
+	if got := args[len(args)-2:]; got[0] != cfg.WorkDir+"/" || got[1] != cfg.BackupDir {
+		t.Errorf("コピー元・先 = %q", got)
+	}
+
+	job.Args = "-rt --bwlimit=100"
+	args = rsyncCommandArgs(job, false)
+	if args[0] != "-rt" || slices.Contains(args, "--delete") || slices.Contains(args, "-n") || slices.Contains(args, "--bwlimit=2") {
+		t.Errorf("copy_args の引数が使用されていません: %q", args)
+	}
+}
+
+func TestRsyncCopierExitCodes(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       int
+		wantErr    bool
+		wantErrors int
+	}{
+		{"成功", 0, false, 0},
+		{"一部のファイルを転送できない", 23, false, 1},
+		{"転送中にファイルが消えた", 24, false, 0},
+		{"失敗", 12, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureProgressOutput(t)
+			cfg := newValidTestConfig(t)
+			writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "A"})
+			out := rsyncTestOutput
+			if tt.code == 23 {
+				out += `rsync: [sender] send_files failed to open "/work/locked.txt": Permission denied (13)` + "\n"
+			}
+			calls := fakeRsync(t, out, tt.code)
+
+			result := rsyncCopier{}.Copy(copyJob{Cfg: cfg, Src: cfg.WorkDir, Dst: filepath.Join(cfg.BackupDir, "nested"), Filter: newCopyFilter(cfg)})
+			if (result.Err != nil) != tt.wantErr || len(result.Errors) != tt.wantErrors {
+				t.Fatalf("結果 = %+v", result)
+			}
+			if len(*calls) != 1 {
+				t.Fatalf("rsync の実行回数 = %d", len(*calls))
+			}
+			if _, err := os.Stat(filepath.Join(cfg.BackupDir, "nested")); err != nil {
+				t.Errorf("コピー先が作成されていません: %v", err)
+			}
+			if !tt.wantErr && (result.Copied != 3 || result.Unchanged != 1 || result.Deleted != 1) {
+				t.Errorf("集計 = %+v", result)
+			}
+		})
+	}
+}
+
+func TestRsyncDryRunPlan(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	calls := fakeRsync(t, rsyncTestOutput, 0)
+	plan := rsyncCopier{}.DryRunPlan(copyJob{Cfg: cfg, Src: cfg.WorkDir, Dst: cfg.BackupDir, Filter: newCopyFilter(cfg)})
+
+	if len(*calls) != 1 || !slices.Contains((*calls)[0], "-n") {
+		t.Fatalf("rsync -n が実行されていません: %q", *calls)
+	}
+	text := strings.Join(plan, "\n")
+	for _, want := range []string{"使用: rsync -a --delete -n", "変更予定: 3個のファイルをコピー、1個を削除", "    *deleting   old.txt", "    >f+++++++++ sub/b.txt"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("実行内容に %q がありません:\n%s", want, text)
+		}
+	}
+
+	fakeRsync(t, "rsync: change_dir \"/missing\" failed: No such file or directory (2)\n", 23)
+	plan = rsyncCopier{}.DryRunPlan(copyJob{Cfg: cfg, Src: cfg.WorkDir, Dst: cfg.BackupDir, Filter: newCopyFilter(cfg)})
+	if text := strings.Join(plan, "\n"); !strings.Contains(text, "rsync -n に失敗: 終了コード 23") || !strings.Contains(text, "No such file") {
+		t.Errorf("失敗時の実行内容が違います:\n%s", text)
+	}
+}
+
+// TestRsyncCopierMirror は実際の rsync でミラーリングします（rsync が必要です）。
+func TestRsyncCopierMirror(t *testing.T) {
+	if _, err := exec.LookPath("rsync"); err != nil || runtime.GOOS == "windows" {
+		t.Skip("rsync がありません")
+	}
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "excluded")}
+	cfg.Extensions = []string{".txt"}
+	cfg.IncludeFiles = []string{filepath.Join(cfg.WorkDir, "keep.bin")}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "A", "B.TXT": "B", "c.bin": "C", "keep.bin": "K", "excluded/d.txt": "D", "sub/e.txt": "E"})
+	writeTestFiles(t, cfg.BackupDir, map[string]string{"old.txt": "old"})
+	job := copyJob{Cfg: cfg, Src: cfg.WorkDir, Dst: cfg.BackupDir, Args: defaultRsyncArgs, Filter: newCopyFilter(cfg)}
+
+	result := rsyncCopier{}.Copy(job)
+	if result.Err != nil || result.Copied != 4 || result.Deleted != 1 {
+		t.Fatalf("結果 = %+v", result)
+	}
+	for name, want := range map[string]bool{"a.txt": true, "B.TXT": true, "keep.bin": true, "sub/e.txt": true, "c.bin": false, "excluded": false, "old.txt": false} {
+		if _, err := os.Stat(filepath.Join(cfg.BackupDir, name)); (err == nil) != want {
+			t.Errorf("%s の有無が違います: %v", name, err)
+		}
+	}
+
+	// 2回目は変更がないため転送しない
+	if result := (rsyncCopier{}).Copy(job); result.Err != nil || result.Copied != 0 || result.Unchanged != 4 {
+		t.Errorf("2回目の結果 = %+v", result)
+	}
+}
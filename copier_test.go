@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// コピー方式のテスト
+// =============================================================================
+
+func TestCopierRegistry(t *testing.T) {
+	if got, want := copierNames(), []string{"robocopy", "xcopy", "copy-item", "rsync", "native"}; !slices.Equal(got, want) {
+		t.Errorf("copierNames = %v, want %v", got, want)
+	}
+	for _, name := range copierNames() {
+		if c, ok := findCopier(name); !ok || c.Name() != name {
+			t.Errorf("findCopier(%s) = %v, %v", name, c, ok)
+		}
+	}
+	if _, ok := findCopier("fastcopy"); ok {
+		t.Error("未登録のコピー方式が見つかりました")
+	}
+	if !isCommandAvailable("native") || isCommandAvailable("fastcopy") {
+		t.Error("isCommandAvailable の判定が違います")
+	}
+}
+
+func TestEnsureAllCopyMethods(t *testing.T) {
+	tests := []struct {
+		priority []string
+		want     []string
+	}{
+		{nil, []string{"robocopy", "xcopy", "copy-item", "rsync", "native"}},
+		{[]string{"native"}, []string{"native", "robocopy", "xcopy", "copy-item", "rsync"}},
+		{[]string{"xcopy", "robocopy", "rsync", "native", "copy-item"}, []string{"xcopy", "robocopy", "rsync", "native", "copy-item"}},
+		// 既存の設定ファイルの既定値では rsync を native の前に補完する
+		{[]string{"robocopy", "xcopy", "copy-item", "native"}, []string{"robocopy", "xcopy", "copy-item", "rsync", "native"}},
+		{[]string{"rsync", "native"}, []string{"rsync", "robocopy", "xcopy", "copy-item", "native"}},
+	}
+	for _, tt := range tests {
+		if got := ensureAllCopyMethods(tt.priority); !slices.Equal(got, tt.want) {
+			t.Errorf("ensureAllCopyMethods(%v) = %v, want %v", tt.priority, got, tt.want)
+		}
+	}
+}
+
+func TestCopyFilterWalk(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "node_modules")}
+	cfg.Extensions = []string{".txt"}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{
+		"a.txt":                           "A",
+		"b.bin":                           "B",
+		"sub/c.txt":                       "C",
+		"node_modules/d.txt":              "D",
+		"$Recycle.Bin/e.txt":              "E",
+		"System Volume Information/f.txt": "F",
+	})
+
+	var result copyResult
+	var got []string
+	err := newCopyFilter(cfg).walk(cfg.WorkDir, &result, func(path, rel string, info os.FileInfo) error {
+		got = append(got, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk がエラーを返しました: %v", err)
+	}
+	if want := []string{"a.txt", "sub", "sub/c.txt"}; !slices.Equal(got, want) {
+		t.Errorf("走査したパス = %v, want %v", got, want)
+	}
+	// b.bin・node_modules・$Recycle.Bin・System Volume Information
+	if result.Skipped != 4 {
+		t.Errorf("Skipped = %d, want 4", result.Skipped)
+	}
+}
+
+func TestCopyFilterExcludes(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "cache")}
+	cfg.Extensions = []string{".txt", ".md"}
+	f := newCopyFilter(cfg)
+
+	if got := f.excludeDirs(); !slices.Contains(got, "$Recycle.Bin") || got[len(got)-1] != cfg.ExcludeDirs[0] {
+		t.Errorf("excludeDirs = %v", got)
+	}
+	if got := f.excludeNames(); !slices.Contains(got, "pagefile.sys") || got[len(got)-1] != "cache" {
+		t.Errorf("excludeNames = %v", got)
+	}
+	if got, want := f.extensionPatterns(), []string{"*.txt", "*.md"}; !slices.Equal(got, want) {
+		t.Errorf("extensionPatterns = %v, want %v", got, want)
+	}
+}
+
+func TestCopyFilterIncludeFiles(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "cache")}
+	cfg.Extensions = []string{".txt"}
+	cfg.IncludeFiles = []string{
+		filepath.Join(cfg.WorkDir, "config", "settings.ini"),
+		filepath.Join(cfg.WorkDir, "notes.txt"),      // extensions の対象
+		filepath.Join(cfg.WorkDir, "cache", "a.ini"), // 除外ディレクトリの配下
+		filepath.Join(t.TempDir(), "outside.ini"),    // work_dir の外
+	}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{
+		"notes.txt":           "N",
+		"config/settings.ini": "S",
+		"config/other.ini":    "O",
+		"cache/a.ini":         "A",
+	})
+	f := newCopyFilter(cfg)
+
+	if got, want := f.includedFiles(cfg.WorkDir), []string{filepath.Join("config", "settings.ini")}; !slices.Equal(got, want) {
+		t.Errorf("includedFiles = %v, want %v", got, want)
+	}
+	var got []string
+	if err := f.walkFiles(cfg.WorkDir, func(path, rel string, info os.FileInfo) error {
+		got = append(got, rel)
+		return nil
+	}); err != nil {
+		t.Fatalf("walkFiles がエラーを返しました: %v", err)
+	}
+	if want := []string{"config/settings.ini", "notes.txt"}; !slices.Equal(got, want) {
+		t.Errorf("走査したファイル = %v, want %v", got, want)
+	}
+
+	// Go で走査する方式は walk で include_files をコピーする
+	job := copyJob{Cfg: cfg, Src: cfg.WorkDir, Dst: cfg.BackupDir, Filter: f}
+	if result := (nativeCopier{}).Copy(job); result.Err != nil || result.Copied != 2 {
+		t.Errorf("native の結果 = %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, "config", "settings.ini")); err != nil {
+		t.Errorf("include_files がコピーされていません: %v", err)
+	}
+	// Copy-Item はスクリプトでフルパスを照合する
+	if script := copyItemScript(job); !strings.Contains(script, "'"+cfg.IncludeFiles[0]+"'") {
+		t.Errorf("Copy-Item のスクリプトに include_files がありません:\n%s", script)
+	}
+	// robocopy の段階2で include_files を削除しない
+	writeTestFiles(t, cfg.BackupDir, map[string]string{"config/other.ini": "O"})
+	if !cleanupUnwantedFiles(f, cfg.WorkDir, cfg.BackupDir) {
+		t.Fatal("クリーンアップに失敗しました")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, "config", "settings.ini")); err != nil {
+		t.Errorf("include_files が削除されました: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, "config", "other.ini")); !os.IsNotExist(err) {
+		t.Errorf("対象外のファイルが削除されていません: %v", err)
+	}
+}
+
+func TestNativeCopierResult(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "excluded")}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "A", "sub/b.txt": "B", "excluded/c.txt": "C"})
+	job := copyJob{Cfg: cfg, Src: cfg.WorkDir, Dst: cfg.BackupDir, Filter: newCopyFilter(cfg)}
+
+	result := nativeCopier{}.Copy(job)
+	if result.Err != nil || result.Copied != 2 || result.Unchanged != 0 || result.Skipped != 1 {
+		t.Fatalf("1回目の結果 = %+v", result)
+	}
+	if data, _ := os.ReadFile(filepath.Join(cfg.BackupDir, "sub", "b.txt")); string(data) != "B" {
+		t.Errorf("コピーされた内容が違います: %q", data)
+	}
+
+	// 変更したファイルのみコピーする
+	path := filepath.Join(cfg.WorkDir, "a.txt")
+	os.WriteFile(path, []byte("AA"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	result = nativeCopier{}.Copy(job)
+	if result.Err != nil || result.Copied != 1 || result.Unchanged != 1 {
+		t.Errorf("2回目の結果 = %+v", result)
+	}
+
+	// コピー元が存在しない
+	job.Src = filepath.Join(t.TempDir(), "missing")
+	if result := (nativeCopier{}).Copy(job); result.Err == nil {
+		t.Error("コピー元がない場合にエラーになりません")
+	}
+}
+
+func TestCopierDryRunPlan(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "cache")}
+	job := copyJob{Cfg: cfg, Src: cfg.WorkDir, Dst: cfg.BackupDir, Args: "/MIR /R:1", Filter: newCopyFilter(cfg)}
+
+	plan := strings.Join(robocopyCopier{}.DryRunPlan(job), "\n")
+	for _, want := range []string{"使用: robocopy " + cfg.WorkDir + " " + cfg.BackupDir + " /MIR /R:1 /XD", cfg.ExcludeDirs[0], "/XA:SH"} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("robocopy の実行内容に %q がありません: %s", want, plan)
+		}
+	}
+	cfg.Extensions = []string{".txt"}
+	if plan := strings.Join(robocopyCopier{}.DryRunPlan(job), "\n"); !strings.Contains(plan, "2段階実行") {
+		t.Errorf("拡張子指定時の robocopy の実行内容が違います: %s", plan)
+	}
+
+	// ドライランでは利用可能な最初の方式の実行内容を表示し、コピーしない
+	cfg.CopyMethodPriority = []string{"native"}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "A"})
+	out := captureStdout(t, func() {
+		if err := tryCopy(cfg, cfg.WorkDir, cfg.BackupDir, true); err != nil {
+			t.Errorf("tryCopy がエラーを返しました: %v", err)
+		}
+	})
+	if !strings.Contains(out, "  使用: native copy "+cfg.WorkDir) || !strings.Contains(out, "  → 成功と仮定") {
+		t.Errorf("ドライランの表示が違います:\n%s", out)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("ドライランでコピーされました: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// =============================================================================
+// xcopy によるコピー
+// =============================================================================
+
+// xcopyCopier は xcopy でコピーします。
+// extensions を指定した場合は、対象のファイルを探索して1ファイルずつコピーします。
+type xcopyCopier struct{}
+
+func (xcopyCopier) Name() string { return "xcopy" }
+
+func (xcopyCopier) Available() bool {
+	_, err := exec.LookPath("xcopy")
+	return err == nil
+}
+
+func (xcopyCopier) DryRunPlan(job copyJob) []string {
+	if len(job.Filter.extensions()) > 0 {
+		plan := []string{
+			"xcopy: 拡張子フィルタありで個別ファイルコピー",
+			fmt.Sprintf("  対象拡張子: %v", job.Filter.extensions()),
+		}
+		if files := job.Filter.includedFiles(job.Src); len(files) > 0 {
+			plan = append(plan, fmt.Sprintf("  include_files: %v", files))
+		}
+		return plan
+	}
+	parts := append([]string{job.Src, job.Dst}, strings.Fields(job.Args)...)
+	return []string{
+		"使用: xcopy " + strings.Join(parts, " ") + " /EXCLUDE:<除外リストの一時ファイル>",
+		"  除外: " + strings.Join(job.Filter.excludeNames(), ", "),
+	}
+}
+
+func (c xcopyCopier) Copy(job copyJob) copyResult {
+	if len(job.Filter.extensions()) > 0 {
+		return c.copyFiles(job)
+	}
+
+	// xcopyでは除外リストファイルを使用
+	parts := append([]string{job.Src, job.Dst}, strings.Fields(job.Args)...)
+	excludeFile, err := writeXcopyExcludeFile(job.Filter.excludeNames())
+	if err != nil {
+		log.Printf("xcopy 除外リストの作成に失敗: %v", err)
+	} else {
+		defer os.Remove(excludeFile) // 実行後に削除
+		parts = append(parts, "/EXCLUDE:"+excludeFile)
+	}
+
+	cmd := exec.Command("xcopy", parts...)
+	log.Printf("実行コマンド: xcopy %s", strings.Join(parts, " "))
+	out, err := cmd.CombinedOutput()
+
+	// Shift_JISからUTF-8に変換
+	outStr := convertShiftJISToUTF8(out)
+	if err != nil {
+		log.Printf("xcopy 失敗: %v", err)
+		if len(outStr) > 0 {
+			log.Printf("xcopy エラー出力:\n%s", outStr)
+		}
+		return copyResult{Err: err}
+	}
+	log.Printf("xcopy でコピー完了")
+	if len(outStr) > 0 {
+		log.Printf("xcopy 出力:\n%s", outStr)
+	}
+	return copyResult{}
+}
+
+// writeXcopyExcludeFile は xcopy の /EXCLUDE に指定する除外リストの一時ファイルを作成します。
+func writeXcopyExcludeFile(names []string) (string, error) {
+	tmpFile, err := os.CreateTemp("", "xcopy_exclude_*.txt")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmpFile.WriteString(strings.Join(names, "\n") + "\n")
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// copyFiles は対象のファイルを探索し、xcopy で1ファイルずつコピーします。
+func (xcopyCopier) copyFiles(job copyJob) copyResult {
+	var result copyResult
+
+	// ディレクトリ探索して対象ファイルを収集
+	var targetFiles []string
+	err := job.Filter.walk(job.Src, &result, func(path, rel string, info os.FileInfo) error {
+		if !info.IsDir() {
+			targetFiles = append(targetFiles, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("xcopy ファイル探索失敗: %v", err)
+		result.Err = err
+		return result
+	}
+	log.Printf("xcopy: %d個のファイルが対象です", len(targetFiles))
+
+	// 各ファイルを個別にコピー
+	for _, rel := range targetFiles {
+		srcFile := filepath.Join(job.Src, rel)
+		dstFile := filepath.Join(job.Dst, rel)
+
+		// コピー先ディレクトリを作成
+		if err := os.MkdirAll(filepath.Dir(dstFile), 0755); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("mkdir %s: %v", filepath.Dir(dstFile), err))
+			continue
+		}
+
+		// xcopy でファイルをコピー
+		xcopyArgs := append([]string{srcFile, dstFile}, strings.Fields(job.Args)...)
+		log.Printf("実行コマンド: xcopy %s", strings.Join(xcopyArgs, " "))
+		out, err := exec.Command("xcopy", xcopyArgs...).CombinedOutput()
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("xcopy %s: %v: %s", srcFile, err, convertShiftJISToUTF8(out)))
+			continue
+		}
+		result.Copied++
+	}
+
+	if result.Copied == 0 {
+		result.Err = errors.New("xcopy: コピーできるファイルが見つかりませんでした")
+		log.Printf("xcopy 失敗: %v", result.Err)
+		return result
+	}
+	log.Printf("xcopy でコピー完了 (%d個のファイル)", result.Copied)
+	return result
+}
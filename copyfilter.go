@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// コピー対象の絞り込み
+// =============================================================================
+
+// isProtectedSystemDir は Windows の保護されたフォルダ名の場合に true を返します。
+func isProtectedSystemDir(name string) bool {
+	lowerName := strings.ToLower(name)
+	return lowerName == "system volume information" ||
+		lowerName == "$recycle.bin" ||
+		lowerName == "recovery" ||
+		strings.HasPrefix(lowerName, "$") ||
+		strings.HasPrefix(lowerName, "hiberfil") ||
+		strings.HasPrefix(lowerName, "pagefile") ||
+		strings.HasPrefix(lowerName, "swapfile")
+}
+
+// isExcludedPath は exclude_dirs のいずれかの配下のパスの場合に true を返します。
+func (cfg *BackupConfig) isExcludedPath(path string) bool {
+	for _, excludeDir := range cfg.ExcludeDirs {
+		if strings.HasPrefix(path, excludeDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesExtension は extensions の対象のファイルの場合に true を返します（未設定の場合はすべて対象）。
+func (cfg *BackupConfig) matchesExtension(path string) bool {
+	if len(cfg.Extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, allowedExt := range cfg.Extensions {
+		if strings.ToLower(allowedExt) == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// isAccessDenied はアクセス拒否のエラーの場合に true を返します。
+func isAccessDenied(err error) bool {
+	return strings.Contains(err.Error(), "Access is denied") ||
+		strings.Contains(err.Error(), "access denied") ||
+		strings.Contains(err.Error(), "permission denied")
+}
+
+// systemExcludeDirs はすべてのコピー方式で除外する Windows のシステムフォルダです。
+var systemExcludeDirs = []string{"System Volume Information", "$Recycle.Bin", "Recovery"}
+
+// systemExcludeFiles は名前で除外するコピー方式（xcopy・Copy-Item）で除外する Windows のシステムファイルです。
+var systemExcludeFiles = []string{"hiberfil.sys", "pagefile.sys", "swapfile.sys"}
+
+// copyFilter は各コピー方式で共通のコピー対象の規則（保護されたフォルダ・exclude_dirs・extensions・include_files）です。
+// コマンドを使う方式はコマンドの引数に、Go で走査する方式は walk で適用します。
+type copyFilter struct {
+	cfg *BackupConfig
+}
+
+func newCopyFilter(cfg *BackupConfig) copyFilter {
+	return copyFilter{cfg: cfg}
+}
+
+// extensions は extensions の設定を返します（未設定の場合は空）。
+func (f copyFilter) extensions() []string {
+	return f.cfg.Extensions
+}
+
+// excludeDirs は除外するディレクトリ（システムフォルダの名前と exclude_dirs のパス）を返します（robocopy の /XD 用）。
+func (f copyFilter) excludeDirs() []string {
+	return append(append([]string{}, systemExcludeDirs...), f.cfg.ExcludeDirs...)
+}
+
+// excludeNames はパスを指定できないコピー方式向けに、除外するファイル・ディレクトリの名前を返します。
+// exclude_dirs は最後の要素の名前で除外します。
+func (f copyFilter) excludeNames() []string {
+	names := append(append([]string{}, systemExcludeDirs...), systemExcludeFiles...)
+	for _, dir := range f.cfg.ExcludeDirs {
+		names = append(names, filepath.Base(dir))
+	}
+	return names
+}
+
+// extensionPatterns は extensions をワイルドカードのパターン（"*.txt"）で返します。
+func (f copyFilter) extensionPatterns() []string {
+	var patterns []string
+	for _, ext := range f.cfg.Extensions {
+		patterns = append(patterns, "*"+ext)
+	}
+	return patterns
+}
+
+// isIncludedFile は include_files に指定されたファイルの場合に true を返します。
+func (f copyFilter) isIncludedFile(path string) bool {
+	for _, file := range f.cfg.IncludeFiles {
+		if filepath.Clean(file) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches はファイルが extensions の対象か include_files に指定されている場合に true を返します。
+func (f copyFilter) matches(path string) bool {
+	return f.cfg.matchesExtension(path) || f.isIncludedFile(path)
+}
+
+// includedFiles は extensions の対象外のため個別にコピーする include_files を src からの相対パスで返します。
+// src 配下にないもの・除外されるディレクトリ配下のものは含めません。extensions を指定しない場合は空です。
+func (f copyFilter) includedFiles(src string) []string {
+	if len(f.extensions()) == 0 {
+		return nil
+	}
+	var files []string
+	for _, file := range f.cfg.IncludeFiles {
+		rel, err := filepath.Rel(src, file)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if f.cfg.isExcludedPath(file) || f.cfg.matchesExtension(file) || f.inProtectedSystemDir(rel) {
+			continue
+		}
+		files = append(files, rel)
+	}
+	return files
+}
+
+// inProtectedSystemDir は相対パスが保護されたフォルダの配下の場合に true を返します。
+func (f copyFilter) inProtectedSystemDir(rel string) bool {
+	for _, name := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if isProtectedSystemDir(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// walk は src 以下のコピー対象のディレクトリ・ファイルを fn に渡します（src 自体は除く）。
+// 除外したもの・アクセスできないものは r.Skipped に数え、その他の走査のエラーは r.Errors に記録して走査を続けます。
+func (f copyFilter) walk(src string, r *copyResult, fn func(path, rel string, info os.FileInfo) error) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if isAccessDenied(err) {
+				r.Skipped++
+				log.Printf("アクセス拒否によりスキップ: %s", path)
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			r.Errors = append(r.Errors, fmt.Sprintf("path %s: %v", path, err))
+			return nil // エラーが発生してもWalkを続行
+		}
+		if path == src {
+			return nil
+		}
+
+		// Windowsの保護されたフォルダをスキップ
+		if info.IsDir() && isProtectedSystemDir(info.Name()) {
+			log.Printf("システムフォルダをスキップ: %s", path)
+			r.Skipped++
+			return filepath.SkipDir
+		}
+
+		// 設定ファイルの除外ディレクトリをチェック
+		if f.cfg.isExcludedPath(path) {
+			log.Printf("除外ディレクトリによりスキップ: %s", path)
+			r.Skipped++
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// 拡張子フィルタリング（設定されている場合。include_files は拡張子に関係なく対象）
+		if !info.IsDir() && !f.matches(path) {
+			r.Skipped++
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, rel, info)
+	})
+}
+
+// walkFiles は walk と同じ規則で src 以下のコピー対象の通常ファイルを fn に渡します。rel は "/" 区切りの相対パスです。
+// アクセスできないものはスキップし、その他の走査のエラーは走査を終えてからまとめて返します。
+func (f copyFilter) walkFiles(src string, fn func(path, rel string, info os.FileInfo) error) error {
+	var r copyResult
+	err := f.walk(src, &r, func(path, rel string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return fn(path, filepath.ToSlash(rel), info)
+	})
+	if err == nil && len(r.Errors) > 0 {
+		err = pkgerrors.New(strings.Join(r.Errors, "; "))
+	}
+	return err
+}
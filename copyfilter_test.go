@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// コピー対象の絞り込みのテスト
+// =============================================================================
+
+func TestCopyFilterWalkFiles(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, map[string]string{
+		"src/main.go":                    "x",
+		"src/README.MD":                  "x",
+		"src/image.png":                  "x",
+		"build/out.go":                   "x",
+		"$RECYCLE.BIN/old.go":            "x",
+		"docs/guide.md":                  "x",
+		"docs/build/nested.md":           "x",
+		"System Volume Information/a.md": "x",
+	})
+	cfg := &BackupConfig{
+		Extensions:  []string{".go", ".md"},
+		ExcludeDirs: []string{filepath.Join(root, "build")},
+	}
+
+	var got []string
+	err := newCopyFilter(cfg).walkFiles(root, func(path, rel string, info os.FileInfo) error {
+		got = append(got, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("走査エラー: %v", err)
+	}
+	// exclude_dirs は コピーと同じくパスの前方一致で判定する
+	expected := "docs/build/nested.md,docs/guide.md,src/README.MD,src/main.go"
+	if strings.Join(got, ",") != expected {
+		t.Errorf("絞り込み結果が違います: %v", got)
+	}
+}
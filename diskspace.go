@@ -0,0 +1,531 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// 空き容量の確認と容量の見積もり（plan）
+// =============================================================================
+
+// DiskSpaceConfig はスナップショット作成前の空き容量の確認の設定です。
+type DiskSpaceConfig struct {
+	MinFreeSpaceMB  int64          `json:"min_free_space_mb"` // スナップショット作成後も残す空き容量[MB]（0で確認のみ）
+	OnLowSpace      string         `json:"on_low_space"`      // 不足時の動作: abort / prune（省略時は abort）
+	MinKeepVersions map[string]int `json:"min_keep_versions"` // prune でも残すレベルごとの数（省略したレベルは 1）
+}
+
+// 空き容量が不足した場合の動作（disk_space.on_low_space）
+const (
+	lowSpaceAbort = "abort" // 中止してエラー通知
+	lowSpacePrune = "prune" // 古いスナップショットを削除してから続行
+)
+
+// lowSpacePolicies は disk_space.on_low_space に指定できる値の一覧です。
+var lowSpacePolicies = []string{lowSpaceAbort, lowSpacePrune}
+
+// diskSpace はボリュームの容量です。
+type diskSpace struct {
+	Volume string // ボリュームの識別子（同じボリュームの判定に使用）
+	Free   int64  // 利用できる空き容量
+	Total  int64
+}
+
+// statDiskSpace は path を含むボリュームの容量を返します（テストで差し替え可能）。
+// path が存在しない場合は存在する親ディレクトリのボリュームを返します。
+var statDiskSpace = func(path string) (diskSpace, error) {
+	return platformDiskSpace(existingParent(path))
+}
+
+// existingParent は path またはその親のうち存在する最も近いパスを返します。
+func existingParent(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// minKeep は prune で残すレベルのスナップショット数を返します。
+func (cfg *BackupConfig) minKeep(level string) int {
+	if n, ok := cfg.DiskSpace.MinKeepVersions[level]; ok {
+		return n
+	}
+	return 1
+}
+
+// entrySize はスナップショット（ファイル・ディレクトリ）のサイズを返します。
+// ハードリンクを共有するディレクトリも全ファイルのサイズを数えます。
+func entrySize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	if !info.IsDir() {
+		return info.Size()
+	}
+	size, _ := treeSize(path)
+	return size
+}
+
+// fileLinkID はハードリンクを共有するファイルを識別するボリューム・ファイル番号です。
+type fileLinkID struct {
+	volume uint64
+	index  uint64
+}
+
+// reclaimCounter は削除するスナップショットを順に加え、削除によって解放される容量を見積もります。
+// ハードリンクは同じファイルのすべてのリンクが削除対象に含まれた時点で1回だけ数えます。
+type reclaimCounter struct {
+	links map[fileLinkID]uint64 // 削除対象に含まれたリンクの数
+}
+
+func newReclaimCounter() *reclaimCounter {
+	return &reclaimCounter{links: make(map[fileLinkID]uint64)}
+}
+
+// add は path（ファイル・ディレクトリ）を削除対象に加え、新たに解放されるサイズを返します。
+func (c *reclaimCounter) add(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		id, nlink, ok := fileLinkInfo(p, info)
+		if !ok || nlink <= 1 {
+			size += info.Size()
+			return nil
+		}
+		c.links[id]++
+		if c.links[id] == nlink {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// latestSnapshotSize は全レベルの中で最も新しい、拡張子が ext のファイルのスナップショットのサイズを返します。
+func latestSnapshotSize(cfg *BackupConfig, ext string) (int64, bool) {
+	var latestName string
+	var size int64
+	for _, dir := range cfg.BackupDirs {
+		names, _ := listSnapshots(dir)
+		for _, name := range names {
+			if strings.HasSuffix(strings.TrimSuffix(name, encryptedExt), ext) && name > latestName {
+				latestName, size = name, entrySize(filepath.Join(dir, name))
+			}
+		}
+	}
+	return size, latestName != ""
+}
+
+// estimateSnapshotSize は次に作成するスナップショットが新たに使用する容量を見積もります。
+// mirrorDelta はコピーで backup_dir に書き込む量です（ミラーの変更はスナップショットにも含まれる）。
+func estimateSnapshotSize(cfg *BackupConfig, format snapshotFormat, mirrorDelta int64) int64 {
+	switch format.Name() {
+	case "vhdx":
+		if info, err := os.Stat(cfg.SourceVHDX); err == nil {
+			return info.Size()
+		}
+		return 0
+	case "directory":
+		size, _ := treeSize(cfg.BackupDir)
+		return size + mirrorDelta
+	case "hardlink":
+		// 前回のスナップショットから変更のあったファイルのみ容量を使用する
+		prev := latestSnapshotDir(cfg)
+		if prev == "" {
+			size, _ := treeSize(cfg.BackupDir)
+			return size + mirrorDelta
+		}
+		changed, _ := pendingCopySize(&BackupConfig{}, cfg.BackupDir, prev)
+		return changed + mirrorDelta
+	case "archive":
+		// 前回のアーカイブの 1.1 倍（ない場合は圧縮前のサイズ）
+		if size, ok := latestSnapshotSize(cfg, format.Ext()); ok {
+			return size + size/10
+		}
+		size, _ := filteredTreeSize(cfg, cfg.WorkDir)
+		return size
+	}
+	return 0
+}
+
+// diskRequirement はボリュームごとに必要な容量です。
+type diskRequirement struct {
+	space    diskSpace
+	required int64
+	items    []string // 内訳（表示用）
+}
+
+// checkDiskSpace はスナップショット作成前に、ミラーの更新とスナップショットの保存に必要な容量と
+// disk_space.min_free_space_mb の合計が空き容量を超えないかを確認します。
+// 不足する場合は on_low_space に従い、中止するか古いスナップショットを削除します。
+func checkDiskSpace(cfg *BackupConfig, level string, format snapshotFormat) error {
+	mirrorDelta, _ := pendingCopySize(cfg, cfg.WorkDir, cfg.BackupDir)
+	needs := []struct {
+		label string
+		path  string
+		bytes int64
+	}{
+		{"ミラーの更新", cfg.BackupDir, mirrorDelta},
+		{"スナップショット", cfg.BackupDirs[level], estimateSnapshotSize(cfg, format, mirrorDelta)},
+	}
+
+	volumes := make(map[string]*diskRequirement)
+	var order []string
+	for _, n := range needs {
+		space, err := statDiskSpace(n.path)
+		if err != nil {
+			log.Printf("空き容量を確認できません: %s: %v", n.path, err)
+			continue
+		}
+		req, ok := volumes[space.Volume]
+		if !ok {
+			req = &diskRequirement{space: space}
+			volumes[space.Volume] = req
+			order = append(order, space.Volume)
+		}
+		req.required += n.bytes
+		req.items = append(req.items, fmt.Sprintf("%s %s", n.label, formatBytes(n.bytes)))
+	}
+
+	minFree := cfg.DiskSpace.MinFreeSpaceMB * 1024 * 1024
+	for _, volume := range order {
+		req := volumes[volume]
+		need := req.required + minFree
+		message := fmt.Sprintf("空き容量 (%s): 空き %s / 必要 %s（%s、最低空き容量 %s）",
+			volume, formatBytes(req.space.Free), formatBytes(need), strings.Join(req.items, "、"), formatBytes(minFree))
+		if cfg.DryRun {
+			fmt.Println(message)
+		} else {
+			log.Print(message)
+		}
+		if req.space.Free >= need {
+			continue
+		}
+		if cfg.DiskSpace.OnLowSpace == lowSpacePrune && pruneForSpace(cfg, volume, req.space.Free, need) {
+			continue
+		}
+		err := pkgerrors.Errorf("空き容量が不足しています (%s): 空き %s / 必要 %s", volume, formatBytes(req.space.Free), formatBytes(need))
+		if cfg.DryRun {
+			fmt.Printf("[DRY-RUN] %v（実行時は中止します）\n", err)
+			continue
+		}
+		return wrapFailure(FailureDiskSpace, err)
+	}
+	return nil
+}
+
+// pruneForSpace は volume 上の各レベルの古いスナップショットを、min_keep_versions の数を残して
+// 通し番号の古い順に空き容量が need 以上になるまで削除します。十分な空き容量を確保できた場合に true を返します。
+// 削除しても足りない場合は何も削除しません。
+func pruneForSpace(cfg *BackupConfig, volume string, free, need int64) bool {
+	var candidates []snapshotEntry
+	for _, level := range orderedLevels(cfg) {
+		dir := cfg.BackupDirs[level]
+		if space, err := statDiskSpace(dir); err != nil || space.Volume != volume {
+			continue
+		}
+		names, err := listSnapshots(dir)
+		if err != nil {
+			continue
+		}
+		for _, name := range names[:max(0, len(names)-cfg.minKeep(level))] {
+			candidates = append(candidates, snapshotEntry{Level: level, Name: name, Path: filepath.Join(dir, name)})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].Name < candidates[j].Name })
+
+	// すべて削除しても足りない場合は削除しない（hardlink で他のスナップショット・ミラーと共有するファイルは解放されない）
+	available := free
+	total := newReclaimCounter()
+	for _, c := range candidates {
+		available += total.add(c.Path)
+	}
+	if available < need {
+		log.Printf("古いスナップショットを削除しても空き容量が不足します (%s): 削除後の空き %s / 必要 %s", volume, formatBytes(available), formatBytes(need))
+		return false
+	}
+
+	reclaimed := newReclaimCounter()
+	for _, c := range candidates {
+		if free >= need {
+			break
+		}
+		size := reclaimed.add(c.Path)
+		if cfg.DryRun {
+			fmt.Printf("[DRY-RUN] 空き容量確保のため削除予定: %s (%s)\n", c.Path, formatBytes(size))
+			free += size
+			continue
+		}
+		if err := os.RemoveAll(c.Path); err != nil {
+			log.Printf("空き容量確保のための削除に失敗: %s: %v", c.Path, err)
+			continue
+		}
+		log.Printf("空き容量確保のため削除: %s (%s)", c.Path, formatBytes(size))
+		if space, err := statDiskSpace(filepath.Dir(c.Path)); err == nil {
+			free = space.Free
+		} else {
+			free += size
+		}
+	}
+	return free >= need
+}
+
+// -----------------------------------------------------------------------------
+// plan: keep_versions による使用量の見積もり
+// -----------------------------------------------------------------------------
+
+// planCheckpoints は使用量を見積もる経過時間です。
+var planCheckpoints = []struct {
+	label string
+	days  float64
+}{
+	{"1日後", 1},
+	{"1週間後", 7},
+	{"30日後", 30},
+}
+
+// dailyLevelCounts はスケジュール実行で1日に作成される各レベルのスナップショット数を返します。
+func dailyLevelCounts() map[string]int {
+	// determineBestBackupLevel の判定ログは出力しない
+	w := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(w)
+	counts := make(map[string]int)
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.Local)
+	for t := day; t.Before(day.AddDate(0, 0, 1)); t = t.Add(30 * time.Minute) {
+		if ok, level := determineBestBackupLevel(t); ok {
+			counts[level]++
+		}
+	}
+	return counts
+}
+
+// snapshotPlan は1つのジョブの使用量の見積もりです。
+type snapshotPlan struct {
+	format   snapshotFormat
+	mirror   int64          // backup_dir（ミラー）の使用量
+	snapshot int64          // スナップショット1個の使用量（hardlink は2個目以降）
+	first    int64          // hardlink の最初のスナップショットの使用量
+	current  map[string]int // レベルごとの現在のスナップショット数
+	usage    map[string]int64
+	perDay   map[string]int
+	levels   []string
+	keep     map[string]int
+	volumes  []planVolume
+}
+
+// planVolume は同じボリュームのミラー・レベルです。
+type planVolume struct {
+	space  diskSpace
+	mirror bool // backup_dir を含む
+	levels []string
+}
+
+// newSnapshotPlan は現在のミラー・スナップショットから使用量を見積もります。
+func newSnapshotPlan(cfg *BackupConfig) *snapshotPlan {
+	p := &snapshotPlan{
+		format:  cfg.snapshotFormat(),
+		current: make(map[string]int),
+		usage:   make(map[string]int64),
+		perDay:  dailyLevelCounts(),
+		levels:  orderedLevels(cfg),
+		keep:    cfg.KeepVersions,
+	}
+	p.mirror, _ = treeSize(cfg.BackupDir)
+	if p.mirror == 0 {
+		p.mirror, _ = filteredTreeSize(cfg, cfg.WorkDir)
+	}
+	delta, _ := pendingCopySize(cfg, cfg.WorkDir, cfg.BackupDir)
+	switch p.format.Name() {
+	case "hardlink":
+		p.first = p.mirror
+		p.snapshot = delta
+	case "directory":
+		p.snapshot = p.mirror
+	default:
+		p.snapshot = estimateSnapshotSize(cfg, p.format, delta)
+	}
+	for _, level := range p.levels {
+		names, _ := listSnapshots(cfg.BackupDirs[level])
+		p.current[level] = len(names)
+		for _, name := range names {
+			p.usage[level] += entrySize(filepath.Join(cfg.BackupDirs[level], name))
+		}
+	}
+
+	// ボリュームごとにまとめる（容量を確認できない場合は1つのボリュームとみなす）
+	volumeOf := func(path string) *planVolume {
+		space, _ := statDiskSpace(path)
+		for i := range p.volumes {
+			if p.volumes[i].space.Volume == space.Volume {
+				return &p.volumes[i]
+			}
+		}
+		p.volumes = append(p.volumes, planVolume{space: space})
+		return &p.volumes[len(p.volumes)-1]
+	}
+	volumeOf(cfg.BackupDir).mirror = true
+	for _, level := range p.levels {
+		v := volumeOf(cfg.BackupDirs[level])
+		v.levels = append(v.levels, level)
+	}
+	return p
+}
+
+// count は days 日後のレベルのスナップショット数を返します（days が負の場合は保持数まで増えた状態）。
+func (p *snapshotPlan) count(level string, days float64) int {
+	keep := p.keep[level]
+	if p.perDay[level] == 0 {
+		return min(p.current[level], keep)
+	}
+	if days < 0 {
+		return keep
+	}
+	return min(keep, p.current[level]+int(math.Floor(float64(p.perDay[level])*days)))
+}
+
+// volumeBytes は days 日後（負の場合は保持数まで増えた状態）のボリュームのスナップショットの使用量を返します。
+// hardlink は同じボリュームのスナップショット間でリンクを共有するため、合計数で見積もります。
+func (p *snapshotPlan) volumeBytes(v planVolume, days float64) int64 {
+	if p.format.Name() == "hardlink" {
+		n := 0
+		for _, level := range v.levels {
+			n += p.count(level, days)
+		}
+		return p.bytes(n)
+	}
+	var sum int64
+	for _, level := range v.levels {
+		sum += p.bytes(p.count(level, days))
+	}
+	return sum
+}
+
+// totalBytes は days 日後のミラーとスナップショットの使用量の合計を返します。
+func (p *snapshotPlan) totalBytes(days float64) int64 {
+	total := p.mirror
+	for _, v := range p.volumes {
+		total += p.volumeBytes(v, days)
+	}
+	return total
+}
+
+// bytes は n 個のスナップショットの使用量を返します。
+func (p *snapshotPlan) bytes(n int) int64 {
+	if n == 0 {
+		return 0
+	}
+	if p.format.Name() == "hardlink" {
+		return p.first + int64(n-1)*p.snapshot
+	}
+	return int64(n) * p.snapshot
+}
+
+// fillDays は保持数に達するまでの日数を返します（スケジュール外のレベルは -1）。
+func (p *snapshotPlan) fillDays(level string) float64 {
+	if p.perDay[level] == 0 {
+		return -1
+	}
+	return math.Max(0, float64(p.keep[level]-p.current[level])/float64(p.perDay[level]))
+}
+
+// formatDays は日数を表示用に返します。
+func formatDays(days float64) string {
+	switch {
+	case days < 0:
+		return "スケジュール外"
+	case days == 0:
+		return "保持数に到達済み"
+	default:
+		return formatETA(time.Duration(days * float64(24*time.Hour)))
+	}
+}
+
+// runPlan は各ジョブについて、現在の keep_versions でのディスク使用量の推移を見積もって表示します。
+func runPlan(configPath string, out io.Writer) error {
+	jobs, err := loadSnapshotJobs(configPath)
+	if err != nil {
+		return err
+	}
+	for i, job := range jobs {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		printPlan(job, newSnapshotPlan(job), out)
+	}
+	return nil
+}
+
+// printPlan は見積もり結果を表示します。
+func printPlan(cfg *BackupConfig, p *snapshotPlan, out io.Writer) {
+	if cfg.jobName != "" {
+		fmt.Fprintf(out, "ジョブ: %s\n", cfg.jobName)
+	}
+	perSnapshot := formatBytes(p.snapshot)
+	if p.format.Name() == "hardlink" {
+		perSnapshot = fmt.Sprintf("最初 %s、以降 %s（前回からの変更量）", formatBytes(p.first), formatBytes(p.snapshot))
+	}
+	fmt.Fprintf(out, "スナップショット形式: %s（1個あたり 約 %s）\n", p.format.Name(), perSnapshot)
+	fmt.Fprintf(out, "ミラー (backup_dir): %s\n\n", formatBytes(p.mirror))
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "レベル\t保持数\t作成/日\t現在\t保持数に達するまで\t満杯時の使用量")
+	for _, level := range p.levels {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d (%s)\t%s\t%s\n", level, p.keep[level], p.perDay[level],
+			p.current[level], formatBytes(p.usage[level]), formatDays(p.fillDays(level)), formatBytes(p.bytes(p.count(level, -1))))
+	}
+	tw.Flush()
+
+	var currentUsage int64
+	for _, level := range p.levels {
+		currentUsage += p.usage[level]
+	}
+	fmt.Fprintln(out, "\n使用量の推移（ミラーを含む）:")
+	tw = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "現在\t%s\n", formatBytes(p.mirror+currentUsage))
+	for _, c := range planCheckpoints {
+		fmt.Fprintf(tw, "%s\t%s\n", c.label, formatBytes(p.totalBytes(c.days)))
+	}
+	fmt.Fprintf(tw, "満杯時\t%s\n", formatBytes(p.totalBytes(-1)))
+	tw.Flush()
+
+	// 保存先のボリュームごとに満杯時の空き容量を見積もる
+	minFree := cfg.DiskSpace.MinFreeSpaceMB * 1024 * 1024
+	fmt.Fprintln(out, "\n保存先の空き容量:")
+	for _, v := range p.volumes {
+		if v.space.Volume == "" {
+			fmt.Fprintln(out, "  空き容量を確認できません")
+			continue
+		}
+		var usage int64
+		for _, level := range v.levels {
+			usage += p.usage[level]
+		}
+		remaining := v.space.Free - (p.volumeBytes(v, -1) - usage)
+		fmt.Fprintf(out, "  %s: 空き %s / 全体 %s → 満杯時 %s\n", v.space.Volume, formatBytes(v.space.Free), formatBytes(v.space.Total), formatBytes(max(remaining, 0)))
+		if remaining < minFree {
+			fmt.Fprintf(out, "  ※ 空き容量が不足する見込みです（最低空き容量 %s）。keep_versions を減らすか保存先を変更してください\n", formatBytes(minFree))
+		}
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"os"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// platformDiskSpace は Unix・Windows 以外では空き容量を確認できないためエラーを返します。
+func platformDiskSpace(path string) (diskSpace, error) {
+	return diskSpace{}, pkgerrors.New("この OS では空き容量を確認できません")
+}
+
+// fileLinkInfo は Unix・Windows 以外ではハードリンクを識別できないため false を返します。
+func fileLinkInfo(path string, info os.FileInfo) (fileLinkID, uint64, bool) {
+	return fileLinkID{}, 0, false
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// 空き容量の確認・使用量の見積もりのテスト
+// =============================================================================
+
+// fakeDiskVolume は backup_dir とレベル別ディレクトリを容量 capacity の1つのボリュームとして扱います。
+// 空き容量は実際に書き込まれたファイルのサイズから計算します。
+func fakeDiskVolume(t *testing.T, cfg *BackupConfig, capacity int64) {
+	root := filepath.Dir(cfg.BackupDir)
+	old := statDiskSpace
+	statDiskSpace = func(path string) (diskSpace, error) {
+		mirror, _ := treeSize(cfg.BackupDir)
+		backups, _ := treeSize(filepath.Join(root, "backups"))
+		return diskSpace{Volume: "test", Free: capacity - mirror - backups, Total: capacity}, nil
+	}
+	t.Cleanup(func() { statDiskSpace = old })
+}
+
+// newDiskSpaceTestConfig は 100 バイトの VHDX と 30m の3個のスナップショット（各 100 バイト）を用意します。
+func newDiskSpaceTestConfig(t *testing.T) *BackupConfig {
+	cfg := newValidTestConfig(t)
+	if err := os.WriteFile(cfg.SourceVHDX, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, name := range []string{"000001_20250701_0900.vhdx", "000002_20250701_0930.vhdx", "000003_20250701_1000.vhdx"} {
+		files[name] = strings.Repeat("x", 100)
+	}
+	writeTestFiles(t, cfg.BackupDirs["30m"], files)
+	return cfg
+}
+
+func TestCheckDiskSpaceAbort(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newDiskSpaceTestConfig(t)
+	format := cfg.snapshotFormat()
+
+	// 使用 300 バイト、空き 50 バイトに対して VHDX の 100 バイトが必要
+	fakeDiskVolume(t, cfg, 350)
+	err := checkDiskSpace(cfg, "30m", format)
+	if err == nil || classifyFailure(err) != FailureDiskSpace {
+		t.Fatalf("空き容量不足で中止されません: %v", err)
+	}
+	if names, _ := listSnapshots(cfg.BackupDirs["30m"]); len(names) != 3 {
+		t.Errorf("abort でスナップショットが削除されました: %v", names)
+	}
+
+	fakeDiskVolume(t, cfg, 400)
+	if err := checkDiskSpace(cfg, "30m", format); err != nil {
+		t.Errorf("空き容量が足りる場合にエラーになりました: %v", err)
+	}
+
+	// min_free_space_mb を加えると不足する
+	cfg.DiskSpace.MinFreeSpaceMB = 1
+	if err := checkDiskSpace(cfg, "30m", format); classifyFailure(err) != FailureDiskSpace {
+		t.Errorf("最低空き容量を考慮していません: %v", err)
+	}
+}
+
+func TestCheckDiskSpacePrune(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int64
+		minKeep  map[string]int
+		dryRun   bool
+		wantErr  bool
+		want     []string
+	}{
+		{"1個削除", 350, nil, false, false, []string{"000002_20250701_0930.vhdx", "000003_20250701_1000.vhdx"}},
+		{"最新の1個を残して削除", 250, nil, false, false, []string{"000003_20250701_1000.vhdx"}},
+		{"min_keep_versions で足りない場合は削除しない", 250, map[string]int{"30m": 2}, false, true,
+			[]string{"000001_20250701_0900.vhdx", "000002_20250701_0930.vhdx", "000003_20250701_1000.vhdx"}},
+		{"ドライラン", 250, nil, true, false,
+			[]string{"000001_20250701_0900.vhdx", "000002_20250701_0930.vhdx", "000003_20250701_1000.vhdx"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureProgressOutput(t)
+			cfg := newDiskSpaceTestConfig(t)
+			cfg.DiskSpace = DiskSpaceConfig{OnLowSpace: lowSpacePrune, MinKeepVersions: tt.minKeep}
+			cfg.DryRun = tt.dryRun
+			fakeDiskVolume(t, cfg, tt.capacity)
+
+			var err error
+			captureStdout(t, func() { err = checkDiskSpace(cfg, "30m", cfg.snapshotFormat()) })
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkDiskSpace = %v, wantErr %v", err, tt.wantErr)
+			}
+			if names, _ := listSnapshots(cfg.BackupDirs["30m"]); !slices.Equal(names, tt.want) {
+				t.Errorf("残ったスナップショット = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestPruneForSpaceHardlinkSnapshots(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.SnapshotFormat = "hardlink"
+	dir := cfg.BackupDirs["30m"]
+	// shared.bin はミラーと全スナップショット、pair.bin は古い2個のスナップショットで共有する
+	writeTestFiles(t, cfg.BackupDir, map[string]string{"shared.bin": strings.Repeat("s", 100)})
+	writeTestFiles(t, dir, map[string]string{"000001_20250701_0900/pair.bin": strings.Repeat("p", 100)})
+	for _, name := range []string{"000001_20250701_0900", "000002_20250701_0930", "000003_20250701_1000"} {
+		os.MkdirAll(filepath.Join(dir, name), 0755)
+		if err := os.Link(filepath.Join(cfg.BackupDir, "shared.bin"), filepath.Join(dir, name, "shared.bin")); err != nil {
+			t.Skipf("ハードリンクを作成できません: %v", err)
+		}
+	}
+	os.Link(filepath.Join(dir, "000001_20250701_0900", "pair.bin"), filepath.Join(dir, "000002_20250701_0930", "pair.bin"))
+	writeTestFiles(t, dir, map[string]string{"000002_20250701_0930/own.txt": strings.Repeat("o", 10)})
+	old := statDiskSpace
+	statDiskSpace = func(path string) (diskSpace, error) { return diskSpace{Volume: "test"}, nil }
+	t.Cleanup(func() { statDiskSpace = old })
+
+	// 削除して解放されるのは pair.bin（1回分）と own.txt の 110 バイトのみ
+	all := []string{"000001_20250701_0900", "000002_20250701_0930", "000003_20250701_1000"}
+	if pruneForSpace(cfg, "test", 0, 150) {
+		t.Error("解放できない容量で空き容量を確保できたと判定しました")
+	}
+	if names, _ := listSnapshots(dir); !slices.Equal(names, all) {
+		t.Errorf("足りない場合に削除されました: %v", names)
+	}
+
+	cfg.DryRun = true
+	var ok bool
+	out := captureStdout(t, func() { ok = pruneForSpace(cfg, "test", 0, 110) })
+	if !ok || !strings.Contains(out, "000002_20250701_0930 (110 B)") {
+		t.Errorf("解放される容量の見積もりが違います: %v\n%s", ok, out)
+	}
+}
+
+func TestDailyLevelCounts(t *testing.T) {
+	want := map[string]int{"30m": 40, "3h": 4, "6h": 2, "12h": 1, "1d": 1}
+	got := dailyLevelCounts()
+	for _, level := range scheduledLevels {
+		if got[level] != want[level] {
+			t.Errorf("%s の1日の作成数 = %d, want %d", level, got[level], want[level])
+		}
+	}
+}
+
+func TestSnapshotPlan(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newDiskSpaceTestConfig(t)
+	cfg.KeepVersions["30m"] = 10
+	fakeDiskVolume(t, cfg, 10000)
+
+	p := newSnapshotPlan(cfg)
+	if p.snapshot != 100 || p.current["30m"] != 3 || p.usage["30m"] != 300 {
+		t.Fatalf("現在の使用量が違います: %+v", p)
+	}
+	tests := []struct {
+		level string
+		days  float64
+		want  int
+	}{
+		{"30m", 0, 3},
+		{"30m", 0.1, 7}, // 40個/日 × 0.1日
+		{"30m", 1, 10},
+		{"30m", -1, 10},
+		{"3h", 0.25, 1},
+		{"1d", 30, 2},
+	}
+	for _, tt := range tests {
+		if got := p.count(tt.level, tt.days); got != tt.want {
+			t.Errorf("count(%s, %v) = %d, want %d", tt.level, tt.days, got, tt.want)
+		}
+	}
+	// 30m: 10個、3h・6h・12h・1d: 2個ずつ → 18個 × 100 バイト
+	if got := p.totalBytes(-1); got != 1800 {
+		t.Errorf("満杯時の使用量 = %d, want 1800", got)
+	}
+	if got := p.fillDays("30m"); got != 7.0/40 {
+		t.Errorf("保持数に達するまでの日数 = %v", got)
+	}
+
+	// hardlink は2個目以降は変更量のみ
+	p.format, _ = findSnapshotFormat("hardlink")
+	p.first, p.snapshot = 1000, 10
+	if got := p.bytes(3); got != 1020 {
+		t.Errorf("hardlink の使用量 = %d, want 1020", got)
+	}
+}
+
+func TestRunPlan(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newDiskSpaceTestConfig(t)
+	fakeDiskVolume(t, cfg, 1000)
+	configPath := writeTestConfig(t, `{
+		"work_dir": "`+filepath.ToSlash(cfg.WorkDir)+`",
+		"backup_dir": "`+filepath.ToSlash(cfg.BackupDir)+`",
+		"source_vhdx": "`+filepath.ToSlash(cfg.SourceVHDX)+`",
+		"keep_versions": {"30m": 5, "1d": 7},
+		"backup_dirs": {
+			"30m": "`+filepath.ToSlash(cfg.BackupDirs["30m"])+`",
+			"1d": "`+filepath.ToSlash(cfg.BackupDirs["1d"])+`"
+		}
+	}`)
+
+	var out bytes.Buffer
+	if err := runPlan(configPath, &out); err != nil {
+		t.Fatalf("runPlan がエラーを返しました: %v", err)
+	}
+	for _, want := range []string{"スナップショット形式: vhdx（1個あたり 約 100 B）", "30m", "1d", "満杯時", "※ 空き容量が不足する見込みです"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("plan の出力に %q がありません:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestValidateDiskSpaceConfig(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.DiskSpace = DiskSpaceConfig{MinFreeSpaceMB: -1, OnLowSpace: "ask", MinKeepVersions: map[string]int{"30m": -1}}
+	problems := validateConfig(cfg)
+	for _, key := range []string{"disk_space.min_free_space_mb", "disk_space.on_low_space", "disk_space.min_keep_versions.30m"} {
+		if p := findProblem(problems, key); p == nil || p.Severity != SeverityError {
+			t.Errorf("%s のエラーが検出されません: %+v", key, problems)
+		}
+	}
+
+	cfg.DiskSpace = DiskSpaceConfig{OnLowSpace: lowSpacePrune, MinKeepVersions: map[string]int{"1w": 1, "1d": 5}}
+	problems = validateConfig(cfg)
+	for _, key := range []string{"disk_space.min_keep_versions.1w", "disk_space.min_keep_versions.1d"} {
+		if p := findProblem(problems, key); p == nil || p.Severity != SeverityWarning {
+			t.Errorf("%s の警告が検出されません: %+v", key, problems)
+		}
+	}
+}
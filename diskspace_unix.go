@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// platformDiskSpace は statfs でボリュームの容量を返します。ボリュームはデバイス番号で識別します。
+func platformDiskSpace(path string) (diskSpace, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return diskSpace{}, err
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return diskSpace{}, err
+	}
+	return diskSpace{
+		Volume: fmt.Sprintf("dev:%d", st.Dev),
+		Free:   int64(uint64(fs.Bavail) * uint64(fs.Bsize)),
+		Total:  int64(uint64(fs.Blocks) * uint64(fs.Bsize)),
+	}, nil
+}
+
+// fileLinkInfo はファイルのデバイス・inode 番号とリンク数を返します。
+func fileLinkInfo(path string, info os.FileInfo) (fileLinkID, uint64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileLinkID{}, 0, false
+	}
+	return fileLinkID{volume: uint64(st.Dev), index: uint64(st.Ino)}, uint64(st.Nlink), true
+}
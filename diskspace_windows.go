@@ -0,0 +1,50 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// platformDiskSpace は GetDiskFreeSpaceEx でボリュームの容量を返します。ボリュームはマウント先（C:\ 等）で識別します。
+func platformDiskSpace(path string) (diskSpace, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return diskSpace{}, err
+	}
+	var free, total, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, &totalFree); err != nil {
+		return diskSpace{}, err
+	}
+	buf := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(p, &buf[0], uint32(len(buf))); err != nil {
+		return diskSpace{}, err
+	}
+	return diskSpace{
+		Volume: strings.ToUpper(windows.UTF16ToString(buf)),
+		Free:   int64(free),
+		Total:  int64(total),
+	}, nil
+}
+
+// fileLinkInfo は GetFileInformationByHandle でファイルのボリュームのシリアル番号・ファイル番号とリンク数を返します。
+func fileLinkInfo(path string, info os.FileInfo) (fileLinkID, uint64, bool) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return fileLinkID{}, 0, false
+	}
+	h, err := windows.CreateFile(p, 0, windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return fileLinkID{}, 0, false
+	}
+	defer windows.CloseHandle(h)
+	var d windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(h, &d); err != nil {
+		return fileLinkID{}, 0, false
+	}
+	id := fileLinkID{volume: uint64(d.VolumeSerialNumber), index: uint64(d.FileIndexHigh)<<32 | uint64(d.FileIndexLow)}
+	return id, uint64(d.NumberOfLinks), true
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// スナップショットの暗号化のテスト
+// =============================================================================
+
+// testEncryptionKey はテスト用の鍵を作成します。
+func testEncryptionKey(t *testing.T, secret string) *encryptionKey {
+	key, err := newEncryptionKey([]byte(secret), "test")
+	if err != nil {
+		t.Fatalf("鍵の作成に失敗: %v", err)
+	}
+	return key
+}
+
+// encryptBytes は plain を暗号化した内容を返します。
+func encryptBytes(t *testing.T, key *encryptionKey, plain []byte) []byte {
+	var buf bytes.Buffer
+	ew, err := newEncryptWriter(&buf, key)
+	if err != nil {
+		t.Fatalf("暗号化の開始に失敗: %v", err)
+	}
+	ew.Write(plain)
+	if err := ew.Close(); err != nil {
+		t.Fatalf("暗号化に失敗: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decryptBytes は暗号化した内容 sealed をすべて復号します。
+func decryptBytes(key *encryptionKey, sealed []byte) ([]byte, error) {
+	d, err := newDecryptReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.NewSectionReader(d, 0, d.Size()))
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	key := testEncryptionKey(t, "correct horse battery staple")
+	rng := rand.New(rand.NewSource(1))
+
+	for _, size := range []int{0, 1, encChunkSize - 1, encChunkSize, encChunkSize + 1, 3*encChunkSize + 5} {
+		plain := make([]byte, size)
+		rng.Read(plain)
+		sealed := encryptBytes(t, key, plain)
+
+		got, err := decryptBytes(key, sealed)
+		if err != nil {
+			t.Fatalf("サイズ %d: 復号に失敗: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("サイズ %d: 復号した内容が一致しません", size)
+		}
+
+		// チャンクをまたぐ任意位置の読み込み
+		if size < 10 {
+			continue
+		}
+		d, _ := newDecryptReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+		for i := 0; i < 20; i++ {
+			off := rng.Intn(size)
+			n := rng.Intn(size-off) + 1
+			p := make([]byte, n)
+			if _, err := d.ReadAt(p, int64(off)); err != nil && err != io.EOF {
+				t.Fatalf("サイズ %d: %d からの読み込みに失敗: %v", size, off, err)
+			}
+			if !bytes.Equal(p, plain[off:off+n]) {
+				t.Fatalf("サイズ %d: %d からの %d バイトが一致しません", size, off, n)
+			}
+		}
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	key := testEncryptionKey(t, "correct horse battery staple")
+	plain := bytes.Repeat([]byte("0123456789abcdef"), encChunkSize/8) // 2 チャンク
+	sealed := encryptBytes(t, key, plain)
+
+	tests := []struct {
+		name   string
+		key    *encryptionKey
+		sealed []byte
+	}{
+		{"異なる鍵", testEncryptionKey(t, "wrong passphrase"), sealed},
+		{"1バイトの改ざん", key, func() []byte {
+			b := bytes.Clone(sealed)
+			b[encHeaderSize+10] ^= 1
+			return b
+		}()},
+		{"最終チャンクの切り詰め", key, sealed[:encHeaderSize+encChunkSize+encOverhead]},
+		{"末尾の欠落", key, sealed[:len(sealed)-1]},
+		{"暗号化していないデータ", key, plain},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decryptBytes(tt.key, tt.sealed); err == nil {
+				t.Error("復号がエラーになりません")
+			}
+		})
+	}
+}
+
+func TestReadEncryptionKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "secret-location.key")
+	os.WriteFile(keyFile, []byte("file-secret-value\n"), 0600)
+	envKeyFile := filepath.Join(dir, "env.key")
+	os.WriteFile(envKeyFile, []byte("env-file-secret"), 0600)
+
+	tests := []struct {
+		name       string
+		keyFile    string
+		envKeyFile string
+		passphrase string
+		wantSecret string
+		wantErr    bool
+	}{
+		{"key_file を優先", keyFile, envKeyFile, "env-passphrase", "file-secret-value", false},
+		{"環境変数の鍵ファイル", "", envKeyFile, "env-passphrase", "env-file-secret", false},
+		{"環境変数のパスフレーズ", "", "", "env-passphrase", "env-passphrase", false},
+		{"未設定", "", "", "", "", true},
+		{"存在しない鍵ファイル", filepath.Join(dir, "missing-secret.key"), "", "", "", true},
+		{"短すぎるパスフレーズ", "", "", "short", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(keyFileEnv, tt.envKeyFile)
+			t.Setenv(passphraseEnv, tt.passphrase)
+			cfg := &BackupConfig{Encryption: EncryptionConfig{Enabled: true, KeyFile: tt.keyFile}}
+			key, err := readEncryptionKey(cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("エラーになりません")
+				}
+				// 鍵ファイルのパス・鍵の内容をメッセージに含めない
+				if strings.Contains(err.Error(), "secret") || strings.Contains(err.Error(), "short") {
+					t.Errorf("エラーメッセージに鍵の情報が含まれています: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("鍵の読み込みに失敗: %v", err)
+			}
+			if string(key.secret) != tt.wantSecret {
+				t.Errorf("読み込んだ鍵が違います: %s", key.source)
+			}
+			if strings.Contains(key.String(), tt.wantSecret) {
+				t.Errorf("String() に鍵の内容が含まれています: %s", key)
+			}
+		})
+	}
+}
+
+// writeEncryptedFixture は暗号化したアーカイブのスナップショットと設定ファイルを作成します。
+func writeEncryptedFixture(t *testing.T) (configPath string, cfg *BackupConfig) {
+	t.Setenv(keyFileEnv, "")
+	t.Setenv(passphraseEnv, "")
+	cfg = newValidTestConfig(t)
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := runKeyGenerate(keyFile, io.Discard); err != nil {
+		t.Fatalf("鍵ファイルの作成に失敗: %v", err)
+	}
+	cfg.SnapshotFormat = "archive"
+	cfg.Encryption = EncryptionConfig{Enabled: true, KeyFile: keyFile}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"src/main.go": "main v1", "docs/a.md": "doc"})
+
+	os.MkdirAll(cfg.BackupDirs["3h"], 0755)
+	if _, err := writeArchive(cfg, zipCodec{}, filepath.Join(cfg.BackupDirs["3h"], "000001_20250701_0900.zip"+encryptedExt)); err != nil {
+		t.Fatalf("アーカイブの作成に失敗: %v", err)
+	}
+	os.MkdirAll(cfg.BackupDirs["1d"], 0755)
+	if _, err := writeArchive(cfg, tarZstdCodec{}, filepath.Join(cfg.BackupDirs["1d"], "000002_20250701_1000.tar.zst"+encryptedExt)); err != nil {
+		t.Fatalf("アーカイブの作成に失敗: %v", err)
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"dry_run":       true,
+		"backup_dirs":   cfg.BackupDirs,
+		"keep_versions": cfg.KeepVersions,
+		"encryption":    map[string]interface{}{"enabled": true, "key_file": keyFile},
+	})
+	return writeTestConfig(t, string(data)), cfg
+}
+
+func TestEncryptedSnapshotListRestoreVerify(t *testing.T) {
+	configPath, cfg := writeEncryptedFixture(t)
+
+	// 暗号化したファイルに平文が含まれない
+	raw, _ := os.ReadFile(filepath.Join(cfg.BackupDirs["3h"], "000001_20250701_0900.zip"+encryptedExt))
+	if bytes.Contains(raw, []byte("src/main.go")) {
+		t.Error("暗号化したスナップショットにファイル名が平文で含まれています")
+	}
+
+	var out bytes.Buffer
+	for _, name := range []string{"1", "000002_20250701_1000.tar.zst"} {
+		out.Reset()
+		if err := runList(configPath, name, &out); err != nil {
+			t.Fatalf("%s の中身の一覧に失敗: %v", name, err)
+		}
+		if !strings.Contains(out.String(), "src/main.go") {
+			t.Errorf("%s の中身の一覧が違います:\n%s", name, out.String())
+		}
+	}
+
+	to := t.TempDir()
+	if err := runRestore(configPath, "2", []string{"src"}, restoreOptions{To: to}, &out); err != nil {
+		t.Fatalf("復元に失敗: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(to, "src", "main.go")); string(got) != "main v1" {
+		t.Errorf("復元した内容が違います: %q", got)
+	}
+
+	out.Reset()
+	if err := runVerify(configPath, "", &out); err != nil {
+		t.Fatalf("検証に失敗: %v\n%s", err, out.String())
+	}
+	if strings.Count(out.String(), "OK  ") != 2 {
+		t.Errorf("検証結果が違います:\n%s", out.String())
+	}
+
+	// 破損したスナップショットは NG
+	path := filepath.Join(cfg.BackupDirs["1d"], "000002_20250701_1000.tar.zst"+encryptedExt)
+	raw, _ = os.ReadFile(path)
+	raw[len(raw)-20] ^= 1
+	os.WriteFile(path, raw, 0644)
+	out.Reset()
+	if err := runVerify(configPath, "", &out); classifyFailure(err) != FailureSnapshot {
+		t.Errorf("破損したスナップショットの検証がエラーになりません: %v", err)
+	}
+	if !strings.Contains(out.String(), "NG  "+path) {
+		t.Errorf("破損したスナップショットが NG になりません:\n%s", out.String())
+	}
+}
+
+func TestEncryptionKeyCheckAndRotate(t *testing.T) {
+	configPath, cfg := writeEncryptedFixture(t)
+
+	var out bytes.Buffer
+	if err := runKeyCheck(configPath, &out); err != nil {
+		t.Fatalf("鍵の確認に失敗: %v", err)
+	}
+	if strings.Contains(out.String(), cfg.Encryption.KeyFile) {
+		t.Errorf("鍵ファイルのパスが表示されています:\n%s", out.String())
+	}
+
+	// 異なる鍵では実行前の確認で失敗する
+	wrong := *cfg
+	wrong.encKey = testEncryptionKey(t, "wrong passphrase")
+	if err := checkEncryptionKey(&wrong); err == nil {
+		t.Error("異なる鍵の確認がエラーになりません")
+	}
+
+	newKeyFile := filepath.Join(t.TempDir(), "new.key")
+	runKeyGenerate(newKeyFile, io.Discard)
+
+	// dry-run では変更しない
+	before, _ := os.ReadFile(filepath.Join(cfg.BackupDirs["3h"], "000001_20250701_0900.zip"+encryptedExt))
+	if err := runKeyRotate(configPath, newKeyFile, true, &out); err != nil {
+		t.Fatalf("鍵の更新 (dry-run) に失敗: %v", err)
+	}
+	after, _ := os.ReadFile(filepath.Join(cfg.BackupDirs["3h"], "000001_20250701_0900.zip"+encryptedExt))
+	if !bytes.Equal(before, after) {
+		t.Error("dry-run でスナップショットが変更されました")
+	}
+
+	out.Reset()
+	if err := runKeyRotate(configPath, newKeyFile, false, &out); err != nil {
+		t.Fatalf("鍵の更新に失敗: %v", err)
+	}
+	if !strings.Contains(out.String(), "2 個のスナップショットを新しい鍵で暗号化し直しました") {
+		t.Errorf("鍵の更新の結果が違います:\n%s", out.String())
+	}
+
+	// 古い鍵では復号できず、新しい鍵で復号できる
+	if err := checkEncryptionKey(cfg); err == nil {
+		t.Error("古い鍵で復号できてしまいます")
+	}
+	rotated := *cfg
+	rotated.encKey = nil
+	rotated.Encryption.KeyFile = newKeyFile
+	for _, name := range []string{"000001_20250701_0900.zip", "000002_20250701_1000.tar.zst"} {
+		level := map[bool]string{true: "3h", false: "1d"}[strings.HasSuffix(name, ".zip")]
+		path := filepath.Join(cfg.BackupDirs[level], name+encryptedExt)
+		if err := verifySnapshot(&rotated, path); err != nil {
+			t.Errorf("%s を新しい鍵で復号できません: %v", name, err)
+		}
+		if _, err := os.Stat(path + ".rekey"); !os.IsNotExist(err) {
+			t.Errorf("一時ファイルが残っています: %s.rekey", path)
+		}
+	}
+}
+
+func TestEncryptionKeyRotateResumes(t *testing.T) {
+	configPath, cfg := writeEncryptedFixture(t)
+	newKeyFile := filepath.Join(t.TempDir(), "new.key")
+	runKeyGenerate(newKeyFile, io.Discard)
+	secret, _ := os.ReadFile(newKeyFile)
+	newKey, err := newEncryptionKey(secret, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 最新のスナップショットだけ再暗号化した状態で中断した
+	latest := filepath.Join(cfg.BackupDirs["1d"], "000002_20250701_1000.tar.zst"+encryptedExt)
+	if err := reencryptSnapshot(cfg, latest, newKey); err != nil {
+		t.Fatalf("再暗号化に失敗: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := runKeyRotate(configPath, newKeyFile, false, &out); err != nil {
+		t.Fatalf("中断後の鍵の更新に失敗: %v\n%s", err, out.String())
+	}
+	for _, want := range []string{"新しい鍵で暗号化済みのためスキップ: " + latest, "1 個のスナップショットを新しい鍵で暗号化し直しました"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("出力に %q が含まれていません:\n%s", want, out.String())
+		}
+	}
+	for _, path := range []string{latest, filepath.Join(cfg.BackupDirs["3h"], "000001_20250701_0900.zip"+encryptedExt)} {
+		if err := decryptsWith(path, newKey); err != nil {
+			t.Errorf("%s を新しい鍵で復号できません: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestEncryptedVHDXSnapshotRotates(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.encKey = testEncryptionKey(t, "correct horse battery staple")
+	cfg.Encryption.Enabled = true
+	dir := cfg.BackupDirs["30m"]
+	if err := (vhdxSnapshot{}).Create(cfg, filepath.Join(dir, "000001_20250701_0900.vhdx"+encryptedExt)); err != nil {
+		t.Fatalf("スナップショットの作成に失敗: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "000001_20250701_0900.vhdx.rekey"), nil, 0644)
+
+	names, err := listSnapshots(dir)
+	if err != nil || len(names) != 1 || names[0] != "000001_20250701_0900.vhdx"+encryptedExt {
+		t.Fatalf("暗号化したスナップショットが一覧に含まれません: %v %v", names, err)
+	}
+	data, err := openSnapshotData(cfg, filepath.Join(dir, names[0]))
+	if err != nil {
+		t.Fatalf("復号に失敗: %v", err)
+	}
+	defer data.Close()
+	got, _ := io.ReadAll(io.NewSectionReader(data, 0, data.Size()))
+	if string(got) != "vhdx" {
+		t.Errorf("復号した内容が違います: %q", got)
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	t.Setenv(keyFileEnv, "")
+	t.Setenv(passphraseEnv, "")
+	tests := []struct {
+		name    string
+		modify  func(cfg *BackupConfig)
+		wantKey string
+	}{
+		{"鍵が未設定", func(cfg *BackupConfig) {}, "encryption.key_file"},
+		{"directory 形式", func(cfg *BackupConfig) {
+			t.Setenv(passphraseEnv, "correct horse battery staple")
+			cfg.SnapshotFormat = "directory"
+		}, "encryption.enabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newValidTestConfig(t)
+			cfg.Encryption.Enabled = true
+			tt.modify(cfg)
+			if p := findProblem(validateConfig(cfg), tt.wantKey); p == nil || p.Severity != SeverityError {
+				t.Errorf("%s のエラーが検出されません", tt.wantKey)
+			}
+		})
+	}
+
+	cfg := newValidTestConfig(t)
+	cfg.Encryption.Enabled = true
+	t.Setenv(passphraseEnv, "correct horse battery staple")
+	for _, p := range validateConfig(cfg) {
+		if strings.HasPrefix(p.Key, "encryption") {
+			t.Errorf("不要な問題が検出されました: %+v", p)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// FailureKind は失敗の分類を表します。
+type FailureKind int
+
+const (
+	FailureUnknown   FailureKind = iota
+	FailureConfig                // 設定ファイルの読み込み・ログ設定
+	FailureLock                  // 多重実行（ロック競合）
+	FailureMount                 // VHDX マウント
+	FailureCopy                  // ファイルコピー
+	FailureSnapshot              // スナップショット保存・通し番号
+	FailureRotate                // ローテーション
+	FailureHook                  // フック（on_failure: abort）
+	FailureRemote                // 保存先（remote）への複製
+	FailureDiskSpace             // 保存先の空き容量不足
+)
+
+// 終了コード。失敗の分類ごとに異なる値を返します。
+const (
+	ExitOK        = 0
+	ExitUnknown   = 1
+	ExitConfig    = 2
+	ExitLock      = 3
+	ExitMount     = 4
+	ExitCopy      = 5
+	ExitSnapshot  = 6
+	ExitRotate    = 7
+	ExitHook      = 8
+	ExitRemote    = 9
+	ExitDiskSpace = 10
+)
+
+// String は失敗分類名を返します。
+func (k FailureKind) String() string {
+	switch k {
+	case FailureConfig:
+		return "config"
+	case FailureLock:
+		return "lock"
+	case FailureMount:
+		return "mount"
+	case FailureCopy:
+		return "copy"
+	case FailureSnapshot:
+		return "snapshot"
+	case FailureRotate:
+		return "rotate"
+	case FailureHook:
+		return "hook"
+	case FailureRemote:
+		return "remote"
+	case FailureDiskSpace:
+		return "diskspace"
+	default:
+		return "unknown"
+	}
+}
+
+// Label は通知・ログ表示用の失敗分類名を返します。
+func (k FailureKind) Label() string {
+	switch k {
+	case FailureConfig:
+		return "設定エラー"
+	case FailureLock:
+		return "多重実行"
+	case FailureMount:
+		return "VHDXマウント失敗"
+	case FailureCopy:
+		return "コピー失敗"
+	case FailureSnapshot:
+		return "バックアップ保存失敗"
+	case FailureRotate:
+		return "ローテーション失敗"
+	case FailureHook:
+		return "フック失敗"
+	case FailureRemote:
+		return "複製失敗"
+	case FailureDiskSpace:
+		return "空き容量不足"
+	default:
+		return "実行エラー"
+	}
+}
+
+// ExitCode は失敗分類に対応する終了コードを返します。
+func (k FailureKind) ExitCode() int {
+	switch k {
+	case FailureConfig:
+		return ExitConfig
+	case FailureLock:
+		return ExitLock
+	case FailureMount:
+		return ExitMount
+	case FailureCopy:
+		return ExitCopy
+	case FailureSnapshot:
+		return ExitSnapshot
+	case FailureRotate:
+		return ExitRotate
+	case FailureHook:
+		return ExitHook
+	case FailureRemote:
+		return ExitRemote
+	case FailureDiskSpace:
+		return ExitDiskSpace
+	default:
+		return ExitUnknown
+	}
+}
+
+// BackupError は分類付きのバックアップ失敗です。
+type BackupError struct {
+	Kind FailureKind
+	Err  error
+}
+
+func (e *BackupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BackupError) Unwrap() error {
+	return e.Err
+}
+
+// wrapFailure はエラーに失敗分類を付けます。既に分類済みの場合はそのまま返します。
+func wrapFailure(kind FailureKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var be *BackupError
+	if errors.As(err, &be) {
+		return err
+	}
+	return &BackupError{Kind: kind, Err: err}
+}
+
+// classifyFailure はエラーの失敗分類を返します。
+func classifyFailure(err error) FailureKind {
+	var be *BackupError
+	if errors.As(err, &be) {
+		return be.Kind
+	}
+	return FailureUnknown
+}
+
+// FailureRecord は最終実行記録に保存する失敗情報です。
+type FailureRecord struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level,omitempty"`
+	Kind    string    `json:"kind"`
+	Message string    `json:"message"`
+}
+
+// reportFailure は失敗をログ・通知・最終実行記録に反映し、分類済みのエラーを返します。
+// 多重実行はロック競合通知を送信済みのため、エラー通知は送信しません。
+func reportFailure(cfg *BackupConfig, level string, err error) error {
+	if err == nil {
+		return nil
+	}
+	kind := classifyFailure(err)
+	log.Printf("バックアップ失敗 [%s] レベル=%s: %v", kind, level, err)
+
+	if cfg == nil {
+		return err
+	}
+
+	if kind != FailureLock {
+		message := fmt.Sprintf("%s: %v", kind.Label(), err)
+		if level != "" {
+			message = fmt.Sprintf("%s (レベル %s): %v", kind.Label(), level, err)
+		}
+		event := newNotificationEvent(NotifyError, message)
+		event.Level = level
+		event.Error = err.Error()
+		notifyEvent(cfg, event, cfg.DryRun)
+	}
+
+	if recErr := recordFailure(cfg, level, kind, err, time.Now()); recErr != nil {
+		log.Printf("失敗記録エラー: %v", recErr)
+	}
+
+	// on_error フックは失敗しても警告のみ
+	runHooks(cfg, HookOnError, HookContext{Level: level, DryRun: cfg.DryRun, Error: err.Error()})
+	return err
+}
+
+// recordFailure は最終実行記録に失敗情報を保存します。
+func recordFailure(cfg *BackupConfig, level string, kind FailureKind, err error, at time.Time) error {
+	if cfg.LastExecutionFile == "" || cfg.DryRun {
+		return nil
+	}
+
+	record, loadErr := loadLastExecutionRecord(cfg.LastExecutionFile)
+	if loadErr != nil && !os.IsNotExist(loadErr) {
+		return loadErr
+	}
+	if record == nil {
+		record = &LastExecutionRecord{LastExecutions: make(map[string]time.Time)}
+	}
+
+	record.LastFailure = &FailureRecord{
+		Time:    at,
+		Level:   level,
+		Kind:    kind.String(),
+		Message: err.Error(),
+	}
+	record.ConsecutiveFailures++
+	return saveLastExecutionRecord(cfg.LastExecutionFile, record)
+}
+
+// exitWithFailure はエラー内容をログに記録し、分類に応じた終了コードで終了します。
+// スタックトレース付きの panic の代わりに使用します。
+func exitWithFailure(err error) {
+	kind := classifyFailure(err)
+	log.Printf("実行エラー [%s]: %v", kind, err)
+	fmt.Fprintf(os.Stderr, "エラー: %s: %v\n", kind.Label(), err)
+	closeLogFile()
+	os.Exit(kind.ExitCode())
+}
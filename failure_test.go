@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// 失敗処理（分類・通知・記録・終了コード）のテスト
+// =============================================================================
+
+func TestFailureKindExitCodes(t *testing.T) {
+	tests := []struct {
+		kind FailureKind
+		name string
+		code int
+	}{
+		{FailureUnknown, "unknown", ExitUnknown},
+		{FailureConfig, "config", ExitConfig},
+		{FailureLock, "lock", ExitLock},
+		{FailureMount, "mount", ExitMount},
+		{FailureCopy, "copy", ExitCopy},
+		{FailureSnapshot, "snapshot", ExitSnapshot},
+		{FailureRotate, "rotate", ExitRotate},
+		{FailureHook, "hook", ExitHook},
+		{FailureRemote, "remote", ExitRemote},
+		{FailureDiskSpace, "diskspace", ExitDiskSpace},
+	}
+	seen := make(map[int]bool)
+	for _, tt := range tests {
+		if tt.kind.String() != tt.name {
+			t.Errorf("分類名が違います: 期待=%s, 実際=%s", tt.name, tt.kind.String())
+		}
+		if tt.kind.ExitCode() != tt.code {
+			t.Errorf("%s の終了コードが違います: 期待=%d, 実際=%d", tt.name, tt.code, tt.kind.ExitCode())
+		}
+		if seen[tt.code] {
+			t.Errorf("終了コードが重複しています: %d", tt.code)
+		}
+		seen[tt.code] = true
+	}
+}
+
+func TestWrapFailureKeepsFirstClassification(t *testing.T) {
+	base := errors.New("disk full")
+	err := wrapFailure(FailureSnapshot, base)
+	err = wrapFailure(FailureUnknown, fmt.Errorf("外側: %w", err))
+
+	if got := classifyFailure(err); got != FailureSnapshot {
+		t.Errorf("分類が違います: 期待=snapshot, 実際=%s", got)
+	}
+	if !errors.Is(err, base) {
+		t.Errorf("元のエラーを辿れません")
+	}
+	if wrapFailure(FailureCopy, nil) != nil {
+		t.Errorf("nil エラーが nil で返されません")
+	}
+	if classifyFailure(errors.New("分類なし")) != FailureUnknown {
+		t.Errorf("分類なしのエラーが unknown になりません")
+	}
+}
+
+// newFailureTestConfig は実処理用（dry_run: false）のテスト設定を作成します。
+func newFailureTestConfig(t *testing.T) *BackupConfig {
+	tempDir := t.TempDir()
+	cfg := &BackupConfig{
+		WorkDir:            filepath.Join(tempDir, "missing_source"),
+		BackupDir:          filepath.Join(tempDir, "mirror"),
+		SourceVHDX:         filepath.Join(tempDir, "source.vhdx"),
+		LastIDFile:         filepath.Join(tempDir, "last_id.txt"),
+		LastExecutionFile:  filepath.Join(tempDir, "last_execution.json"),
+		CopyMethodPriority: []string{"native"},
+		KeepVersions:       map[string]int{"30m": 2},
+		BackupDirs:         map[string]string{"30m": filepath.Join(tempDir, "30m")},
+	}
+	return cfg
+}
+
+func TestRunBackupWithLevelClassifiesFailures(t *testing.T) {
+	t.Run("レベル未設定は設定エラー", func(t *testing.T) {
+		cfg := newFailureTestConfig(t)
+		err := runBackupWithLevel(cfg, "3h")
+		if classifyFailure(err) != FailureConfig {
+			t.Errorf("分類が違います: %v (%s)", err, classifyFailure(err))
+		}
+	})
+
+	t.Run("ロック競合", func(t *testing.T) {
+		cfg := newFailureTestConfig(t)
+		cfg.EnableLock = true
+		cfg.LockFilePath = filepath.Join(t.TempDir(), "backup.lock")
+		os.WriteFile(cfg.LockFilePath, []byte("1\n"), 0644)
+		err := runBackupWithLevel(cfg, "30m")
+		if classifyFailure(err) != FailureLock {
+			t.Errorf("分類が違います: %v (%s)", err, classifyFailure(err))
+		}
+	})
+
+	t.Run("コピー失敗", func(t *testing.T) {
+		if hasExternalCopyTools() {
+			t.Skip("外部コピーコマンドが利用可能な環境ではスキップ")
+		}
+		cfg := newFailureTestConfig(t)
+		err := runBackupWithLevel(cfg, "30m")
+		if classifyFailure(err) != FailureCopy {
+			t.Errorf("分類が違います: %v (%s)", err, classifyFailure(err))
+		}
+	})
+
+	t.Run("スナップショット保存失敗", func(t *testing.T) {
+		cfg := newFailureTestConfig(t)
+		os.MkdirAll(cfg.WorkDir, 0755)
+		os.WriteFile(filepath.Join(cfg.WorkDir, "main.cpp"), []byte("int main(){}"), 0644)
+		// source_vhdx が存在しない
+		err := runBackupWithLevel(cfg, "30m")
+		if classifyFailure(err) != FailureSnapshot {
+			t.Errorf("分類が違います: %v (%s)", err, classifyFailure(err))
+		}
+	})
+}
+
+// hasExternalCopyTools は native 以外のコピー方式が利用可能か判定します。
+func hasExternalCopyTools() bool {
+	for _, c := range copiers {
+		if c.Name() != "native" && c.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestReportFailureNotifiesAndRecords(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+	cfg := newFailureTestConfig(t)
+	cfg.Notifiers = []NotifierConfig{{Type: "webhook", URL: server.URL}}
+	cfg.Notifications.Error = true
+
+	failure := wrapFailure(FailureMount, errors.New("Mount-DiskImage failed"))
+	if err := reportFailure(cfg, "3h", failure); err != failure {
+		t.Errorf("元のエラーが返されていません: %v", err)
+	}
+	reportFailure(cfg, "3h", failure)
+
+	got := server.received()
+	if len(got) != 2 {
+		t.Fatalf("エラー通知数が違います: 期待=2, 実際=%d", len(got))
+	}
+	if !strings.Contains(got[0], `"event":"error"`) || !strings.Contains(got[0], "VHDXマウント失敗") ||
+		!strings.Contains(got[0], `"level":"3h"`) {
+		t.Errorf("エラー通知の内容が違います: %s", got[0])
+	}
+
+	record, err := loadLastExecutionRecord(cfg.LastExecutionFile)
+	if err != nil {
+		t.Fatalf("最終実行記録の読み込みに失敗: %v", err)
+	}
+	if record.LastFailure == nil || record.LastFailure.Kind != "mount" || record.LastFailure.Level != "3h" {
+		t.Errorf("失敗記録が違います: %+v", record.LastFailure)
+	}
+	if record.ConsecutiveFailures != 2 {
+		t.Errorf("連続失敗回数が違います: 期待=2, 実際=%d", record.ConsecutiveFailures)
+	}
+
+	// 成功すると連続失敗回数はリセットされる
+	if err := recordLastExecution(cfg, "3h", time.Now()); err != nil {
+		t.Fatalf("最終実行時刻の記録に失敗: %v", err)
+	}
+	record, _ = loadLastExecutionRecord(cfg.LastExecutionFile)
+	if record.ConsecutiveFailures != 0 {
+		t.Errorf("成功後に連続失敗回数がリセットされていません: %d", record.ConsecutiveFailures)
+	}
+	if record.LastFailure == nil {
+		t.Errorf("成功後も最後の失敗記録は残るべきです")
+	}
+}
+
+func TestReportFailureLockConflictSkipsErrorNotification(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+	cfg := newFailureTestConfig(t)
+	cfg.Notifiers = []NotifierConfig{{Type: "webhook", URL: server.URL}}
+	cfg.Notifications.Error = true
+
+	reportFailure(cfg, "30m", wrapFailure(FailureLock, errors.New("ロックファイルが既に存在します")))
+	if got := server.received(); len(got) != 0 {
+		t.Errorf("多重実行でエラー通知が送信されました: %v", got)
+	}
+}
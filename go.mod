@@ -5,13 +5,18 @@ go 1.23.0
 require (
 	github.com/go-toast/toast v0.0.0-20190211030409-01e6764cf0a4
 	github.com/hjson/hjson-go v3.3.0+incompatible
+	github.com/klauspost/compress v1.18.0
 	github.com/pkg/errors v0.9.1
+	github.com/pkg/sftp v1.13.9
 	github.com/spf13/cobra v1.9.1
+	github.com/spf13/pflag v1.0.6
+	golang.org/x/crypto v0.36.0
+	golang.org/x/sys v0.31.0
 	golang.org/x/text v0.26.0
 )
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
-	github.com/spf13/pflag v1.0.6 // indirect
 )
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// フックを実行するフェーズ
+const (
+	HookPreBackup    = "pre_backup"
+	HookPostCopy     = "post_copy"
+	HookPostSnapshot = "post_snapshot"
+	HookPostRotate   = "post_rotate"
+	HookOnError      = "on_error"
+)
+
+// HookConfig はフック1件分の設定です。
+type HookConfig struct {
+	Name      string   `json:"name"`       // ログ表示用の名前（省略時は command）
+	Command   string   `json:"command"`    // 実行するコマンド
+	Args      []string `json:"args"`       // 引数（省略時は command をシェル経由で実行）
+	Timeout   string   `json:"timeout"`    // タイムアウト（例: "5m"、省略時は 10m）
+	OnFailure string   `json:"on_failure"` // 失敗時の動作: "abort"（既定）または "warn"
+}
+
+// HooksConfig はフェーズごとのフック設定です。
+type HooksConfig struct {
+	PreBackup    []HookConfig `json:"pre_backup"`
+	PostCopy     []HookConfig `json:"post_copy"`
+	PostSnapshot []HookConfig `json:"post_snapshot"`
+	PostRotate   []HookConfig `json:"post_rotate"`
+	OnError      []HookConfig `json:"on_error"`
+}
+
+// HookContext はフックに環境変数として渡す実行情報です。
+type HookContext struct {
+	Level        string
+	SnapshotPath string
+	ID           int
+	DryRun       bool
+	Error        string
+	Job          string // ジョブ名（runHooks が設定）
+}
+
+// 既定のフックタイムアウト
+const defaultHookTimeout = 10 * time.Minute
+
+// hooksFor は指定フェーズのフック一覧を返します。
+func (h *HooksConfig) hooksFor(phase string) []HookConfig {
+	switch phase {
+	case HookPreBackup:
+		return h.PreBackup
+	case HookPostCopy:
+		return h.PostCopy
+	case HookPostSnapshot:
+		return h.PostSnapshot
+	case HookPostRotate:
+		return h.PostRotate
+	case HookOnError:
+		return h.OnError
+	}
+	return nil
+}
+
+// runHooks は指定フェーズのフックを順に実行します。
+// on_failure が "abort" のフックが失敗した場合は残りのフックを実行せずエラーを返します。
+// on_error フェーズの失敗は常に警告のみです。
+func runHooks(cfg *BackupConfig, phase string, hc HookContext) error {
+	hooks := cfg.Hooks.hooksFor(phase)
+	if len(hooks) == 0 {
+		return nil
+	}
+	hc.Job = cfg.jobName
+
+	for i, hook := range hooks {
+		name := hook.Name
+		if name == "" {
+			name = hook.Command
+		}
+
+		if hc.DryRun {
+			fmt.Printf("[DRY-RUN] フック (%s): %s\n", phase, hookCommandLine(hook))
+			continue
+		}
+
+		log.Printf("フック実行開始 (%s #%d): %s", phase, i+1, name)
+		start := time.Now()
+		out, err := executeHook(hook, phase, hc)
+		if len(out) > 0 {
+			log.Printf("フック出力 (%s):\n%s", name, strings.TrimRight(out, "\r\n"))
+		}
+		if err == nil {
+			log.Printf("フック完了 (%s): %s (%v)", phase, name, time.Since(start).Round(time.Millisecond))
+			continue
+		}
+
+		if phase == HookOnError || strings.EqualFold(hook.OnFailure, "warn") {
+			log.Printf("警告: フック失敗 (%s): %s: %v", phase, name, err)
+			continue
+		}
+		return wrapFailure(FailureHook, pkgerrors.Errorf("フック失敗 (%s): %s: %v", phase, name, err))
+	}
+	return nil
+}
+
+// executeHook はフックを1件実行し、出力を返します。
+func executeHook(hook HookConfig, phase string, hc HookContext) (string, error) {
+	if hook.Command == "" {
+		return "", fmt.Errorf("command が設定されていません")
+	}
+
+	timeout := defaultHookTimeout
+	if hook.Timeout != "" {
+		d, err := time.ParseDuration(hook.Timeout)
+		if err != nil {
+			return "", fmt.Errorf("timeout の形式が不正です: %v", err)
+		}
+		timeout = d
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := hookCommand(ctx, hook)
+	cmd.Env = append(os.Environ(), hookEnv(phase, hc)...)
+	out, err := cmd.CombinedOutput()
+	outStr := string(out)
+	if runtime.GOOS == "windows" {
+		outStr = convertShiftJISToUTF8(out)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return outStr, fmt.Errorf("タイムアウト (%v)", timeout)
+	}
+	return outStr, err
+}
+
+// hookCommand はフックの実行コマンドを作成します。
+// args が未指定の場合は command をシェル経由で実行します（リダイレクト等を使用可能）。
+func hookCommand(ctx context.Context, hook HookConfig) *exec.Cmd {
+	if len(hook.Args) > 0 {
+		return exec.CommandContext(ctx, hook.Command, hook.Args...)
+	}
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", hook.Command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", hook.Command)
+}
+
+// hookCommandLine は表示用のコマンドラインを返します。
+func hookCommandLine(hook HookConfig) string {
+	if len(hook.Args) == 0 {
+		return hook.Command
+	}
+	return hook.Command + " " + strings.Join(hook.Args, " ")
+}
+
+// hookEnv はフックに渡す環境変数を返します。
+func hookEnv(phase string, hc HookContext) []string {
+	env := []string{
+		"ROTATE_BACKUP_PHASE=" + phase,
+		"ROTATE_BACKUP_LEVEL=" + hc.Level,
+		"ROTATE_BACKUP_SNAPSHOT=" + hc.SnapshotPath,
+		"ROTATE_BACKUP_DRY_RUN=" + strconv.FormatBool(hc.DryRun),
+		"ROTATE_BACKUP_JOB=" + hc.Job,
+	}
+	if hc.ID > 0 {
+		env = append(env, fmt.Sprintf("ROTATE_BACKUP_ID=%06d", hc.ID))
+	} else {
+		env = append(env, "ROTATE_BACKUP_ID=")
+	}
+	if hc.Error != "" {
+		env = append(env, "ROTATE_BACKUP_ERROR="+hc.Error)
+	}
+	return env
+}
+
+// printHooksDryRun は dry_run 時に実行予定のフックを表示します。
+func printHooksDryRun(cfg *BackupConfig, level string) {
+	for _, phase := range []string{HookPreBackup, HookPostCopy, HookPostSnapshot, HookPostRotate} {
+		runHooks(cfg, phase, HookContext{Level: level, DryRun: true})
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// フックのテスト
+// =============================================================================
+
+// skipIfNoShell は sh が利用できない環境でテストをスキップします。
+func skipIfNoShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh 前提のテストのため Windows ではスキップ")
+	}
+}
+
+func TestRunHooksPassesEnvironment(t *testing.T) {
+	skipIfNoShell(t)
+	outFile := filepath.Join(t.TempDir(), "env.txt")
+
+	cfg := &BackupConfig{}
+	cfg.Hooks.PostSnapshot = []HookConfig{{
+		Command: `echo "$ROTATE_BACKUP_PHASE $ROTATE_BACKUP_LEVEL $ROTATE_BACKUP_ID $ROTATE_BACKUP_SNAPSHOT $ROTATE_BACKUP_DRY_RUN" > ` + outFile,
+	}}
+
+	err := runHooks(cfg, HookPostSnapshot, HookContext{
+		Level:        "3h",
+		SnapshotPath: "/backups/3h/000012_20250701_0900.vhdx",
+		ID:           12,
+	})
+	if err != nil {
+		t.Fatalf("フック実行エラー: %v", err)
+	}
+
+	data, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatalf("フックの出力ファイルが作成されていません: %v", err)
+	}
+	expected := "post_snapshot 3h 000012 /backups/3h/000012_20250701_0900.vhdx false\n"
+	if string(data) != expected {
+		t.Errorf("環境変数が違います: 期待=%q, 実際=%q", expected, string(data))
+	}
+}
+
+func TestRunHooksFailurePolicy(t *testing.T) {
+	skipIfNoShell(t)
+	marker := filepath.Join(t.TempDir(), "second.txt")
+
+	t.Run("abort は中断", func(t *testing.T) {
+		cfg := &BackupConfig{}
+		cfg.Hooks.PreBackup = []HookConfig{
+			{Command: "exit 3"},
+			{Command: "touch " + marker},
+		}
+		err := runHooks(cfg, HookPreBackup, HookContext{Level: "30m"})
+		if classifyFailure(err) != FailureHook {
+			t.Fatalf("フック失敗として分類されていません: %v", err)
+		}
+		if fileExists(marker) {
+			t.Errorf("中断後のフックが実行されました")
+		}
+	})
+
+	t.Run("warn は継続", func(t *testing.T) {
+		cfg := &BackupConfig{}
+		cfg.Hooks.PreBackup = []HookConfig{
+			{Command: "exit 3", OnFailure: "warn"},
+			{Command: "touch " + marker},
+		}
+		if err := runHooks(cfg, HookPreBackup, HookContext{Level: "30m"}); err != nil {
+			t.Fatalf("warn のフック失敗でエラーが返されました: %v", err)
+		}
+		if !fileExists(marker) {
+			t.Errorf("後続のフックが実行されていません")
+		}
+	})
+
+	t.Run("on_error は常に警告のみ", func(t *testing.T) {
+		cfg := &BackupConfig{}
+		cfg.Hooks.OnError = []HookConfig{{Command: "exit 1"}}
+		if err := runHooks(cfg, HookOnError, HookContext{Error: "コピー失敗"}); err != nil {
+			t.Errorf("on_error のフック失敗でエラーが返されました: %v", err)
+		}
+	})
+}
+
+func TestRunHooksTimeout(t *testing.T) {
+	skipIfNoShell(t)
+	cfg := &BackupConfig{}
+	cfg.Hooks.PostCopy = []HookConfig{{Command: "sleep", Args: []string{"5"}, Timeout: "100ms"}}
+
+	err := runHooks(cfg, HookPostCopy, HookContext{})
+	if err == nil || !strings.Contains(err.Error(), "タイムアウト") {
+		t.Errorf("タイムアウトエラーが返されていません: %v", err)
+	}
+}
+
+func TestRunHooksDryRunPrintsOnly(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "should_not_exist.txt")
+	cfg := &BackupConfig{}
+	cfg.Hooks.PreBackup = []HookConfig{{Command: "touch", Args: []string{marker}}}
+
+	oldStdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err := runHooks(cfg, HookPreBackup, HookContext{DryRun: true})
+	w.Close()
+	os.Stdout = oldStdout
+	var out bytes.Buffer
+	io.Copy(&out, r)
+
+	if err != nil {
+		t.Fatalf("dry-run でエラー: %v", err)
+	}
+	if fileExists(marker) {
+		t.Errorf("dry-run でフックが実行されました")
+	}
+	if !strings.Contains(out.String(), "[DRY-RUN] フック (pre_backup): touch "+marker) {
+		t.Errorf("dry-run の表示が違います: %q", out.String())
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hjson/hjson-go"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// initOptions は init で生成する設定ファイルの内容です。
+// 空の項目はテンプレートの値をそのまま使用します。
+type initOptions struct {
+	Interactive bool
+	Force       bool
+
+	Source      string   // コピー元 (work_dir)
+	BackupRoot  string   // 世代別ディレクトリと管理ファイルの保存先
+	VHDX        string   // source_vhdx
+	MountDrive  string   // vhdx_mount_drive（backup_dir はドライブ直下）
+	Extensions  []string // "auto" のみの場合はコピー元から推定
+	ExcludeDirs []string // "auto" のみの場合はコピー元から推定
+	Retention   string   // 保持数のプリセット名
+}
+
+// 推定を指定する値
+const initAutoValue = "auto"
+
+// tailored はテンプレートを書き換える指定があるか判定します。
+func (o *initOptions) tailored() bool {
+	return o.Source != "" || o.BackupRoot != "" || o.VHDX != "" || o.MountDrive != "" ||
+		o.Extensions != nil || o.ExcludeDirs != nil || o.Retention != ""
+}
+
+// retentionPreset は keep_versions のプリセットです。
+type retentionPreset struct {
+	name        string
+	description string
+	keep        map[string]int
+}
+
+var retentionPresets = []retentionPreset{
+	{"minimal", "直近のみ保持（容量重視）", map[string]int{"30m": 3, "3h": 2, "6h": 1, "12h": 1, "1d": 3}},
+	{"standard", "標準（テンプレートの既定値）", map[string]int{"30m": 5, "3h": 2, "6h": 2, "12h": 2, "1d": 5}},
+	{"long", "長期保持（1か月分の日次）", map[string]int{"30m": 6, "3h": 4, "6h": 4, "12h": 2, "1d": 30}},
+}
+
+func findRetentionPreset(name string) (retentionPreset, bool) {
+	for _, p := range retentionPresets {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return retentionPreset{}, false
+}
+
+// String は "30m×5, 3h×2, ..." 形式の保持数を返します。
+func (p retentionPreset) String() string {
+	var parts []string
+	for _, level := range scheduledLevels {
+		parts = append(parts, fmt.Sprintf("%s×%d", level, p.keep[level]))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// 除外を提案するディレクトリ名（ビルド成果物・依存パッケージ等）
+var suggestedExcludeNames = []string{
+	"node_modules", "build", "dist", "obj", "target", ".vs", "__pycache__", "Debug", "Release",
+}
+
+// 拡張子の推定に使用する最大ファイル数（大きなツリーで時間がかからないように）
+const maxScanFiles = 20000
+
+// 提案する拡張子の最大数
+const maxSuggestedExtensions = 8
+
+// sourceScan はコピー元の走査結果です。
+type sourceScan struct {
+	Extensions  []string // 出現数の多い順
+	ExcludeDirs []string // 除外を提案するディレクトリ（絶対パス、/ 区切り）
+	Files       int
+}
+
+// scanSourceTree はコピー元を走査し、ファイル数の多い拡張子と除外候補のディレクトリを返します。
+func scanSourceTree(root string) (*sourceScan, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+
+	scan := &sourceScan{}
+	counts := make(map[string]int)
+	excluded := make(map[string]bool)
+	for _, name := range suggestedExcludeNames {
+		excluded[name] = true
+	}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // 読めないディレクトリは無視
+		}
+		if d.IsDir() {
+			if path == root {
+				return nil
+			}
+			if d.Name() == ".git" {
+				// 履歴のオブジェクトのみ除外を提案（設定等は残す）
+				if info, err := os.Stat(filepath.Join(path, "objects")); err == nil && info.IsDir() {
+					scan.ExcludeDirs = append(scan.ExcludeDirs, filepath.ToSlash(filepath.Join(path, "objects")))
+				}
+				return filepath.SkipDir
+			}
+			if excluded[d.Name()] {
+				scan.ExcludeDirs = append(scan.ExcludeDirs, filepath.ToSlash(path))
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		scan.Files++
+		if ext := strings.ToLower(filepath.Ext(d.Name())); ext != "" && ext != d.Name() {
+			counts[ext]++
+		}
+		if scan.Files >= maxScanFiles {
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for ext := range counts {
+		scan.Extensions = append(scan.Extensions, ext)
+	}
+	sort.Slice(scan.Extensions, func(i, j int) bool {
+		a, b := scan.Extensions[i], scan.Extensions[j]
+		if counts[a] != counts[b] {
+			return counts[a] > counts[b]
+		}
+		return a < b
+	})
+	if len(scan.Extensions) > maxSuggestedExtensions {
+		scan.Extensions = scan.Extensions[:maxSuggestedExtensions]
+	}
+	sort.Strings(scan.ExcludeDirs)
+	return scan, nil
+}
+
+// detectCopyMethods はこの環境で利用可能なコピー方式を優先順に返します。
+func detectCopyMethods() []string {
+	var methods []string
+	for _, c := range copiers {
+		if c.Available() {
+			methods = append(methods, c.Name())
+		}
+	}
+	return methods
+}
+
+// runInit は設定ファイルを生成します。
+// 既存のファイルは opts.Force の場合のみ上書きします。
+func runInit(configPath string, opts initOptions, in io.Reader, out io.Writer) error {
+	if _, err := os.Stat(configPath); err == nil && !opts.Force {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("設定ファイルが既に存在します: %s（上書きするには --force を指定してください）", configPath))
+	}
+
+	if opts.Interactive {
+		if err := runInitWizard(in, out, &opts); err != nil {
+			return err
+		}
+	}
+	if !opts.tailored() {
+		return generateTemplate(configPath)
+	}
+
+	text, err := tailoredTemplate(&opts, out)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath, []byte(text), 0644)
+}
+
+// tailoredTemplate はテンプレートのコメントを保持したまま、指定された値に書き換えた設定を返します。
+func tailoredTemplate(opts *initOptions, out io.Writer) (string, error) {
+	if err := opts.resolveAuto(out); err != nil {
+		return "", err
+	}
+
+	template := configTemplate()
+	var tree map[string]interface{}
+	if err := hjson.Unmarshal([]byte(template), &tree); err != nil {
+		return "", pkgerrors.Errorf("テンプレートの解析に失敗: %v", err)
+	}
+	doc := &configDocument{tree: tree, view: tree, source: newConfigSource("config.hjson", []byte(template))}
+
+	if opts.Source != "" {
+		source := filepath.ToSlash(opts.Source)
+		doc.set("work_dir", source, "コピー元")
+		doc.set("include_files", []interface{}{}, "個別に含めるファイル（テンプレートの例を削除）")
+	}
+	if opts.BackupRoot != "" {
+		root := strings.TrimRight(filepath.ToSlash(opts.BackupRoot), "/")
+		dirs := make(map[string]interface{})
+		for _, level := range scheduledLevels {
+			dirs[level] = root + "/" + level
+		}
+		doc.set("backup_dirs", dirs, "世代別の保存先")
+		for _, f := range []struct{ key, name string }{
+			{"last_id_file", "last_id.txt"},
+			{"lock_file_path", "backup.lock"},
+			{"last_execution_file", "last_execution.json"},
+			{"log_file", "log.txt"},
+			{"perf_log_path", "perf.tsv"},
+		} {
+			doc.set(f.key, root+"/"+f.name, "管理ファイル")
+		}
+		if opts.VHDX == "" {
+			doc.set("source_vhdx", root+"/backup.vhdx", "バックアップする VHDX")
+		}
+	}
+	if opts.VHDX != "" {
+		doc.set("source_vhdx", filepath.ToSlash(opts.VHDX), "バックアップする VHDX")
+	}
+	if opts.MountDrive != "" {
+		drive := strings.TrimRight(filepath.ToSlash(opts.MountDrive), "/")
+		doc.set("vhdx_mount_drive", drive, "VHDX のマウント先")
+		doc.set("backup_dir", drive+"/", "コピー先（VHDX のマウント先）")
+	}
+	if opts.Extensions != nil {
+		doc.set("extensions", toInterfaceSlice(opts.Extensions), "バックアップ対象の拡張子")
+	}
+	if opts.ExcludeDirs != nil {
+		doc.set("exclude_dirs", toInterfaceSlice(opts.ExcludeDirs), "除外ディレクトリ")
+	}
+	if opts.Retention != "" {
+		preset, ok := findRetentionPreset(opts.Retention)
+		if !ok {
+			return "", wrapFailure(FailureConfig, pkgerrors.Errorf("不明な保持期間のプリセット: %s（%s）", opts.Retention, strings.Join(retentionPresetNames(), " / ")))
+		}
+		keep := make(map[string]interface{})
+		for level, n := range preset.keep {
+			keep[level] = n
+		}
+		doc.set("keep_versions", keep, fmt.Sprintf("保持数 (%s)", preset.name))
+	}
+	if methods := detectCopyMethods(); len(methods) > 0 {
+		doc.set("copy_method_priority", toInterfaceSlice(methods), "この環境で利用可能なコピー方式")
+	}
+
+	text, _, err := doc.render()
+	if err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+// resolveAuto は "auto" が指定された拡張子・除外ディレクトリをコピー元から推定します。
+func (o *initOptions) resolveAuto(out io.Writer) error {
+	autoExt := len(o.Extensions) == 1 && o.Extensions[0] == initAutoValue
+	autoExclude := len(o.ExcludeDirs) == 1 && o.ExcludeDirs[0] == initAutoValue
+	if !autoExt && !autoExclude {
+		return nil
+	}
+	if o.Source == "" {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("auto を指定する場合は --source でコピー元を指定してください"))
+	}
+	scan, err := scanSourceTree(o.Source)
+	if err != nil {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("コピー元を走査できません: %v", err))
+	}
+	fmt.Fprintf(out, "コピー元を走査しました: %s（%d ファイル）\n", o.Source, scan.Files)
+	if autoExt {
+		o.Extensions = scan.Extensions
+	}
+	if autoExclude {
+		o.ExcludeDirs = scan.ExcludeDirs
+	}
+	return nil
+}
+
+// runInitWizard は対話形式で設定内容を入力します。
+// 入力が空の場合は [] 内の既定値を使用します（入力の終端以降もすべて既定値）。
+func runInitWizard(in io.Reader, out io.Writer, opts *initOptions) error {
+	reader := bufio.NewReader(in)
+	ask := func(label, def string) string {
+		if def != "" {
+			fmt.Fprintf(out, "%s [%s]: ", label, def)
+		} else {
+			fmt.Fprintf(out, "%s: ", label)
+		}
+		line, _ := reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+		return def
+	}
+
+	fmt.Fprintln(out, "=== rotate_backup 設定ウィザード ===")
+	fmt.Fprintln(out, "空欄のまま Enter で [] 内の値を使用します。")
+	fmt.Fprintln(out)
+
+	opts.Source = ask("コピー元ディレクトリ (work_dir)", defaultString(opts.Source, "P:/"))
+	opts.BackupRoot = ask("バックアップの保存先ルート（世代別ディレクトリ・管理ファイル）", defaultString(opts.BackupRoot, "C:/Backups"))
+	opts.VHDX = ask("バックアップする VHDX ファイル (source_vhdx)", defaultString(opts.VHDX, strings.TrimRight(filepath.ToSlash(opts.BackupRoot), "/")+"/backup.vhdx"))
+	opts.MountDrive = ask("VHDX のマウント先ドライブ (vhdx_mount_drive)", defaultString(opts.MountDrive, "Q:"))
+
+	methods := detectCopyMethods()
+	fmt.Fprintf(out, "利用可能なコピー方式: %s\n", strings.Join(methods, ", "))
+
+	// コピー元を走査して拡張子と除外ディレクトリを提案
+	var extSuggestion, excludeSuggestion []string
+	if scan, err := scanSourceTree(opts.Source); err == nil {
+		fmt.Fprintf(out, "コピー元を走査しました（%d ファイル）\n", scan.Files)
+		extSuggestion, excludeSuggestion = scan.Extensions, scan.ExcludeDirs
+	} else {
+		fmt.Fprintf(out, "コピー元を走査できません（拡張子・除外ディレクトリは提案しません）: %v\n", err)
+	}
+	if opts.Extensions != nil {
+		extSuggestion = opts.Extensions
+	}
+	if opts.ExcludeDirs != nil {
+		excludeSuggestion = opts.ExcludeDirs
+	}
+
+	ext := ask("バックアップ対象の拡張子（カンマ区切り、* で全ファイル）", defaultString(strings.Join(extSuggestion, ","), "*"))
+	opts.Extensions = splitInitList(ext, "*")
+	exclude := ask("除外ディレクトリ（カンマ区切り、- でなし）", defaultString(strings.Join(excludeSuggestion, ","), "-"))
+	opts.ExcludeDirs = splitInitList(exclude, "-")
+
+	fmt.Fprintln(out, "保持期間のプリセット:")
+	for _, p := range retentionPresets {
+		fmt.Fprintf(out, "  %-8s %s（%s）\n", p.name, p.description, p)
+	}
+	for {
+		opts.Retention = ask("プリセット", defaultString(opts.Retention, "standard"))
+		if _, ok := findRetentionPreset(opts.Retention); ok {
+			break
+		}
+		fmt.Fprintf(out, "不明なプリセットです: %s\n", opts.Retention)
+		opts.Retention = ""
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+// splitInitList はカンマ区切りの入力を分割します。none と一致する場合は空のリストを返します。
+func splitInitList(value, none string) []string {
+	list := []string{}
+	if value == none {
+		return list
+	}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func retentionPresetNames() []string {
+	var names []string
+	for _, p := range retentionPresets {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+func toInterfaceSlice(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
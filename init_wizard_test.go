@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// init（設定ファイル生成）のテスト
+// =============================================================================
+
+// writeSourceTree はコピー元のテスト用ディレクトリを作成します。
+func writeSourceTree(t *testing.T) string {
+	root := t.TempDir()
+	for _, name := range []string{
+		"src/main.go", "src/util.go", "src/sub/a.go", "docs/readme.md", "docs/guide.md", "Makefile",
+		"node_modules/pkg/index.js", "node_modules/pkg/lib.js", "node_modules/pkg/more.js",
+		"build/out.o", ".git/objects/ab/cdef", ".git/config",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("x"), 0644)
+	}
+	return root
+}
+
+func TestScanSourceTree(t *testing.T) {
+	root := writeSourceTree(t)
+	scan, err := scanSourceTree(root)
+	if err != nil {
+		t.Fatalf("走査エラー: %v", err)
+	}
+	// 除外候補の配下は拡張子の推定に含めない
+	if got := strings.Join(scan.Extensions, ","); got != ".go,.md" {
+		t.Errorf("拡張子の推定が違います: %s", got)
+	}
+	slash := filepath.ToSlash(root)
+	expected := []string{slash + "/.git/objects", slash + "/build", slash + "/node_modules"}
+	if strings.Join(scan.ExcludeDirs, ",") != strings.Join(expected, ",") {
+		t.Errorf("除外ディレクトリの提案が違います: %v", scan.ExcludeDirs)
+	}
+	if _, err := scanSourceTree(filepath.Join(root, "missing")); err == nil {
+		t.Errorf("存在しないコピー元でエラーになりません")
+	}
+}
+
+func TestRunInitRefusesOverwrite(t *testing.T) {
+	path := writeTestConfig(t, "{ dry_run: false }")
+	err := runInit(path, initOptions{}, nil, &bytes.Buffer{})
+	if classifyFailure(err) != FailureConfig || !strings.Contains(err.Error(), "--force") {
+		t.Errorf("既存ファイルの上書きが拒否されていません: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "{ dry_run: false }" {
+		t.Fatalf("既存ファイルが変更されています")
+	}
+
+	if err := runInit(path, initOptions{Force: true}, nil, &bytes.Buffer{}); err != nil {
+		t.Fatalf("--force での生成エラー: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != configTemplate() {
+		t.Errorf("--force で上書きされていません")
+	}
+}
+
+func TestRunInitWithFlags(t *testing.T) {
+	source := writeSourceTree(t)
+	path := filepath.Join(t.TempDir(), "config.hjson")
+	opts := initOptions{
+		Source:      source,
+		BackupRoot:  "D:/Backups/",
+		MountDrive:  "R:",
+		Extensions:  []string{initAutoValue},
+		ExcludeDirs: []string{initAutoValue},
+		Retention:   "long",
+	}
+	if err := runInit(path, opts, nil, &bytes.Buffer{}); err != nil {
+		t.Fatalf("生成エラー: %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "// work_dir: コピー元") {
+		t.Errorf("テンプレートのコメントが保持されていません")
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("生成した設定の読み込みに失敗: %v", err)
+	}
+	checks := []struct {
+		name          string
+		got, expected string
+	}{
+		{"work_dir", cfg.WorkDir, filepath.ToSlash(source)},
+		{"backup_dir", cfg.BackupDir, "R:/"},
+		{"backup_dirs.1d", cfg.BackupDirs["1d"], "D:/Backups/1d"},
+		{"source_vhdx", cfg.SourceVHDX, "D:/Backups/backup.vhdx"},
+		{"lock_file_path", cfg.LockFilePath, "D:/Backups/backup.lock"},
+		{"extensions", strings.Join(cfg.Extensions, ","), ".go,.md"},
+	}
+	for _, c := range checks {
+		if c.got != c.expected {
+			t.Errorf("%s が違います: 期待=%s, 実際=%s", c.name, c.expected, c.got)
+		}
+	}
+	if cfg.KeepVersions["1d"] != 30 || len(cfg.ExcludeDirs) != 3 || len(cfg.IncludeFiles) != 0 {
+		t.Errorf("保持数・除外ディレクトリが違います: %v, %v, %v", cfg.KeepVersions, cfg.ExcludeDirs, cfg.IncludeFiles)
+	}
+	if strings.Join(cfg.CopyMethodPriority, ",") != strings.Join(detectCopyMethods(), ",") {
+		t.Errorf("利用可能なコピー方式が設定されていません: %v", cfg.CopyMethodPriority)
+	}
+
+	err = runInit(filepath.Join(t.TempDir(), "config.hjson"), initOptions{Retention: "forever"}, nil, &bytes.Buffer{})
+	if classifyFailure(err) != FailureConfig {
+		t.Errorf("不明なプリセットがエラーになりません: %v", err)
+	}
+}
+
+func TestRunInitInteractive(t *testing.T) {
+	source := writeSourceTree(t)
+	path := filepath.Join(t.TempDir(), "config.hjson")
+	input := strings.Join([]string{
+		source,       // コピー元
+		"E:/Backups", // 保存先ルート
+		"",           // VHDX（既定値）
+		"S:",         // マウント先
+		"",           // 拡張子（提案を採用）
+		"-",          // 除外ディレクトリなし
+		"weekly",     // 不明なプリセット → 再入力
+		"minimal",
+	}, "\n") + "\n"
+
+	var out bytes.Buffer
+	if err := runInit(path, initOptions{Interactive: true}, strings.NewReader(input), &out); err != nil {
+		t.Fatalf("ウィザードのエラー: %v", err)
+	}
+	for _, want := range []string{"利用可能なコピー方式:", "[.go,.md]", "不明なプリセットです: weekly"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("ウィザードの表示に %q が含まれていません:\n%s", want, out.String())
+		}
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("生成した設定の読み込みに失敗: %v", err)
+	}
+	if cfg.SourceVHDX != "E:/Backups/backup.vhdx" || cfg.VHDXMountDrive != "S:" || len(cfg.ExcludeDirs) != 0 {
+		t.Errorf("入力内容が反映されていません: %+v", cfg)
+	}
+	if strings.Join(cfg.Extensions, ",") != ".go,.md" || cfg.KeepVersions["1d"] != 3 {
+		t.Errorf("提案・プリセットが反映されていません: %v, %v", cfg.Extensions, cfg.KeepVersions)
+	}
+}
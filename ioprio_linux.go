@@ -0,0 +1,40 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set の引数（linux/ioprio.h）
+const (
+	ioprioWhoProcess    = 1
+	ioprioClassBE       = 2 // best-effort
+	ioprioClassShift    = 13
+	ioprioLowestBELevel = 7
+)
+
+// setLowIOPriority はプロセスの全スレッドの I/O 優先度を best-effort の最低（ionice -c2 -n7 相当）にします。
+// 以後に作成されるスレッド・子プロセス（robocopy 等の外部コマンド）は優先度を引き継ぎます。
+// idle クラスはディスクが混雑していると処理が進まずロックを保持し続けるため使用しません。
+func setLowIOPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return pkgerrors.Errorf("スレッドの一覧を取得できません: %v", err)
+	}
+	prio := uintptr(ioprioClassBE<<ioprioClassShift | ioprioLowestBELevel)
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), prio); errno != 0 && errno != unix.ESRCH {
+			return pkgerrors.Errorf("ioprio_set に失敗: %v", errno)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build linux
+
+package main
+
+import (
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSetLowIOPriority(t *testing.T) {
+	if err := setLowIOPriority(); err != nil {
+		t.Fatalf("setLowIOPriority がエラーを返しました: %v", err)
+	}
+	// 既存のスレッド・新しいスレッドのどちらで実行しても優先度が下がっている
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	prio, _, errno := unix.Syscall(unix.SYS_IOPRIO_GET, ioprioWhoProcess, 0, 0)
+	if errno != 0 {
+		t.Fatalf("ioprio_get に失敗: %v", errno)
+	}
+	if want := uintptr(ioprioClassBE<<ioprioClassShift | ioprioLowestBELevel); prio != want {
+		t.Errorf("I/O 優先度 = %#x, want %#x", prio, want)
+	}
+}
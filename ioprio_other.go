@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package main
+
+import pkgerrors "github.com/pkg/errors"
+
+// setLowIOPriority は Linux・Windows 以外では I/O 優先度の変更に対応していないためエラーを返します。
+func setLowIOPriority() error {
+	return pkgerrors.New("この OS では I/O 優先度の変更に対応していません（Linux・Windows のみ）")
+}
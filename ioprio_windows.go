@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// setLowIOPriority はプロセスをバックグラウンド処理モードにし、I/O・メモリの優先度を下げます。
+// 子プロセス（robocopy 等の外部コマンド）には引き継がれないため、robocopy は /IPG で制限します。
+func setLowIOPriority() error {
+	process, err := windows.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	if err := windows.SetPriorityClass(process, windows.PROCESS_MODE_BACKGROUND_BEGIN); err != nil {
+		return pkgerrors.Errorf("SetPriorityClass に失敗: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// JobConfig は jobs に記述するバックアップジョブ1件分の設定です。
+// name 以外のキーはトップレベルと同じで、省略したキーはトップレベルの値を継承します。
+// 継承はトップレベルと同じ規則（オブジェクトはキーごとにマージ、配列と値は置き換え）で行います。
+type JobConfig struct {
+	Name string `json:"name"`
+	BackupConfig
+}
+
+// ジョブ名に使用できる文字（ロックファイル名等に使用するため）
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// jobScopedKeys はジョブで上書きされていない場合にジョブ名を付けて分離するファイルパスです。
+// ロック・通し番号・最終実行記録・通知状態をジョブ間で共有しないようにします。
+var jobScopedKeys = []string{"last_id_file", "lock_file_path", "last_execution_file", "notification_policy.state_file"}
+
+// JobName はジョブ名を返します（jobs を使用しない設定では空文字）。
+func (cfg *BackupConfig) JobName() string {
+	return cfg.jobName
+}
+
+// buildJobConfigs は jobs の各ジョブについて、トップレベルの値を継承した実効設定を作成します。
+func buildJobConfigs(r *resolvedConfig) ([]*BackupConfig, error) {
+	raw, ok := r.tree["jobs"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, &ConfigValidationError{Path: r.path, Problems: []ConfigProblem{
+			r.problem(SeverityError, "jobs", "ジョブの配列を指定してください"),
+		}}
+	}
+
+	var problems []ConfigProblem
+	var jobs []*BackupConfig
+	seen := make(map[string]bool)
+	for i, item := range list {
+		key := fmt.Sprintf("jobs[%d]", i)
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			problems = append(problems, r.problem(SeverityError, key, "ジョブはオブジェクトで指定してください"))
+			continue
+		}
+		name, _ := obj["name"].(string)
+		switch {
+		case name == "":
+			problems = append(problems, r.problem(SeverityError, key+".name", "ジョブ名が設定されていません"))
+			continue
+		case !jobNamePattern.MatchString(name):
+			problems = append(problems, r.problem(SeverityError, key+".name", fmt.Sprintf("ジョブ名 %q に使用できない文字が含まれています（英数字・-・_ のみ）", name)))
+			continue
+		case seen[name]:
+			problems = append(problems, r.problem(SeverityError, key+".name", fmt.Sprintf("ジョブ名 %q が重複しています", name)))
+			continue
+		}
+		seen[name] = true
+		if _, nested := obj["jobs"]; nested {
+			problems = append(problems, r.problem(SeverityError, key+".jobs", "ジョブ内に jobs は指定できません"))
+			continue
+		}
+
+		job, err := r.jobConfig(i, name, obj)
+		if err != nil {
+			var verr *ConfigValidationError
+			if errors.As(err, &verr) {
+				problems = append(problems, verr.Problems...)
+				continue
+			}
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	if len(problems) > 0 {
+		return nil, &ConfigValidationError{Path: r.path, Problems: problems}
+	}
+	return jobs, nil
+}
+
+// jobConfig はトップレベルの設定にジョブの値を重ねた実効設定を作成します。
+func (r *resolvedConfig) jobConfig(index int, name string, obj map[string]interface{}) (*BackupConfig, error) {
+	srcPrefix := fmt.Sprintf("jobs[%d]", index)
+
+	// トップレベル（jobs 関連を除く）を複製
+	tree := copyConfigTree(r.tree)
+	delete(tree, "jobs")
+	delete(tree, "max_concurrent_jobs")
+	origins := make(map[string]valueOrigin)
+	for k, o := range r.origins {
+		if k != "jobs" && !isConfigKeyUnder(k, "jobs") && k != "max_concurrent_jobs" {
+			origins[k] = o
+		}
+	}
+
+	own := copyConfigTree(obj)
+	delete(own, "name")
+	for _, key := range jobScopedKeys {
+		if lookupConfigTree(own, key) == nil {
+			if value, ok := lookupConfigTree(tree, key).(string); ok && value != "" {
+				setConfigTree(tree, key, jobScopedPath(value, name))
+			}
+		}
+	}
+
+	ownOrigins := make(map[string]valueOrigin)
+	file := r.path
+	if k, ok := r.originKey(srcPrefix); ok {
+		file = r.origins[k].File
+	}
+	if src := r.sources[file]; src != nil {
+		recordConfigOrigins(own, "", srcPrefix, src, ownOrigins)
+	}
+	mergeConfigTree(tree, own, "", origins, ownOrigins)
+
+	jobSource := &resolvedConfig{path: r.path, files: r.files, tree: tree, origins: origins, sources: r.sources}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, pkgerrors.Errorf("JSON marshal error: %v", err)
+	}
+	var cfg BackupConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, &ConfigValidationError{Path: r.path, Problems: []ConfigProblem{typeErrorProblem(typeErr, jobSource)}}
+		}
+		return nil, pkgerrors.Errorf("struct unmarshal error: %v", err)
+	}
+	cfg.jobName = name
+	cfg.source = jobSource
+	return &cfg, nil
+}
+
+// jobScopedPath はファイル名の拡張子の前にジョブ名を挿入します（backup.lock → backup.name.lock）。
+func jobScopedPath(path, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + name + ext
+}
+
+// copyConfigTree は設定ツリーを複製します。
+func copyConfigTree(tree map[string]interface{}) map[string]interface{} {
+	dup := make(map[string]interface{}, len(tree))
+	for k, v := range tree {
+		if child, ok := v.(map[string]interface{}); ok {
+			dup[k] = copyConfigTree(child)
+		} else {
+			dup[k] = v
+		}
+	}
+	return dup
+}
+
+// lookupConfigTree は "a.b" 形式のキーの値を返します。
+func lookupConfigTree(tree map[string]interface{}, key string) interface{} {
+	var node interface{} = tree
+	for _, part := range strings.Split(key, ".") {
+		obj, ok := node.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		node = obj[part]
+	}
+	return node
+}
+
+// setConfigTree は "a.b" 形式のキーに値を設定します。途中のオブジェクトが存在する場合のみ設定します。
+func setConfigTree(tree map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	node := tree
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := node[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		node = child
+	}
+	node[parts[len(parts)-1]] = value
+}
+
+// selectJobs は実行するジョブを返します。
+// jobs を使用しない設定では設定全体を1つのジョブとして返します。
+func selectJobs(cfg *BackupConfig, names []string) ([]*BackupConfig, error) {
+	if len(cfg.jobs) == 0 {
+		if len(names) > 0 {
+			return nil, wrapFailure(FailureConfig, pkgerrors.Errorf("--job が指定されましたが設定ファイルに jobs がありません"))
+		}
+		return []*BackupConfig{cfg}, nil
+	}
+	if len(names) == 0 {
+		return cfg.jobs, nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+	var selected []*BackupConfig
+	for _, job := range cfg.jobs {
+		if wanted[job.jobName] {
+			selected = append(selected, job)
+			delete(wanted, job.jobName)
+		}
+	}
+	if len(wanted) > 0 {
+		var unknown []string
+		for _, name := range names {
+			if wanted[name] {
+				unknown = append(unknown, name)
+			}
+		}
+		return nil, wrapFailure(FailureConfig, pkgerrors.Errorf("不明なジョブ: %s（定義済み: %s）",
+			strings.Join(unknown, ", "), strings.Join(jobNames(cfg.jobs), ", ")))
+	}
+	return selected, nil
+}
+
+func jobNames(jobs []*BackupConfig) []string {
+	var names []string
+	for _, job := range jobs {
+		names = append(names, job.jobName)
+	}
+	return names
+}
+
+// runJobs は各ジョブに fn を適用します。
+// max_concurrent_jobs が2以上の場合はその数まで並行に、それ以外は設定順に1件ずつ実行します。
+// 失敗したジョブがあっても残りのジョブは実行し、失敗をすべてまとめたエラーを返します（分類は設定順で最初の失敗に従う）。
+func runJobs(cfg *BackupConfig, jobs []*BackupConfig, fn func(job *BackupConfig) error) error {
+	if len(jobs) == 1 && jobs[0].jobName == "" {
+		return fn(jobs[0])
+	}
+
+	limit := cfg.MaxConcurrentJobs
+	if limit < 1 {
+		limit = 1
+	}
+
+	errs := make([]error, len(jobs))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, job *BackupConfig) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			log.Printf("ジョブ開始: %s", job.jobName)
+			if err := fn(job); err != nil {
+				log.Printf("ジョブ失敗: %s: %v", job.jobName, err)
+				errs[i] = fmt.Errorf("ジョブ %s: %w", job.jobName, err)
+				return
+			}
+			log.Printf("ジョブ完了: %s", job.jobName)
+		}(i, job)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// validateJobs は各ジョブの実効設定とジョブ間の整合性を検査します。
+// 複数のジョブで同じ問題（継承したトップレベルの値の問題等）はまとめて1件にします。
+func validateJobs(cfg *BackupConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	if cfg.MaxConcurrentJobs < 0 {
+		problems = append(problems, cfg.source.problem(SeverityError, "max_concurrent_jobs", "0以上にしてください"))
+	}
+
+	type jobProblem struct {
+		problem ConfigProblem
+		jobs    []string
+	}
+	var collected []*jobProblem
+	index := make(map[ConfigProblem]*jobProblem)
+	for _, job := range cfg.jobs {
+		jobProblems := validateSingleConfig(job)
+		if o, ok := job.source.origins["log_file"]; ok && isConfigKeyUnder(o.Key, "jobs") {
+			jobProblems = append(jobProblems, job.source.problem(SeverityWarning, "log_file", "ログファイルはトップレベルの設定のみ使用されます"))
+		}
+		for _, p := range jobProblems {
+			if jp, ok := index[p]; ok {
+				jp.jobs = append(jp.jobs, job.jobName)
+				continue
+			}
+			jp := &jobProblem{problem: p, jobs: []string{job.jobName}}
+			index[p] = jp
+			collected = append(collected, jp)
+		}
+	}
+	for _, jp := range collected {
+		p := jp.problem
+		p.Message = fmt.Sprintf("ジョブ %s: %s", strings.Join(jp.jobs, ", "), p.Message)
+		problems = append(problems, p)
+	}
+	return append(problems, checkJobOverlaps(cfg.jobs)...)
+}
+
+// jobDir は重なりを検査するジョブのディレクトリです。
+type jobDir struct {
+	key  string
+	path string
+}
+
+// jobBackupDirs はジョブの保存先ディレクトリ（backup_dir と backup_dirs）を返します。
+func jobBackupDirs(job *BackupConfig) []jobDir {
+	var dirs []jobDir
+	if job.BackupDir != "" {
+		dirs = append(dirs, jobDir{"backup_dir", job.BackupDir})
+	}
+	var levels []string
+	for level := range job.BackupDirs {
+		levels = append(levels, level)
+	}
+	sort.Strings(levels)
+	for _, level := range levels {
+		if dir := job.BackupDirs[level]; dir != "" {
+			dirs = append(dirs, jobDir{"backup_dirs." + level, dir})
+		}
+	}
+	return dirs
+}
+
+// checkJobOverlaps はジョブ間で保存先が重なっていないか、他のジョブの保存先をコピー元にしていないかを検査します。
+// 保存先が重なるとミラーリングやローテーションで他のジョブのバックアップを削除してしまいます。
+func checkJobOverlaps(jobs []*BackupConfig) []ConfigProblem {
+	var problems []ConfigProblem
+	for i, a := range jobs {
+		for _, b := range jobs[i+1:] {
+			for _, da := range jobBackupDirs(a) {
+				for _, db := range jobBackupDirs(b) {
+					if pathsOverlap(da.path, db.path) {
+						problems = append(problems, b.source.problem(SeverityError, db.key,
+							fmt.Sprintf("ジョブ %s: ジョブ %s の %s (%s) と重なっています", b.jobName, a.jobName, da.key, da.path)))
+					}
+				}
+			}
+		}
+		for _, b := range jobs {
+			if a == b || a.WorkDir == "" {
+				continue
+			}
+			for _, db := range jobBackupDirs(b) {
+				if pathsOverlap(a.WorkDir, db.path) {
+					problems = append(problems, a.source.problem(SeverityError, "work_dir",
+						fmt.Sprintf("ジョブ %s: ジョブ %s の %s (%s) と重なっています", a.jobName, b.jobName, db.key, db.path)))
+				}
+			}
+		}
+	}
+	return problems
+}
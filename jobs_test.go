@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// 複数ジョブのテスト
+// =============================================================================
+
+func TestLoadConfigJobsInheritTopLevel(t *testing.T) {
+	path := writeTestConfig(t, `{
+	dry_run: true
+	work_dir: "P:/"
+	last_id_file: "C:/rb/last_id.txt"
+	lock_file_path: "C:/rb/backup.lock"
+	extensions: [".cpp", ".h"]
+	keep_versions: { "30m": 5, "3h": 2 }
+	jobs: [
+		{
+			name: "src"
+		}
+		{
+			name: "docs"
+			work_dir: "Q:/"
+			extensions: [".md"]
+			keep_versions: { "3h": 8 }
+			lock_file_path: "C:/rb/docs-only.lock"
+		}
+	]
+}`)
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("設定の読み込みに失敗: %v", err)
+	}
+	if len(cfg.jobs) != 2 {
+		t.Fatalf("ジョブ数が違います: %d", len(cfg.jobs))
+	}
+
+	src, docs := cfg.jobs[0], cfg.jobs[1]
+	if src.JobName() != "src" || docs.JobName() != "docs" {
+		t.Errorf("ジョブ名が違います: %s, %s", src.JobName(), docs.JobName())
+	}
+	if src.WorkDir != "P:/" || !src.DryRun || len(src.Extensions) != 2 {
+		t.Errorf("トップレベルの値が継承されていません: %+v", src)
+	}
+	if docs.WorkDir != "Q:/" || len(docs.Extensions) != 1 || docs.Extensions[0] != ".md" {
+		t.Errorf("ジョブの値で上書きされていません: %+v", docs)
+	}
+	// オブジェクトはキーごとにマージ
+	if docs.KeepVersions["30m"] != 5 || docs.KeepVersions["3h"] != 8 {
+		t.Errorf("keep_versions がマージされていません: %v", docs.KeepVersions)
+	}
+
+	// ロック・通し番号はジョブごとに分離（ジョブで指定した値はそのまま）
+	scoped := []struct {
+		got, expected string
+	}{
+		{src.LastIDFile, "C:/rb/last_id.src.txt"},
+		{src.LockFilePath, "C:/rb/backup.src.lock"},
+		{docs.LastIDFile, "C:/rb/last_id.docs.txt"},
+		{docs.LockFilePath, "C:/rb/docs-only.lock"},
+	}
+	for _, s := range scoped {
+		if s.got != s.expected {
+			t.Errorf("ジョブのファイルパスが違います: 期待=%s, 実際=%s", s.expected, s.got)
+		}
+	}
+}
+
+func TestLoadConfigJobErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs string
+		key  string
+		line int
+	}{
+		{"名前なし", `[ { work_dir: "P:/" } ]`, "jobs[0].name", 0},
+		{"不正な名前", `[
+		{ name: "a b" }
+	]`, "jobs[0].name", 4},
+		{"名前の重複", `[
+		{ name: "a" }
+		{ name: "a" }
+	]`, "jobs[1].name", 5},
+		{"入れ子", `[ { name: "a", jobs: [] } ]`, "jobs[0].jobs", 0},
+		{"不明なキー", `[
+		{ name: "a" }
+		{
+			name: "b"
+			wrok_dir: "P:/"
+		}
+	]`, "jobs[1].wrok_dir", 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestConfig(t, "{\n\tdry_run: true\n\tjobs: "+tt.jobs+"\n}")
+			_, err := loadConfig(path)
+			verr, ok := err.(*ConfigValidationError)
+			if !ok {
+				t.Fatalf("ConfigValidationError が返されていません: %v", err)
+			}
+			p := findProblem(verr.Problems, tt.key)
+			if p == nil {
+				t.Fatalf("%s の問題が検出されていません: %v", tt.key, verr.Problems)
+			}
+			if tt.line > 0 && p.Line != tt.line {
+				t.Errorf("行番号が違います: 期待=%d, 実際=%d (%s)", tt.line, p.Line, p)
+			}
+		})
+	}
+}
+
+func TestValidateJobs(t *testing.T) {
+	newJobs := func(t *testing.T) *BackupConfig {
+		cfg := &BackupConfig{source: &resolvedConfig{path: "config.hjson"}}
+		for _, name := range []string{"a", "b"} {
+			job := newValidTestConfig(t)
+			job.jobName = name
+			job.source = cfg.source
+			cfg.jobs = append(cfg.jobs, job)
+		}
+		return cfg
+	}
+
+	if problems := validateConfig(newJobs(t)); len(problems) != 0 {
+		t.Fatalf("正常な設定で問題が検出されました: %v", problems)
+	}
+
+	t.Run("保存先の重複", func(t *testing.T) {
+		cfg := newJobs(t)
+		cfg.jobs[1].BackupDirs["1d"] = cfg.jobs[0].BackupDirs["1d"]
+		p := findProblem(validateConfig(cfg), "backup_dirs.1d")
+		if p == nil || p.Severity != SeverityError || !strings.Contains(p.Message, "ジョブ b") {
+			t.Errorf("ジョブ間の保存先の重複が検出されていません: %v", p)
+		}
+	})
+
+	t.Run("他のジョブの保存先をコピー元にする", func(t *testing.T) {
+		cfg := newJobs(t)
+		cfg.jobs[0].WorkDir = filepath.Dir(cfg.jobs[1].BackupDirs["30m"])
+		if p := findProblem(validateConfig(cfg), "work_dir"); p == nil {
+			t.Errorf("他のジョブの保存先との重なりが検出されていません")
+		}
+	})
+
+	t.Run("同じ問題はまとめる", func(t *testing.T) {
+		cfg := newJobs(t)
+		for _, job := range cfg.jobs {
+			job.OnLockConflict = "wait"
+		}
+		var found []ConfigProblem
+		for _, p := range validateConfig(cfg) {
+			if p.Key == "on_lock_conflict" {
+				found = append(found, p)
+			}
+		}
+		if len(found) != 1 || !strings.Contains(found[0].Message, "ジョブ a, b:") {
+			t.Errorf("ジョブ共通の問題がまとめられていません: %v", found)
+		}
+	})
+
+	t.Run("同時実行数が負", func(t *testing.T) {
+		cfg := newJobs(t)
+		cfg.MaxConcurrentJobs = -1
+		if p := findProblem(validateConfig(cfg), "max_concurrent_jobs"); p == nil {
+			t.Errorf("負の同時実行数が検出されていません")
+		}
+	})
+}
+
+func TestSelectJobs(t *testing.T) {
+	single := &BackupConfig{}
+	if jobs, err := selectJobs(single, nil); err != nil || len(jobs) != 1 || jobs[0] != single {
+		t.Errorf("jobs なしの設定は設定全体を1ジョブとして返すべきです: %v, %v", jobs, err)
+	}
+	if _, err := selectJobs(single, []string{"a"}); classifyFailure(err) != FailureConfig {
+		t.Errorf("jobs なしで --job を指定した場合は設定エラーになるべきです: %v", err)
+	}
+
+	cfg := &BackupConfig{jobs: []*BackupConfig{{jobName: "a"}, {jobName: "b"}, {jobName: "c"}}}
+	jobs, err := selectJobs(cfg, []string{"c", "a"})
+	if err != nil || strings.Join(jobNames(jobs), ",") != "a,c" {
+		t.Errorf("ジョブの選択が違います（設定順で返すべき）: %v, %v", jobNames(jobs), err)
+	}
+	_, err = selectJobs(cfg, []string{"a", "x"})
+	if classifyFailure(err) != FailureConfig || !strings.Contains(err.Error(), "x") {
+		t.Errorf("不明なジョブ名が検出されていません: %v", err)
+	}
+}
+
+func TestRunJobsConcurrencyLimit(t *testing.T) {
+	var jobs []*BackupConfig
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		jobs = append(jobs, &BackupConfig{jobName: name})
+	}
+
+	tests := []struct {
+		limit    int
+		expected int32
+	}{
+		{0, 1}, // 既定は1件ずつ
+		{2, 2},
+	}
+	for _, tt := range tests {
+		var running, peak int32
+		var mu sync.Mutex
+		var order []string
+		err := runJobs(&BackupConfig{MaxConcurrentJobs: tt.limit}, jobs, func(job *BackupConfig) error {
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+			mu.Lock()
+			order = append(order, job.jobName)
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Errorf("エラーが返されました: %v", err)
+		}
+		if peak != tt.expected {
+			t.Errorf("同時実行数が違います (max_concurrent_jobs=%d): 期待=%d, 実際=%d", tt.limit, tt.expected, peak)
+		}
+		if len(order) != len(jobs) {
+			t.Errorf("すべてのジョブが実行されていません: %v", order)
+		}
+		if tt.limit == 0 && strings.Join(order, "") != "abcde" {
+			t.Errorf("逐次実行が設定順ではありません: %v", order)
+		}
+	}
+}
+
+func TestRunJobsContinuesAfterFailure(t *testing.T) {
+	jobs := []*BackupConfig{{jobName: "a"}, {jobName: "b"}, {jobName: "c"}}
+	var ran []string
+	err := runJobs(&BackupConfig{}, jobs, func(job *BackupConfig) error {
+		ran = append(ran, job.jobName)
+		switch job.jobName {
+		case "a":
+			return wrapFailure(FailureCopy, errors.New("コピー失敗"))
+		case "b":
+			return wrapFailure(FailureRotate, errors.New("ローテーション失敗"))
+		}
+		return nil
+	})
+	if len(ran) != 3 {
+		t.Errorf("失敗後も残りのジョブを実行すべきです: %v", ran)
+	}
+	if err == nil || !strings.Contains(err.Error(), "ジョブ a") || !strings.Contains(err.Error(), "ジョブ b") {
+		t.Fatalf("失敗したジョブがエラーに含まれていません: %v", err)
+	}
+	if classifyFailure(err) != FailureCopy {
+		t.Errorf("最初に失敗したジョブの分類になるべきです: %v", classifyFailure(err))
+	}
+}
+
+func TestJobScopedPathAndHookEnv(t *testing.T) {
+	env := strings.Join(hookEnv(HookPreBackup, HookContext{Job: "docs"}), "\n")
+	if !strings.Contains(env, "ROTATE_BACKUP_JOB=docs") {
+		t.Errorf("フックにジョブ名が渡されていません:\n%s", env)
+	}
+	if got := jobScopedPath("C:/rb/notify.state.json", "docs"); got != "C:/rb/notify.state.docs.json" {
+		t.Errorf("ジョブのファイルパスが違います: %s", got)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingLogWriter はサイズ・日付でローテーションするログファイル出力先です。
+type RotatingLogWriter struct {
+	path      string
+	maxSize   int64 // 0 の場合はサイズによるローテーションなし
+	daily     bool  // 日付が変わったらローテーション
+	compress  bool  // ローテーション済みファイルをgzip圧縮
+	maxFiles  int   // 保持するローテーション済みファイル数（0の場合は無制限）
+	now       func() time.Time
+	file      *os.File
+	size      int64
+	openedDay string
+	mutex     sync.Mutex
+}
+
+// newRotatingLogWriter は設定からローテーション付きログ出力先を作成しファイルを開きます。
+func newRotatingLogWriter(cfg *BackupConfig) (*RotatingLogWriter, error) {
+	w := &RotatingLogWriter{
+		path:     cfg.LogFile,
+		maxSize:  int64(cfg.LogMaxSizeMB) * 1024 * 1024,
+		daily:    cfg.LogRotateDaily,
+		compress: cfg.LogCompress,
+		maxFiles: cfg.MaxLogFiles,
+		now:      time.Now,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open はログファイルを追記モードで開きます。
+func (w *RotatingLogWriter) open() error {
+	if dir := filepath.Dir(w.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = info.Size()
+	// 既存ファイルは最終更新日を基準にする（再起動をまたいだ日付ローテーション用）
+	w.openedDay = info.ModTime().Format("20060102")
+	if info.Size() == 0 {
+		w.openedDay = w.now().Format("20060102")
+	}
+	return nil
+}
+
+// Write はログを書き込み、必要に応じてローテーションします。
+func (w *RotatingLogWriter) Write(p []byte) (n int, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file == nil {
+		return 0, os.ErrClosed
+	}
+	if w.shouldRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			// ローテーション失敗時も書き込みは継続する
+			fmt.Fprintf(os.Stderr, "ログローテーションエラー: %v\n", err)
+		}
+	}
+	n, err = w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// shouldRotate は次の書き込み前にローテーションが必要か判定します。
+func (w *RotatingLogWriter) shouldRotate(next int64) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.maxSize > 0 && w.size+next > w.maxSize {
+		return true
+	}
+	if w.daily && w.now().Format("20060102") != w.openedDay {
+		return true
+	}
+	return false
+}
+
+// rotate は現在のログファイルを退避し、新しいファイルを開きます。
+func (w *RotatingLogWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	rotated := w.rotatedName(w.now())
+	if err := os.Rename(w.path, rotated); err != nil {
+		// 退避できなくても出力先は開き直す
+		if openErr := w.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.openedDay = w.now().Format("20060102")
+
+	if w.compress {
+		if err := gzipFile(rotated); err != nil {
+			return err
+		}
+	}
+	return w.prune()
+}
+
+// rotatedName はローテーション後のファイル名を返します。
+// 例: log.txt → log.20250701-150405.txt
+// 同一秒に複数回ローテーションした場合は、既存のファイルより大きい連番を付けます（log.20250701-150405-1.txt）。
+// 古いファイルを削除した後も連番を戻さないため、名前の順序と時系列が一致します。
+func (w *RotatingLogWriter) rotatedName(t time.Time) string {
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(w.path, ext)
+	stamp := t.Format("20060102-150405")
+
+	next := 0
+	names, _ := w.rotatedFiles()
+	for _, name := range names {
+		if s, seq, _ := w.rotatedOrder(name); s == stamp {
+			next = max(next, seq+1)
+		}
+	}
+	if next == 0 {
+		return fmt.Sprintf("%s.%s%s", base, stamp, ext)
+	}
+	return fmt.Sprintf("%s.%s-%d%s", base, stamp, next, ext)
+}
+
+// rotatedFiles はローテーション済みファイル（rotatedName で作成した名前のもの）を古い順に返します。
+func (w *RotatingLogWriter) rotatedFiles() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(w.path))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if _, _, ok := w.rotatedOrder(e.Name()); ok {
+			names = append(names, filepath.Join(filepath.Dir(w.path), e.Name()))
+		}
+	}
+	// ファイル名のタイムスタンプと衝突回避の連番の順（名前順では "-1" が連番なしより前になるため）
+	sort.SliceStable(names, func(i, j int) bool {
+		si, ni, _ := w.rotatedOrder(names[i])
+		sj, nj, _ := w.rotatedOrder(names[j])
+		if si != sj {
+			return si < sj
+		}
+		return ni < nj
+	})
+	return names, nil
+}
+
+// rotatedOrder はローテーション済みファイル名からタイムスタンプと衝突回避の連番（ない場合は 0）を返します。
+// rotatedName で作成した形式（log.20250701-150405[-N].txt[.gz]）でない場合は false を返します。
+func (w *RotatingLogWriter) rotatedOrder(name string) (string, int, bool) {
+	const layout = "20060102-150405"
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(filepath.Base(w.path), ext)
+	rest, ok := strings.CutPrefix(strings.TrimSuffix(filepath.Base(name), ".gz"), base+".")
+	if !ok || !strings.HasSuffix(rest, ext) {
+		return "", 0, false
+	}
+	rest = strings.TrimSuffix(rest, ext)
+	if len(rest) < len(layout) {
+		return "", 0, false
+	}
+	stamp := rest[:len(layout)]
+	if _, err := time.Parse(layout, stamp); err != nil {
+		return "", 0, false
+	}
+	if rest == stamp {
+		return stamp, 0, true
+	}
+	digits, ok := strings.CutPrefix(rest[len(layout):], "-")
+	seq, err := strconv.Atoi(digits)
+	if !ok || err != nil || seq <= 0 || strings.Trim(digits, "0123456789") != "" {
+		return "", 0, false
+	}
+	return stamp, seq, true
+}
+
+// prune は max_log_files を超えた古いローテーション済みファイルを削除します。
+func (w *RotatingLogWriter) prune() error {
+	if w.maxFiles <= 0 {
+		return nil
+	}
+	names, err := w.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	if len(names) <= w.maxFiles {
+		return nil
+	}
+	for _, old := range names[:len(names)-w.maxFiles] {
+		if err := os.Remove(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reopen はログファイルを閉じて開き直します。
+// 外部ツールによりログファイルが移動・削除された場合に使用します。
+func (w *RotatingLogWriter) Reopen() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	return w.open()
+}
+
+// IsMoved はオープン中のファイルとパス上のファイルが異なるか判定します。
+func (w *RotatingLogWriter) IsMoved() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return false
+	}
+	opened, err := w.file.Stat()
+	if err != nil {
+		return true
+	}
+	current, err := os.Stat(w.path)
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(opened, current)
+}
+
+// Close はログファイルを閉じます。
+func (w *RotatingLogWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// gzipFile はファイルを gzip 圧縮し、元ファイルを削除します。
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	gz.Name = filepath.Base(path)
+	if _, err := io.Copy(gz, in); err != nil {
+		gz.Close()
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(path)
+}
+
+// fileExists はファイルが存在するか確認します。
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// reopenLogFileIfMoved は常駐モード用に、ログファイルが外部で移動された場合に開き直します。
+func reopenLogFileIfMoved() {
+	if logfile == nil || !logfile.IsMoved() {
+		return
+	}
+	if err := logfile.Reopen(); err != nil {
+		log.Printf("ログファイル再オープンエラー: %v", err)
+		return
+	}
+	log.Printf("ログファイルを開き直しました: %s", logfile.path)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// ログローテーションのテスト
+// =============================================================================
+
+func TestRotatingLogWriterSizeRotation(t *testing.T) {
+	tempDir := t.TempDir()
+	logPath := filepath.Join(tempDir, "log.txt")
+
+	cfg := &BackupConfig{
+		LogFile:     logPath,
+		LogCompress: true,
+		MaxLogFiles: 2,
+	}
+	w, err := newRotatingLogWriter(cfg)
+	if err != nil {
+		t.Fatalf("ログファイルのオープンに失敗: %v", err)
+	}
+	defer w.Close()
+	w.maxSize = 100 // テスト用に100バイトでローテーション
+
+	// 同一秒内でもファイル名が衝突しないよう時刻を進める
+	base := time.Date(2025, 7, 1, 10, 0, 0, 0, time.Local)
+	count := 0
+	w.now = func() time.Time {
+		count++
+		return base.Add(time.Duration(count) * time.Second)
+	}
+
+	line := strings.Repeat("x", 60) + "\n"
+	for i := 0; i < 5; i++ {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatalf("書き込みエラー: %v", err)
+		}
+	}
+
+	rotated, err := w.rotatedFiles()
+	if err != nil {
+		t.Fatalf("ローテーション済みファイルの取得に失敗: %v", err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("保持数が違います: 期待=2, 実際=%d (%v)", len(rotated), rotated)
+	}
+	for _, name := range rotated {
+		if !strings.HasSuffix(name, ".txt.gz") {
+			t.Errorf("圧縮されていません: %s", name)
+		}
+	}
+
+	// 圧縮ファイルの中身を確認
+	f, err := os.Open(rotated[len(rotated)-1])
+	if err != nil {
+		t.Fatalf("圧縮ファイルのオープンに失敗: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("gzipリーダー作成に失敗: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("gzip展開に失敗: %v", err)
+	}
+	if string(data) != line {
+		t.Errorf("圧縮ファイルの内容が違います: %q", string(data))
+	}
+
+	// 現在のログファイルはサイズ上限以下
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatalf("ログファイルが存在しません: %v", err)
+	}
+	if info.Size() > 100 {
+		t.Errorf("ログファイルがサイズ上限を超えています: %d", info.Size())
+	}
+}
+
+func TestRotatingLogWriterSameSecondRotation(t *testing.T) {
+	tempDir := t.TempDir()
+	logPath := filepath.Join(tempDir, "log.txt")
+
+	cfg := &BackupConfig{LogFile: logPath, MaxLogFiles: 1}
+	w, err := newRotatingLogWriter(cfg)
+	if err != nil {
+		t.Fatalf("ログファイルのオープンに失敗: %v", err)
+	}
+	defer w.Close()
+	w.maxSize = 100
+	// 同一秒内に複数回ローテーションする
+	w.now = func() time.Time { return time.Date(2025, 7, 1, 10, 0, 0, 0, time.Local) }
+
+	for i := 0; i < 12; i++ {
+		if _, err := w.Write([]byte(fmt.Sprintf("%02d", i) + strings.Repeat("x", 57) + "\n")); err != nil {
+			t.Fatalf("書き込みエラー: %v", err)
+		}
+	}
+
+	rotated, err := w.rotatedFiles()
+	if err != nil {
+		t.Fatalf("ローテーション済みファイルの取得に失敗: %v", err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("保持数が違います: 期待=1, 実際=%d (%v)", len(rotated), rotated)
+	}
+	// 最も新しいローテーション（連番 10）が残る
+	if want := filepath.Join(tempDir, "log.20250701-100000-10.txt"); rotated[0] != want {
+		t.Errorf("残ったファイル = %s, want %s", rotated[0], want)
+	}
+	if data, _ := os.ReadFile(rotated[0]); !strings.HasPrefix(string(data), "10") {
+		t.Errorf("残ったファイルの内容が古いです: %q", data)
+	}
+}
+
+func TestRotatingLogWriterKeepsUnrelatedFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		logName   string
+		unrelated []string
+	}{
+		{"拡張子あり", "backup.log", []string{"backup.old.log", "backup.2025.log", "backup.20250701-100000-x.log", "backup.20251399-100000.log", "other.20250701-100000.log"}},
+		{"拡張子なし", "backup", []string{"backup.old", "backup.conf", "backup.20250701-100000.bak"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			for _, name := range tt.unrelated {
+				os.WriteFile(filepath.Join(tempDir, name), []byte("user"), 0644)
+			}
+			current := time.Date(2025, 7, 1, 10, 0, 0, 0, time.Local)
+			w := &RotatingLogWriter{
+				path:     filepath.Join(tempDir, tt.logName),
+				maxSize:  10,
+				maxFiles: 1,
+				now: func() time.Time {
+					current = current.Add(time.Second)
+					return current
+				},
+			}
+			if err := w.open(); err != nil {
+				t.Fatalf("ログファイルのオープンに失敗: %v", err)
+			}
+			defer w.Close()
+			for i := 0; i < 5; i++ {
+				w.Write([]byte("0123456789ab\n"))
+			}
+
+			rotated, _ := w.rotatedFiles()
+			if len(rotated) != 1 {
+				t.Errorf("ローテーション済みファイル = %v, want 1個", rotated)
+			}
+			for _, name := range tt.unrelated {
+				if _, err := os.Stat(filepath.Join(tempDir, name)); err != nil {
+					t.Errorf("無関係なファイル %s が削除されました: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingLogWriterDailyRotation(t *testing.T) {
+	tempDir := t.TempDir()
+	logPath := filepath.Join(tempDir, "log.txt")
+
+	current := time.Date(2025, 7, 1, 23, 59, 0, 0, time.Local)
+	w := &RotatingLogWriter{
+		path:  logPath,
+		daily: true,
+		now:   func() time.Time { return current },
+	}
+	if err := w.open(); err != nil {
+		t.Fatalf("ログファイルのオープンに失敗: %v", err)
+	}
+	defer w.Close()
+	w.openedDay = current.Format("20060102")
+
+	w.Write([]byte("day1\n"))
+	current = current.Add(2 * time.Minute) // 日付をまたぐ
+	w.Write([]byte("day2\n"))
+
+	rotated, err := w.rotatedFiles()
+	if err != nil {
+		t.Fatalf("ローテーション済みファイルの取得に失敗: %v", err)
+	}
+	if len(rotated) != 1 {
+		t.Fatalf("ローテーション数が違います: 期待=1, 実際=%d", len(rotated))
+	}
+	if !strings.Contains(filepath.Base(rotated[0]), "20250702-000100") {
+		t.Errorf("ローテーション済みファイル名が違います: %s", rotated[0])
+	}
+
+	data, _ := os.ReadFile(logPath)
+	if string(data) != "day2\n" {
+		t.Errorf("現在のログ内容が違います: %q", string(data))
+	}
+}
+
+func TestRotatingLogWriterReopen(t *testing.T) {
+	tempDir := t.TempDir()
+	logPath := filepath.Join(tempDir, "log.txt")
+
+	w, err := newRotatingLogWriter(&BackupConfig{LogFile: logPath})
+	if err != nil {
+		t.Fatalf("ログファイルのオープンに失敗: %v", err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("before\n"))
+	if w.IsMoved() {
+		t.Fatalf("移動していないのに移動済みと判定されました")
+	}
+
+	// 外部ツールによるローテーションを模擬
+	if err := os.Rename(logPath, logPath+".old"); err != nil {
+		t.Fatalf("リネームに失敗: %v", err)
+	}
+	if !w.IsMoved() {
+		t.Fatalf("移動が検出されませんでした")
+	}
+	if err := w.Reopen(); err != nil {
+		t.Fatalf("再オープンに失敗: %v", err)
+	}
+	w.Write([]byte("after\n"))
+
+	data, _ := os.ReadFile(logPath)
+	if string(data) != "after\n" {
+		t.Errorf("再オープン後のログ内容が違います: %q", string(data))
+	}
+}
+
+func TestSetupLogOutputReplacesPreviousFile(t *testing.T) {
+	tempDir := t.TempDir()
+	defer closeLogFile()
+
+	first := filepath.Join(tempDir, "first.txt")
+	second := filepath.Join(tempDir, "second.txt")
+
+	if err := setupLogOutput(&BackupConfig{LogFile: first}); err != nil {
+		t.Fatalf("setupLogOutput エラー: %v", err)
+	}
+	firstWriter := logfile
+	if err := setupLogOutput(&BackupConfig{LogFile: second}); err != nil {
+		t.Fatalf("setupLogOutput エラー: %v", err)
+	}
+	if firstWriter.file != nil {
+		t.Errorf("以前のログファイルが閉じられていません")
+	}
+	for _, w := range multiWriter.writers {
+		if w == io.Writer(firstWriter) {
+			t.Errorf("以前のログファイルがマルチライターに残っています")
+		}
+	}
+}
@@ -10,19 +10,14 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"runtime/debug"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/go-toast/toast"
-	"github.com/hjson/hjson-go"
 	pkgerrors "github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -39,16 +34,21 @@ const (
 	NotifyBackupEnd
 	NotifyUpdateEnd
 	NotifyError
+	NotifyRecovered // 失敗後の復旧
+	NotifyDigest    // 日次ダイジェスト
 )
 
 // Args はコマンドライン引数を保持します。
 type Args struct {
 	ConfigPath   string
 	UpdateBackup bool
+	Set          []string // --set key=value による設定値の上書き
+	Jobs         []string // --job による実行ジョブの指定
 }
 
 // BackupConfig は設定ファイルの構造を表します。
 type BackupConfig struct {
+	ConfigVersion      int               `json:"config_version"` // 設定ファイルの形式のバージョン（省略時は 1）
 	DryRun             bool              `json:"dry_run"`
 	CopyMethodPriority []string          `json:"copy_method_priority"`
 	CopyArgs           map[string]string `json:"copy_args"`
@@ -59,6 +59,20 @@ type BackupConfig struct {
 	LastIDFile     string `json:"last_id_file"`
 	VHDXMountDrive string `json:"vhdx_mount_drive"`
 	MountIfMissing bool   `json:"mount_vhdx_if_missing"`
+	// スナップショットの保存時に VHDX を読み取り専用でマウントし直す
+	VHDXReadOnlySnapshot bool `json:"vhdx_read_only_snapshot"`
+	// 自動マウントした VHDX を終了後もマウントしたままにする
+	KeepVHDXMounted bool `json:"keep_vhdx_mounted"`
+
+	// 各レベルに保存するスナップショットの形式
+	SnapshotFormat   string `json:"snapshot_format"`   // スナップショット形式（省略時は vhdx）
+	HardlinkCompare  string `json:"hardlink_compare"`  // hardlink 形式の変更の判定方法（省略時は mtime）
+	ArchiveFormat    string `json:"archive_format"`    // archive 形式の圧縮形式（省略時は zip）
+	CompressionLevel int    `json:"compression_level"` // archive 形式の圧縮レベル（0で既定値）
+	// スナップショットの暗号化（vhdx・archive 形式のみ）
+	Encryption EncryptionConfig `json:"encryption"`
+	// スナップショットの複製先（vhdx・archive 形式のみ）
+	Remote RemoteConfig `json:"remote"`
 
 	KeepVersions map[string]int    `json:"keep_versions"`
 	BackupDirs   map[string]string `json:"backup_dirs"`
@@ -66,6 +80,17 @@ type BackupConfig struct {
 	ExcludeDirs  []string          `json:"exclude_dirs"`
 	IncludeFiles []string          `json:"include_files"`
 
+	// watch コマンド（変更監視による update-backup）の設定
+	Watch WatchConfig `json:"watch"`
+	// コピー・スナップショット保存の進捗表示
+	Progress ProgressConfig `json:"progress"`
+	// コピー・スナップショット保存・複製の帯域・I/O 制限
+	Throttle ThrottleConfig `json:"throttle"`
+	// スナップショット作成前の空き容量の確認
+	DiskSpace DiskSpaceConfig `json:"disk_space"`
+	// コピー中の work_dir の固定
+	SourceSnapshot SourceSnapshotConfig `json:"source_snapshot"`
+
 	Notifications struct {
 		LockConflict bool `json:"lock_conflict"`
 		BackupStart  bool `json:"backup_start"`
@@ -74,20 +99,52 @@ type BackupConfig struct {
 		Error        bool `json:"error"`
 	} `json:"notifications"`
 
+	// 通知先一覧（未設定の場合はトースト通知のみ）
+	Notifiers []NotifierConfig `json:"notifiers"`
+	// 通知の抑制・集約・テンプレート設定
+	NotificationPolicy NotificationPolicy `json:"notification_policy"`
+
 	LogFile     string `json:"log_file"`
 	PerfLogPath string `json:"perf_log_path"`
 
+	// ログローテーション設定
+	LogMaxSizeMB   int  `json:"log_max_size_mb"`  // このサイズ(MB)を超えたらローテーション（0で無効）
+	LogRotateDaily bool `json:"log_rotate_daily"` // 日付が変わったらローテーション
+	LogCompress    bool `json:"log_compress"`     // ローテーション済みログをgzip圧縮
+	MaxLogFiles    int  `json:"max_log_files"`    // 保持するローテーション済みログ数（0で無制限）
+
 	EnableLock     bool   `json:"enable_lock"`
 	LockFilePath   string `json:"lock_file_path"`
 	OnLockConflict string `json:"on_lock_conflict"`
 	
 	// 重複実行防止用：最終実行時刻記録ファイル
 	LastExecutionFile string `json:"last_execution_file"`
+
+	// バックアップ各フェーズの前後に実行するフック
+	Hooks HooksConfig `json:"hooks"`
+
+	// 複数ジョブ（未設定の場合は設定全体を1つのジョブとして実行）
+	Jobs              []JobConfig `json:"jobs"`
+	MaxConcurrentJobs int         `json:"max_concurrent_jobs"` // 同時に実行するジョブ数（0・1で順次実行）
+
+	// 読み込み元の設定ファイルと各値の出所（検査結果の行番号表示用）
+	source *resolvedConfig
+	// jobs の各ジョブの実効設定（トップレベルの値を継承済み）
+	jobs []*BackupConfig
+	// ジョブとして実行する場合のジョブ名
+	jobName string
+	// 読み込み済みの暗号化の鍵
+	encKey *encryptionKey
+	// VHDX のマウント状態
+	vhdx *diskImageManager
 }
 
 // LastExecutionRecord は最終実行時刻を記録する構造体です。
 type LastExecutionRecord struct {
 	LastExecutions map[string]time.Time `json:"last_executions"` // レベル別最終実行時刻
+
+	LastFailure         *FailureRecord `json:"last_failure,omitempty"` // 最後に発生した失敗
+	ConsecutiveFailures int            `json:"consecutive_failures"`   // 連続失敗回数（成功で0に戻る）
 }
 
 // ログバッファリング用の構造体
@@ -155,7 +212,7 @@ var (
 		UpdateBackup: false,
 	}
 	logWriter   io.Writer
-	logfile     *os.File
+	logfile     *RotatingLogWriter
 	logBuffer   *LogBuffer
 	multiWriter *MultiWriter
 
@@ -209,12 +266,16 @@ func setupLogOutput(cfg *BackupConfig) error {
 	
 	log.Printf("ログファイル設定開始: %s", cfg.LogFile)
 	
+	// 既にログファイルを開いている場合は閉じてから開き直す（常駐モードでの再設定用）
+	closeLogFile()
+
 	// ログファイルを開く
-	logfile, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	w, err := newRotatingLogWriter(cfg)
 	if err != nil {
 		log.Printf("ログファイルオープンエラー: %v", err)
 		return fmt.Errorf("ログファイルオープンエラー: %v", err)
 	}
+	logfile = w
 	
 	// バッファに溜まったログを先にファイルに出力
 	bufferedLogs := logBuffer.GetAndClear()
@@ -238,6 +299,7 @@ func setupLogOutput(cfg *BackupConfig) error {
 func closeLogFile() {
 	if logfile != nil {
 		log.Printf("ログファイルを閉じます")
+		multiWriter.RemoveWriter(logfile)
 		logfile.Close()
 		logfile = nil
 	}
@@ -255,313 +317,6 @@ func convertShiftJISToUTF8(sjisBytes []byte) string {
 	return string(utf8Bytes)
 }
 
-// executeRobocopyWithExtensions は拡張子フィルタリング付きの2段階robocopyを実行します。
-func executeRobocopyWithExtensions(cfg *BackupConfig, src, dst, args string) bool {
-	log.Printf("robocopy 2段階実行開始: 拡張子フィルタリング + ミラーリング")
-
-	// 除外ディレクトリオプション
-	excludeDirs := []string{
-		"/XD", "System Volume Information", "$Recycle.Bin", "Recovery",
-	}
-	for _, excludeDir := range cfg.ExcludeDirs {
-		excludeDirs = append(excludeDirs, excludeDir)
-	}
-
-	// 段階1: 指定拡張子のファイルをコピー
-	log.Printf("段階1: 指定拡張子ファイルのコピー")
-	
-	// 拡張子パターンを作成
-	var extPatterns []string
-	for _, ext := range cfg.Extensions {
-		extPatterns = append(extPatterns, "*"+ext)
-	}
-
-	// 段階1のコマンド構築
-	parts1 := []string{src, dst}
-	parts1 = append(parts1, extPatterns...)
-	parts1 = append(parts1, strings.Fields(args)...)
-	// /MIRではなく/Eを使用（削除なし）
-	for i, arg := range parts1 {
-		if arg == "/MIR" {
-			parts1[i] = "/E"
-		}
-	}
-	parts1 = append(parts1, excludeDirs...)
-	parts1 = append(parts1, "/XA:SH")
-
-	cmd1 := exec.Command("robocopy", parts1...)
-	log.Printf("実行コマンド(段階1): robocopy %s", strings.Join(parts1, " "))
-	out1, err1 := cmd1.CombinedOutput()
-	outStr1 := convertShiftJISToUTF8(out1)
-
-	stage1Success := false
-	if err1 == nil {
-		stage1Success = true
-		log.Printf("段階1完了: 指定拡張子ファイルのコピー成功")
-	} else if exitError, ok := err1.(*exec.ExitError); ok {
-		exitCode := exitError.ExitCode()
-		if exitCode <= 3 {
-			stage1Success = true
-			log.Printf("段階1完了: 指定拡張子ファイルのコピー成功 (終了コード: %d)", exitCode)
-		} else {
-			log.Printf("段階1失敗: robocopy エラー (終了コード: %d)", exitCode)
-		}
-	}
-
-	if len(outStr1) > 0 {
-		log.Printf("段階1出力:")
-		logRobocopyOutput(outStr1)
-	}
-
-	if !stage1Success {
-		return false
-	}
-
-	// 段階2: 対象外ファイルの削除（カスタムクリーンアップ）
-	log.Printf("段階2: 対象外ファイルの削除")
-
-	// Go言語で対象外ファイルを探索・削除
-	stage2Success := cleanupUnwantedFiles(cfg, src, dst)
-	if !stage2Success {
-		log.Printf("段階2失敗: 対象外ファイルの削除に失敗")
-	} else {
-		log.Printf("段階2完了: 対象外ファイルの削除成功")
-	}
-
-	if stage1Success && stage2Success {
-		log.Printf("robocopy 2段階実行完了: 拡張子フィルタリング + ミラーリング成功")
-		return true
-	}
-
-	return false
-}
-
-// cleanupUnwantedFiles はバックアップ先の対象外ファイルを削除します。
-func cleanupUnwantedFiles(cfg *BackupConfig, src, dst string) bool {
-	log.Printf("対象外ファイルのクリーンアップを開始: %s", dst)
-	
-	deletedFiles := 0
-	deletedDirs := 0
-	skippedFiles := 0
-	errors := 0
-
-	// バックアップ先ディレクトリを走査
-	err := filepath.Walk(dst, func(dstPath string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Printf("ファイル走査エラー: %s, %v", dstPath, err)
-			errors++
-			return nil
-		}
-
-		// ルートディレクトリはスキップ
-		if dstPath == dst {
-			return nil
-		}
-
-		// バックアップ先のパスから相対パスを取得
-		relPath, err := filepath.Rel(dst, dstPath)
-		if err != nil {
-			log.Printf("相対パス計算エラー: %s, %v", dstPath, err)
-			errors++
-			return nil
-		}
-
-		// ソース側の対応するパス
-		srcPath := filepath.Join(src, relPath)
-
-		if info.IsDir() {
-			// ディレクトリの場合：ソース側に存在しない場合は削除
-			if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-				log.Printf("対象外ディレクトリを削除: %s", dstPath)
-				if err := os.RemoveAll(dstPath); err != nil {
-					log.Printf("ディレクトリ削除エラー: %s, %v", dstPath, err)
-					errors++
-				} else {
-					deletedDirs++
-				}
-				return filepath.SkipDir // サブディレクトリもスキップ
-			}
-		} else {
-			// ファイルの場合
-			shouldDelete := false
-
-			// ソース側に対応するファイルが存在しない場合は削除
-			if _, err := os.Stat(srcPath); os.IsNotExist(err) {
-				shouldDelete = true
-				log.Printf("ソース側に存在しないファイルを削除: %s", dstPath)
-			} else {
-				// ソース側にファイルが存在する場合、拡張子をチェック
-				if len(cfg.Extensions) > 0 {
-					matched := false
-					fileName := strings.ToLower(filepath.Base(dstPath))
-					
-					for _, allowedExt := range cfg.Extensions {
-						allowedExt = strings.ToLower(allowedExt)
-						if strings.HasSuffix(fileName, allowedExt) {
-							matched = true
-							break
-						}
-					}
-					
-					if !matched {
-						ext := strings.ToLower(filepath.Ext(dstPath))
-						log.Printf("対象外拡張子のファイルを削除: %s (拡張子: %s)", dstPath, ext)
-						shouldDelete = true
-					}
-				}
-			}
-
-			if shouldDelete {
-				if err := os.Remove(dstPath); err != nil {
-					log.Printf("ファイル削除エラー: %s, %v", dstPath, err)
-					errors++
-				} else {
-					deletedFiles++
-				}
-			} else {
-				skippedFiles++
-			}
-		}
-
-		return nil
-	})
-
-	if err != nil {
-		log.Printf("ディレクトリ走査でエラー: %v", err)
-		return false
-	}
-
-	log.Printf("クリーンアップ完了: 削除ファイル数=%d, 削除ディレクトリ数=%d, スキップ=%d, エラー=%d", 
-		deletedFiles, deletedDirs, skippedFiles, errors)
-
-	// エラーがあっても部分的に成功していれば成功とみなす
-	return errors < (deletedFiles + deletedDirs + skippedFiles)
-}
-
-// logRobocopyOutput はrobocopyの出力を解析してログに記録します。
-func logRobocopyOutput(output string) {
-	if len(output) == 0 {
-		log.Printf("robocopy 出力: (出力なし)")
-		return
-	}
-
-	lines := strings.Split(output, "\n")
-	var summaryLines []string
-	var importantLines []string
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-
-		// 統計情報やサマリーを抽出
-		if strings.Contains(line, "Files :") ||
-			strings.Contains(line, "Dirs :") ||
-			strings.Contains(line, "Bytes :") ||
-			strings.Contains(line, "Times :") ||
-			strings.Contains(line, "Speed :") ||
-			strings.Contains(line, "Ended :") ||
-			strings.Contains(line, "Total") ||
-			strings.Contains(line, "Copied") ||
-			strings.Contains(line, "Skipped") {
-			summaryLines = append(summaryLines, line)
-		} else if strings.Contains(line, "ERROR") ||
-			strings.Contains(line, "WARN") ||
-			strings.Contains(line, "FAIL") {
-			importantLines = append(importantLines, line)
-		}
-	}
-
-	// 重要な情報（エラーなど）があれば優先して表示
-	if len(importantLines) > 0 {
-		log.Printf("robocopy 重要な出力:")
-		for _, line := range importantLines {
-			log.Printf("  %s", line)
-		}
-	}
-
-	// サマリー情報があれば表示
-	if len(summaryLines) > 0 {
-		log.Printf("robocopy サマリー:")
-		for _, line := range summaryLines {
-			log.Printf("  %s", line)
-		}
-	} else {
-		// サマリーがない場合は意味のある出力のみ表示
-		log.Printf("robocopy 出力:")
-		count := 0
-		for _, line := range lines {
-			line = strings.TrimSpace(line)
-			if line != "" && shouldShowRobocopyLine(line) {
-				log.Printf("  %s", line)
-				count++
-			}
-		}
-		if count == 0 {
-			log.Printf("  (変化なし - コピー・削除されたファイルはありません)")
-		}
-	}
-}
-
-// shouldShowRobocopyLine はrobocopyの出力行を表示すべきかどうかを判定します。
-func shouldShowRobocopyLine(line string) bool {
-	// 空行はスキップ
-	if strings.TrimSpace(line) == "" {
-		return false
-	}
-
-	// 変化なし（0のみ）の行をスキップ
-	// 例: "   0       P:\neco\.git\modules\cereal\branches\"
-	if matched, _ := regexp.MatchString(`^\s*0\s+.*\\$`, line); matched {
-		return false
-	}
-
-	// ディレクトリのみで変化がない行をスキップ
-	// 例: "   0       P:\some\directory\"
-	if matched, _ := regexp.MatchString(`^\s*0\s+[A-Za-z]:\\.*\\$`, line); matched {
-		return false
-	}
-
-	// ヘッダー情報はスキップ（既に統計で表示されるため）
-	if strings.Contains(line, "ROBOCOPY") ||
-		strings.Contains(line, "Source :") ||
-		strings.Contains(line, "Dest :") ||
-		strings.Contains(line, "Files :") ||
-		strings.Contains(line, "Options :") ||
-		strings.Contains(line, "Started :") {
-		return false
-	}
-
-	// 実際にコピーされたファイル（0以外）は表示
-	if matched, _ := regexp.MatchString(`^\s*[1-9]\d*\s+.*`, line); matched {
-		return true
-	}
-
-	// New File、Modified、Same、などの状態表示
-	if strings.Contains(line, "New File") ||
-		strings.Contains(line, "Modified") ||
-		strings.Contains(line, "Newer") ||
-		strings.Contains(line, "Older") ||
-		strings.Contains(line, "Extra File") ||
-		strings.Contains(line, "Extra Dir") ||
-		strings.Contains(line, "*EXTRA File") ||
-		strings.Contains(line, "*EXTRA Dir") {
-		return true
-	}
-
-	// エラーや警告は表示
-	if strings.Contains(line, "ERROR") ||
-		strings.Contains(line, "WARNING") ||
-		strings.Contains(line, "RETRY") ||
-		strings.Contains(line, "FAILED") {
-		return true
-	}
-
-	// その他の情報行はスキップ
-	return false
-}
-
 func main() {
 	// プログラム終了時にログファイルをクローズ
 	defer closeLogFile()
@@ -587,25 +342,29 @@ var rootCmd = &cobra.Command{
 		if args.UpdateBackup {
 			log.Printf("update-backup モード開始 - バージョン: %s", GetVersion())
 			if err := runUpdateBackup(args.ConfigPath); err != nil {
-				log.Printf("実行エラー: %v", err)
-				panic(pkgerrors.Errorf("%v", err))
+				exitWithFailure(err)
 			}
 			log.Printf("update-backup モード正常終了")
 		} else {
 			log.Printf("rotate_backup 開始 - バージョン: %s", GetVersion())
 			if err := runOneShotMode(args.ConfigPath); err != nil {
-				log.Printf("実行エラー: %v", err)
-				panic(pkgerrors.Errorf("%v", err))
+				exitWithFailure(err)
 			}
 			log.Printf("rotate_backup 正常終了")
 		}
 	},
 }
 
+// init 用のフラグ変数
+var initOpts initOptions
+
 var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "設定テンプレートを生成",
-	Long:  "設定ファイルのテンプレートを生成します。",
+	Long: `設定ファイルのテンプレートを生成します。
+--interactive を指定すると、コピー元・保存先等を対話形式で入力し、利用可能なコピー方式の検出や
+コピー元の走査による拡張子・除外ディレクトリの提案を行った設定ファイルを生成します。
+--source 等のフラグで同じ内容を非対話で指定することもできます。既存のファイルは --force 指定時のみ上書きします。`,
 	Run: func(cmd *cobra.Command, cmdArgs []string) {
 		var configPath string
 		if args.ConfigPath != "config.hjson" {
@@ -614,8 +373,8 @@ var initCmd = &cobra.Command{
 			configPath = "config.hjson"
 		}
 
-		if err := generateTemplate(configPath); err != nil {
-			panic(pkgerrors.Errorf("%v", err))
+		if err := runInit(configPath, initOpts, os.Stdin, os.Stdout); err != nil {
+			exitWithFailure(wrapFailure(FailureConfig, err))
 		}
 		fmt.Printf("設定テンプレートを生成しました: %s\n", configPath)
 	},
@@ -633,13 +392,208 @@ var daemonCmd = &cobra.Command{
 			LogLevel: logLevel,
 		}
 		if err := runDaemonMode(args.ConfigPath, daemonConfig); err != nil {
-			log.Printf("実行エラー: %v", err)
-			panic(pkgerrors.Errorf("%v", err))
+			exitWithFailure(err)
 		}
 		log.Printf("daemon モード正常終了")
 	},
 }
 
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "設定ファイルの管理",
+	Long:  "設定ファイルの検査・表示などを行います。",
+}
+
+// config show 用のフラグ変数
+var showResolved bool
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "設定ファイルを表示",
+	Long:  "設定ファイルを表示します。--resolved を指定すると include・--set・環境変数展開を適用した実効値を、各値の出所（ファイル:行）付きで表示します。",
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runConfigShow(args.ConfigPath, showResolved, args.Set); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+// config upgrade 用のフラグ変数
+var upgradeDryRun bool
+
+var configUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "設定ファイルを現在の形式に更新",
+	Long:  "旧形式の設定ファイルを現在の形式 (config_version) に更新します。コメントは可能な限り保持し、元のファイルは <設定ファイル>.v<旧バージョン>.bak に退避します。--dry-run を指定すると差分を表示するのみでファイルを変更しません。",
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runConfigUpgrade(args.ConfigPath, upgradeDryRun); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "設定ファイルを検査",
+	Long:  "設定ファイルの不明なキー・型の不一致・設定値の矛盾を検査し、すべての問題を一覧表示します。",
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runConfigValidate(args.ConfigPath); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list [スナップショット]",
+	Short: "スナップショットの一覧を表示",
+	Long: `各レベルのスナップショットを一覧表示します。
+スナップショット（名前・通し番号・パス）を指定すると、その中のファイルを展開せずに一覧表示します。`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		name := ""
+		if len(cmdArgs) > 0 {
+			name = cmdArgs[0]
+		}
+		if err := runList(args.ConfigPath, name, os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+// restore 用のフラグ変数
+var restoreOpts restoreOptions
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <スナップショット> [パス...]",
+	Short: "スナップショットからファイルを復元",
+	Long: `スナップショット（名前・通し番号・パス）から --to のディレクトリへファイルを復元します。
+パスを指定した場合はそのファイル・ディレクトリのみを復元します（アーカイブ全体は展開しません）。
+既存のファイルは --force 指定時のみ上書きします。`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runRestore(args.ConfigPath, cmdArgs[0], cmdArgs[1:], restoreOpts, os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [スナップショット]",
+	Short: "スナップショットを検証",
+	Long: `スナップショット（省略時はすべて）の内容をすべて読み出し、破損していないかを検証します。
+暗号化したスナップショットは復号して改ざん・破損を検出します。`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		name := ""
+		if len(cmdArgs) > 0 {
+			name = cmdArgs[0]
+		}
+		if err := runVerify(args.ConfigPath, name, os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "暗号化の鍵の管理",
+	Long:  "スナップショットの暗号化 (encryption) の鍵の確認・生成・更新を行います。",
+}
+
+var keyCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "鍵を確認",
+	Long:  "設定の鍵を読み込み、最新の暗号化したスナップショットを復号できるかを確認します。",
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runKeyCheck(args.ConfigPath, os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var keyGenerateCmd = &cobra.Command{
+	Use:   "generate <鍵ファイル>",
+	Short: "鍵ファイルを生成",
+	Long:  "ランダムな鍵ファイルを作成します（既存のファイルは上書きしません）。",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runKeyGenerate(cmdArgs[0], os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+// key rotate 用のフラグ変数
+var (
+	rotateNewKeyFile string
+	rotateKeyDryRun  bool
+)
+
+var keyRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "鍵を更新",
+	Long: `暗号化したすべてのスナップショットを新しい鍵で暗号化し直します。
+新しい鍵は --new-key-file または環境変数 ROTATE_BACKUP_NEW_PASSPHRASE で指定します。
+完了後に設定の鍵（encryption.key_file 等）を新しい鍵に切り替えてください。`,
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runKeyRotate(args.ConfigPath, rotateNewKeyFile, rotateKeyDryRun, os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var replicateCmd = &cobra.Command{
+	Use:   "replicate",
+	Short: "スナップショットを保存先へ複製",
+	Long: `remote.levels の各レベルのスナップショットのうち、保存先にないものをアップロードし、
+保存先の保持数を超えた古いスナップショットを削除します（バックアップ実行時と同じ処理）。
+前回中断したアップロードは続きから再開します。`,
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runReplicate(args.ConfigPath, os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "work_dir の変更を監視して backup_dir へ反映",
+	Long: `work_dir の変更を監視し（Linux は inotify、Windows は ReadDirectoryChangesW）、
+変更されたファイルのみを extensions・exclude_dirs に従って backup_dir へコピー・削除します。
+変更が落ち着いてから watch.debounce 後に反映し、取りこぼしを補うため watch.reconcile_interval ごとに全体を照合します。
+Ctrl+C で終了します。`,
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runWatch(args.ConfigPath); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var statusJSON bool
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "実行中のコピー・スナップショット保存の進捗を表示",
+	Long: `progress.status_file から、実行中（daemon を含む）の処理の進捗・速度・残り時間を表示します。`,
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runStatus(args.ConfigPath, statusJSON, os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "keep_versions によるディスク使用量の推移を見積もる",
+	Long: `現在のミラー・スナップショットのサイズとスケジュールから、各レベルが保持数に達するまでの時間と
+ディスク使用量の推移、満杯時の保存先の空き容量を見積もって表示します。`,
+	Run: func(cmd *cobra.Command, cmdArgs []string) {
+		if err := runPlan(args.ConfigPath, os.Stdout); err != nil {
+			exitWithFailure(err)
+		}
+	},
+}
+
 // DaemonCmd は常駐モード用の引数です。
 type DaemonCmd struct {
 	PIDFile  string
@@ -943,6 +897,8 @@ var autoCompletionCmd = &cobra.Command{
 func init() {
 	// ルートコマンドのフラグ
 	rootCmd.PersistentFlags().StringVarP(&args.ConfigPath, "config", "c", "config.hjson", "設定ファイルのパス")
+	rootCmd.PersistentFlags().StringArrayVar(&args.Set, "set", nil, "設定値を上書き (key=value、複数指定可。例: --set keep_versions.30m=3)")
+	rootCmd.PersistentFlags().StringSliceVar(&args.Jobs, "job", nil, "実行するジョブ名 (複数指定可。省略時は全ジョブ)")
 	rootCmd.Flags().BoolVarP(&args.UpdateBackup, "update-backup", "u", false, "コピー処理のみ実行する（ローテーション・VHDX保存なし）")
 
 	// daemonコマンドのフラグ
@@ -956,6 +912,37 @@ func init() {
 	rootCmd.AddCommand(initCmd)
 	rootCmd.AddCommand(daemonCmd)
 	rootCmd.AddCommand(autoCompletionCmd)
+	configShowCmd.Flags().BoolVar(&showResolved, "resolved", false, "include・--set・環境変数展開を適用した実効値を出所付きで表示")
+	configCmd.AddCommand(configValidateCmd)
+	initCmd.Flags().BoolVarP(&initOpts.Interactive, "interactive", "i", false, "対話形式で設定内容を入力")
+	initCmd.Flags().BoolVar(&initOpts.Force, "force", false, "既存の設定ファイルを上書き")
+	initCmd.Flags().StringVar(&initOpts.Source, "source", "", "コピー元ディレクトリ (work_dir)")
+	initCmd.Flags().StringVar(&initOpts.BackupRoot, "backup-root", "", "世代別ディレクトリ・管理ファイルの保存先ルート")
+	initCmd.Flags().StringVar(&initOpts.VHDX, "vhdx", "", "バックアップする VHDX ファイル (source_vhdx)")
+	initCmd.Flags().StringVar(&initOpts.MountDrive, "mount-drive", "", "VHDX のマウント先ドライブ (vhdx_mount_drive)")
+	initCmd.Flags().StringSliceVar(&initOpts.Extensions, "extensions", nil, "バックアップ対象の拡張子 (auto でコピー元から推定)")
+	initCmd.Flags().StringSliceVar(&initOpts.ExcludeDirs, "exclude-dirs", nil, "除外ディレクトリ (auto でコピー元から推定)")
+	initCmd.Flags().StringVar(&initOpts.Retention, "retention", "", "保持期間のプリセット (minimal/standard/long)")
+	configUpgradeCmd.Flags().BoolVar(&upgradeDryRun, "dry-run", false, "変更内容の差分を表示するのみでファイルを変更しない")
+	configCmd.AddCommand(configShowCmd)
+	configCmd.AddCommand(configUpgradeCmd)
+	rootCmd.AddCommand(configCmd)
+	restoreCmd.Flags().StringVar(&restoreOpts.To, "to", "", "復元先ディレクトリ")
+	restoreCmd.Flags().BoolVar(&restoreOpts.Force, "force", false, "既存のファイルを上書き")
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(replicateCmd)
+	rootCmd.AddCommand(watchCmd)
+	statusCmd.Flags().BoolVar(&statusJSON, "json", false, "status_file の内容を JSON のまま出力")
+	rootCmd.AddCommand(statusCmd)
+	rootCmd.AddCommand(planCmd)
+	keyRotateCmd.Flags().StringVar(&rotateNewKeyFile, "new-key-file", "", "新しい鍵ファイル")
+	keyRotateCmd.Flags().BoolVar(&rotateKeyDryRun, "dry-run", false, "再暗号化の対象を表示するのみで変更しない")
+	keyCmd.AddCommand(keyCheckCmd)
+	keyCmd.AddCommand(keyGenerateCmd)
+	keyCmd.AddCommand(keyRotateCmd)
+	rootCmd.AddCommand(keyCmd)
 }
 
 func GetFileNameWithoutExt(path string) string {
@@ -993,8 +980,8 @@ func runOneShotMode(configPath string) error {
 			fmt.Printf("既定の設定ファイルを自動生成します...\n")
 			if genErr := generateTemplate(configPath); genErr != nil {
 				fmt.Printf("設定ファイルの自動生成に失敗しました: %v\n", genErr)
-				fmt.Println("--init-config でテンプレートを生成してください。")
-				return err
+				fmt.Println("rotate_backup init でテンプレートを生成してください。")
+				return wrapFailure(FailureConfig, err)
 			}
 			fmt.Printf("設定ファイルを生成しました: %s\n", configPath)
 			fmt.Println("dry_run が true に設定されています。設定を確認後、false に変更してください。")
@@ -1002,10 +989,10 @@ func runOneShotMode(configPath string) error {
 			cfg, err = loadConfig(configPath)
 			if err != nil {
 				fmt.Printf("生成された設定ファイルの読み込みエラー: %v\n", err)
-				return err
+				return wrapFailure(FailureConfig, err)
 			}
 		} else {
-			return err
+			return wrapFailure(FailureConfig, err)
 		}
 	}
 	
@@ -1015,9 +1002,25 @@ func runOneShotMode(configPath string) error {
 	// ログ出力先を設定ファイルに基づいて切り替え
 	if err := setupLogOutput(cfg); err != nil {
 		log.Printf("ログ出力設定エラー: %v", err)
-		return fmt.Errorf("ログ出力設定エラー: %v", err)
+		return wrapFailure(FailureConfig, fmt.Errorf("ログ出力設定エラー: %v", err))
 	}
-	
+
+	// 実行するジョブを選択し、設定値の整合性を検査
+	jobs, err := prepareJobs(cfg)
+	if err != nil {
+		return reportFailure(cfg, "", err)
+	}
+
+	// throttle.low_io_priority が有効な場合はプロセスの I/O 優先度を下げる
+	lowerIOPriority(cfg)
+
+	return runJobs(cfg, jobs, func(job *BackupConfig) error {
+		return runOneShotJob(job, now)
+	})
+}
+
+// runOneShotJob は1つのジョブについて、必要であればバックアップを実行します。
+func runOneShotJob(cfg *BackupConfig, now time.Time) error {
 	// バックアップが必要かどうかを判定（重複実行防止含む）
 	shouldExecute, level, err := shouldExecuteBackup(cfg, now)
 	if err != nil {
@@ -1033,10 +1036,7 @@ func runOneShotMode(configPath string) error {
 	
 	// dry-run出力
 	if cfg.DryRun {
-		fmt.Printf("[DRY-RUN] バックアップ実行: %s\n", level)
-		fmt.Printf("[DRY-RUN] 実行時刻: %s\n", now.Format("2006-01-02 15:04:05"))
-		fmt.Printf("[DRY-RUN] バックアップレベル: %s\n", level)
-		fmt.Printf("[DRY-RUN] 保存先: %s\n", cfg.BackupDirs[level])
+		printScheduledDryRun(cfg, level, now)
 		
 		// dry-runでも最終実行時刻を記録（テスト用）
 		if err := recordLastExecution(cfg, level, now); err != nil {
@@ -1047,11 +1047,17 @@ func runOneShotMode(configPath string) error {
 	
 	// 実際のバックアップ処理を実行
 	if err := runBackupWithLevel(cfg, level); err != nil {
-		return err
+		return reportFailure(cfg, level, err)
 	}
 	
 	// 実行成功時に最終実行時刻を記録
-	return recordLastExecution(cfg, level, now)
+	if err := recordLastExecution(cfg, level, now); err != nil {
+		return err
+	}
+
+	// 保存先（remote）へ複製します（失敗してもバックアップは成功として扱う）
+	replicateAfterBackup(cfg, level)
+	return nil
 }
 
 // runDaemonMode は常駐モードでバックアップを実行します。
@@ -1067,33 +1073,54 @@ func runDaemonMode(configPath string, daemonConfig *DaemonCmd) error {
 	// 設定ファイルを読み込み
 	cfg, err := loadConfig(configPath)
 	if err != nil {
-		return err
+		return wrapFailure(FailureConfig, err)
 	}
 	
 	// ログ出力先を設定ファイルに基づいて切り替え
 	if err := setupLogOutput(cfg); err != nil {
 		log.Printf("ログ出力設定エラー: %v", err)
-		return fmt.Errorf("ログ出力設定エラー: %v", err)
+		return wrapFailure(FailureConfig, fmt.Errorf("ログ出力設定エラー: %v", err))
 	}
+
+	// 実行するジョブを選択し、設定値の整合性を検査
+	jobs, err := prepareJobs(cfg)
+	if err != nil {
+		return reportFailure(cfg, "", err)
+	}
+
+	// throttle.low_io_priority が有効な場合はプロセスの I/O 優先度を下げる
+	lowerIOPriority(cfg)
 	
 	// 無限ループでスケジュール実行
 	for {
+		// 外部ツールでログファイルが移動された場合は開き直す
+		reopenLogFileIfMoved()
+
+		// 日次ダイジェストの送信時刻を過ぎていれば送信
+		for _, job := range jobs {
+			if !job.DryRun {
+				flushNotificationDigest(job, time.Now())
+			}
+		}
+
 		now := time.Now()
 		shouldBackup, level := determineBestBackupLevel(now)
 		
 		if shouldBackup {
 			log.Printf("スケジュール実行: %s (時刻: %s)", level, now.Format("2006-01-02 15:04:05"))
 			
-			if cfg.DryRun {
-				fmt.Printf("[DRY-RUN] バックアップ実行: %s\n", level)
-				fmt.Printf("[DRY-RUN] 実行時刻: %s\n", now.Format("2006-01-02 15:04:05"))
-				fmt.Printf("[DRY-RUN] バックアップレベル: %s\n", level)
-				fmt.Printf("[DRY-RUN] 保存先: %s\n", cfg.BackupDirs[level])
-			} else {
-				if err := runBackupWithLevel(cfg, level); err != nil {
-					log.Printf("バックアップエラー: %v", err)
+			runJobs(cfg, jobs, func(job *BackupConfig) error {
+				if job.DryRun {
+					printScheduledDryRun(job, level, now)
+					return nil
 				}
-			}
+				// 失敗しても常駐は継続し、通知と記録のみ行う
+				if err := runBackupWithLevel(job, level); err != nil {
+					return reportFailure(job, level, err)
+				}
+				replicateAfterBackup(job, level)
+				return nil
+			})
 		}
 		
 		// 次のチェックまで30秒待機
@@ -1101,6 +1128,18 @@ func runDaemonMode(configPath string, daemonConfig *DaemonCmd) error {
 	}
 }
 
+// printScheduledDryRun はスケジュール実行のドライラン内容を表示します。
+func printScheduledDryRun(cfg *BackupConfig, level string, now time.Time) {
+	if cfg.JobName() != "" {
+		fmt.Printf("[DRY-RUN] ジョブ: %s\n", cfg.JobName())
+	}
+	fmt.Printf("[DRY-RUN] バックアップ実行: %s\n", level)
+	fmt.Printf("[DRY-RUN] 実行時刻: %s\n", now.Format("2006-01-02 15:04:05"))
+	fmt.Printf("[DRY-RUN] バックアップレベル: %s\n", level)
+	fmt.Printf("[DRY-RUN] 保存先: %s\n", cfg.BackupDirs[level])
+	printHooksDryRun(cfg, level)
+}
+
 // バックアップレベル決定ロジック（排他的実行）
 func determineBestBackupLevel(t time.Time) (bool, string) {
 	hour, min := t.Hour(), t.Minute()
@@ -1228,6 +1267,7 @@ func recordLastExecution(cfg *BackupConfig, level string, executionTime time.Tim
 	}
 	
 	record.LastExecutions[level] = executionTime
+	record.ConsecutiveFailures = 0
 	
 	return saveLastExecutionRecord(cfg.LastExecutionFile, record)
 }
@@ -1277,76 +1317,40 @@ func removePIDFile(pidFile string) {
 }
 
 // runBackupWithLevel は指定されたレベルでバックアップを実行します。
+// コピー後に VHDX を該当レベルのディレクトリへ保存し、保持数を超えた分を削除します。
 func runBackupWithLevel(cfg *BackupConfig, level string) error {
 	log.Printf("バックアップレベル %s で処理を開始します", level)
-	
-	// 実際のバックアップ処理をここに実装
-	// （現在は簡略化版）
-	log.Printf("バックアップレベル %s の処理が完了しました", level)
-	return nil
-}
-
-// 既存のrunBackup関数をrunBackupWithLevelに変更
-func runBackup(configPath string) error {
-	// 設定ファイルを読み込みます。
-	log.Printf("設定ファイルを読み込み中: %s", configPath)
-	cfg, err := loadConfig(configPath)
-	if err != nil {
-		// 設定ファイルが見つからない場合は自動生成を試行
-		if os.IsNotExist(err) && isDefaultConfigPath(configPath) {
-			fmt.Printf("設定ファイルが見つかりません: %s\n", configPath)
-			fmt.Printf("既定の設定ファイルを自動生成します...\n")
-			if genErr := generateTemplate(configPath); genErr != nil {
-				fmt.Printf("設定ファイルの自動生成に失敗しました: %v\n", genErr)
-				fmt.Println("--init-config でテンプレートを生成してください。")
-				return err
-			}
-			fmt.Printf("設定ファイルを生成しました: %s\n", configPath)
-			fmt.Println("dry_run が true に設定されています。設定を確認後、false に変更してください。")
-			// 生成された設定ファイルを再読み込み
-			cfg, err = loadConfig(configPath)
-			if err != nil {
-				fmt.Printf("生成された設定ファイルの読み込みエラー: %v\n", err)
-				return err
-			}
-		} else {
-			fmt.Printf("設定ファイルの読み込みエラー: %v\n", err)
-			fmt.Println("--init-config でテンプレートを生成してください。")
-			return err
-		}
-	}
-	log.Printf("設定ファイルの読み込みが完了しました")
-
-	// ログ出力先を設定ファイルに基づいて切り替え
-	if err := setupLogOutput(cfg); err != nil {
-		log.Printf("ログ出力設定エラー: %v", err)
-		return fmt.Errorf("ログ出力設定エラー: %v", err)
-	}
 
-	// dry_run フラグが true ならドライランモードで処理します。
-	if cfg.DryRun {
-		fmt.Println("=== DRY RUN MODE ===")
-		fmt.Println("実際の処理は実行せず、動作をシミュレートします。")
-		fmt.Println()
+	dir, ok := cfg.BackupDirs[level]
+	if !ok || dir == "" {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("backup_dirs にレベル %s が設定されていません", level))
 	}
 
 	// 多重実行防止のためファイルロックを取得します。
 	var lockFile *os.File
 	if cfg.EnableLock && !cfg.DryRun {
 		log.Printf("多重実行防止のためファイルロックを取得します。: %v", cfg.LockFilePath)
+		var err error
 		lockFile, err = acquireFileLock(cfg.LockFilePath)
 		if err != nil {
 			notify(cfg, NotifyLockConflict, "多重実行を検出しました。処理を終了します。", cfg.DryRun)
-			return nil
+			return wrapFailure(FailureLock, pkgerrors.Errorf("ロック取得失敗: %v", err))
 		}
 		defer releaseFileLock(lockFile)
 	}
 
-	// 全体処理開始時刻を記録します。
-	startTime := time.Now()
+	// 暗号化の鍵で既存のスナップショットを復号できるかを確認します。
+	if cfg.Encryption.Enabled {
+		if err := checkEncryptionKey(cfg); err != nil {
+			return wrapFailure(FailureConfig, err)
+		}
+	}
+
+	// 全体処理開始時刻を記録します。
+	startTime := time.Now()
 
 	// 開始通知を送信します。
-	notify(cfg, NotifyBackupStart, "バックアップを開始します", cfg.DryRun)
+	notify(cfg, NotifyBackupStart, fmt.Sprintf("バックアップ (%s) を開始します", level), cfg.DryRun)
 
 	// 通し番号を取得し増分します。
 	id, err := getNextID(cfg.LastIDFile, cfg.DryRun)
@@ -1354,24 +1358,40 @@ func runBackup(configPath string) error {
 	log.Printf("通し番号: %v", id)
 	if err != nil {
 		log.Printf("Error: ID取得失敗: %v", err)
-		return pkgerrors.Errorf("ID取得失敗: %v", err)
+		return wrapFailure(FailureSnapshot, pkgerrors.Errorf("ID取得失敗: %v", err))
 	}
+	format := cfg.snapshotFormat()
 	timeStamp := time.Now().Format("20060102_1504")
-	filename := fmt.Sprintf("%06d_%s.vhdx", id, timeStamp)
+	filename := snapshotName(format, id, timeStamp)
+	if cfg.Encryption.Enabled {
+		filename += encryptedExt
+	}
 	log.Printf("作成予定のバックアップ: %v", filename)
 
 	if cfg.DryRun {
 		fmt.Printf("生成予定ファイル名: %s\n", filename)
 	}
 
-	// VHDX が未マウントであればマウントします。
-	if cfg.MountIfMissing && !isDriveMounted(cfg.VHDXMountDrive) {
-		if err := mountVHDX(cfg.SourceVHDX, cfg.VHDXMountDrive, cfg.DryRun); err != nil {
-			log.Printf("VHDXマウント失敗: %v", err)
-			return pkgerrors.Errorf("VHDXマウント失敗: %v", err)
-		}
-	} else if cfg.DryRun {
-		fmt.Printf("VHDXマウント状態: %s は既にマウント済み\n", cfg.VHDXMountDrive)
+	// フックに渡す実行情報
+	hookCtx := HookContext{
+		Level:        level,
+		SnapshotPath: filepath.Join(dir, filename),
+		ID:           id,
+		DryRun:       cfg.DryRun,
+	}
+	if err := runHooks(cfg, HookPreBackup, hookCtx); err != nil {
+		return err
+	}
+
+	// コピー前の準備を行います（VHDX が未マウントであればマウントします）。
+	if err := format.Prepare(cfg); err != nil {
+		return err
+	}
+	defer releaseVHDX(cfg)
+
+	// 保存先の空き容量を確認します（不足する場合は古いスナップショットを削除するか中止します）。
+	if err := checkDiskSpace(cfg, level, format); err != nil {
+		return err
 	}
 
 	// コピー処理開始時刻を記録します。
@@ -1381,52 +1401,60 @@ func runBackup(configPath string) error {
 	if !cfg.DryRun {
 		log.Printf("バックアップ処理開始: %s → %s", cfg.WorkDir, cfg.BackupDir)
 	}
-	if err := tryCopy(cfg, cfg.WorkDir, cfg.BackupDir, cfg.DryRun); err != nil {
+	if err := copySource(cfg, cfg.WorkDir, cfg.BackupDir, cfg.DryRun); err != nil {
 		if !cfg.DryRun {
 			log.Printf("コピー処理でエラーが発生しました: %v", err)
 		}
-		return pkgerrors.Errorf("コピー失敗: %v", err)
+		return wrapFailure(FailureCopy, pkgerrors.Errorf("コピー失敗: %v", err))
 	}
 	if !cfg.DryRun {
 		log.Printf("コピー処理が正常に完了しました")
 	}
 	copyDur := time.Since(copyStart)
+	if err := runHooks(cfg, HookPostCopy, hookCtx); err != nil {
+		return err
+	}
 
-	// ローテーション処理: 新しいファイルを保存する前に昇格・削除処理を実行
-	levels := []string{"30m", "3h", "6h", "12h", "1d"}
+	// レベル別ディレクトリにスナップショットを保存します。
+	if !cfg.DryRun {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return wrapFailure(FailureSnapshot, pkgerrors.Errorf("バックアップ保存失敗: %v", err))
+		}
+	}
+	if err := createSnapshot(cfg, format, filepath.Join(dir, filename)); err != nil {
+		return wrapFailure(FailureSnapshot, pkgerrors.Errorf("バックアップ保存失敗: %v", err))
+	}
+	if err := runHooks(cfg, HookPostSnapshot, hookCtx); err != nil {
+		return err
+	}
+
+	// 保持数を超えた最古のバックアップを上位レベルへ昇格し、残りの超過分を削除します。
 	if cfg.DryRun {
 		fmt.Println("ローテーション処理:")
 	}
-	
-	// まず昇格処理を実行（新しいファイル保存前に行うことが重要）
+	levels := promotionLevels(cfg, level)
 	promoteBackup(cfg, levels, cfg.DryRun)
-	
-	// その後、各レベルで上限超過分を削除
 	for _, lvl := range levels {
 		if err := rotateBackupsWithPromotion(cfg, lvl, cfg.DryRun); err != nil {
-			if !cfg.DryRun {
-				log.Println("rotate error:", lvl, err)
-			}
+			return wrapFailure(FailureRotate, pkgerrors.Errorf("ローテーション失敗 (%s): %v", lvl, err))
 		}
 	}
-
-	// 30分バックアップ用ディレクトリに VHDX を保存します。
-	if err := saveBackup(cfg.BackupDirs["30m"], filename, cfg.SourceVHDX, cfg.DryRun); err != nil {
-		return pkgerrors.Errorf("バックアップ保存失敗: %v", err)
+	if err := runHooks(cfg, HookPostRotate, hookCtx); err != nil {
+		return err
 	}
 
 	// 処理時間をパフォーマンスログに記録します。
 	logPerformance(cfg.PerfLogPath, startTime, copyDur, time.Since(startTime)-copyDur, cfg.DryRun)
 
 	// 完了通知を送信します。
-	notify(cfg, NotifyBackupEnd, "バックアップ完了: "+filename, cfg.DryRun)
-
-	if cfg.DryRun {
-		fmt.Println()
-		fmt.Println("=== DRY RUN 完了 ===")
-		fmt.Println("実際に処理を実行するには、設定ファイルの dry_run を false に変更してください。")
-	}
+	endEvent := newNotificationEvent(NotifyBackupEnd, "バックアップ完了: "+filename)
+	endEvent.Level = level
+	endEvent.Filename = filename
+	endEvent.CopyDuration = copyDur
+	endEvent.TotalDuration = time.Since(startTime)
+	notifyEvent(cfg, endEvent, cfg.DryRun)
 
+	log.Printf("バックアップレベル %s の処理が完了しました", level)
 	return nil
 }
 
@@ -1442,8 +1470,8 @@ func runUpdateBackup(configPath string) error {
 			fmt.Printf("既定の設定ファイルを自動生成します...\n")
 			if genErr := generateTemplate(configPath); genErr != nil {
 				fmt.Printf("設定ファイルの自動生成に失敗しました: %v\n", genErr)
-				fmt.Println("--init-config でテンプレートを生成してください。")
-				return err
+				fmt.Println("rotate_backup init でテンプレートを生成してください。")
+				return wrapFailure(FailureConfig, err)
 			}
 			fmt.Printf("設定ファイルを生成しました: %s\n", configPath)
 			fmt.Println("dry_run が true に設定されています。設定を確認後、false に変更してください。")
@@ -1451,12 +1479,12 @@ func runUpdateBackup(configPath string) error {
 			cfg, err = loadConfig(configPath)
 			if err != nil {
 				fmt.Printf("生成された設定ファイルの読み込みエラー: %v\n", err)
-				return err
+				return wrapFailure(FailureConfig, err)
 			}
 		} else {
 			fmt.Printf("設定ファイルの読み込みエラー: %v\n", err)
-			fmt.Println("--init-config でテンプレートを生成してください。")
-			return err
+			fmt.Println("rotate_backup init でテンプレートを生成してください。")
+			return wrapFailure(FailureConfig, err)
 		}
 	}
 	log.Printf("設定ファイルの読み込みが完了しました")
@@ -1464,9 +1492,18 @@ func runUpdateBackup(configPath string) error {
 	// ログ出力先を設定ファイルに基づいて切り替え
 	if err := setupLogOutput(cfg); err != nil {
 		log.Printf("ログ出力設定エラー: %v", err)
-		return fmt.Errorf("ログ出力設定エラー: %v", err)
+		return wrapFailure(FailureConfig, fmt.Errorf("ログ出力設定エラー: %v", err))
+	}
+
+	// 実行するジョブを選択し、設定値の整合性を検査
+	jobs, err := prepareJobs(cfg)
+	if err != nil {
+		return reportFailure(cfg, "", err)
 	}
 
+	// throttle.low_io_priority が有効な場合はプロセスの I/O 優先度を下げる
+	lowerIOPriority(cfg)
+
 	// dry_run フラグが true ならドライランモードで処理します。
 	if cfg.DryRun {
 		fmt.Println("=== DRY RUN MODE (UPDATE-BACKUP) ===")
@@ -1474,22 +1511,38 @@ func runUpdateBackup(configPath string) error {
 		fmt.Println()
 	}
 
+	if err := runJobs(cfg, jobs, runUpdateJob); err != nil {
+		return err
+	}
+
+	if cfg.DryRun {
+		fmt.Println()
+		fmt.Println("=== DRY RUN 完了 (UPDATE-BACKUP) ===")
+		fmt.Println("実際に処理を実行するには、設定ファイルの dry_run を false に変更してください。")
+	}
+
+	return nil
+}
+
+// runUpdateJob は1つのジョブについてコピー処理のみを実行します。
+func runUpdateJob(cfg *BackupConfig) error {
 	// 全体処理開始時刻を記録します。
 	startTime := time.Now()
 
 	// 開始通知を送信します。
 	notify(cfg, NotifyBackupStart, "バックアップ更新を開始します", cfg.DryRun)
 
-	// VHDX が未マウントであればマウントします。
-	if cfg.MountIfMissing && !isDriveMounted(cfg.VHDXMountDrive) {
-		if err := mountVHDX(cfg.SourceVHDX, cfg.VHDXMountDrive, cfg.DryRun); err != nil {
-			log.Printf("VHDXマウント失敗: %v", err)
-			return pkgerrors.Errorf("VHDXマウント失敗: %v", err)
-		}
-	} else if cfg.DryRun {
-		fmt.Printf("VHDXマウント状態: %s は既にマウント済み\n", cfg.VHDXMountDrive)
+	hookCtx := HookContext{DryRun: cfg.DryRun}
+	if err := runHooks(cfg, HookPreBackup, hookCtx); err != nil {
+		return reportFailure(cfg, "", err)
 	}
 
+	// コピー前の準備を行います（VHDX が未マウントであればマウントします）。
+	if err := cfg.snapshotFormat().Prepare(cfg); err != nil {
+		return reportFailure(cfg, "", err)
+	}
+	defer releaseVHDX(cfg)
+
 	// コピー処理開始時刻を記録します。
 	copyStart := time.Now()
 
@@ -1497,29 +1550,28 @@ func runUpdateBackup(configPath string) error {
 	if !cfg.DryRun {
 		log.Printf("バックアップ処理開始 (update-backup): %s → %s", cfg.WorkDir, cfg.BackupDir)
 	}
-	if err := tryCopy(cfg, cfg.WorkDir, cfg.BackupDir, cfg.DryRun); err != nil {
+	if err := copySource(cfg, cfg.WorkDir, cfg.BackupDir, cfg.DryRun); err != nil {
 		if !cfg.DryRun {
 			log.Printf("コピー処理でエラーが発生しました: %v", err)
 		}
-		return pkgerrors.Errorf("コピー失敗: %v", err)
+		return reportFailure(cfg, "", wrapFailure(FailureCopy, pkgerrors.Errorf("コピー失敗: %v", err)))
 	}
 	if !cfg.DryRun {
 		log.Printf("コピー処理が正常に完了しました")
 	}
 	copyDur := time.Since(copyStart)
+	if err := runHooks(cfg, HookPostCopy, hookCtx); err != nil {
+		return reportFailure(cfg, "", err)
+	}
 
 	// 処理時間をパフォーマンスログに記録します。
 	logPerformance(cfg.PerfLogPath, startTime, copyDur, 0, cfg.DryRun) // ローテーション時間は0
 
 	// 完了通知を送信します。
-	notify(cfg, NotifyUpdateEnd, "バックアップ更新完了 (update-backup)", cfg.DryRun)
-
-	if cfg.DryRun {
-		fmt.Println()
-		fmt.Println("=== DRY RUN 完了 (UPDATE-BACKUP) ===")
-		fmt.Println("実際に処理を実行するには、設定ファイルの dry_run を false に変更してください。")
-	}
-
+	endEvent := newNotificationEvent(NotifyUpdateEnd, "バックアップ更新完了 (update-backup)")
+	endEvent.CopyDuration = copyDur
+	endEvent.TotalDuration = time.Since(startTime)
+	notifyEvent(cfg, endEvent, cfg.DryRun)
 	return nil
 }
 
@@ -1528,7 +1580,12 @@ func generateTemplate(destPath string) error {
 	if destPath == "" {
 		destPath = "config.hjson"
 	}
-	template := `{
+	return ioutil.WriteFile(destPath, []byte(configTemplate()), 0644)
+}
+
+// configTemplate は設定ファイルのテンプレートを返します。
+func configTemplate() string {
+	return `{
 // ========================================
 // 🔄 VHDX Backup Rotation Tool 設定ファイル
 // ========================================
@@ -1536,6 +1593,21 @@ func generateTemplate(destPath string) error {
 // 設定を変更した後は、dry_run を false にして実行してください。
 // 詳細なドキュメントは readme.md を参照してください。
 
+// config_version: 設定ファイルの形式のバージョン（変更しないでください）
+// 旧形式の設定ファイルは rotate_backup.exe config upgrade で更新できます。
+config_version: 2
+
+// ========================================
+// 🧩 共通設定の取り込み・環境変数
+// ========================================
+// include: 共通設定ファイルを取り込みます（このファイルからの相対パス）
+// 取り込んだファイルを列挙順に適用し、このファイルの値で上書きします。
+// オブジェクトはキーごとにマージ、配列と値は丸ごと置き換えます。
+// 文字列値では ${VAR} / ${VAR:-既定値} で環境変数を展開できます。
+// 例: include: ["common.hjson"]
+//     work_dir: "${WORK_DRIVE:-P:}/"
+// 実効値の確認: rotate_backup.exe config show --resolved
+
 // ========================================
 // 🎯 実行モード設定
 // ========================================
@@ -1551,8 +1623,9 @@ dry_run: true
 // 1. robocopy: 高速・高機能、拡張子フィルタ時は2段階実行（コピー→削除）
 // 2. xcopy: Windows標準、安定性重視、個別ファイルコピー対応
 // 3. copy-item: PowerShell、柔軟性が高い、スクリプト処理
-// 4. native: Go言語内蔵、クロスプラットフォーム、最終手段
-copy_method_priority: ["robocopy","xcopy","copy-item","native"]
+// 4. rsync: Linux・WSL、差分転送・--delete でミラーリング（Windows では使用しません）
+// 5. native: Go言語内蔵、クロスプラットフォーム、最終手段
+copy_method_priority: ["robocopy","xcopy","copy-item","rsync","native"]
 
 // copy_args: 各コピー方式の引数
 copy_args: {
@@ -1562,6 +1635,8 @@ copy_args: {
 	xcopy: "/E /Y /D /H"
 	// copy-item: PowerShell、再帰、強制上書き
 	copy-item: "-Recurse -Force"
+	// rsync: アーカイブモード、コピー元にないファイルを削除
+	rsync: "-a --delete"
 	// native: Go言語内蔵（引数なし）
 	native: ""
 }
@@ -1573,14 +1648,67 @@ copy_args: {
 work_dir: "P:/"
 // backup_dir: コピー先（バックアップの保存先）
 backup_dir: "Q:/"
-// source_vhdx: バックアップするVHDXファイル
+// source_vhdx: バックアップするVHDXファイル（snapshot_format が vhdx の場合のみ使用）
 source_vhdx: "C:/Backups/backup.vhdx"
+// snapshot_format: 各レベルに保存するスナップショットの形式
+//   vhdx      : source_vhdx のファイルをコピー（既定）
+//   directory : backup_dir をタイムスタンプ付きのディレクトリへ複製
+//   hardlink  : directory と同じだが、変更のないファイルは前回のスナップショットからハードリンク
+//   archive   : work_dir を拡張子・除外設定で絞り込んだファイルを圧縮アーカイブに保存
+// VHDX を使用しない環境（Linux 等）では directory / hardlink / archive を指定します
+snapshot_format: "vhdx"
+// hardlink_compare: hardlink 形式で前回のスナップショットから変更がないと判定する方法
+//   mtime : サイズと更新日時が同じ（既定）
+//   hash  : サイズと内容（SHA-256）が同じ。更新日時を保持しないコピー方式向け（低速）
+hardlink_compare: "mtime"
+// archive_format: archive 形式の圧縮形式
+//   zip     : 目次を持つため一部のファイルの復元が速い（既定）
+//   tar.zst : zip より高速・高圧縮（一覧・復元はアーカイブを先頭から読み進める）
+archive_format: "zip"
+// compression_level: 圧縮レベル（0 で既定値。zip は 1〜9、tar.zst は 1〜22）
+compression_level: 0
+// encryption: スナップショットの暗号化（vhdx・archive 形式のみ。AES-256-GCM）
+//   enabled  : true で暗号化（ファイル名の末尾に .enc が付きます）
+//   key_file : 鍵ファイル（rotate_backup key generate で作成）。
+//              空の場合は環境変数 ROTATE_BACKUP_KEY_FILE・ROTATE_BACKUP_PASSPHRASE を使用
+encryption: {
+  enabled: false
+  key_file: ""
+}
+// remote: スナップショットの複製先（vhdx・archive 形式のみ。type が空の場合は複製しない）
+//   type              : local（ネットワークドライブ等）/ sftp / s3（S3 互換ストレージ）
+//   path              : 保存先のディレクトリ（s3 はキーの接頭辞）。<path>/<レベル>/ に保存
+//   host, user        : sftp のサーバ（ホスト名[:ポート]）とユーザー名
+//   key_file          : sftp の秘密鍵（空の場合は環境変数 ROTATE_BACKUP_SFTP_PASSWORD）
+//   known_hosts_file  : sftp のホスト鍵の検証に使用（空の場合は ~/.ssh/known_hosts）
+//   endpoint, bucket, region : s3 の接続先（認証情報は環境変数 AWS_ACCESS_KEY_ID・AWS_SECRET_ACCESS_KEY）
+//   levels            : 複製するレベル
+//   keep_versions     : 保存先での保持数（省略したレベルは keep_versions と同じ）
+//   max_bytes_per_sec : 転送速度の上限（0 で無制限）
+remote: {
+  type: ""
+  path: ""
+  host: ""
+  user: ""
+  key_file: ""
+  known_hosts_file: ""
+  endpoint: ""
+  bucket: ""
+  region: ""
+  levels: ["1d", "1w"]
+  keep_versions: {}
+  max_bytes_per_sec: 0
+}
 // last_id_file: 通し番号管理ファイル（6桁の連番生成）
 last_id_file: "C:/Backups/last_id.txt"
 // vhdx_mount_drive: VHDXをマウントするドライブレター
 vhdx_mount_drive: "Q:"
 // mount_vhdx_if_missing: VHDXが未マウントの場合に自動マウント
 mount_vhdx_if_missing: true
+// vhdx_read_only_snapshot: VHDX の保存中は読み取り専用でマウントし直す（保存中の書き込みを防ぐ）
+vhdx_read_only_snapshot: false
+// keep_vhdx_mounted: 自動マウントした VHDX を終了後もマウントしたままにする（false で終了時に解除）
+keep_vhdx_mounted: false
 
 // ========================================
 // 📊 多段階ローテーション設定
@@ -1628,6 +1756,65 @@ include_files: [
 	"P:/config/settings.ini"
 ]
 
+// watch: rotate_backup watch（変更を監視して backup_dir へ反映）の設定
+//   debounce           : 最後の変更から反映するまでの待ち時間（変更が続く場合も10倍の時間で反映）
+//   reconcile_interval : 取りこぼしを補うため work_dir 全体を照合する間隔
+watch: {
+	debounce: "2s"
+	reconcile_interval: "30m"
+}
+
+// progress: コピー・スナップショット保存の進捗（完了量・速度・残り時間）の表示
+//   mode         : auto（端末ならプログレスバー、それ以外はログ）/ bar / log / off
+//   log_interval : log で進捗を出力する間隔
+//   status_file  : 実行中の進捗を書き出す JSON ファイル（rotate_backup status で表示。空の場合は書き出さない）
+progress: {
+	mode: "auto"
+	log_interval: "30s"
+	status_file: ""
+}
+
+// throttle: コピー・スナップショット保存・複製の転送速度の上限（開発作業中のディスクの引っかかりを抑える）
+//   max_bytes_per_sec            : 転送速度の上限[バイト/秒]（0で無制限）
+//   work_hours                   : 作業時間帯（"HH:MM-HH:MM"、空の場合は区別しない）
+//   work_days                    : 作業時間帯を適用する曜日（mon〜sun、省略時は mon〜fri）
+//   work_hours_max_bytes_per_sec : 作業時間帯の転送速度の上限（0で max_bytes_per_sec と同じ）
+//   low_io_priority              : プロセスの I/O 優先度を下げる
+//   ※ robocopy は /IPG（64KiB ごとの待ち時間）、rsync は --bwlimit に変換します。xcopy・PowerShell は制限できません
+throttle: {
+	max_bytes_per_sec: 0
+	work_hours: ""
+	work_days: ["mon", "tue", "wed", "thu", "fri"]
+	work_hours_max_bytes_per_sec: 0
+	low_io_priority: false
+}
+
+// disk_space: スナップショット作成前の空き容量の確認（rotate_backup plan で使用量の推移を見積もれます）
+//   min_free_space_mb : ミラーの更新・スナップショットの保存後も残す空き容量[MB]（0で確認のみ）
+//   on_low_space      : 不足時の動作 abort（中止してエラー通知）/ prune（古いスナップショットを削除して続行）
+//   min_keep_versions : prune でも残すレベルごとの数（省略したレベルは 1）
+disk_space: {
+	min_free_space_mb: 1024
+	on_low_space: "abort"
+	min_keep_versions: {}
+}
+
+// source_snapshot: コピー中に work_dir が書き換えられても一貫した内容をミラーへ反映する
+//   method       : none（固定しない）/ vss（Windows、管理者権限が必要）/ btrfs / lvm（Linux、root 権限が必要）
+//                  / copy_twice（コピー前後を比較し、変更があればコピーし直す）
+//   snapshot_dir : btrfs はスナップショットの作成先（省略時はサブボリューム内の .rotate_backup_snapshots）、
+//                  vss・lvm はマウント・リンクの作成先（省略時は一時ディレクトリ）
+//   lvm_size     : lvm のスナップショットの変更を記録する領域のサイズ
+//   max_retries  : copy_twice で変更を検出した場合にコピーし直す回数
+//   on_failure   : 固定に失敗した場合の動作 abort（中止）/ warn（work_dir から直接コピー）
+source_snapshot: {
+	method: "none"
+	snapshot_dir: ""
+	lvm_size: "1G"
+	max_retries: 2
+	on_failure: "abort"
+}
+
 // ========================================
 // 🔔 通知システム設定
 // ========================================
@@ -1641,6 +1828,38 @@ notifications: {
 	error: true            // エラー発生時（重要・推奨ON）
 }
 
+// notifiers: 通知先一覧（省略時は Windows トースト通知のみ）
+// type: toast / webhook / slack / email / notify-send / command
+// events: 送信する通知種別（省略時は上記 notifications 設定に従う）
+// timeout_sec: 送信のタイムアウト秒数（既定 30。webhook / slack / email / notify-send / command）
+// 例:
+// notifiers: [
+//	{ type: "toast" }
+//	{ type: "slack", url: "https://hooks.slack.com/services/XXX", events: ["error", "lock_conflict"] }
+//	{ type: "webhook", url: "http://monitor.local/hook", headers: { Authorization: "Bearer TOKEN" } }
+//	{ type: "email", smtp_host: "smtp.example.com", smtp_port: 587, username: "user", password: "pass",
+//	  from: "backup@example.com", to: ["admin@example.com"], events: ["error"] }
+//	{ type: "notify-send" }
+//	{ type: "command", command: "/usr/local/bin/backup-hook", args: ["--notify"] }
+// ]
+
+// notification_policy: 通知の抑制・集約・テンプレート
+notification_policy: {
+	// rate_limits: 通知種別ごとの最小送信間隔（30分間隔の完了通知を3時間に1回に抑える等）
+	rate_limits: { backup_end: "3h" }
+	// dedup_window: 同一エラーの再送を抑制する期間
+	dedup_window: "1h"
+	// recovery: 失敗後に成功した場合に復旧通知（recovered）を送信
+	recovery: true
+	// daily_digest: 1日分の実行結果をまとめて通知（digest）
+	daily_digest: { enabled: false, time: "09:00" }
+	// templates: Go テンプレートによるメッセージ（.Level .Filename .CopyDuration .TotalDuration .Error .Hostname 等）
+	// templates: { backup_end: "{{.Level}} 完了: {{.Filename}} ({{.TotalDuration}})" }
+	templates: {}
+	// state_file: 抑制・集約の状態保存先（定期起動モードでは設定推奨）
+	state_file: "C:/Backups/notification_state.json"
+}
+
 // ========================================
 // 📝 ログ・パフォーマンス記録設定
 // ========================================
@@ -1650,6 +1869,16 @@ log_file: "C:/Backups/log.txt"
 // 列: 実行日時, UNIXミリ秒, 全体処理時間(ms), コピー時間(ms), ローテーション時間(ms)
 perf_log_path: "C:/Backups/perf.tsv"
 
+// ログローテーション設定
+// log_max_size_mb: ログファイルがこのサイズ(MB)を超えたらローテーション（0で無効）
+log_max_size_mb: 10
+// log_rotate_daily: 日付が変わったらローテーション
+log_rotate_daily: true
+// log_compress: ローテーション済みログをgzip圧縮（log.20250701-000000.txt.gz）
+log_compress: true
+// max_log_files: 保持するローテーション済みログ数（0で無制限）
+max_log_files: 14
+
 // ========================================
 // 🔒 多重実行防止
 // ========================================
@@ -1667,6 +1896,41 @@ on_lock_conflict: "notify-exit"
 // 同一分内での重複実行を防止します
 last_execution_file: "C:/Backups/last_execution.json"
 
+// ========================================
+// 🪝 フック
+// ========================================
+// hooks: バックアップ各フェーズで実行するコマンド
+// フェーズ: pre_backup / post_copy / post_snapshot / post_rotate / on_error
+// 各フックの設定:
+//   command: 実行するコマンド（args 省略時はシェル経由: Windows は cmd /C、その他は sh -c）
+//   args: 引数の配列
+//   timeout: タイムアウト（既定 10m）
+//   on_failure: "abort"（既定、バックアップを中断）または "warn"（警告のみ）
+// 環境変数: ROTATE_BACKUP_PHASE, ROTATE_BACKUP_LEVEL, ROTATE_BACKUP_SNAPSHOT,
+//           ROTATE_BACKUP_ID, ROTATE_BACKUP_DRY_RUN, ROTATE_BACKUP_JOB,
+//           ROTATE_BACKUP_ERROR（on_error のみ）
+// dry_run 時は実行せずコマンドを表示します。
+hooks: {
+	// pre_backup: [ { command: "C:/Tools/flush_db.bat", timeout: "2m" } ]
+	// post_snapshot: [ { command: "C:/Tools/upload.bat", on_failure: "warn" } ]
+	// on_error: [ { command: "C:/Tools/report.bat" } ]
+}
+
+// ========================================
+// 🗂️ 複数ジョブ
+// ========================================
+// jobs: 1つの設定ファイルで複数のバックアップを実行します（省略時はこのファイル全体が1ジョブ）
+// 各ジョブは name 以外はトップレベルと同じキーを指定でき、省略したキーはトップレベルの値を継承します。
+// last_id_file / lock_file_path / last_execution_file / notification_policy.state_file は
+// ジョブで指定しない場合、ファイル名にジョブ名を付けて分離します（backup.lock → backup.src.lock）。
+// 一部のジョブのみ実行: rotate_backup.exe --job src
+// jobs: [
+//   { name: "src", work_dir: "P:/src", backup_dir: "C:/Backups/src/mirror" }
+//   { name: "docs", work_dir: "P:/docs", extensions: [".md"], backup_dir: "C:/Backups/docs/mirror" }
+// ]
+// max_concurrent_jobs: 同時に実行するジョブ数（0 または 1 で設定順に1件ずつ）
+max_concurrent_jobs: 1
+
 // ========================================
 // 📋 使用例・Tips
 // ========================================
@@ -1688,7 +1952,6 @@ last_execution_file: "C:/Backups/last_execution.json"
 // 詳細なドキュメント: readme.md
 
 }`
-	return ioutil.WriteFile(destPath, []byte(template), 0644)
 }
 
 // isDefaultConfigPath は指定されたパスがデフォルトの設定ファイルパスかどうかを判定します。
@@ -1717,20 +1980,34 @@ func isDefaultConfigPath(configPath string) bool {
 }
 
 // loadConfig は HJSON 設定を読み込み BackupConfig を返します。
+// include・--set・環境変数展開を適用します（適用順は resolvedConfig を参照）。
+// 不明なキー・未定義の環境変数・型の不一致がある場合は行番号付きの ConfigValidationError を返します。
 func loadConfig(path string) (*BackupConfig, error) {
-	data, err := ioutil.ReadFile(path)
+	return decodeConfig(path, true)
+}
+
+// loadConfigLenient は不明なキーを無視して設定ファイルを読み込みます（config validate 用）。
+func loadConfigLenient(path string) (*BackupConfig, error) {
+	return decodeConfig(path, false)
+}
+
+func decodeConfig(path string, strict bool) (*BackupConfig, error) {
+	// include・--set・環境変数展開を適用
+	resolved, err := resolveConfig(path, args.Set)
 	if err != nil {
 		return nil, err
 	}
 
-	// HJSON を JSON に変換
-	var jsonData interface{}
-	if err := hjson.Unmarshal(data, &jsonData); err != nil {
-		return nil, pkgerrors.Errorf("HJSON parse error: %v", err)
+	// 未定義のキーと環境変数を検出（誤字の設定が黙って無視されるのを防ぐ）
+	if strict {
+		problems := append(checkUnknownKeys(resolved.tree, resolved), resolved.envProblems...)
+		if len(problems) > 0 {
+			return nil, &ConfigValidationError{Path: path, Problems: problems}
+		}
 	}
 
 	// JSON データを再エンコード
-	jsonBytes, err := json.Marshal(jsonData)
+	jsonBytes, err := json.Marshal(resolved.tree)
 	if err != nil {
 		return nil, pkgerrors.Errorf("JSON marshal error: %v", err)
 	}
@@ -1738,8 +2015,19 @@ func loadConfig(path string) (*BackupConfig, error) {
 	// 標準の JSON として構造体にデコード
 	var cfg BackupConfig
 	if err := json.Unmarshal(jsonBytes, &cfg); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			return nil, &ConfigValidationError{Path: path, Problems: []ConfigProblem{typeErrorProblem(typeErr, resolved)}}
+		}
 		return nil, pkgerrors.Errorf("struct unmarshal error: %v", err)
 	}
+	cfg.source = resolved
+
+	// 各ジョブの実効設定を作成
+	jobs, err := buildJobConfigs(resolved)
+	if err != nil {
+		return nil, err
+	}
+	cfg.jobs = jobs
 	return &cfg, nil
 }
 
@@ -1783,611 +2071,10 @@ func getNextID(path string, dryRun bool) (int, error) {
 	return id, nil
 }
 
-// isCommandAvailable はコマンドが利用可能かチェックします。
-func isCommandAvailable(command string) bool {
-	switch command {
-	case "robocopy":
-		_, err := exec.LookPath("robocopy")
-		return err == nil
-	case "xcopy":
-		_, err := exec.LookPath("xcopy")
-		return err == nil
-	case "copy-item":
-		_, err := exec.LookPath("powershell")
-		return err == nil
-	case "native":
-		return true // native は常に利用可能
-	default:
-		return false
-	}
-}
-
-// ensureAllCopyMethods は設定されていないコピー方式を末尾に追加します。
-func ensureAllCopyMethods(priority []string) []string {
-	defaultMethods := []string{"robocopy", "xcopy", "copy-item", "native"}
-	
-	// 既に設定されている方式を記録
-	existing := make(map[string]bool)
-	for _, method := range priority {
-		existing[method] = true
-	}
-	
-	// 設定されていない方式を末尾に追加
-	result := append([]string{}, priority...)
-	for _, method := range defaultMethods {
-		if !existing[method] {
-			result = append(result, method)
-		}
-	}
-	
-	return result
-}
-
-// tryCopy は設定の優先順で最初に利用可能なコマンドを使用してコピーします。
-func tryCopy(cfg *BackupConfig, src, dst string, dryRun bool) error {
-	if dryRun {
-		fmt.Printf("コピー処理: %s → %s\n", src, dst)
-	} else {
-		log.Printf("コピー処理開始: %s → %s", src, dst)
-	}
-
-	// コピー方式の優先順位を補完
-	copyMethods := ensureAllCopyMethods(cfg.CopyMethodPriority)
-	if len(cfg.CopyMethodPriority) != len(copyMethods) {
-		log.Printf("コピー方式を補完しました: %v → %v", cfg.CopyMethodPriority, copyMethods)
-	}
-
-	var lastErr error
-	availableCount := 0
-
-	for _, method := range copyMethods {
-		if !isCommandAvailable(method) {
-			if dryRun {
-				fmt.Printf("  %s: コマンドが利用できません\n", method)
-			} else {
-				log.Printf("コピー方法 %s: コマンドが利用できません", method)
-			}
-			continue
-		}
-
-		availableCount++
-		args := cfg.CopyArgs[method]
-
-		if !dryRun {
-			log.Printf("コピー方法 %s を試行中...", method)
-		}
-
-		switch method {
-		case "robocopy":
-			// 拡張子フィルタリングが指定されている場合は、2段階実行
-			if len(cfg.Extensions) > 0 {
-				if dryRun {
-					fmt.Printf("  robocopy: 拡張子フィルタ付き2段階実行\n")
-					fmt.Printf("    対象拡張子: %v\n", cfg.Extensions)
-					fmt.Println("    1. 指定拡張子ファイルのコピー")
-					fmt.Println("    2. 不要ファイルの削除")
-					fmt.Println("  → 成功と仮定")
-					return nil
-				}
-
-				// 2段階robocopyを実行
-				success := executeRobocopyWithExtensions(cfg, src, dst, args)
-				if success {
-					return nil
-				} else {
-					lastErr = errors.New("robocopy拡張子フィルタリング失敗")
-					log.Printf("robocopy 拡張子フィルタリング失敗、次の方法を試行")
-					continue
-				}
-			}
-
-			// robocopy の基本構文: robocopy <source> <destination> [files] [options]
-			parts := []string{src, dst}
-
-			// robocopy オプションを追加
-			parts = append(parts, strings.Fields(args)...)
-
-			// 除外ディレクトリオプションを追加
-			excludeDirs := []string{
-				"/XD", "System Volume Information", "$Recycle.Bin", "Recovery",
-			}
-
-			// ユーザー定義の除外ディレクトリも追加
-			for _, excludeDir := range cfg.ExcludeDirs {
-				excludeDirs = append(excludeDirs, excludeDir)
-			}
-			parts = append(parts, excludeDirs...)
-
-			// 除外ファイル属性（システム・隠しファイル）
-			parts = append(parts, "/XA:SH")
-
-			if dryRun {
-				fmt.Printf("  使用: robocopy %s\n", strings.Join(parts, " "))
-				fmt.Println("  → 成功と仮定")
-				return nil
-			}
-			cmd := exec.Command("robocopy", parts...)
-			log.Printf("実行コマンド: robocopy %s", strings.Join(parts, " "))
-			out, err := cmd.CombinedOutput()
-
-			// Shift_JISからUTF-8に変換
-			outStr := convertShiftJISToUTF8(out)
-
-			// robocopyの終了コードをチェック
-			// 0-3: 成功、4以上: エラー
-			if err == nil {
-				log.Printf("robocopy でコピー完了")
-				logRobocopyOutput(outStr)
-				return nil
-			} else if exitError, ok := err.(*exec.ExitError); ok {
-				exitCode := exitError.ExitCode()
-				if exitCode <= 3 {
-					log.Printf("robocopy でコピー完了 (終了コード: %d)", exitCode)
-					logRobocopyOutput(outStr)
-					return nil
-				} else {
-					lastErr = err
-					log.Printf("robocopy 失敗 (終了コード: %d): %v", exitCode, err)
-					if len(outStr) > 0 {
-						log.Printf("robocopy エラー出力:\n%s", outStr)
-					}
-					continue
-				}
-			} else {
-				lastErr = err
-				log.Printf("robocopy 失敗: %v", err)
-				if len(outStr) > 0 {
-					log.Printf("robocopy エラー出力:\n%s", outStr)
-				}
-				continue
-			}
-
-		case "xcopy":
-			// 拡張子フィルタリングが指定されている場合は、事前にファイルリストを作成
-			if len(cfg.Extensions) > 0 {
-				if dryRun {
-					fmt.Printf("  xcopy: 拡張子フィルタありで個別ファイルコピー\n")
-					fmt.Printf("    対象拡張子: %v\n", cfg.Extensions)
-					fmt.Println("  → 成功と仮定")
-					return nil
-				}
-
-				// ディレクトリ探索して対象ファイルを収集
-				var targetFiles []string
-				var copiedFiles int
-				var skippedFiles int
-
-				err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
-					if err != nil {
-						// アクセス権限エラーやその他のエラーをスキップ
-						if strings.Contains(err.Error(), "Access is denied") ||
-							strings.Contains(err.Error(), "access denied") ||
-							strings.Contains(err.Error(), "permission denied") {
-							skippedFiles++
-							log.Printf("アクセス拒否によりスキップ: %s", path)
-							return filepath.SkipDir
-						}
-						return nil
-					}
-
-					// Windowsの保護されたフォルダをスキップ
-					if info.IsDir() {
-						lowerName := strings.ToLower(info.Name())
-						if lowerName == "system volume information" ||
-							lowerName == "$recycle.bin" ||
-							lowerName == "recovery" ||
-							strings.HasPrefix(lowerName, "$") ||
-							strings.HasPrefix(lowerName, "hiberfil") ||
-							strings.HasPrefix(lowerName, "pagefile") ||
-							strings.HasPrefix(lowerName, "swapfile") {
-							log.Printf("システムフォルダをスキップ: %s", path)
-							skippedFiles++
-							return filepath.SkipDir
-						}
-					}
-
-					// 設定ファイルの除外ディレクトリをチェック
-					for _, excludeDir := range cfg.ExcludeDirs {
-						if strings.HasPrefix(path, excludeDir) {
-							log.Printf("除外ディレクトリによりスキップ: %s", path)
-							skippedFiles++
-							if info.IsDir() {
-								return filepath.SkipDir
-							}
-							return nil
-						}
-					}
-
-					// 拡張子フィルタリング
-					if !info.IsDir() {
-						ext := strings.ToLower(filepath.Ext(path))
-						matched := false
-						for _, allowedExt := range cfg.Extensions {
-							if strings.ToLower(allowedExt) == ext {
-								matched = true
-								break
-							}
-						}
-						if matched {
-							targetFiles = append(targetFiles, path)
-						} else {
-							skippedFiles++
-						}
-					}
-
-					return nil
-				})
-
-				if err != nil {
-					lastErr = err
-					log.Printf("xcopy ファイル探索失敗: %v", err)
-					continue
-				}
-
-				log.Printf("xcopy: %d個のファイルが対象です", len(targetFiles))
-
-				// 各ファイルを個別にコピー
-				for _, srcFile := range targetFiles {
-					rel, _ := filepath.Rel(src, srcFile)
-					dstFile := filepath.Join(dst, rel)
-					dstDir := filepath.Dir(dstFile)
-
-					// コピー先ディレクトリを作成
-					if err := os.MkdirAll(dstDir, 0755); err != nil {
-						log.Printf("xcopy ディレクトリ作成失敗 %s: %v", dstDir, err)
-						continue
-					}
-
-					// xcopy でファイルをコピー
-					xcopyArgs := append([]string{srcFile, dstFile}, strings.Fields(args)...)
-					cmd := exec.Command("xcopy", xcopyArgs...)
-					log.Printf("実行コマンド: xcopy %s", strings.Join(xcopyArgs, " "))
-					out, err := cmd.CombinedOutput()
-
-					if err != nil {
-						outStr := convertShiftJISToUTF8(out)
-						log.Printf("xcopy ファイルコピー失敗 %s: %v\n出力: %s", srcFile, err, outStr)
-						continue
-					}
-					copiedFiles++
-				}
-
-				if copiedFiles > 0 {
-					log.Printf("xcopy でコピー完了 (%d個のファイル)", copiedFiles)
-					return nil
-				} else {
-					lastErr = errors.New("xcopy: コピーできるファイルが見つかりませんでした")
-					log.Printf("xcopy 失敗: %v", lastErr)
-					continue
-				}
-			} else {
-				// 拡張子フィルタリングなしの場合は従来通り
-				parts := append([]string{src, dst}, strings.Fields(args)...)
-
-				// xcopyでは除外リストファイルを使用
-				excludeFile := ""
-				if len(cfg.ExcludeDirs) > 0 || runtime.GOOS == "windows" {
-					// 一時的な除外ファイルを作成
-					tmpFile, err := os.CreateTemp("", "xcopy_exclude_*.txt")
-					if err == nil {
-						excludeFile = tmpFile.Name()
-						// Windowsのシステムフォルダを除外
-						tmpFile.WriteString("System Volume Information\n")
-						tmpFile.WriteString("$Recycle.Bin\n")
-						tmpFile.WriteString("Recovery\n")
-						tmpFile.WriteString("hiberfil.sys\n")
-						tmpFile.WriteString("pagefile.sys\n")
-						tmpFile.WriteString("swapfile.sys\n")
-
-						// ユーザー定義の除外ディレクトリも追加
-						for _, excludeDir := range cfg.ExcludeDirs {
-							tmpFile.WriteString(filepath.Base(excludeDir) + "\n")
-						}
-						tmpFile.Close()
-
-						parts = append(parts, "/EXCLUDE:"+excludeFile)
-						defer os.Remove(excludeFile) // 実行後に削除
-					}
-				}
-
-				if dryRun {
-					fmt.Printf("  使用: xcopy %s\n", strings.Join(parts, " "))
-					if excludeFile != "" {
-						fmt.Printf("    除外ファイル: %s\n", excludeFile)
-					}
-					fmt.Println("  → 成功と仮定")
-					return nil
-				}
-				cmd := exec.Command("xcopy", parts...)
-				log.Printf("実行コマンド: xcopy %s", strings.Join(parts, " "))
-				out, err := cmd.CombinedOutput()
-
-				// Shift_JISからUTF-8に変換
-				outStr := convertShiftJISToUTF8(out)
-
-				if err == nil {
-					log.Printf("xcopy でコピー完了")
-					if len(outStr) > 0 {
-						log.Printf("xcopy 出力:\n%s", outStr)
-					}
-					return nil
-				} else {
-					lastErr = err
-					log.Printf("xcopy 失敗: %v", err)
-					if len(outStr) > 0 {
-						log.Printf("xcopy エラー出力:\n%s", outStr)
-					}
-					continue
-				}
-			}
-
-		case "copy-item":
-			// PowerShellスクリプトで除外処理を含むコピーを実行
-			excludePaths := []string{
-				"'System Volume Information'", "'$Recycle.Bin'", "'Recovery'",
-				"'hiberfil.sys'", "'pagefile.sys'", "'swapfile.sys'",
-			}
-
-			// ユーザー定義の除外パスも追加
-			for _, excludeDir := range cfg.ExcludeDirs {
-				excludePaths = append(excludePaths, "'"+filepath.Base(excludeDir)+"'")
-			}
-
-			excludeScript := strings.Join(excludePaths, ",")
-
-			// PowerShell の引数を処理 (-Force が重複しないように)
-			psArgs := args
-			if !strings.Contains(args, "-Force") {
-				psArgs = args + " -Force"
-			}
-
-			// 拡張子フィルタリングと除外処理を含むPowerShellスクリプト
-			var ps string
-			if len(cfg.Extensions) > 0 {
-				// 拡張子フィルタリングがある場合
-				var extConditions []string
-				for _, ext := range cfg.Extensions {
-					extConditions = append(extConditions, fmt.Sprintf("$_.Extension -eq '%s'", ext))
-				}
-				extensionFilter := strings.Join(extConditions, " -or ")
-
-				ps = fmt.Sprintf(`
-$excludePaths = @(%s)
-Get-ChildItem -Path '%s' -Recurse -File | Where-Object {
-	# 除外パスチェック
-	$excluded = $false
-	foreach ($exclude in $excludePaths) {
-		if ($_.Name -eq $exclude -or $_.FullName -like "*\$exclude\*") {
-			$excluded = $true
-			break
-		}
-	}
-	# 拡張子フィルタリング
-	$extensionMatch = %s
-	
-	(-not $excluded) -and $extensionMatch
-} | ForEach-Object {
-	$relativePath = $_.FullName.Substring('%s'.Length).TrimStart('\')
-	$destPath = Join-Path '%s' $relativePath
-	$destDir = Split-Path $destPath -Parent
-	if ($destDir -and -not (Test-Path $destDir)) {
-		New-Item -ItemType Directory -Path $destDir -Force | Out-Null
-	}
-	Copy-Item $_.FullName $destPath %s
-}
-`, excludeScript, src, extensionFilter, src, dst, psArgs)
-			} else {
-				// 拡張子フィルタリングがない場合（従来通り）
-				ps = fmt.Sprintf(`
-$excludePaths = @(%s)
-Get-ChildItem -Path '%s' -Recurse | Where-Object {
-	$excluded = $false
-	foreach ($exclude in $excludePaths) {
-		if ($_.Name -eq $exclude -or $_.FullName -like "*\$exclude\*") {
-			$excluded = $true
-			break
-		}
-	}
-	-not $excluded
-} | Copy-Item -Destination '%s' %s
-`, excludeScript, src, dst, psArgs)
-			}
-
-			if dryRun {
-				fmt.Printf("  使用: powershell で除外処理付きコピー\n")
-				fmt.Printf("    除外パス: %s\n", excludeScript)
-				if len(cfg.Extensions) > 0 {
-					fmt.Printf("    対象拡張子: %v\n", cfg.Extensions)
-				}
-				fmt.Println("  → 成功と仮定")
-				return nil
-			}
-			cmd := exec.Command("powershell", "-Command", ps)
-			log.Printf("実行コマンド: powershell -Command %s", ps)
-			out, err := cmd.CombinedOutput()
-
-			// PowerShellの出力もShift_JISの可能性があるため変換
-			outStr := convertShiftJISToUTF8(out)
-
-			if err == nil {
-				log.Printf("PowerShell Copy-Item でコピー完了")
-				if len(outStr) > 0 {
-					log.Printf("PowerShell 出力:\n%s", outStr)
-				}
-				return nil
-			} else {
-				lastErr = err
-				log.Printf("PowerShell Copy-Item 失敗: %v", err)
-				if len(outStr) > 0 {
-					log.Printf("PowerShell エラー出力:\n%s", outStr)
-				}
-				continue
-			}
-
-		case "native":
-			if dryRun {
-				fmt.Printf("  使用: native copy %s → %s\n", src, dst)
-				fmt.Println("  → 成功と仮定")
-				return nil
-			}
-
-			// ソースディレクトリの存在確認
-			if _, err := os.Stat(src); err != nil {
-				lastErr = err
-				log.Printf("native copy 失敗: ソースディレクトリが存在しません: %v", err)
-				continue
-			}
-
-			var copyErrors []string
-			copiedFiles := 0
-			skippedFiles := 0
-
-			err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					// アクセス権限エラーやその他のエラーをスキップ
-					if strings.Contains(err.Error(), "Access is denied") ||
-						strings.Contains(err.Error(), "access denied") ||
-						strings.Contains(err.Error(), "permission denied") {
-						skippedFiles++
-						log.Printf("アクセス拒否によりスキップ: %s", path)
-						return filepath.SkipDir
-					}
-					copyErrors = append(copyErrors, fmt.Sprintf("path %s: %v", path, err))
-					return nil // エラーが発生してもWalkを続行
-				}
-
-				// Windowsの保護されたフォルダをスキップ
-				if info.IsDir() {
-					lowerName := strings.ToLower(info.Name())
-					if lowerName == "system volume information" ||
-						lowerName == "$recycle.bin" ||
-						lowerName == "recovery" ||
-						strings.HasPrefix(lowerName, "$") ||
-						strings.HasPrefix(lowerName, "hiberfil") ||
-						strings.HasPrefix(lowerName, "pagefile") ||
-						strings.HasPrefix(lowerName, "swapfile") {
-						log.Printf("システムフォルダをスキップ: %s", path)
-						skippedFiles++
-						return filepath.SkipDir
-					}
-				}
-
-				// 設定ファイルの除外ディレクトリをチェック
-				for _, excludeDir := range cfg.ExcludeDirs {
-					if strings.HasPrefix(path, excludeDir) {
-						log.Printf("除外ディレクトリによりスキップ: %s", path)
-						skippedFiles++
-						if info.IsDir() {
-							return filepath.SkipDir
-						}
-						return nil
-					}
-				}
-
-				// 拡張子フィルタリング（設定されている場合）
-				if len(cfg.Extensions) > 0 && !info.IsDir() {
-					ext := strings.ToLower(filepath.Ext(path))
-					matched := false
-					for _, allowedExt := range cfg.Extensions {
-						if strings.ToLower(allowedExt) == ext {
-							matched = true
-							break
-						}
-					}
-					if !matched {
-						skippedFiles++
-						return nil
-					}
-				}
-
-				rel, _ := filepath.Rel(src, path)
-				dest := filepath.Join(dst, rel)
-
-				if info.IsDir() {
-					if err := os.MkdirAll(dest, 0755); err != nil {
-						copyErrors = append(copyErrors, fmt.Sprintf("mkdir %s: %v", dest, err))
-					}
-					return nil
-				}
-
-				// ファイルのコピー
-				in, err := os.Open(path)
-				if err != nil {
-					if strings.Contains(err.Error(), "Access is denied") ||
-						strings.Contains(err.Error(), "access denied") ||
-						strings.Contains(err.Error(), "permission denied") {
-						log.Printf("ファイルアクセス拒否によりスキップ: %s", path)
-						skippedFiles++
-						return nil
-					}
-					copyErrors = append(copyErrors, fmt.Sprintf("open %s: %v", path, err))
-					return nil
-				}
-				defer in.Close()
-
-				out, err := os.Create(dest)
-				if err != nil {
-					copyErrors = append(copyErrors, fmt.Sprintf("create %s: %v", dest, err))
-					return nil
-				}
-				defer out.Close()
-
-				if _, err = io.Copy(out, in); err != nil {
-					copyErrors = append(copyErrors, fmt.Sprintf("copy %s to %s: %v", path, dest, err))
-					return nil
-				}
-
-				copiedFiles++
-				return nil
-			})
-
-			log.Printf("native copy 結果: %d個のファイルをコピー、%d個をスキップ", copiedFiles, skippedFiles)
-
-			if len(copyErrors) > 0 {
-				log.Printf("コピー中に %d個のエラーが発生しましたが、処理を継続しました", len(copyErrors))
-				for i, errMsg := range copyErrors {
-					if i < 5 { // 最初の5つのエラーのみ表示
-						log.Printf("  エラー: %s", errMsg)
-					} else if i == 5 {
-						log.Printf("  ... 他に %d個のエラー", len(copyErrors)-5)
-						break
-					}
-				}
-			}
-
-			if copiedFiles > 0 {
-				log.Printf("native copy でコピー完了 (%d個のファイル)", copiedFiles)
-				return nil
-			} else if skippedFiles > 0 {
-				log.Printf("すべてのファイルがスキップされましたが、エラーではありません")
-				return nil
-			}
-
-			if err != nil {
-				lastErr = err
-				log.Printf("native copy 失敗: %v", err)
-				continue
-			}
-
-			lastErr = errors.New("コピーできるファイルが見つかりませんでした")
-			log.Printf("native copy 失敗: %v", lastErr)
-			continue
-		}
-	}
-
-	if availableCount == 0 {
-		err := errors.New("利用可能なコピー方法がありません")
-		log.Printf("コピー失敗: %v", err)
-		return err
-	}
-
-	err := fmt.Errorf("すべてのコピー方法に失敗しました。最後のエラー: %v", lastErr)
-	log.Printf("コピー失敗: %v", err)
-	return err
-}
-
 // saveBackup は VHDX を指定ディレクトリにコピーします。
-func saveBackup(dstDir, filename, srcPath string, dryRun bool) error {
+// key を指定した場合は暗号化しながら書き込みます。limiter で転送速度を制限し、p にはコピーしたバイト数を加算します。
+// 書き込み後にディスクへ同期し、コピーしたサイズが元のファイルと一致することを確認します。
+func saveBackup(dstDir, filename, srcPath string, key *encryptionKey, limiter *rateLimiter, p *progress, dryRun bool) error {
 	if dryRun {
 		fmt.Printf("VHDXバックアップ保存: %s → %s/%s\n", srcPath, dstDir, filename)
 		return nil
@@ -2401,13 +2088,49 @@ func saveBackup(dstDir, filename, srcPath string, dryRun bool) error {
 		return err
 	}
 	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
 	out, err := os.Create(dstPath)
 	if err != nil {
 		return err
 	}
 	defer out.Close()
-	_, err = io.Copy(out, in)
-	return err
+	var w io.Writer = out
+	var ew *encryptWriter
+	if key != nil {
+		if ew, err = newEncryptWriter(out, key); err != nil {
+			return err
+		}
+		w = ew
+	}
+	n, err := io.Copy(w, limiter.Reader(p.Reader(in)))
+	if err != nil {
+		return err
+	}
+	if ew != nil {
+		if err := ew.Close(); err != nil {
+			return err
+		}
+	}
+	// コピー中に拡張された VHDX は大きくなる場合がある
+	if n < info.Size() {
+		return pkgerrors.Errorf("VHDX を最後まで読み込めませんでした (%d / %d bytes): %s", n, info.Size(), srcPath)
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if key == nil {
+		written, err := out.Stat()
+		if err != nil {
+			return err
+		}
+		if written.Size() != n {
+			return pkgerrors.Errorf("書き込んだサイズが一致しません (%d / %d bytes): %s", written.Size(), n, dstPath)
+		}
+	}
+	return out.Close()
 }
 
 // rotateBackupsWithPromotion は指定レベルで上限超過分を削除します。
@@ -2427,7 +2150,7 @@ func rotateBackupsWithPromotion(cfg *BackupConfig, level string, dryRun bool) er
 		return err
 	}
 
-	entries, err := os.ReadDir(dir)
+	names, err := listSnapshots(dir)
 	if err != nil {
 		if dryRun {
 			fmt.Printf("    → ディレクトリが存在しません\n")
@@ -2436,20 +2159,14 @@ func rotateBackupsWithPromotion(cfg *BackupConfig, level string, dryRun bool) er
 		}
 		return err
 	}
-	var names []string
-	for _, e := range entries {
-		if strings.HasSuffix(e.Name(), ".vhdx") {
-			names = append(names, e.Name())
-		}
-	}
-	sort.Strings(names)
 
 	if len(names) > keep {
 		if dryRun {
 			fmt.Printf("    → %d個のファイルを削除予定\n", len(names)-keep)
 		} else {
+			// ディレクトリのスナップショットは配下ごと削除
 			for _, old := range names[:len(names)-keep] {
-				os.Remove(filepath.Join(dir, old))
+				os.RemoveAll(filepath.Join(dir, old))
 			}
 		}
 	} else {
@@ -2460,8 +2177,24 @@ func rotateBackupsWithPromotion(cfg *BackupConfig, level string, dryRun bool) er
 	return nil
 }
 
+// promotionLevels は level から上位へ昇格順に並べた、保存先が設定されているレベルを返します。
+func promotionLevels(cfg *BackupConfig, level string) []string {
+	levels := []string{level}
+	for i, lvl := range scheduledLevels {
+		if lvl != level {
+			continue
+		}
+		for _, next := range scheduledLevels[i+1:] {
+			if cfg.BackupDirs[next] != "" {
+				levels = append(levels, next)
+			}
+		}
+	}
+	return levels
+}
+
 // promoteBackup は下位レベルから上位レベルへ古いファイルを昇格します。
-// 新しいファイルが追加される前に実行されるべきです。
+// 新しいスナップショットを保存した後、各レベルの保持数を超えた分を削除する前に実行します。
 func promoteBackup(cfg *BackupConfig, levels []string, dryRun bool) {
 	if dryRun {
 		fmt.Println("昇格処理:")
@@ -2483,7 +2216,7 @@ func promoteBackup(cfg *BackupConfig, levels []string, dryRun bool) {
 			}
 		}
 
-		entries, err := os.ReadDir(curDir)
+		names, err := listSnapshots(curDir)
 		if err != nil {
 			if dryRun {
 				fmt.Println("    → ソースディレクトリが存在しません")
@@ -2491,14 +2224,6 @@ func promoteBackup(cfg *BackupConfig, levels []string, dryRun bool) {
 			continue
 		}
 
-		var names []string
-		for _, e := range entries {
-			if strings.HasSuffix(e.Name(), ".vhdx") {
-				names = append(names, e.Name())
-			}
-		}
-		sort.Strings(names)
-
 		// 現在のレベルが保持数を超える場合、最古のファイルを昇格
 		if len(names) > cfg.KeepVersions[levels[i]] {
 			old := names[0]
@@ -2515,7 +2240,7 @@ func promoteBackup(cfg *BackupConfig, levels []string, dryRun bool) {
 					}
 				} else {
 					log.Printf("昇格先に同名ファイルが存在するため削除: %s", src)
-					os.Remove(src)
+					os.RemoveAll(src)
 				}
 			}
 		} else {
@@ -2552,70 +2277,24 @@ func releaseFileLock(f *os.File) {
 	}
 }
 
-// isDriveMounted はドライブレターがマウントされているか確認します。
-func isDriveMounted(drive string) bool {
-	var path string
-	if runtime.GOOS == "windows" {
-		path = drive + "\\"
-	} else {
-		path = drive
-	}
-	_, err := os.Stat(path)
-	return err == nil
+// notify は指定された種類の通知を送信します。
+func notify(cfg *BackupConfig, notifyType NotificationType, message string, dryRun bool) {
+	notifyEvent(cfg, newNotificationEvent(notifyType, message), dryRun)
 }
 
-// mountVHDX は PowerShell 経由で VHDX をマウントします。
-func mountVHDX(imagePath string, mountDrive string, dryRun bool) error {
-	if dryRun {
-		fmt.Printf("VHDXマウント予定: %s → %s\n", imagePath, mountDrive)
-		return nil
-	}
-	ps := fmt.Sprintf("Mount-DiskImage -ImagePath '%s'", imagePath)
-	cmd := exec.Command("powershell", "-Command", ps)
-	log.Printf("実行コマンド: powershell -Command %s", ps)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		// PowerShellの出力を文字エンコーディング変換
-		outStr := convertShiftJISToUTF8(out)
-		return pkgerrors.Errorf("mount failed: %v\n出力: %s", err, outStr)
-	}
-
-	// 成功時も出力があれば表示
-	if len(out) > 0 {
-		outStr := convertShiftJISToUTF8(out)
-		log.Printf("VHDX マウント出力:\n%s", outStr)
+// notifyEvent は実行情報付きの通知を送信します。
+func notifyEvent(cfg *BackupConfig, event NotificationEvent, dryRun bool) {
+	if cfg.jobName != "" {
+		event.Job = cfg.jobName
+		event.Title = fmt.Sprintf("%s [%s]", event.Title, cfg.jobName)
 	}
-	return nil
-}
-
-
-// notify は指定された種類の通知を送信します。
-func notify(cfg *BackupConfig, notifyType NotificationType, message string, dryRun bool) {
 	if dryRun {
-		fmt.Printf("通知: %s\n", message)
+		fmt.Printf("通知: %s\n", event.Message)
 		return
 	}
 
-	// 通知タイプに応じて送信するかどうかを判定
-	shouldNotify := false
-	switch notifyType {
-	case NotifyLockConflict:
-		shouldNotify = cfg.Notifications.LockConflict
-	case NotifyBackupStart:
-		shouldNotify = cfg.Notifications.BackupStart
-	case NotifyBackupEnd:
-		shouldNotify = cfg.Notifications.BackupEnd
-	case NotifyUpdateEnd:
-		shouldNotify = cfg.Notifications.UpdateEnd
-	case NotifyError:
-		shouldNotify = cfg.Notifications.Error
-	}
-
-	if shouldNotify {
-		sendToastNotification(message)
-	} else {
-		log.Printf("通知スキップ (%s): %s", getNotificationTypeName(notifyType), message)
-	}
+	// 抑制・集約・テンプレートを適用した上で、通知先ごとの通知種別フィルタを適用して送信
+	applyNotificationPolicy(cfg, event)
 }
 
 // getNotificationTypeName は通知タイプの名前を返します。
@@ -2631,56 +2310,15 @@ func getNotificationTypeName(notifyType NotificationType) string {
 		return "update_end"
 	case NotifyError:
 		return "error"
+	case NotifyRecovered:
+		return "recovered"
+	case NotifyDigest:
+		return "digest"
 	default:
 		return "unknown"
 	}
 }
 
-// sendToastNotification は Windows トースト通知を送信します。
-func sendToastNotification(message string) {
-	log.Printf("トースト通知を送信中: %s", message)
-	
-	// go-toast ライブラリを使用してトースト通知を送信
-	notification := toast.Notification{
-		AppID:   "Backup Rotation Tool",
-		Title:   "Backup Notification",
-		Message: message,
-		Icon:    "", // アイコンファイルのパス（オプション）
-		Actions: []toast.Action{
-			{
-				Type:      "protocol",
-				Label:     "OK",
-				Arguments: "",
-			},
-		},
-	}
-
-	err := notification.Push()
-	if err != nil {
-		log.Printf("go-toast トースト通知エラー: %v", err)
-		
-		// フォールバック: PowerShell経由で試行
-		sendFallbackNotification(message)
-	} else {
-		log.Printf("go-toast でトースト通知を送信しました: %s", message)
-	}
-}
-
-// sendFallbackNotification はフォールバック通知を送信します。
-func sendFallbackNotification(message string) {
-	log.Printf("フォールバック通知を試行中: %s", message)
-	
-	// msg.exe を使用したシンプルな通知
-	cmd := exec.Command("msg", "*", fmt.Sprintf("Backup Notification: %s", message))
-	err := cmd.Run()
-	if err != nil {
-		log.Printf("msg.exe 通知失敗: %v", err)
-		log.Printf("通知メッセージ (フォールバック): %s", message)
-	} else {
-		log.Printf("msg.exe で通知を送信しました: %s", message)
-	}
-}
-
 // logPerformance は性能ログをタブ区切りで追記します。
 func logPerformance(path string, startTime time.Time, copyDur, rotateDur time.Duration, dryRun bool) {
 	if dryRun {
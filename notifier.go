@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// NotificationEvent は通知先に渡す通知内容です。
+type NotificationEvent struct {
+	Type     NotificationType
+	Title    string
+	Message  string
+	Time     time.Time
+	Hostname string
+	Job      string // ジョブ名（jobs 使用時のみ）
+
+	// 実行情報（メッセージテンプレートから参照可能）
+	Level         string
+	Filename      string
+	CopyDuration  time.Duration
+	TotalDuration time.Duration
+	Error         string
+}
+
+// TypeName は通知種別名を返します（テンプレート用）。
+func (e NotificationEvent) TypeName() string {
+	return getNotificationTypeName(e.Type)
+}
+
+// Notifier は通知の送信先を表します。
+type Notifier interface {
+	// Name はログ表示用の通知先名を返します。
+	Name() string
+	// Send は通知を送信します。
+	Send(event NotificationEvent) error
+}
+
+// NotifierConfig は notifiers 設定の各要素を表します。
+type NotifierConfig struct {
+	Type    string   `json:"type"`   // toast, webhook, slack, email, notify-send, command
+	Name    string   `json:"name"`   // ログ表示用の名前（省略時は type）
+	Events  []string `json:"events"` // 送信する通知種別（省略時は notifications 設定に従う）
+	Timeout int      `json:"timeout_sec"`
+
+	// webhook / slack
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+
+	// email
+	SMTPHost string   `json:"smtp_host"`
+	SMTPPort int      `json:"smtp_port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	// command
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// configuredNotifier は通知先と送信対象の通知種別の組です。
+type configuredNotifier struct {
+	notifier Notifier
+	events   map[NotificationType]bool // nil の場合は notifications 設定に従う
+}
+
+// smtpSendMail はメール送信関数です（テストで差し替え可能）。
+// smtp.SendMail と異なり、接続から送信完了までを timeout で打ち切ります。
+var smtpSendMail = sendMailWithTimeout
+
+// parseNotificationType は通知種別名を NotificationType に変換します。
+func parseNotificationType(name string) (NotificationType, bool) {
+	for _, t := range []NotificationType{NotifyLockConflict, NotifyBackupStart, NotifyBackupEnd, NotifyUpdateEnd, NotifyError, NotifyRecovered, NotifyDigest} {
+		if getNotificationTypeName(t) == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// isNotificationEnabled は notifications 設定で通知種別が有効か判定します。
+func isNotificationEnabled(cfg *BackupConfig, notifyType NotificationType) bool {
+	switch notifyType {
+	case NotifyLockConflict:
+		return cfg.Notifications.LockConflict
+	case NotifyBackupStart:
+		return cfg.Notifications.BackupStart
+	case NotifyBackupEnd:
+		return cfg.Notifications.BackupEnd
+	case NotifyUpdateEnd:
+		return cfg.Notifications.UpdateEnd
+	case NotifyError:
+		return cfg.Notifications.Error
+	case NotifyRecovered:
+		return cfg.NotificationPolicy.Recovery
+	case NotifyDigest:
+		return cfg.NotificationPolicy.DailyDigest.Enabled
+	}
+	return false
+}
+
+// buildNotifiers は設定から通知先一覧を作成します。
+// notifiers が未設定の場合は従来通りトースト通知のみを使用します。
+func buildNotifiers(cfg *BackupConfig) ([]configuredNotifier, error) {
+	if len(cfg.Notifiers) == 0 {
+		return []configuredNotifier{{notifier: &toastNotifier{}}}, nil
+	}
+
+	var result []configuredNotifier
+	for i, nc := range cfg.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, fmt.Errorf("notifiers[%d]: %v", i, err)
+		}
+		cn := configuredNotifier{notifier: n}
+		if len(nc.Events) > 0 {
+			cn.events = make(map[NotificationType]bool)
+			for _, name := range nc.Events {
+				t, ok := parseNotificationType(name)
+				if !ok {
+					return nil, fmt.Errorf("notifiers[%d]: 不明な通知種別: %s", i, name)
+				}
+				cn.events[t] = true
+			}
+		}
+		result = append(result, cn)
+	}
+	return result, nil
+}
+
+// newNotifier は通知先設定から Notifier を作成します。
+func newNotifier(nc NotifierConfig) (Notifier, error) {
+	name := nc.Name
+	if name == "" {
+		name = nc.Type
+	}
+	timeout := time.Duration(nc.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+
+	switch nc.Type {
+	case "toast":
+		return &toastNotifier{}, nil
+	case "webhook":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("webhook: url が設定されていません")
+		}
+		return &webhookNotifier{name: name, url: nc.URL, headers: nc.Headers, client: client}, nil
+	case "slack":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("slack: url が設定されていません")
+		}
+		return &slackNotifier{name: name, url: nc.URL, client: client}, nil
+	case "email":
+		if nc.SMTPHost == "" || nc.From == "" || len(nc.To) == 0 {
+			return nil, fmt.Errorf("email: smtp_host, from, to は必須です")
+		}
+		port := nc.SMTPPort
+		if port == 0 {
+			port = 25
+		}
+		return &emailNotifier{
+			name: name, host: nc.SMTPHost, port: port,
+			username: nc.Username, password: nc.Password,
+			from: nc.From, to: nc.To, timeout: timeout,
+		}, nil
+	case "notify-send":
+		return &notifySendNotifier{name: name, timeout: timeout}, nil
+	case "command":
+		if nc.Command == "" {
+			return nil, fmt.Errorf("command: command が設定されていません")
+		}
+		return &commandNotifier{name: name, command: nc.Command, args: nc.Args, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("不明な通知先の種類: %s", nc.Type)
+	}
+}
+
+// dispatchNotification は通知を各通知先へ送信します。
+// 1つの通知先で失敗しても他の通知先への送信は継続します。
+func dispatchNotification(cfg *BackupConfig, event NotificationEvent) {
+	notifiers, err := buildNotifiers(cfg)
+	if err != nil {
+		log.Printf("通知先設定エラー: %v", err)
+		return
+	}
+
+	for _, cn := range notifiers {
+		enabled := isNotificationEnabled(cfg, event.Type)
+		if cn.events != nil {
+			enabled = cn.events[event.Type]
+		}
+		if !enabled {
+			log.Printf("通知スキップ (%s → %s): %s", getNotificationTypeName(event.Type), cn.notifier.Name(), event.Message)
+			continue
+		}
+		if err := cn.notifier.Send(event); err != nil {
+			log.Printf("通知送信エラー (%s): %v", cn.notifier.Name(), err)
+		} else {
+			log.Printf("通知送信完了 (%s): %s", cn.notifier.Name(), event.Message)
+		}
+	}
+}
+
+// newNotificationEvent は通知イベントを作成します。
+func newNotificationEvent(notifyType NotificationType, message string) NotificationEvent {
+	hostname, _ := os.Hostname()
+	return NotificationEvent{
+		Type:     notifyType,
+		Title:    "Backup Notification",
+		Message:  message,
+		Time:     time.Now(),
+		Hostname: hostname,
+	}
+}
+
+// postJSON は JSON を POST し、2xx 以外のレスポンスをエラーにします。
+func postJSON(client *http.Client, url string, headers map[string]string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// toastNotifier は Windows トースト通知です（従来の通知方式）。
+type toastNotifier struct{}
+
+func (n *toastNotifier) Name() string { return "toast" }
+
+func (n *toastNotifier) Send(event NotificationEvent) error {
+	sendToastNotification(event.Message)
+	return nil
+}
+
+// webhookNotifier は汎用 JSON Webhook に通知を POST します。
+type webhookNotifier struct {
+	name    string
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// webhookPayload は汎用 Webhook の送信内容です。
+type webhookPayload struct {
+	Event      string    `json:"event"`
+	Title      string    `json:"title"`
+	Message    string    `json:"message"`
+	Time       time.Time `json:"time"`
+	Hostname   string    `json:"hostname"`
+	Job        string    `json:"job,omitempty"`
+	Level      string    `json:"level,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	DurationMs int64     `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func (n *webhookNotifier) Name() string { return n.name }
+
+func (n *webhookNotifier) Send(event NotificationEvent) error {
+	return postJSON(n.client, n.url, n.headers, webhookPayload{
+		Event:      getNotificationTypeName(event.Type),
+		Title:      event.Title,
+		Message:    event.Message,
+		Time:       event.Time,
+		Hostname:   event.Hostname,
+		Job:        event.Job,
+		Level:      event.Level,
+		Filename:   event.Filename,
+		DurationMs: event.TotalDuration.Milliseconds(),
+		Error:      event.Error,
+	})
+}
+
+// slackNotifier は Slack/Teams 形式の Incoming Webhook に通知します。
+type slackNotifier struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func (n *slackNotifier) Name() string { return n.name }
+
+func (n *slackNotifier) Send(event NotificationEvent) error {
+	// Slack・Teams ともに text フィールドを解釈する
+	text := fmt.Sprintf("[%s] %s: %s", event.Hostname, getNotificationTypeName(event.Type), event.Message)
+	return postJSON(n.client, n.url, nil, map[string]string{"text": text})
+}
+
+// emailNotifier は SMTP でメール通知します。
+type emailNotifier struct {
+	name     string
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	to       []string
+	timeout  time.Duration
+}
+
+func (n *emailNotifier) Name() string { return n.name }
+
+func (n *emailNotifier) Send(event NotificationEvent) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	addr := fmt.Sprintf("%s:%d", n.host, n.port)
+	return smtpSendMail(addr, n.timeout, auth, n.from, n.to, n.buildMessage(event))
+}
+
+// sendMailWithTimeout は smtp.SendMail と同じ手順（STARTTLS・認証）でメールを送信します。
+// 接続は timeout で打ち切り、接続後の送信全体にも同じ期限を設定します。
+func sendMailWithTimeout(addr string, timeout time.Duration, a smtp.Auth, from string, to []string, msg []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: サーバーが認証（AUTH）に対応していません")
+		}
+		if err := c.Auth(a); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMessage はメール本文（ヘッダー含む）を作成します。
+func (n *emailNotifier) buildMessage(event NotificationEvent) []byte {
+	var b bytes.Buffer
+	subject := fmt.Sprintf("[rotate_backup] %s: %s", getNotificationTypeName(event.Type), event.Hostname)
+	fmt.Fprintf(&b, "From: %s\r\n", n.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "%s\r\n\r\n", event.Message)
+	fmt.Fprintf(&b, "ホスト: %s\r\n", event.Hostname)
+	fmt.Fprintf(&b, "時刻: %s\r\n", event.Time.Format("2006-01-02 15:04:05"))
+	return b.Bytes()
+}
+
+// notifySendNotifier は Linux デスクトップ通知（notify-send）です。
+type notifySendNotifier struct {
+	name    string
+	timeout time.Duration
+}
+
+func (n *notifySendNotifier) Name() string { return n.name }
+
+func (n *notifySendNotifier) Send(event NotificationEvent) error {
+	urgency := "normal"
+	if event.Type == NotifyError || event.Type == NotifyLockConflict {
+		urgency = "critical"
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "notify-send", "-u", urgency, event.Title, event.Message).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("notify-send 失敗: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// commandNotifier は任意のコマンドを実行して通知します。
+// 通知内容は環境変数で渡します。
+type commandNotifier struct {
+	name    string
+	command string
+	args    []string
+	timeout time.Duration
+}
+
+func (n *commandNotifier) Name() string { return n.name }
+
+func (n *commandNotifier) Send(event NotificationEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, n.command, n.args...)
+	cmd.Env = append(os.Environ(),
+		"ROTATE_BACKUP_EVENT="+getNotificationTypeName(event.Type),
+		"ROTATE_BACKUP_TITLE="+event.Title,
+		"ROTATE_BACKUP_MESSAGE="+event.Message,
+		"ROTATE_BACKUP_TIME="+event.Time.Format(time.RFC3339),
+		"ROTATE_BACKUP_HOSTNAME="+event.Hostname,
+		"ROTATE_BACKUP_JOB="+event.Job,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("通知コマンド失敗: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
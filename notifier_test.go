@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// 通知先プラグインのテスト
+// =============================================================================
+
+// recordingServer は受信したリクエストボディを記録するテスト用HTTPサーバーです。
+type recordingServer struct {
+	*httptest.Server
+	mutex   sync.Mutex
+	bodies  []string
+	headers []http.Header
+}
+
+func newRecordingServer(t *testing.T, status int) *recordingServer {
+	rs := &recordingServer{}
+	rs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rs.mutex.Lock()
+		rs.bodies = append(rs.bodies, string(body))
+		rs.headers = append(rs.headers, r.Header.Clone())
+		rs.mutex.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(rs.Close)
+	return rs
+}
+
+func (rs *recordingServer) received() []string {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return append([]string{}, rs.bodies...)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+
+	n, err := newNotifier(NotifierConfig{
+		Type:    "webhook",
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer test"},
+	})
+	if err != nil {
+		t.Fatalf("通知先作成エラー: %v", err)
+	}
+
+	event := NotificationEvent{
+		Type:     NotifyBackupEnd,
+		Title:    "Backup Notification",
+		Message:  "バックアップ完了: 000001_20250701_1000.vhdx",
+		Time:     time.Date(2025, 7, 1, 10, 0, 0, 0, time.UTC),
+		Hostname: "build01",
+	}
+	if err := n.Send(event); err != nil {
+		t.Fatalf("送信エラー: %v", err)
+	}
+
+	bodies := server.received()
+	if len(bodies) != 1 {
+		t.Fatalf("受信数が違います: %d", len(bodies))
+	}
+	var payload webhookPayload
+	if err := json.Unmarshal([]byte(bodies[0]), &payload); err != nil {
+		t.Fatalf("JSONデコードエラー: %v", err)
+	}
+	if payload.Event != "backup_end" || payload.Message != event.Message || payload.Hostname != "build01" {
+		t.Errorf("送信内容が違います: %+v", payload)
+	}
+	if got := server.headers[0].Get("Authorization"); got != "Bearer test" {
+		t.Errorf("ヘッダーが送信されていません: %q", got)
+	}
+}
+
+func TestWebhookNotifierHTTPError(t *testing.T) {
+	server := newRecordingServer(t, http.StatusInternalServerError)
+	n, _ := newNotifier(NotifierConfig{Type: "webhook", URL: server.URL})
+	if err := n.Send(newNotificationEvent(NotifyError, "失敗")); err == nil {
+		t.Errorf("HTTP 500 でエラーが返されませんでした")
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+	n, _ := newNotifier(NotifierConfig{Type: "slack", URL: server.URL})
+
+	event := NotificationEvent{Type: NotifyError, Message: "コピー失敗", Hostname: "build01"}
+	if err := n.Send(event); err != nil {
+		t.Fatalf("送信エラー: %v", err)
+	}
+
+	var payload map[string]string
+	json.Unmarshal([]byte(server.received()[0]), &payload)
+	if !strings.Contains(payload["text"], "コピー失敗") || !strings.Contains(payload["text"], "build01") {
+		t.Errorf("text フィールドが違います: %q", payload["text"])
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	var gotAddr, gotFrom string
+	var gotTo []string
+	var gotMsg []byte
+	original := smtpSendMail
+	defer func() { smtpSendMail = original }()
+	smtpSendMail = func(addr string, timeout time.Duration, a smtp.Auth, from string, to []string, msg []byte) error {
+		gotAddr, gotFrom, gotTo, gotMsg = addr, from, to, msg
+		return nil
+	}
+
+	n, err := newNotifier(NotifierConfig{
+		Type:     "email",
+		SMTPHost: "smtp.example.com",
+		SMTPPort: 587,
+		From:     "backup@example.com",
+		To:       []string{"admin@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("通知先作成エラー: %v", err)
+	}
+	if err := n.Send(NotificationEvent{Type: NotifyError, Message: "マウント失敗", Hostname: "build01"}); err != nil {
+		t.Fatalf("送信エラー: %v", err)
+	}
+
+	if gotAddr != "smtp.example.com:587" || gotFrom != "backup@example.com" || len(gotTo) != 1 {
+		t.Errorf("送信パラメータが違います: addr=%s from=%s to=%v", gotAddr, gotFrom, gotTo)
+	}
+	msg := string(gotMsg)
+	if !strings.Contains(msg, "Subject: [rotate_backup] error: build01") || !strings.Contains(msg, "マウント失敗") {
+		t.Errorf("メール本文が違います:\n%s", msg)
+	}
+}
+
+func TestNotifierTimeout(t *testing.T) {
+	// 応答しない HTTP サーバー
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-block }))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(block) })
+
+	// 接続を受け付けるだけで応答しない SMTP サーバー
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	smtpAddr := listener.Addr().(*net.TCPAddr)
+
+	for _, nc := range []NotifierConfig{
+		{Type: "webhook", URL: server.URL, Timeout: 1},
+		{Type: "slack", URL: server.URL, Timeout: 1},
+		{Type: "email", SMTPHost: "127.0.0.1", SMTPPort: smtpAddr.Port, From: "backup@example.com", To: []string{"admin@example.com"}, Timeout: 1},
+	} {
+		n, err := newNotifier(nc)
+		if err != nil {
+			t.Fatalf("通知先作成エラー: %v", err)
+		}
+		start := time.Now()
+		if err := n.Send(NotificationEvent{Type: NotifyError, Message: "失敗"}); err == nil {
+			t.Errorf("%s: 応答しない送信先でエラーになりません", nc.Type)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: timeout_sec で打ち切られません (%v)", nc.Type, elapsed)
+		}
+	}
+}
+
+func TestNewNotifierValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		config NotifierConfig
+	}{
+		{"webhookのURLなし", NotifierConfig{Type: "webhook"}},
+		{"slackのURLなし", NotifierConfig{Type: "slack"}},
+		{"emailの宛先なし", NotifierConfig{Type: "email", SMTPHost: "smtp", From: "a@example.com"}},
+		{"commandのコマンドなし", NotifierConfig{Type: "command"}},
+		{"不明な種類", NotifierConfig{Type: "pager"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newNotifier(tt.config); err == nil {
+				t.Errorf("エラーが期待されましたが成功しました")
+			}
+		})
+	}
+}
+
+func TestDispatchNotificationEventFilter(t *testing.T) {
+	errorsOnly := newRecordingServer(t, http.StatusOK)
+	followGlobal := newRecordingServer(t, http.StatusOK)
+
+	cfg := &BackupConfig{
+		Notifiers: []NotifierConfig{
+			{Type: "webhook", Name: "errors-only", URL: errorsOnly.URL, Events: []string{"error"}},
+			{Type: "webhook", Name: "global", URL: followGlobal.URL},
+		},
+	}
+	cfg.Notifications.BackupEnd = true
+	cfg.Notifications.Error = false
+
+	dispatchNotification(cfg, newNotificationEvent(NotifyBackupEnd, "完了"))
+	dispatchNotification(cfg, newNotificationEvent(NotifyError, "失敗"))
+
+	if got := errorsOnly.received(); len(got) != 1 || !strings.Contains(got[0], "失敗") {
+		t.Errorf("errors-only の受信内容が違います: %v", got)
+	}
+	if got := followGlobal.received(); len(got) != 1 || !strings.Contains(got[0], "完了") {
+		t.Errorf("global の受信内容が違います: %v", got)
+	}
+}
+
+func TestBuildNotifiersUnknownEvent(t *testing.T) {
+	cfg := &BackupConfig{
+		Notifiers: []NotifierConfig{{Type: "toast", Events: []string{"backup_finished"}}},
+	}
+	if _, err := buildNotifiers(cfg); err == nil {
+		t.Errorf("不明な通知種別でエラーが返されませんでした")
+	}
+}
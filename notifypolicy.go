@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// NotificationPolicy は通知の抑制・集約・テンプレート設定です。
+type NotificationPolicy struct {
+	// 通知種別ごとの最小送信間隔（例: {"backup_end": "3h"}）
+	RateLimits map[string]string `json:"rate_limits"`
+	// 同一エラーメッセージの再送を抑制する期間（例: "1h"）
+	DedupWindow string `json:"dedup_window"`
+	// 失敗後に成功した場合に復旧通知を送信
+	Recovery bool `json:"recovery"`
+	// 全実行結果をまとめた日次ダイジェスト
+	DailyDigest struct {
+		Enabled bool   `json:"enabled"`
+		Time    string `json:"time"` // 送信時刻 "HH:MM"（省略時は 09:00）
+	} `json:"daily_digest"`
+	// 通知種別ごとのメッセージテンプレート（Go text/template）
+	Templates map[string]string `json:"templates"`
+	// 抑制・集約の状態を保存するファイル（未設定時はプロセス内にのみ保持するため、
+	// 定期起動モードで抑制・集約を使う場合は設定してください）
+	StateFile string `json:"state_file"`
+}
+
+// notificationState はプロセスをまたいで保持する通知状態です。
+type notificationState struct {
+	LastSent      map[string]time.Time `json:"last_sent"`
+	LastError     string               `json:"last_error"`
+	LastErrorTime time.Time            `json:"last_error_time"`
+	Failing       bool                 `json:"failing"`
+	FailingSince  time.Time            `json:"failing_since"`
+	LastDigest    time.Time            `json:"last_digest"`
+	Runs          []digestRun          `json:"runs"`
+	Suppressed    map[string]int       `json:"suppressed"`
+}
+
+// digestRun は日次ダイジェストに含める1回分の実行結果です。
+type digestRun struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Level      string    `json:"level,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// notificationTemplateData はメッセージテンプレートに渡すデータです。
+type notificationTemplateData struct {
+	NotificationEvent
+	Runs       []digestRun
+	Succeeded  int
+	Failed     int
+	Suppressed int
+}
+
+var (
+	// state_file 未設定時に使用するプロセス内の通知状態（ジョブ名ごと）
+	memoryNotificationState = make(map[string]*notificationState)
+	notificationStateMutex  sync.Mutex
+)
+
+// applyNotificationPolicy は通知ポリシーを適用し、送信すべき通知を送信します。
+func applyNotificationPolicy(cfg *BackupConfig, event NotificationEvent) {
+	notificationStateMutex.Lock()
+	defer notificationStateMutex.Unlock()
+
+	policy := &cfg.NotificationPolicy
+	state := loadNotificationState(cfg)
+	name := getNotificationTypeName(event.Type)
+	now := event.Time
+
+	// ダイジェスト用に実行結果を記録
+	if policy.DailyDigest.Enabled {
+		switch event.Type {
+		case NotifyBackupEnd, NotifyUpdateEnd, NotifyError:
+			state.Runs = append(state.Runs, digestRun{
+				Time:       now,
+				Type:       name,
+				Level:      event.Level,
+				Filename:   event.Filename,
+				DurationMs: event.TotalDuration.Milliseconds(),
+				Error:      event.Error,
+			})
+		}
+	}
+
+	send := true
+	var recovered *NotificationEvent
+
+	switch event.Type {
+	case NotifyError:
+		key := event.Error
+		if key == "" {
+			key = event.Message
+		}
+		window := parsePolicyDuration(policy.DedupWindow, "dedup_window")
+		if window > 0 && state.LastError == key && now.Sub(state.LastErrorTime) < window {
+			log.Printf("通知抑制 (error): 同一エラーを %s 以内に通知済み", window)
+			send = false
+		} else {
+			state.LastError = key
+			state.LastErrorTime = now
+		}
+		if !state.Failing {
+			state.Failing = true
+			state.FailingSince = now
+		}
+	case NotifyBackupEnd, NotifyUpdateEnd:
+		if state.Failing {
+			if policy.Recovery {
+				ev := event
+				ev.Type = NotifyRecovered
+				ev.Message = fmt.Sprintf("バックアップが復旧しました（%s から失敗が継続していました）",
+					state.FailingSince.Format("2006-01-02 15:04"))
+				recovered = &ev
+			}
+			state.Failing = false
+			state.LastError = ""
+		}
+	}
+
+	// 通知種別ごとの送信間隔制限
+	if send {
+		interval := parsePolicyDuration(policy.RateLimits[name], "rate_limits."+name)
+		if last, ok := state.LastSent[name]; ok && interval > 0 && now.Sub(last) < interval {
+			log.Printf("通知抑制 (%s): 前回送信 %s から %s 経過していません", name, last.Format("15:04:05"), interval)
+			send = false
+		}
+	}
+
+	if send {
+		dispatchNotification(cfg, renderNotification(policy, notificationTemplateData{NotificationEvent: event}))
+		state.LastSent[name] = now
+	} else {
+		state.Suppressed[name]++
+	}
+
+	if recovered != nil {
+		dispatchNotification(cfg, renderNotification(policy, notificationTemplateData{NotificationEvent: *recovered}))
+		state.LastSent[getNotificationTypeName(NotifyRecovered)] = now
+	}
+
+	flushDigest(cfg, state, now)
+	saveNotificationState(cfg, state)
+}
+
+// flushNotificationDigest は送信時刻を過ぎていれば日次ダイジェストを送信します。
+// 常駐モードのループから定期的に呼び出されます。
+func flushNotificationDigest(cfg *BackupConfig, now time.Time) {
+	if !cfg.NotificationPolicy.DailyDigest.Enabled {
+		return
+	}
+	notificationStateMutex.Lock()
+	defer notificationStateMutex.Unlock()
+
+	state := loadNotificationState(cfg)
+	if flushDigest(cfg, state, now) {
+		saveNotificationState(cfg, state)
+	}
+}
+
+// flushDigest はダイジェスト送信時刻を過ぎていれば集計を送信し、状態をリセットします。
+// 状態を変更した場合は true を返します。
+func flushDigest(cfg *BackupConfig, state *notificationState, now time.Time) bool {
+	policy := &cfg.NotificationPolicy
+	if !policy.DailyDigest.Enabled {
+		return false
+	}
+
+	digestAt, err := time.ParseInLocation("15:04", defaultString(policy.DailyDigest.Time, "09:00"), now.Location())
+	if err != nil {
+		log.Printf("daily_digest.time の形式が不正です: %v", err)
+		return false
+	}
+	today := time.Date(now.Year(), now.Month(), now.Day(), digestAt.Hour(), digestAt.Minute(), 0, 0, now.Location())
+	if now.Before(today) || !state.LastDigest.Before(today) {
+		return false
+	}
+	state.LastDigest = now
+
+	data := notificationTemplateData{Runs: state.Runs}
+	for _, r := range state.Runs {
+		if r.Type == getNotificationTypeName(NotifyError) {
+			data.Failed++
+		} else {
+			data.Succeeded++
+		}
+	}
+	for _, n := range state.Suppressed {
+		data.Suppressed += n
+	}
+	state.Runs = nil
+	state.Suppressed = make(map[string]int)
+
+	if len(data.Runs) == 0 && data.Suppressed == 0 {
+		return true
+	}
+
+	data.NotificationEvent = newNotificationEvent(NotifyDigest, fmt.Sprintf(
+		"日次ダイジェスト: 実行 %d 回（成功 %d / 失敗 %d）、抑制した通知 %d 件",
+		len(data.Runs), data.Succeeded, data.Failed, data.Suppressed))
+	data.Time = now
+	if data.Failed > 0 {
+		for i := len(data.Runs) - 1; i >= 0; i-- {
+			if data.Runs[i].Error != "" {
+				data.Message += "\n最新のエラー: " + data.Runs[i].Error
+				break
+			}
+		}
+	}
+	dispatchNotification(cfg, renderNotification(policy, data))
+	return true
+}
+
+// renderNotification はテンプレートが設定されていればメッセージを差し替えます。
+func renderNotification(policy *NotificationPolicy, data notificationTemplateData) NotificationEvent {
+	event := data.NotificationEvent
+	text, ok := policy.Templates[getNotificationTypeName(event.Type)]
+	if !ok || text == "" {
+		return event
+	}
+	tmpl, err := template.New(getNotificationTypeName(event.Type)).Parse(text)
+	if err != nil {
+		log.Printf("通知テンプレート解析エラー (%s): %v", getNotificationTypeName(event.Type), err)
+		return event
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		log.Printf("通知テンプレート実行エラー (%s): %v", getNotificationTypeName(event.Type), err)
+		return event
+	}
+	event.Message = b.String()
+	return event
+}
+
+// parsePolicyDuration は期間文字列を解析します。空または不正な場合は 0 を返します。
+func parsePolicyDuration(value, key string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("notification_policy.%s の形式が不正です: %v", key, err)
+		return 0
+	}
+	return d
+}
+
+// defaultString は value が空の場合に def を返します。
+func defaultString(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// loadNotificationState は通知状態を読み込みます。
+func loadNotificationState(cfg *BackupConfig) *notificationState {
+	path := cfg.NotificationPolicy.StateFile
+	var state *notificationState
+	if path == "" {
+		state = memoryNotificationState[cfg.jobName]
+	} else if data, err := os.ReadFile(path); err == nil {
+		state = &notificationState{}
+		if err := json.Unmarshal(data, state); err != nil {
+			log.Printf("通知状態ファイルの読み込みエラー: %v", err)
+			state = nil
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("通知状態ファイルの読み込みエラー: %v", err)
+	}
+
+	if state == nil {
+		state = &notificationState{}
+	}
+	if state.LastSent == nil {
+		state.LastSent = make(map[string]time.Time)
+	}
+	if state.Suppressed == nil {
+		state.Suppressed = make(map[string]int)
+	}
+	return state
+}
+
+// saveNotificationState は通知状態を保存します。
+func saveNotificationState(cfg *BackupConfig, state *notificationState) {
+	path := cfg.NotificationPolicy.StateFile
+	if path == "" {
+		memoryNotificationState[cfg.jobName] = state
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		log.Printf("通知状態ファイルの保存エラー: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Printf("通知状態ファイルの保存エラー: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		log.Printf("通知状態ファイルの保存エラー: %v", err)
+	}
+}
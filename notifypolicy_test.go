@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// 通知ポリシー（抑制・集約・テンプレート）のテスト
+// =============================================================================
+
+// newPolicyTestConfig は webhook 1件と状態ファイルを持つテスト用設定を作成します。
+func newPolicyTestConfig(t *testing.T, url string) *BackupConfig {
+	cfg := &BackupConfig{
+		Notifiers: []NotifierConfig{{Type: "webhook", URL: url}},
+	}
+	cfg.Notifications.BackupEnd = true
+	cfg.Notifications.Error = true
+	cfg.NotificationPolicy.StateFile = filepath.Join(t.TempDir(), "state.json")
+	return cfg
+}
+
+func policyEvent(notifyType NotificationType, message string, at time.Time) NotificationEvent {
+	event := newNotificationEvent(notifyType, message)
+	event.Time = at
+	return event
+}
+
+func TestNotificationRateLimit(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+	cfg := newPolicyTestConfig(t, server.URL)
+	cfg.NotificationPolicy.RateLimits = map[string]string{"backup_end": "3h"}
+
+	base := time.Date(2025, 7, 1, 10, 0, 0, 0, time.Local)
+	for i := 0; i < 7; i++ { // 30分間隔で3時間分
+		applyNotificationPolicy(cfg, policyEvent(NotifyBackupEnd, "完了", base.Add(time.Duration(i)*30*time.Minute)))
+	}
+
+	if got := len(server.received()); got != 2 {
+		t.Errorf("送信数が違います: 期待=2 (10:00, 13:00), 実際=%d", got)
+	}
+	state := loadNotificationState(cfg)
+	if state.Suppressed["backup_end"] != 5 {
+		t.Errorf("抑制数が違います: 期待=5, 実際=%d", state.Suppressed["backup_end"])
+	}
+}
+
+func TestNotificationErrorDedup(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+	cfg := newPolicyTestConfig(t, server.URL)
+	cfg.NotificationPolicy.DedupWindow = "1h"
+
+	base := time.Date(2025, 7, 1, 10, 0, 0, 0, time.Local)
+	applyNotificationPolicy(cfg, policyEvent(NotifyError, "コピー失敗", base))
+	applyNotificationPolicy(cfg, policyEvent(NotifyError, "コピー失敗", base.Add(30*time.Minute)))
+	applyNotificationPolicy(cfg, policyEvent(NotifyError, "マウント失敗", base.Add(40*time.Minute)))
+	applyNotificationPolicy(cfg, policyEvent(NotifyError, "マウント失敗", base.Add(2*time.Hour)))
+
+	got := server.received()
+	if len(got) != 3 {
+		t.Fatalf("送信数が違います: 期待=3, 実際=%d", len(got))
+	}
+}
+
+func TestNotificationRecovery(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+	cfg := newPolicyTestConfig(t, server.URL)
+	cfg.NotificationPolicy.Recovery = true
+
+	base := time.Date(2025, 7, 1, 10, 0, 0, 0, time.Local)
+	applyNotificationPolicy(cfg, policyEvent(NotifyError, "コピー失敗", base))
+	applyNotificationPolicy(cfg, policyEvent(NotifyBackupEnd, "完了", base.Add(30*time.Minute)))
+	applyNotificationPolicy(cfg, policyEvent(NotifyBackupEnd, "完了", base.Add(time.Hour)))
+
+	got := server.received()
+	if len(got) != 4 {
+		t.Fatalf("送信数が違います: 期待=4 (error, backup_end, recovered, backup_end), 実際=%d", len(got))
+	}
+	if !strings.Contains(got[2], `"event":"recovered"`) {
+		t.Errorf("復旧通知が送信されていません: %s", got[2])
+	}
+}
+
+func TestNotificationTemplate(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+	cfg := newPolicyTestConfig(t, server.URL)
+	cfg.NotificationPolicy.Templates = map[string]string{
+		"backup_end": "{{.Level}} 完了: {{.Filename}} ({{.TotalDuration}})",
+	}
+
+	event := policyEvent(NotifyBackupEnd, "完了", time.Now())
+	event.Level = "3h"
+	event.Filename = "000010_20250701_0900.vhdx"
+	event.TotalDuration = 90 * time.Second
+	applyNotificationPolicy(cfg, event)
+
+	got := server.received()
+	if len(got) != 1 || !strings.Contains(got[0], "3h 完了: 000010_20250701_0900.vhdx (1m30s)") {
+		t.Errorf("テンプレートが適用されていません: %v", got)
+	}
+}
+
+func TestNotificationTemplateInvalidFallsBack(t *testing.T) {
+	policy := &NotificationPolicy{Templates: map[string]string{"error": "{{.Unknown"}}
+	event := renderNotification(policy, notificationTemplateData{NotificationEvent: newNotificationEvent(NotifyError, "元のメッセージ")})
+	if event.Message != "元のメッセージ" {
+		t.Errorf("不正なテンプレートで元のメッセージが使用されていません: %q", event.Message)
+	}
+}
+
+func TestNotificationDailyDigest(t *testing.T) {
+	server := newRecordingServer(t, http.StatusOK)
+	cfg := newPolicyTestConfig(t, server.URL)
+	cfg.Notifications.BackupEnd = false // 個別の完了通知は送らない
+	cfg.NotificationPolicy.DailyDigest.Enabled = true
+	cfg.NotificationPolicy.DailyDigest.Time = "09:00"
+	cfg.NotificationPolicy.Templates = map[string]string{
+		"digest": "{{.Succeeded}} 件成功 / {{.Failed}} 件失敗",
+	}
+
+	// 前日の09:00以降の実行
+	base := time.Date(2025, 7, 1, 9, 30, 0, 0, time.Local)
+	saveNotificationState(cfg, &notificationState{LastDigest: base.Add(-time.Minute)})
+	applyNotificationPolicy(cfg, policyEvent(NotifyBackupEnd, "完了", base))
+	applyNotificationPolicy(cfg, policyEvent(NotifyBackupEnd, "完了", base.Add(30*time.Minute)))
+	failed := policyEvent(NotifyError, "失敗", base.Add(time.Hour))
+	failed.Error = "コピー失敗"
+	applyNotificationPolicy(cfg, failed)
+
+	if got := server.received(); len(got) != 1 {
+		t.Fatalf("ダイジェスト送信前の送信数が違います: 期待=1 (error), 実際=%d", len(got))
+	}
+
+	// 翌日の送信時刻前は送信しない
+	flushNotificationDigest(cfg, time.Date(2025, 7, 2, 8, 59, 0, 0, time.Local))
+	if got := server.received(); len(got) != 1 {
+		t.Fatalf("送信時刻前にダイジェストが送信されました")
+	}
+
+	flushNotificationDigest(cfg, time.Date(2025, 7, 2, 9, 0, 0, 0, time.Local))
+	got := server.received()
+	if len(got) != 2 || !strings.Contains(got[1], "2 件成功 / 1 件失敗") {
+		t.Fatalf("ダイジェストの内容が違います: %v", got)
+	}
+
+	// 同じ日には再送しない
+	flushNotificationDigest(cfg, time.Date(2025, 7, 2, 12, 0, 0, 0, time.Local))
+	if len(server.received()) != 2 {
+		t.Errorf("同じ日にダイジェストが再送されました")
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// 進捗表示（コピー・スナップショット保存の進捗・速度・残り時間）
+// =============================================================================
+
+// ProgressConfig は進捗表示の設定です。
+type ProgressConfig struct {
+	Mode        string `json:"mode"`         // auto / bar / log / off（省略時は auto）
+	LogInterval string `json:"log_interval"` // log で進捗を出力する間隔（省略時は 30s）
+	StatusFile  string `json:"status_file"`  // 実行中の進捗を書き出す JSON ファイル（空の場合は書き出さない）
+}
+
+// 進捗の表示方法（progress.mode）
+const (
+	progressModeAuto = "auto" // 標準出力が端末ならプログレスバー、それ以外はログ
+	progressModeBar  = "bar"  // プログレスバー
+	progressModeLog  = "log"  // 一定間隔でログに出力
+	progressModeOff  = "off"  // 表示しない（status_file は書き出す）
+)
+
+// progressModes は progress.mode に指定できる値の一覧です。
+var progressModes = []string{progressModeAuto, progressModeBar, progressModeLog, progressModeOff}
+
+const (
+	defaultProgressLogInterval = 30 * time.Second
+	progressBarInterval        = 200 * time.Millisecond
+	progressStatusInterval     = 2 * time.Second
+	// progressRateWindow は速度を計算する期間です（開始直後の変更なしファイルのスキップ等による偏りを抑える）。
+	progressRateWindow = 10 * time.Second
+	progressBarWidth   = 30
+)
+
+// progressStatus は1つの処理の進捗です（status_file に書き出す内容）。
+type progressStatus struct {
+	Job         string    `json:"job,omitempty"`
+	Phase       string    `json:"phase"`
+	TotalBytes  int64     `json:"total_bytes"` // 0 の場合は不明
+	DoneBytes   int64     `json:"done_bytes"`
+	TotalFiles  int       `json:"total_files"`
+	DoneFiles   int       `json:"done_files"`
+	Estimated   bool      `json:"estimated"` // total_bytes が推定値
+	BytesPerSec float64   `json:"bytes_per_sec"`
+	ETASeconds  int64     `json:"eta_seconds"` // -1 の場合は不明
+	StartedAt   time.Time `json:"started_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// String は進捗を1行で返します。
+func (s progressStatus) String() string {
+	var b strings.Builder
+	if s.Job != "" {
+		fmt.Fprintf(&b, "[%s] ", s.Job)
+	}
+	b.WriteString(s.Phase + ": ")
+	if s.TotalBytes > 0 {
+		approx := ""
+		if s.Estimated {
+			approx = "約 "
+		}
+		fmt.Fprintf(&b, "%5.1f%% %s / %s%s", s.percent(), formatBytes(s.DoneBytes), approx, formatBytes(s.TotalBytes))
+	} else {
+		b.WriteString(formatBytes(s.DoneBytes))
+	}
+	if s.TotalFiles > 0 {
+		fmt.Fprintf(&b, " (%d / %d ファイル)", s.DoneFiles, s.TotalFiles)
+	} else if s.DoneFiles > 0 {
+		fmt.Fprintf(&b, " (%d ファイル)", s.DoneFiles)
+	}
+	fmt.Fprintf(&b, ", %s/s", formatBytes(int64(s.BytesPerSec)))
+	if s.ETASeconds >= 0 {
+		fmt.Fprintf(&b, ", 残り %s", formatETA(time.Duration(s.ETASeconds)*time.Second))
+	}
+	return b.String()
+}
+
+// percent は完了した割合（0〜100）を返します。
+func (s progressStatus) percent() float64 {
+	if s.TotalBytes <= 0 {
+		return 0
+	}
+	return min(100, float64(s.DoneBytes)*100/float64(s.TotalBytes))
+}
+
+// formatETA は残り時間を時・分・秒で返します。
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%d時間%02d分", h, m)
+	case m > 0:
+		return fmt.Sprintf("%d分%02d秒", m, s)
+	default:
+		return fmt.Sprintf("%d秒", s)
+	}
+}
+
+// progressSample は速度の計算に使用する時刻ごとの完了バイト数です。
+type progressSample struct {
+	at   time.Time
+	done int64
+}
+
+// progress は1つの処理（コピー・スナップショット保存）の進捗を追跡し、設定に応じて表示します。
+// nil の場合は何もしないため、呼び出し側は進捗表示の有無を区別せずに使用できます。
+type progress struct {
+	mu         sync.Mutex
+	status     progressStatus
+	bar        io.Writer // プログレスバーの出力先（nil の場合は表示しない）
+	logEvery   time.Duration
+	statusFile string
+	now        func() time.Time
+
+	samples                      []progressSample
+	lastBar, lastLog, lastStatus time.Time
+	finished                     bool
+}
+
+// progressStdout はプログレスバーの出力先です（テストで差し替え可能）。
+var progressStdout io.Writer = os.Stdout
+
+// progressNow は現在時刻を返します（テストで差し替え可能）。
+var progressNow = time.Now
+
+// startProgress は進捗の追跡を開始します。総量は SetTotal で設定します（未設定の場合は速度のみ表示）。
+// 表示しない設定で status_file もない場合は nil を返します（総量の集計も不要）。
+func startProgress(cfg *BackupConfig, phase string) *progress {
+	if cfg == nil || cfg.DryRun {
+		return nil
+	}
+	mode := defaultString(cfg.Progress.Mode, progressModeAuto)
+	if mode == progressModeAuto {
+		mode = progressModeLog
+		if isTerminal(progressStdout) {
+			mode = progressModeBar
+		}
+	}
+	if mode == progressModeOff && cfg.Progress.StatusFile == "" {
+		return nil
+	}
+
+	p := &progress{statusFile: cfg.Progress.StatusFile, now: progressNow}
+	switch mode {
+	case progressModeBar:
+		p.bar = progressStdout
+	case progressModeLog:
+		p.logEvery = defaultProgressLogInterval
+		if d, err := time.ParseDuration(cfg.Progress.LogInterval); err == nil && d > 0 {
+			p.logEvery = d
+		}
+	}
+	now := p.now()
+	p.status = progressStatus{
+		Job:        cfg.jobName,
+		Phase:      phase,
+		ETASeconds: -1,
+		StartedAt:  now,
+		UpdatedAt:  now,
+	}
+	p.samples = []progressSample{{at: now}}
+	p.lastLog, p.lastStatus = now, now
+	p.publish()
+	return p
+}
+
+// SetTotal は処理する総バイト数・ファイル数を設定します。estimated は推定値の場合に true を指定します。
+func (p *progress) SetTotal(bytes int64, files int, estimated bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.TotalBytes, p.status.TotalFiles, p.status.Estimated = bytes, files, estimated
+	if p.logEvery > 0 {
+		log.Printf("%s開始: %s (%d ファイル)", p.status.Phase, formatBytes(bytes), files)
+	}
+	p.publish()
+}
+
+// isTerminal は w が端末の場合に true を返します。
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Add は処理済みのバイト数を加算します。
+func (p *progress) Add(n int64) {
+	if p == nil || n == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.DoneBytes += n
+	p.update(false)
+}
+
+// AddFile は処理済みのファイル数を加算します。
+func (p *progress) AddFile() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.DoneFiles++
+	p.update(false)
+}
+
+// Reader は読み込んだバイト数を進捗に加算する Reader を返します。
+func (p *progress) Reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, p: p}
+}
+
+type progressReader struct {
+	r io.Reader
+	p *progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.p.Add(int64(n))
+	return n, err
+}
+
+// Finish は進捗の追跡を終了し、所要時間と平均速度を出力します。
+func (p *progress) Finish() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return
+	}
+	p.update(true)
+	p.finished = true
+	elapsed := p.status.UpdatedAt.Sub(p.status.StartedAt)
+	if p.bar != nil {
+		fmt.Fprintln(p.bar)
+	}
+	if p.bar != nil || p.logEvery > 0 {
+		avg := float64(p.status.DoneBytes)
+		if elapsed > 0 {
+			avg /= elapsed.Seconds()
+		}
+		log.Printf("%s完了: %s を %s で処理 (平均 %s/s)", p.status.Phase, formatBytes(p.status.DoneBytes), formatETA(elapsed), formatBytes(int64(avg)))
+	}
+	progressStatuses.remove(p)
+	p.writeStatusFile()
+}
+
+// update は速度・残り時間を計算し、間隔に応じて表示・書き出しを行います（p.mu を保持して呼び出す）。
+func (p *progress) update(final bool) {
+	if p.finished {
+		return
+	}
+	now := p.now()
+	p.status.UpdatedAt = now
+
+	// 直近 progressRateWindow の完了バイト数から速度を計算する
+	if last := p.samples[len(p.samples)-1]; now.Sub(last.at) >= time.Second/10 || final {
+		p.samples = append(p.samples, progressSample{at: now, done: p.status.DoneBytes})
+		for len(p.samples) > 2 && now.Sub(p.samples[1].at) >= progressRateWindow {
+			p.samples = p.samples[1:]
+		}
+		first := p.samples[0]
+		if dt := now.Sub(first.at).Seconds(); dt > 0 {
+			p.status.BytesPerSec = float64(p.status.DoneBytes-first.done) / dt
+		}
+		p.status.ETASeconds = -1
+		if remaining := p.status.TotalBytes - p.status.DoneBytes; p.status.TotalBytes > 0 && p.status.BytesPerSec > 0 {
+			p.status.ETASeconds = int64(float64(max(remaining, 0)) / p.status.BytesPerSec)
+		}
+	}
+
+	if p.bar != nil && (final || now.Sub(p.lastBar) >= progressBarInterval) {
+		p.lastBar = now
+		fmt.Fprintf(p.bar, "\r%s\033[K", p.renderBar())
+	}
+	if p.logEvery > 0 && !final && now.Sub(p.lastLog) >= p.logEvery {
+		p.lastLog = now
+		log.Printf("進捗 %s", p.status)
+	}
+	if p.statusFile != "" && (final || now.Sub(p.lastStatus) >= progressStatusInterval) {
+		p.lastStatus = now
+		p.publish()
+	}
+}
+
+// renderBar はプログレスバーの1行を返します。総量が不明な場合はバーを表示しません。
+func (p *progress) renderBar() string {
+	if p.status.TotalBytes <= 0 {
+		return p.status.String()
+	}
+	filled := int(p.status.percent() * progressBarWidth / 100)
+	bar := strings.Repeat("=", filled)
+	if filled < progressBarWidth {
+		bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+	}
+	return fmt.Sprintf("[%s] %s", bar, p.status)
+}
+
+// publish は現在の進捗を status_file に書き出します。
+func (p *progress) publish() {
+	if p.statusFile == "" {
+		return
+	}
+	progressStatuses.set(p, p.status)
+	p.writeStatusFile()
+}
+
+// writeStatusFile は同じ status_file を使用する実行中の処理の進捗を書き出します。
+// 実行中の処理がなくなった場合は削除します。
+func (p *progress) writeStatusFile() {
+	if p.statusFile == "" {
+		return
+	}
+	if err := progressStatuses.write(p.statusFile); err != nil {
+		log.Printf("進捗ファイルの書き込みに失敗: %v", err)
+	}
+}
+
+// statusFileContent は status_file の内容です。
+type statusFileContent struct {
+	PID       int              `json:"pid"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Tasks     []progressStatus `json:"tasks"`
+}
+
+// progressRegistry は実行中の処理の進捗を保持します（複数ジョブの同時実行時に1つの status_file にまとめる）。
+type progressRegistry struct {
+	mu     sync.Mutex
+	active map[*progress]progressStatus
+	files  map[*progress]string
+}
+
+var progressStatuses = &progressRegistry{}
+
+func (r *progressRegistry) set(p *progress, s progressStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active == nil {
+		r.active = make(map[*progress]progressStatus)
+		r.files = make(map[*progress]string)
+	}
+	r.active[p] = s
+	r.files[p] = p.statusFile
+}
+
+func (r *progressRegistry) remove(p *progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, p)
+	delete(r.files, p)
+}
+
+// write は path を status_file とする処理の進捗を書き出します（一時ファイルに書いてから置き換え）。
+func (r *progressRegistry) write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var tasks []progressStatus
+	for p, s := range r.active {
+		if r.files[p] == path {
+			tasks = append(tasks, s)
+		}
+	}
+	if len(tasks) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	slices.SortFunc(tasks, func(a, b progressStatus) int { return a.StartedAt.Compare(b.StartedAt) })
+	data, err := json.MarshalIndent(statusFileContent{PID: os.Getpid(), UpdatedAt: time.Now(), Tasks: tasks}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// treeSize は root 以下の通常ファイルの合計サイズと数を返します。
+func treeSize(root string) (bytes int64, files int) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			bytes += info.Size()
+			files++
+		}
+		return nil
+	})
+	return bytes, files
+}
+
+// filteredTreeSize は root 以下の コピー対象のファイルの合計サイズと数を返します。
+func filteredTreeSize(cfg *BackupConfig, root string) (bytes int64, files int) {
+	newCopyFilter(cfg).walkFiles(root, func(path, rel string, info os.FileInfo) error {
+		bytes += info.Size()
+		files++
+		return nil
+	})
+	return bytes, files
+}
+
+// pendingCopySize は src から dst へのコピーで、dst にない・サイズか更新日時が異なるファイルの
+// 合計サイズと数を返します（native コピーと同じ判定）。
+func pendingCopySize(cfg *BackupConfig, src, dst string) (bytes int64, files int) {
+	newCopyFilter(cfg).walkFiles(src, func(path, rel string, info os.FileInfo) error {
+		if d, err := os.Stat(filepath.Join(dst, filepath.FromSlash(rel))); err == nil && d.Mode().IsRegular() &&
+			d.Size() == info.Size() && d.ModTime().Equal(info.ModTime()) {
+			return nil
+		}
+		bytes += info.Size()
+		files++
+		return nil
+	})
+	return bytes, files
+}
+
+// startCopyProgress は src から dst へのコピーの進捗の追跡を開始します。
+// 総量はコピーが必要なファイルから集計します（estimated はコピー方式の判定と異なる場合に true）。
+func startCopyProgress(cfg *BackupConfig, src, dst string, estimated bool) *progress {
+	p := startProgress(cfg, "コピー")
+	if p != nil {
+		bytes, files := pendingCopySize(cfg, src, dst)
+		p.SetTotal(bytes, files, estimated)
+	}
+	return p
+}
+
+// -----------------------------------------------------------------------------
+// robocopy の出力からの進捗
+// -----------------------------------------------------------------------------
+
+// robocopyFileSizePattern は robocopy のファイル行のサイズ（"12345" / "1.5 m"）です。
+var robocopyFileSizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kmgt]?)$`)
+
+// parseRobocopyFileLine は robocopy（/NP）の出力のコピーしたファイルの行からサイズを返します。
+// 例: "\t    New File  \t\t    1.5 m\tfoo.txt"（ディレクトリ・削除対象の行は除く）
+func parseRobocopyFileLine(line string) (int64, bool) {
+	var fields []string
+	for _, f := range strings.Split(strings.TrimRight(line, "\r\n"), "\t") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	if len(fields) == 3 {
+		class := fields[0]
+		for _, skip := range []string{"Dir", "EXTRA", "ディレクトリ", "余分"} {
+			if strings.Contains(class, skip) {
+				return 0, false
+			}
+		}
+		fields = fields[1:]
+	}
+	// ラベルのないディレクトリの行（"\t   3\tC:\work\sub\"）は末尾が "\"
+	if len(fields) != 2 || strings.HasSuffix(fields[1], `\`) {
+		return 0, false
+	}
+	return parseRobocopySize(fields[0])
+}
+
+// parseRobocopySize は robocopy の出力のサイズ（"12345" / "1.5 m"）をバイト数に変換します。
+func parseRobocopySize(s string) (int64, bool) {
+	m := robocopyFileSizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(s)))
+	if m == nil {
+		return 0, false
+	}
+	size, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	if m[2] != "" {
+		size *= math.Pow(1024, float64(strings.Index("kmgt", m[2])+1))
+	}
+	return int64(size), true
+}
+
+// runRobocopy は robocopy を実行して出力（標準出力・標準エラー）を返します。
+// p が nil でない場合は出力を逐次読み取り、コピーしたファイルのサイズを進捗に加算します。
+func runRobocopy(parts []string, p *progress) ([]byte, error) {
+	cmd := exec.Command("robocopy", parts...)
+	if p == nil {
+		return cmd.CombinedOutput()
+	}
+	pr, pw := io.Pipe()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(io.TeeReader(pr, &out))
+		for scanner.Scan() {
+			if size, ok := parseRobocopyFileLine(convertShiftJISToUTF8(scanner.Bytes())); ok {
+				p.Add(size)
+				p.AddFile()
+			}
+		}
+		io.Copy(&out, pr) // 長すぎる行で読み取りを中断した場合の残り
+	}()
+	err := cmd.Run()
+	pw.Close()
+	<-done
+	return out.Bytes(), err
+}
+
+// runStatus は status_file から実行中の処理の進捗を表示します。
+func runStatus(configPath string, asJSON bool, out io.Writer) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return wrapFailure(FailureConfig, err)
+	}
+	if cfg.Progress.StatusFile == "" {
+		return wrapFailure(FailureConfig, pkgerrors.New("progress.status_file が設定されていません"))
+	}
+	data, err := os.ReadFile(cfg.Progress.StatusFile)
+	if os.IsNotExist(err) {
+		fmt.Fprintln(out, "実行中の処理はありません")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if asJSON {
+		_, err := out.Write(data)
+		return err
+	}
+	var content statusFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return pkgerrors.Errorf("進捗ファイルを読み込めません: %v", err)
+	}
+	fmt.Fprintf(out, "PID %d (更新: %s)\n", content.PID, content.UpdatedAt.Local().Format("2006-01-02 15:04:05"))
+	if time.Since(content.UpdatedAt) > time.Minute {
+		fmt.Fprintln(out, "  ※ 1分以上更新されていません（処理が異常終了した可能性があります）")
+	}
+	for _, task := range content.Tasks {
+		fmt.Fprintf(out, "  %s\n", task)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// 進捗表示のテスト
+// =============================================================================
+
+// fakeProgressClock は進捗の時刻をテストから進めます。
+func fakeProgressClock(t *testing.T) (advance func(time.Duration)) {
+	now := time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC)
+	old := progressNow
+	progressNow = func() time.Time { return now }
+	t.Cleanup(func() { progressNow = old })
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+// captureProgressOutput はプログレスバーとログの出力先をバッファに差し替えます。
+func captureProgressOutput(t *testing.T) (bar, logs *bytes.Buffer) {
+	bar, logs = &bytes.Buffer{}, &bytes.Buffer{}
+	oldStdout := progressStdout
+	progressStdout = bar
+	log.SetOutput(logs)
+	t.Cleanup(func() {
+		progressStdout = oldStdout
+		log.SetOutput(os.Stderr)
+	})
+	return bar, logs
+}
+
+func TestProgressBarAndETA(t *testing.T) {
+	advance := fakeProgressClock(t)
+	bar, logs := captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.Progress.Mode = progressModeBar
+
+	p := startProgress(cfg, "コピー")
+	p.SetTotal(100*1024*1024, 4, false)
+	p.AddFile()
+	advance(10 * time.Second)
+	p.Add(25 * 1024 * 1024)
+
+	// 10秒で 25MiB → 2.5MiB/s、残り 75MiB は30秒
+	want := "[=======>                      ] コピー:  25.0% 25.0 MiB / 100.0 MiB (1 / 4 ファイル), 2.5 MiB/s, 残り 30秒"
+	if !strings.Contains(bar.String(), want) {
+		t.Errorf("プログレスバーが違います:\ngot:  %q\nwant: %q", bar.String(), want)
+	}
+
+	advance(30 * time.Second)
+	p.Add(75 * 1024 * 1024)
+	p.Finish()
+	p.Finish() // 2回目は何もしない
+	if !strings.Contains(bar.String(), "[==============================] コピー: 100.0%") || !strings.HasSuffix(bar.String(), "\n") {
+		t.Errorf("完了時のプログレスバーが違います: %q", bar.String())
+	}
+	if got := strings.Count(logs.String(), "コピー完了: 100.0 MiB を 40秒 で処理 (平均 2.5 MiB/s)"); got != 1 {
+		t.Errorf("完了のログが %d 回出力されました: %s", got, logs)
+	}
+}
+
+func TestProgressLogMode(t *testing.T) {
+	advance := fakeProgressClock(t)
+	bar, logs := captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.Progress = ProgressConfig{Mode: progressModeAuto, LogInterval: "1m"}
+
+	// 端末でない場合は auto でログに出力する
+	p := startProgress(cfg, "アーカイブ作成")
+	p.SetTotal(0, 0, false)
+	advance(30 * time.Second)
+	p.Add(1024)
+	if strings.Contains(logs.String(), "進捗") {
+		t.Errorf("log_interval より前に進捗が出力されました: %s", logs)
+	}
+	advance(30 * time.Second)
+	p.Add(1024)
+	p.Finish()
+	if !strings.Contains(logs.String(), "進捗 アーカイブ作成: 2.0 KiB") {
+		t.Errorf("進捗のログがありません: %s", logs)
+	}
+	if bar.Len() != 0 {
+		t.Errorf("ログモードでプログレスバーが出力されました: %q", bar)
+	}
+}
+
+func TestProgressDisabled(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.Progress.Mode = progressModeOff
+	if p := startProgress(cfg, "コピー"); p != nil {
+		t.Error("off で status_file がない場合は nil を返す必要があります")
+	}
+	cfg.Progress.Mode = progressModeBar
+	cfg.DryRun = true
+	if p := startProgress(cfg, "コピー"); p != nil {
+		t.Error("ドライランでは nil を返す必要があります")
+	}
+
+	// nil でも呼び出せる
+	var p *progress
+	p.SetTotal(1, 1, false)
+	p.Add(1)
+	p.AddFile()
+	p.Finish()
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(p.Reader(strings.NewReader("data"))); err != nil || buf.String() != "data" {
+		t.Errorf("nil の Reader が元の内容を返しません: %q %v", buf.String(), err)
+	}
+}
+
+func TestProgressStatusFile(t *testing.T) {
+	advance := fakeProgressClock(t)
+	captureProgressOutput(t)
+	statusFile := filepath.Join(t.TempDir(), "status", "progress.json")
+	cfg := newValidTestConfig(t)
+	cfg.Progress = ProgressConfig{Mode: progressModeOff, StatusFile: statusFile}
+
+	readStatus := func() statusFileContent {
+		t.Helper()
+		var content statusFileContent
+		data, err := os.ReadFile(statusFile)
+		if err != nil {
+			t.Fatalf("進捗ファイルを読み込めません: %v", err)
+		}
+		if err := json.Unmarshal(data, &content); err != nil {
+			t.Fatalf("進捗ファイルの形式が不正です: %v", err)
+		}
+		return content
+	}
+
+	copyCfg := *cfg
+	copyCfg.jobName = "docs"
+	p1 := startProgress(&copyCfg, "コピー")
+	p1.SetTotal(1000, 2, true)
+	advance(time.Second)
+	p2 := startProgress(cfg, "VHDX保存")
+	advance(2 * time.Second)
+	p1.Add(500)
+
+	// 同時に実行中の処理を開始順にまとめる
+	content := readStatus()
+	if content.PID != os.Getpid() || len(content.Tasks) != 2 {
+		t.Fatalf("進捗ファイルの内容が違います: %+v", content)
+	}
+	if task := content.Tasks[0]; task.Job != "docs" || task.DoneBytes != 500 || task.TotalBytes != 1000 || !task.Estimated || task.ETASeconds != 3 {
+		t.Errorf("コピーの進捗が違います: %+v", task)
+	}
+	if task := content.Tasks[1]; task.Phase != "VHDX保存" || task.ETASeconds != -1 {
+		t.Errorf("VHDX保存の進捗が違います: %+v", task)
+	}
+
+	var out bytes.Buffer
+	configPath := writeTestConfig(t, `{"progress": {"status_file": "`+filepath.ToSlash(statusFile)+`"}}`)
+	if err := runStatus(configPath, false, &out); err != nil {
+		t.Fatalf("runStatus がエラーを返しました: %v", err)
+	}
+	if !strings.Contains(out.String(), "[docs] コピー:  50.0% 500 B / 約 1000 B") || !strings.Contains(out.String(), "VHDX保存: 0 B") {
+		t.Errorf("status の出力が違います: %s", out.String())
+	}
+
+	// すべて完了したら削除する
+	p1.Finish()
+	if got := readStatus(); len(got.Tasks) != 1 || got.Tasks[0].Phase != "VHDX保存" {
+		t.Errorf("完了した処理が残っています: %+v", got)
+	}
+	p2.Finish()
+	if _, err := os.Stat(statusFile); !os.IsNotExist(err) {
+		t.Errorf("すべて完了した後も進捗ファイルが残っています: %v", err)
+	}
+	out.Reset()
+	if err := runStatus(configPath, true, &out); err != nil || !strings.Contains(out.String(), "実行中の処理はありません") {
+		t.Errorf("実行中の処理がない場合の出力が違います: %q %v", out.String(), err)
+	}
+}
+
+func TestRunStatusRequiresStatusFile(t *testing.T) {
+	err := runStatus(writeTestConfig(t, `{}`), false, &bytes.Buffer{})
+	if err == nil || classifyFailure(err) != FailureConfig {
+		t.Errorf("status_file 未設定で設定エラーになりません: %v", err)
+	}
+}
+
+func TestPendingCopySize(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.Extensions = []string{".txt"}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"same.txt": "same", "changed.txt": "new!!", "new.txt": "abc", "skip.log": "xxxxx"})
+	writeTestFiles(t, cfg.BackupDir, map[string]string{"same.txt": "same", "changed.txt": "old"})
+	mtime := time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC)
+	for _, dir := range []string{cfg.WorkDir, cfg.BackupDir} {
+		os.Chtimes(filepath.Join(dir, "same.txt"), mtime, mtime)
+	}
+
+	if bytes, files := pendingCopySize(cfg, cfg.WorkDir, cfg.BackupDir); bytes != 8 || files != 2 {
+		t.Errorf("pendingCopySize = %d バイト %d ファイル, want 8 バイト 2 ファイル", bytes, files)
+	}
+	if bytes, files := filteredTreeSize(cfg, cfg.WorkDir); bytes != 12 || files != 3 {
+		t.Errorf("filteredTreeSize = %d バイト %d ファイル, want 12 バイト 3 ファイル", bytes, files)
+	}
+	if bytes, files := treeSize(cfg.WorkDir); bytes != 17 || files != 4 {
+		t.Errorf("treeSize = %d バイト %d ファイル, want 17 バイト 4 ファイル", bytes, files)
+	}
+}
+
+func TestParseRobocopyFileLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		size int64
+		ok   bool
+	}{
+		{"新しいファイル", "\t    New File  \t\t    1234\tC:\\work\\a.txt", 1234, true},
+		{"更新されたファイル（単位付き）", "\t    Newer     \t\t   1.5 m\tb.bin", 1572864, true},
+		{"ラベルなし", "\t\t\t\t  2.0 g\tbig.vhdx", 2147483648, true},
+		{"日本語（新しいファイル）", "\t    新しいファイル\t\t     512\tc.txt", 512, true},
+		{"日本語（更新）", "\t    新しい      \t\t   10 k\td.txt", 10240, true},
+		{"ディレクトリ", "\t  New Dir          3\tC:\\work\\sub\\", 0, false},
+		{"ラベルなしのディレクトリ", "\t                   3\tC:\\work\\sub\\", 0, false},
+		{"日本語のディレクトリ", "\t新しいディレクトリ       3\tC:\\work\\sub\\", 0, false},
+		{"削除対象", "\t    *EXTRA File \t\t     100\told.txt", 0, false},
+		{"日本語の削除対象", "\t    *余分なファイル\t\t     100\told.txt", 0, false},
+		{"サマリー", "    Files :         3         2         1         0         0         0", 0, false},
+		{"空行", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size, ok := parseRobocopyFileLine(tt.line)
+			if size != tt.size || ok != tt.ok {
+				t.Errorf("parseRobocopyFileLine(%q) = %d, %v, want %d, %v", tt.line, size, ok, tt.size, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidateProgressConfig(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.Progress = ProgressConfig{Mode: "fancy", LogInterval: "0s"}
+	problems := validateConfig(cfg)
+	if findProblem(problems, "progress.mode") == nil || findProblem(problems, "progress.log_interval") == nil {
+		t.Errorf("不正な進捗設定が検出されません: %+v", problems)
+	}
+}
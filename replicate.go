@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// 保存先（remote）へのスナップショットの複製
+// =============================================================================
+
+// RemoteConfig はスナップショットの複製先の設定です。
+type RemoteConfig struct {
+	Type string `json:"type"` // local / sftp / s3（空の場合は複製しない）
+	Path string `json:"path"` // 保存先のディレクトリ（s3 はキーの接頭辞）
+
+	// sftp
+	Host           string `json:"host"`             // ホスト名[:ポート]
+	User           string `json:"user"`             // ユーザー名
+	KeyFile        string `json:"key_file"`         // 秘密鍵（省略時は環境変数 ROTATE_BACKUP_SFTP_PASSWORD のパスワード）
+	KnownHostsFile string `json:"known_hosts_file"` // ホスト鍵の検証に使用する known_hosts（省略時は ~/.ssh/known_hosts）
+
+	// s3（認証情報は環境変数 AWS_ACCESS_KEY_ID・AWS_SECRET_ACCESS_KEY）
+	Endpoint string `json:"endpoint"` // 省略時は AWS S3
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region"` // 省略時は us-east-1
+
+	Levels         []string       `json:"levels"`            // 複製するレベル
+	KeepVersions   map[string]int `json:"keep_versions"`     // 保存先での保持数（省略したレベルは keep_versions と同じ）
+	MaxBytesPerSec int64          `json:"max_bytes_per_sec"` // 転送速度の上限（0で無制限）
+}
+
+// remoteTypes は remote.type に指定できる値の一覧です。
+var remoteTypes = []string{"local", "sftp", "s3"}
+
+// openStorage は設定に対応する保存先に接続します。
+func openStorage(remote *RemoteConfig) (storageBackend, error) {
+	switch remote.Type {
+	case "local":
+		return newLocalStorage(remote.Path), nil
+	case "sftp":
+		return dialSFTP(remote)
+	case "s3":
+		return newS3Storage(remote)
+	default:
+		return nil, pkgerrors.Errorf("不明な remote.type です: %s", remote.Type)
+	}
+}
+
+// remoteKeep は保存先でのレベルの保持数を返します。
+func (cfg *BackupConfig) remoteKeep(level string) int {
+	if keep, ok := cfg.Remote.KeepVersions[level]; ok {
+		return keep
+	}
+	return cfg.KeepVersions[level]
+}
+
+// remoteDir は保存先でのレベルのディレクトリを返します（ジョブごとに分離）。
+func (cfg *BackupConfig) remoteDir(level string) string {
+	return path.Join(cfg.jobName, level)
+}
+
+// replicateSnapshots は remote.levels の各レベルについて、保持数分の新しいスナップショットのうち
+// 保存先にないもの（前回中断したものを含む）をアップロードし、保存先の古いスナップショットを削除します。
+func replicateSnapshots(cfg *BackupConfig, dryRun bool) error {
+	if cfg.Remote.Type == "" || len(cfg.Remote.Levels) == 0 {
+		return nil
+	}
+	// ドライランではネットワーク越しの保存先に接続せず、手元のスナップショットから予定だけを表示する
+	if dryRun && cfg.Remote.Type != "local" {
+		return printReplicationPlan(cfg)
+	}
+	backend, err := openStorage(&cfg.Remote)
+	if err != nil {
+		return wrapFailure(FailureRemote, err)
+	}
+	defer backend.Close()
+
+	if dryRun {
+		fmt.Printf("複製処理: %s\n", backend)
+	}
+	// remote.max_bytes_per_sec を優先し、未設定の場合は throttle の上限で制限する
+	limiter := newRateLimiter(cfg.Remote.MaxBytesPerSec)
+	if limiter == nil {
+		limiter = cfg.Throttle.newLimiter()
+	}
+	var failed []string
+	for _, level := range cfg.Remote.Levels {
+		if err := replicateLevel(cfg, backend, level, limiter, dryRun); err != nil {
+			log.Printf("複製失敗 (%s → %s): %v", level, backend, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", level, err))
+		}
+	}
+	if len(failed) > 0 {
+		return wrapFailure(FailureRemote, pkgerrors.Errorf("複製失敗 (%s): %s", backend, strings.Join(failed, "; ")))
+	}
+	return nil
+}
+
+// printReplicationPlan は保存先に接続せずに複製の予定を表示します。
+// 保存先の状態は確認しないため、既にアップロード済みのものも予定に含まれます。
+func printReplicationPlan(cfg *BackupConfig) error {
+	fmt.Printf("複製処理: %s (ドライランのため接続しません)\n", remoteDesc(&cfg.Remote))
+	for _, level := range cfg.Remote.Levels {
+		local, err := replicationCandidates(cfg, level)
+		if err != nil {
+			return wrapFailure(FailureRemote, err)
+		}
+		dir := cfg.BackupDirs[level]
+		for _, name := range local {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				return wrapFailure(FailureRemote, err)
+			}
+			fmt.Printf("  %s: %s をアップロード予定 (%s、保存先に同じものがあれば省略)\n", level, name, formatBytes(info.Size()))
+		}
+		fmt.Printf("  %s: 保存先では新しい %d 個を保持し、それより古いものを削除予定\n", level, cfg.remoteKeep(level))
+	}
+	return nil
+}
+
+// remoteDesc は接続せずに保存先を表示用の文字列にします。
+func remoteDesc(remote *RemoteConfig) string {
+	switch remote.Type {
+	case "sftp":
+		return "sftp:" + remote.User + "@" + remote.Host + ":" + remote.Path
+	case "s3":
+		return "s3:" + path.Join(remote.Bucket, remote.Path)
+	default:
+		return remote.Type + ":" + remote.Path
+	}
+}
+
+// replicationCandidates はレベルの保存先に置くべき手元のスナップショット（保持数分の新しいファイル）を返します。
+func replicationCandidates(cfg *BackupConfig, level string) ([]string, error) {
+	dir := cfg.BackupDirs[level]
+	keep := cfg.remoteKeep(level)
+
+	names, err := listSnapshots(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var local []string
+	for _, name := range names {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			local = append(local, name)
+		}
+	}
+	if len(local) > keep {
+		local = local[len(local)-keep:]
+	}
+	return local, nil
+}
+
+// replicateAfterBackup はバックアップの成功後にスナップショットを保存先へ複製します。
+// 複製の失敗は保存先の失敗として通知・記録しますが、手元のバックアップは成功のまま扱います。
+func replicateAfterBackup(cfg *BackupConfig, level string) {
+	if err := replicateSnapshots(cfg, cfg.DryRun); err != nil {
+		reportFailure(cfg, level, wrapFailure(FailureRemote, err))
+	}
+}
+
+// replicateLevel は1レベル分の複製と保存先のローテーションを行います。
+func replicateLevel(cfg *BackupConfig, backend storageBackend, level string, limiter *rateLimiter, dryRun bool) error {
+	dir := cfg.BackupDirs[level]
+	keep := cfg.remoteKeep(level)
+	remoteDir := cfg.remoteDir(level)
+
+	local, err := replicationCandidates(cfg, level)
+	if err != nil {
+		return err
+	}
+
+	objects, err := backend.List(remoteDir)
+	if err != nil {
+		return pkgerrors.Errorf("一覧の取得に失敗: %v", err)
+	}
+	remote := make(map[string]int64)
+	for _, o := range objects {
+		if name := path.Base(o.Name); isSnapshotName(name, false) {
+			remote[name] = o.Size
+		}
+	}
+
+	for _, name := range local {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		if size, ok := remote[name]; ok && size == info.Size() {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("  %s: %s をアップロード予定 (%s)\n", level, name, formatBytes(info.Size()))
+		} else {
+			log.Printf("アップロード開始: %s → %s/%s", name, backend, remoteDir)
+			if err := uploadSnapshot(backend, path.Join(remoteDir, name), filepath.Join(dir, name), limiter); err != nil {
+				return pkgerrors.Errorf("%s のアップロードに失敗: %v", name, err)
+			}
+			log.Printf("アップロード完了: %s (%s)", name, formatBytes(info.Size()))
+		}
+		remote[name] = info.Size()
+	}
+
+	// 保存先の保持数を超えた古いスナップショットを削除
+	var all []string
+	for name := range remote {
+		all = append(all, name)
+	}
+	if len(all) <= keep {
+		return nil
+	}
+	sort.Strings(all)
+	for _, name := range all[:len(all)-keep] {
+		if dryRun {
+			fmt.Printf("  %s: 保存先の %s を削除予定\n", level, name)
+			continue
+		}
+		if err := backend.Remove(path.Join(remoteDir, name)); err != nil {
+			return pkgerrors.Errorf("%s の削除に失敗: %v", name, err)
+		}
+		log.Printf("保存先の古いスナップショットを削除: %s/%s", remoteDir, name)
+	}
+	return nil
+}
+
+// uploadSnapshot はスナップショットのファイルをアップロードします。
+func uploadSnapshot(backend storageBackend, name, localPath string, limiter *rateLimiter) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return backend.Upload(name, f, info.Size(), limiter)
+}
+
+// runReplicate は各ジョブのスナップショットを保存先へ複製します（バックアップの実行時と同じ処理）。
+func runReplicate(configPath string, out io.Writer) error {
+	jobs, err := loadSnapshotJobs(configPath)
+	if err != nil {
+		return err
+	}
+	replicated := 0
+	for _, job := range jobs {
+		if job.Remote.Type == "" {
+			continue
+		}
+		if err := replicateSnapshots(job, job.DryRun); err != nil {
+			return err
+		}
+		replicated++
+	}
+	if replicated == 0 {
+		return wrapFailure(FailureConfig, pkgerrors.New("remote が設定されていません"))
+	}
+	fmt.Fprintln(out, "保存先への複製が完了しました")
+	return nil
+}
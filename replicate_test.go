@@ -0,0 +1,222 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// 保存先への複製のテスト
+// =============================================================================
+
+// newReplicateTestConfig は archive 形式で local の保存先に複製する設定を作成します。
+func newReplicateTestConfig(t *testing.T) (*BackupConfig, string) {
+	cfg := newValidTestConfig(t)
+	cfg.SnapshotFormat = "archive"
+	remoteRoot := filepath.Join(t.TempDir(), "remote")
+	cfg.Remote = RemoteConfig{Type: "local", Path: remoteRoot, Levels: []string{"1d"}, KeepVersions: map[string]int{"1d": 2}}
+	cfg.KeepVersions["1d"] = 3
+	return cfg, remoteRoot
+}
+
+// remoteFiles は保存先のディレクトリのファイル名一覧を返します。
+func remoteFiles(t *testing.T, dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestReplicateSnapshots(t *testing.T) {
+	cfg, remoteRoot := newReplicateTestConfig(t)
+	writeTestFiles(t, cfg.BackupDirs["1d"], map[string]string{
+		"000001_20250701_0000.zip": "one",
+		"000002_20250702_0000.zip": "two",
+		"000003_20250703_0000.zip": "three",
+		"notes.txt":                "not a snapshot",
+	})
+	writeTestFiles(t, filepath.Join(remoteRoot, "1d"), map[string]string{
+		"000002_20250702_0000.zip": "tw", // サイズが違う（前回の不完全なアップロード）
+		"readme.txt":               "keep",
+	})
+
+	if err := replicateSnapshots(cfg, false); err != nil {
+		t.Fatalf("複製に失敗: %v", err)
+	}
+	remoteDir := filepath.Join(remoteRoot, "1d")
+	if got := strings.Join(remoteFiles(t, remoteDir), ","); got != "000002_20250702_0000.zip,000003_20250703_0000.zip,readme.txt" {
+		t.Errorf("保存先のファイルが違います: %s", got)
+	}
+	if got, _ := os.ReadFile(filepath.Join(remoteDir, "000002_20250702_0000.zip")); string(got) != "two" {
+		t.Errorf("サイズの違うスナップショットが再アップロードされていません: %q", got)
+	}
+
+	// ローカルのローテーション後は保存先の古いスナップショットが削除される
+	os.Remove(filepath.Join(cfg.BackupDirs["1d"], "000001_20250701_0000.zip"))
+	writeTestFiles(t, cfg.BackupDirs["1d"], map[string]string{"000004_20250704_0000.zip": "four"})
+	if err := replicateSnapshots(cfg, false); err != nil {
+		t.Fatalf("複製に失敗: %v", err)
+	}
+	if got := strings.Join(remoteFiles(t, remoteDir), ","); got != "000003_20250703_0000.zip,000004_20250704_0000.zip,readme.txt" {
+		t.Errorf("保存先のローテーション結果が違います: %s", got)
+	}
+}
+
+func TestReplicateSnapshotsDryRun(t *testing.T) {
+	cfg, remoteRoot := newReplicateTestConfig(t)
+	writeTestFiles(t, cfg.BackupDirs["1d"], map[string]string{"000002_20250702_0000.zip": "two"})
+	writeTestFiles(t, filepath.Join(remoteRoot, "1d"), map[string]string{
+		"000000_20250630_0000.zip": "old",
+		"000001_20250701_0000.zip": "one",
+	})
+
+	out := captureStdout(t, func() {
+		if err := replicateSnapshots(cfg, true); err != nil {
+			t.Errorf("複製に失敗: %v", err)
+		}
+	})
+	for _, want := range []string{"000002_20250702_0000.zip をアップロード予定", "保存先の 000000_20250630_0000.zip を削除予定"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("出力に %q が含まれていません: %s", want, out)
+		}
+	}
+	if got := strings.Join(remoteFiles(t, filepath.Join(remoteRoot, "1d")), ","); got != "000000_20250630_0000.zip,000001_20250701_0000.zip" {
+		t.Errorf("ドライランで保存先が変更されました: %s", got)
+	}
+}
+
+func TestReplicateSnapshotsJobAndFailure(t *testing.T) {
+	cfg, remoteRoot := newReplicateTestConfig(t)
+	cfg.jobName = "pc1"
+	writeTestFiles(t, cfg.BackupDirs["1d"], map[string]string{"000001_20250701_0000.zip": "one"})
+	if err := replicateSnapshots(cfg, false); err != nil {
+		t.Fatalf("複製に失敗: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(remoteRoot, "pc1", "1d", "000001_20250701_0000.zip")); err != nil {
+		t.Errorf("ジョブ名のディレクトリに複製されていません: %v", err)
+	}
+
+	// 認証情報のない S3 は複製失敗
+	t.Setenv(s3AccessKeyEnv, "")
+	t.Setenv(s3SecretKeyEnv, "")
+	cfg.Remote = RemoteConfig{Type: "s3", Bucket: "backups", Levels: []string{"1d"}}
+	if err := replicateSnapshots(cfg, false); classifyFailure(err) != FailureRemote {
+		t.Errorf("失敗の種類が違います: %v", err)
+	}
+
+	// 未設定の場合は何もしない
+	cfg.Remote = RemoteConfig{}
+	if err := replicateSnapshots(cfg, false); err != nil {
+		t.Errorf("remote 未設定でエラー: %v", err)
+	}
+}
+
+func TestReplicateSnapshotsDryRunDoesNotConnect(t *testing.T) {
+	cfg, _ := newReplicateTestConfig(t)
+	writeTestFiles(t, cfg.BackupDirs["1d"], map[string]string{"000001_20250701_0000.zip": "one"})
+	// 接続すると失敗する保存先（S3 は認証情報なし、SFTP は接続できないアドレス）
+	t.Setenv(s3AccessKeyEnv, "")
+	t.Setenv(s3SecretKeyEnv, "")
+	remotes := []RemoteConfig{
+		{Type: "s3", Bucket: "backups", Path: "pc1", Levels: []string{"1d"}},
+		{Type: "sftp", Host: "127.0.0.1:1", User: "backup", Path: "/backups", Levels: []string{"1d"}},
+	}
+	for _, remote := range remotes {
+		cfg.Remote = remote
+		out := captureStdout(t, func() {
+			if err := replicateSnapshots(cfg, true); err != nil {
+				t.Errorf("%s: ドライランで接続しています: %v", remote.Type, err)
+			}
+		})
+		for _, want := range []string{"接続しません", "000001_20250701_0000.zip をアップロード予定"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: 出力に %q が含まれていません: %s", remote.Type, want, out)
+			}
+		}
+	}
+}
+
+func TestReplicateFailureDoesNotFailBackup(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.SnapshotFormat = "directory"
+	cfg.SourceVHDX = ""
+	cfg.CopyMethodPriority = []string{"native"}
+	cfg.PerfLogPath = filepath.Join(t.TempDir(), "perf.log")
+	cfg.LastExecutionFile = filepath.Join(t.TempDir(), "last_execution.json")
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"main.go": "package main"})
+	t.Setenv(s3AccessKeyEnv, "")
+	t.Setenv(s3SecretKeyEnv, "")
+	cfg.Remote = RemoteConfig{Type: "s3", Bucket: "backups", Levels: []string{"30m"}}
+
+	now := time.Date(2025, 7, 1, 10, 30, 0, 0, time.Local)
+	if err := runOneShotJob(cfg, now); err != nil {
+		t.Fatalf("複製の失敗でバックアップが失敗しました: %v", err)
+	}
+	record, err := loadLastExecutionRecord(cfg.LastExecutionFile)
+	if err != nil {
+		t.Fatalf("最終実行記録の読み込みに失敗: %v", err)
+	}
+	if !record.LastExecutions["30m"].Equal(now) {
+		t.Errorf("最終実行時刻が記録されていません: %v", record.LastExecutions)
+	}
+	if record.LastFailure == nil || record.LastFailure.Kind != FailureRemote.String() {
+		t.Errorf("複製の失敗が記録されていません: %+v", record.LastFailure)
+	}
+
+	// 同じ時刻の再実行では重複してスナップショットを作成しない
+	if err := runOneShotJob(cfg, now); err != nil {
+		t.Fatalf("再実行でエラー: %v", err)
+	}
+	if names, _ := listSnapshots(cfg.BackupDirs["30m"]); len(names) != 1 {
+		t.Errorf("スナップショットが重複して作成されました: %v", names)
+	}
+}
+
+func TestValidateConfigRemote(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(cfg *BackupConfig)
+		key      string
+		severity string
+	}{
+		{"不明な種類", func(cfg *BackupConfig) { cfg.Remote.Type = "ftp" }, "remote.type", SeverityError},
+		{"ディレクトリ形式", func(cfg *BackupConfig) { cfg.SnapshotFormat = "directory" }, "remote.type", SeverityError},
+		{"local のパス未設定", func(cfg *BackupConfig) { cfg.Remote.Path = "" }, "remote.path", SeverityError},
+		{"sftp のホスト未設定", func(cfg *BackupConfig) { cfg.Remote.Type = "sftp"; cfg.Remote.User = "backup" }, "remote.host", SeverityError},
+		{"sftp のユーザー未設定", func(cfg *BackupConfig) { cfg.Remote.Type = "sftp"; cfg.Remote.Host = "nas" }, "remote.user", SeverityError},
+		{"s3 のバケット未設定", func(cfg *BackupConfig) { cfg.Remote.Type = "s3" }, "remote.bucket", SeverityError},
+		{"s3 のエンドポイント不正", func(cfg *BackupConfig) {
+			cfg.Remote = RemoteConfig{Type: "s3", Bucket: "b", Endpoint: "minio:9000", Levels: []string{"1d"}}
+		}, "remote.endpoint", SeverityError},
+		{"レベル未設定", func(cfg *BackupConfig) { cfg.Remote.Levels = nil; cfg.Remote.KeepVersions = nil }, "remote.levels", SeverityWarning},
+		{"不明なレベル", func(cfg *BackupConfig) { cfg.Remote.Levels = []string{"1d", "2d"} }, "remote.levels", SeverityError},
+		{"負の保持数", func(cfg *BackupConfig) { cfg.Remote.KeepVersions["1d"] = -1 }, "remote.keep_versions.1d", SeverityError},
+		{"使用されない保持数", func(cfg *BackupConfig) { cfg.Remote.KeepVersions["1w"] = 1 }, "remote.keep_versions.1w", SeverityWarning},
+		{"負の転送速度", func(cfg *BackupConfig) { cfg.Remote.MaxBytesPerSec = -1 }, "remote.max_bytes_per_sec", SeverityError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, _ := newReplicateTestConfig(t)
+			tt.modify(cfg)
+			p := findProblem(validateConfig(cfg), tt.key)
+			if p == nil {
+				t.Fatalf("%s の問題が検出されません", tt.key)
+			}
+			if p.Severity != tt.severity {
+				t.Errorf("重要度が違います: %v", p.Severity)
+			}
+		})
+	}
+
+	cfg, _ := newReplicateTestConfig(t)
+	for _, p := range validateConfig(cfg) {
+		if strings.HasPrefix(p.Key, "remote") {
+			t.Errorf("正しい設定で問題が検出されました: %+v", p)
+		}
+	}
+}
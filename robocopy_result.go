@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// =============================================================================
+// robocopy の実行結果の解析
+// =============================================================================
+
+// robocopyExitCode は robocopy の終了コード（ビットの組み合わせ）です。
+// 8 以上（コピーできないファイルがある・致命的なエラー）が失敗です。
+type robocopyExitCode int
+
+const (
+	robocopyCopied   robocopyExitCode = 1 << iota // ファイルをコピーした
+	robocopyExtra                                 // コピー先に余分なファイル・ディレクトリがある
+	robocopyMismatch                              // 不一致のファイル・ディレクトリがある
+	robocopyFailed                                // コピーできないファイル・ディレクトリがある
+	robocopyFatal                                 // 致命的なエラー（引数の誤り・アクセス権限の不足）
+)
+
+var robocopyExitCodeLabels = []struct {
+	bit   robocopyExitCode
+	label string
+}{
+	{robocopyCopied, "ファイルをコピー"},
+	{robocopyExtra, "余分なファイルを検出"},
+	{robocopyMismatch, "不一致を検出"},
+	{robocopyFailed, "コピーできないファイルあり"},
+	{robocopyFatal, "致命的なエラー"},
+}
+
+// Succeeded はコピーに失敗したファイルがない場合に true を返します（強制終了した場合の負の値は失敗）。
+func (c robocopyExitCode) Succeeded() bool {
+	return c >= 0 && c&(robocopyFailed|robocopyFatal) == 0
+}
+
+// Has は終了コードに bit が含まれる場合に true を返します。
+func (c robocopyExitCode) Has(bit robocopyExitCode) bool {
+	return c >= 0 && c&bit != 0
+}
+
+func (c robocopyExitCode) String() string {
+	if c < 0 {
+		return fmt.Sprintf("%d: 強制終了", int(c))
+	}
+	if c == 0 {
+		return "0: 変更なし"
+	}
+	var labels []string
+	for _, l := range robocopyExitCodeLabels {
+		if c.Has(l.bit) {
+			labels = append(labels, l.label)
+		}
+	}
+	return fmt.Sprintf("%d: %s", int(c), strings.Join(labels, "・"))
+}
+
+// robocopyCounts はサマリーの1行（ディレクトリ・ファイル・バイト）の値です。
+type robocopyCounts struct {
+	Total, Copied, Skipped, Mismatch, Failed, Extras int64
+}
+
+// robocopyFailure はコピーできなかったファイル・ディレクトリ1件です。
+type robocopyFailure struct {
+	Code    int    // Windows のエラーコード（5 はアクセス拒否）
+	Detail  string // 実行していた処理とパス（例: "Copying File C:\work\a.txt"）
+	Path    string // Detail の中のパス（分からない場合は空）
+	Message string // エラーの説明（次の行）
+}
+
+func (f robocopyFailure) String() string {
+	if f.Message == "" {
+		return fmt.Sprintf("エラー %d: %s", f.Code, f.Detail)
+	}
+	return fmt.Sprintf("エラー %d: %s: %s", f.Code, f.Detail, f.Message)
+}
+
+// robocopyResult は robocopy の出力と終了コードを解析した結果です。
+type robocopyResult struct {
+	ExitCode   robocopyExitCode
+	HasSummary bool // サマリー（/NJS を指定しない場合に出力）がある
+	Dirs       robocopyCounts
+	Files      robocopyCounts
+	Bytes      robocopyCounts
+	Failures   []robocopyFailure
+	// サマリーがない場合のため、ファイルの行から集計したコピーしたファイル数・バイト数
+	CopiedLines int
+	CopiedBytes int64
+	Output      string
+}
+
+var (
+	// robocopyErrorPattern はエラーの行です（英語: "2025/07/07 10:00:00 ERROR 5 (0x00000005) Copying File C:\a.txt"、
+	// 日本語: "... エラー 5 (0x00000005) ファイルをコピーしています C:\a.txt"）。
+	robocopyErrorPattern = regexp.MustCompile(`(?:ERROR|エラー)\s+(\d+)\s+\(0x[0-9A-Fa-f]+\)\s+(.+)$`)
+	// robocopyPathPattern はエラーの行のパス（ドライブレター・UNC）です。
+	robocopyPathPattern = regexp.MustCompile(`(?:[A-Za-z]:\\|\\\\).*$`)
+)
+
+// robocopySummaryRows はサマリーの行の見出し（英語・日本語）です。
+var robocopySummaryRows = map[string]func(r *robocopyResult) *robocopyCounts{
+	"dirs":   func(r *robocopyResult) *robocopyCounts { return &r.Dirs },
+	"ディレクトリ": func(r *robocopyResult) *robocopyCounts { return &r.Dirs },
+	"files":  func(r *robocopyResult) *robocopyCounts { return &r.Files },
+	"ファイル":   func(r *robocopyResult) *robocopyCounts { return &r.Files },
+	"bytes":  func(r *robocopyResult) *robocopyCounts { return &r.Bytes },
+	"バイト":    func(r *robocopyResult) *robocopyCounts { return &r.Bytes },
+}
+
+// parseRobocopyResult は robocopy の出力（UTF-8 に変換済み）と終了コードを解析します。
+func parseRobocopyResult(output string, exitCode int) robocopyResult {
+	r := robocopyResult{ExitCode: robocopyExitCode(exitCode), Output: output}
+	seen := make(map[string]int)
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+
+		if m := robocopyErrorPattern.FindStringSubmatch(line); m != nil {
+			f := robocopyFailure{Detail: strings.TrimSpace(m[2])}
+			fmt.Sscan(m[1], &f.Code)
+			f.Path = robocopyPathPattern.FindString(f.Detail)
+			if i+1 < len(lines) {
+				f.Message = strings.TrimSpace(lines[i+1])
+			}
+			// リトライで同じエラーが繰り返される場合は1件にまとめる
+			if j, ok := seen[f.Detail]; ok {
+				r.Failures[j] = f
+			} else {
+				seen[f.Detail] = len(r.Failures)
+				r.Failures = append(r.Failures, f)
+			}
+			continue
+		}
+
+		if row, counts, ok := parseRobocopySummaryLine(line); ok {
+			*robocopySummaryRows[row](&r) = counts
+			r.HasSummary = true
+			continue
+		}
+
+		if size, ok := parseRobocopyFileLine(line); ok {
+			r.CopiedLines++
+			r.CopiedBytes += size
+		}
+	}
+	return r
+}
+
+// parseRobocopySummaryLine はサマリーの表の行（"   Files :  10  4  6  0  0  1"）を解析します。
+// ヘッダーの "Files : *.*" のように6つの値がない行は false を返します。
+func parseRobocopySummaryLine(line string) (string, robocopyCounts, bool) {
+	label, values, ok := strings.Cut(strings.Replace(line, "：", ":", 1), ":")
+	if !ok {
+		return "", robocopyCounts{}, false
+	}
+	row := strings.ToLower(strings.TrimSpace(label))
+	if _, ok := robocopySummaryRows[row]; !ok {
+		return "", robocopyCounts{}, false
+	}
+
+	// "1.25 m" のように単位が次の要素に分かれている値を結合する
+	var nums []int64
+	fields := strings.Fields(values)
+	for i := 0; i < len(fields); i++ {
+		v := fields[i]
+		if i+1 < len(fields) && len(fields[i+1]) == 1 && strings.Contains("kmgt", strings.ToLower(fields[i+1])) {
+			v += " " + fields[i+1]
+			i++
+		}
+		n, ok := parseRobocopySize(v)
+		if !ok {
+			return "", robocopyCounts{}, false
+		}
+		nums = append(nums, n)
+	}
+	if len(nums) != 6 {
+		return "", robocopyCounts{}, false
+	}
+	return row, robocopyCounts{nums[0], nums[1], nums[2], nums[3], nums[4], nums[5]}, true
+}
+
+// copyResult はコピー方式の共通の結果に変換します。
+// robocopy のスキップは変更のないファイル、余分なファイルは /MIR・/PURGE の場合に削除したファイルです。
+func (r robocopyResult) copyResult(mirror bool) copyResult {
+	result := copyResult{Copied: r.CopiedLines}
+	if r.HasSummary {
+		result.Copied = int(r.Files.Copied)
+		result.Unchanged = int(r.Files.Skipped)
+		if mirror {
+			result.Deleted = int(r.Files.Extras)
+		}
+	}
+	for _, f := range r.Failures {
+		result.Errors = append(result.Errors, f.String())
+	}
+	return result
+}
+
+// log は解析した結果をログに記録します（失敗したファイルは copyResult.logErrors で記録）。
+func (r robocopyResult) log() {
+	log.Printf("robocopy 終了コード %s", r.ExitCode)
+	if r.ExitCode.Has(robocopyMismatch) {
+		log.Printf("robocopy: 不一致のファイル・ディレクトリがあります（同じ名前のファイルとディレクトリなど）")
+	}
+	if !r.HasSummary {
+		if r.CopiedLines == 0 {
+			log.Printf("robocopy 結果: (変化なし - コピーされたファイルはありません)")
+			return
+		}
+		log.Printf("robocopy 結果: %d個のファイルをコピー (%s)", r.CopiedLines, formatBytes(r.CopiedBytes))
+		return
+	}
+	log.Printf("robocopy サマリー:")
+	for _, row := range []struct {
+		name   string
+		counts robocopyCounts
+	}{{"ディレクトリ", r.Dirs}, {"ファイル", r.Files}} {
+		c := row.counts
+		log.Printf("  %s: 合計=%d コピー=%d スキップ=%d 不一致=%d 失敗=%d 余分=%d",
+			row.name, c.Total, c.Copied, c.Skipped, c.Mismatch, c.Failed, c.Extras)
+	}
+	b := r.Bytes
+	log.Printf("  バイト: 合計=%s コピー=%s スキップ=%s 失敗=%s",
+		formatBytes(b.Total), formatBytes(b.Copied), formatBytes(b.Skipped), formatBytes(b.Failed))
+}
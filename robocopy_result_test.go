@@ -0,0 +1,133 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// =============================================================================
+// robocopy の実行結果の解析のテスト
+// =============================================================================
+
+// readRobocopySample は testdata の robocopy の出力を読み込み、実行時と同じく UTF-8 に変換します。
+func readRobocopySample(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return convertShiftJISToUTF8(data)
+}
+
+func TestRobocopyExitCode(t *testing.T) {
+	tests := []struct {
+		code      int
+		succeeded bool
+		want      string
+	}{
+		{0, true, "0: 変更なし"},
+		{1, true, "1: ファイルをコピー"},
+		{3, true, "3: ファイルをコピー・余分なファイルを検出"},
+		{7, true, "7: ファイルをコピー・余分なファイルを検出・不一致を検出"},
+		{8, false, "8: コピーできないファイルあり"},
+		{9, false, "9: ファイルをコピー・コピーできないファイルあり"},
+		{16, false, "16: 致命的なエラー"},
+		{-1, false, "-1: 強制終了"},
+	}
+	for _, tt := range tests {
+		c := robocopyExitCode(tt.code)
+		if c.Succeeded() != tt.succeeded || c.String() != tt.want {
+			t.Errorf("終了コード %d: Succeeded = %v, String = %q, want %v, %q", tt.code, c.Succeeded(), c.String(), tt.succeeded, tt.want)
+		}
+	}
+}
+
+func TestParseRobocopyResultEnglish(t *testing.T) {
+	r := parseRobocopyResult(readRobocopySample(t, "robocopy_en.txt"), 3)
+	if !r.HasSummary {
+		t.Fatal("サマリーを解析できません")
+	}
+	want := []robocopyCounts{
+		{Total: 3, Copied: 1, Skipped: 2},
+		{Total: 5, Copied: 3, Skipped: 2, Extras: 1},
+		{Total: 1835008, Copied: 1572864, Skipped: 262144, Extras: 100},
+	}
+	if got := []robocopyCounts{r.Dirs, r.Files, r.Bytes}; !reflect.DeepEqual(got, want) {
+		t.Errorf("サマリー = %+v, want %+v", got, want)
+	}
+	if len(r.Failures) != 0 {
+		t.Errorf("失敗したファイル = %+v", r.Failures)
+	}
+	// ディレクトリ・削除対象の行は数えない
+	if r.CopiedLines != 3 || r.CopiedBytes != 512+1572864+2048 {
+		t.Errorf("ファイルの行の集計 = %d, %d", r.CopiedLines, r.CopiedBytes)
+	}
+
+	result := r.copyResult(true)
+	if result.Copied != 3 || result.Unchanged != 2 || result.Deleted != 1 || len(result.Errors) != 0 {
+		t.Errorf("copyResult = %+v", result)
+	}
+	if result := r.copyResult(false); result.Deleted != 0 {
+		t.Errorf("/MIR なしで削除数が設定されました: %+v", result)
+	}
+}
+
+func TestParseRobocopyResultJapanese(t *testing.T) {
+	r := parseRobocopyResult(readRobocopySample(t, "robocopy_ja_sjis.txt"), 9)
+	if r.ExitCode.Succeeded() {
+		t.Error("終了コード 9 が成功になりました")
+	}
+	if !r.HasSummary || r.Dirs.Failed != 1 || r.Files != (robocopyCounts{Total: 4, Copied: 2, Skipped: 1, Failed: 1}) ||
+		r.Bytes != (robocopyCounts{Total: 1572864, Copied: 1572864, Skipped: 10, Failed: 10}) {
+		t.Errorf("サマリー = %v %+v %+v %+v", r.HasSummary, r.Dirs, r.Files, r.Bytes)
+	}
+
+	// リトライで繰り返されたエラーは1件にまとめる
+	want := []robocopyFailure{
+		{Code: 5, Detail: `ファイルをコピーしています C:\work\locked.txt`, Path: `C:\work\locked.txt`, Message: "アクセスが拒否されました。"},
+		{Code: 32, Detail: `コピー先ディレクトリを作成しています D:\mirror\busy\`, Path: `D:\mirror\busy\`, Message: "プロセスはファイルにアクセスできません。別のプロセスが使用中です。"},
+	}
+	if !reflect.DeepEqual(r.Failures, want) {
+		t.Errorf("失敗したファイル = %+v, want %+v", r.Failures, want)
+	}
+	result := r.copyResult(true)
+	if len(result.Errors) != 2 || result.Errors[0] != `エラー 5: ファイルをコピーしています C:\work\locked.txt: アクセスが拒否されました。` {
+		t.Errorf("copyResult のエラー = %q", result.Errors)
+	}
+}
+
+func TestParseRobocopyResultWithoutSummary(t *testing.T) {
+	// /NJH /NJS（テンプレートの既定値）ではファイルの行のみ
+	out := "\t    New File  \t\t     512\ta.txt\r\n\t    Newer     \t\t    10 k\tb.txt\r\n"
+	r := parseRobocopyResult(out, 1)
+	if r.HasSummary || r.CopiedLines != 2 || r.CopiedBytes != 512+10240 {
+		t.Errorf("結果 = %+v", r)
+	}
+	if result := r.copyResult(true); result.Copied != 2 || result.Unchanged != 0 {
+		t.Errorf("copyResult = %+v", result)
+	}
+}
+
+func TestParseRobocopySummaryLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		row    string
+		counts robocopyCounts
+		ok     bool
+	}{
+		{"    Dirs :         3         1         2         0         0         0", "dirs", robocopyCounts{3, 1, 2, 0, 0, 0}, true},
+		{"   Bytes :   1.0 g   512 m         0         0         0     1.5 k", "bytes", robocopyCounts{1 << 30, 512 << 20, 0, 0, 0, 1536}, true},
+		{"  ファイル：         1         1         0         0         0         0", "ファイル", robocopyCounts{1, 1, 0, 0, 0, 0}, true},
+		{"    Files : *.*", "", robocopyCounts{}, false},
+		{"   Times :   0:00:00   0:00:00                       0:00:00   0:00:00", "", robocopyCounts{}, false},
+		{"   Files :         3         1", "", robocopyCounts{}, false},
+	}
+	for _, tt := range tests {
+		row, counts, ok := parseRobocopySummaryLine(tt.line)
+		if row != tt.row || counts != tt.counts || ok != tt.ok {
+			t.Errorf("parseRobocopySummaryLine(%q) = %q, %+v, %v", tt.line, row, counts, ok)
+		}
+	}
+}
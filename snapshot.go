@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// スナップショット形式
+// =============================================================================
+
+// snapshotFormat はレベル別ディレクトリに保存するスナップショットの形式です。
+// directory・hardlink はコピー先 backup_dir（ミラー）の内容を、archive は拡張子・除外設定で
+// 絞り込んだ work_dir のファイルを保存します。
+type snapshotFormat interface {
+	// Name は snapshot_format に指定する名前を返します。
+	Name() string
+	// Ext はスナップショット名の拡張子を返します（ディレクトリの形式は空）。
+	Ext() string
+	// IsDir はスナップショットがディレクトリの場合に true を返します。
+	IsDir() bool
+	// Prepare はコピー前の準備（VHDX のマウント等）を行います。
+	Prepare(cfg *BackupConfig) error
+	// Create は dst にスナップショットを作成します。
+	Create(cfg *BackupConfig, dst string) error
+}
+
+// defaultSnapshotFormat は snapshot_format 省略時の形式です。
+const defaultSnapshotFormat = "vhdx"
+
+// snapshotFormats は利用できるスナップショット形式の一覧です。
+var snapshotFormats = []snapshotFormat{
+	vhdxSnapshot{},
+	directorySnapshot{},
+	hardlinkSnapshot{},
+	archiveSnapshot{},
+}
+
+// snapshotFormatNames は snapshot_format に指定できる名前の一覧を返します。
+func snapshotFormatNames() []string {
+	var names []string
+	for _, f := range snapshotFormats {
+		names = append(names, f.Name())
+	}
+	return names
+}
+
+// findSnapshotFormat は名前に対応するスナップショット形式を返します。
+func findSnapshotFormat(name string) (snapshotFormat, bool) {
+	for _, f := range snapshotFormats {
+		if f.Name() == name {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// snapshotFormat は設定されたスナップショット形式を返します。
+// 不明な名前は設定検査で検出されるため、ここでは既定の形式として扱います。
+func (cfg *BackupConfig) snapshotFormat() snapshotFormat {
+	if f, ok := findSnapshotFormat(defaultString(cfg.SnapshotFormat, defaultSnapshotFormat)); ok {
+		if _, ok := f.(archiveSnapshot); ok {
+			return archiveSnapshot{codec: cfg.archiveCodec()}
+		}
+		return f
+	}
+	f, _ := findSnapshotFormat(defaultSnapshotFormat)
+	return f
+}
+
+// snapshotName は通し番号と時刻からスナップショット名を生成します。
+func snapshotName(format snapshotFormat, id int, timeStamp string) string {
+	return fmt.Sprintf("%06d_%s%s", id, timeStamp, format.Ext())
+}
+
+// snapshotNamePattern は拡張子を除いたスナップショット名に一致します。
+var snapshotNamePattern = regexp.MustCompile(`^\d+_\d{8}_\d{4}$`)
+
+// isSnapshotEntry はディレクトリ内の項目がいずれかの形式のスナップショットかを判定します。
+// 形式や暗号化の有無を切り替えた後も、以前のスナップショットをローテーションの対象にします。
+func isSnapshotEntry(e os.DirEntry) bool {
+	return isSnapshotName(e.Name(), e.IsDir())
+}
+
+// isSnapshotName は名前がいずれかの形式のスナップショットの名前かを判定します。
+func isSnapshotName(name string, isDir bool) bool {
+	if !isDir {
+		name = strings.TrimSuffix(name, encryptedExt)
+	}
+	for _, f := range snapshotVariants() {
+		if f.IsDir() != isDir || !strings.HasSuffix(name, f.Ext()) {
+			continue
+		}
+		if snapshotNamePattern.MatchString(strings.TrimSuffix(name, f.Ext())) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotVariants はローテーションで認識する形式（アーカイブは圧縮形式ごと）の一覧を返します。
+func snapshotVariants() []snapshotFormat {
+	variants := append([]snapshotFormat{}, snapshotFormats...)
+	for _, c := range archiveCodecs {
+		variants = append(variants, archiveSnapshot{codec: c})
+	}
+	return variants
+}
+
+// listSnapshots はディレクトリ内のスナップショット名を古い順に返します。
+func listSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if isSnapshotEntry(e) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// createSnapshot は dst の一時名（dst + ".partial"）にスナップショットを作成し、完了後に dst へ名前を変更します。
+// 途中で中断した・ディスクが一杯になった場合の不完全なスナップショットは名前が異なるため、
+// ローテーション・昇格・一覧の対象になりません（次回の実行時に removePartialSnapshots で削除）。
+func createSnapshot(cfg *BackupConfig, format snapshotFormat, dst string) error {
+	if cfg.DryRun {
+		return format.Create(cfg, dst)
+	}
+	removePartialSnapshots(cfg)
+	partial := dst + partialExt
+	if err := format.Create(cfg, partial); err != nil {
+		os.RemoveAll(partial)
+		return err
+	}
+	if err := os.Rename(partial, dst); err != nil {
+		os.RemoveAll(partial)
+		return pkgerrors.Errorf("スナップショットの名前を変更できません: %v", err)
+	}
+	syncDir(filepath.Dir(dst))
+	return nil
+}
+
+// isPartialSnapshotName は名前が作成途中のスナップショット（createSnapshot の一時名）かを判定します。
+func isPartialSnapshotName(name string, isDir bool) bool {
+	return strings.HasSuffix(name, partialExt) && isSnapshotName(strings.TrimSuffix(name, partialExt), isDir)
+}
+
+// removePartialSnapshots は各レベルのディレクトリに残っている作成途中のスナップショットを削除します。
+// VHDX・backup_dir は実行のたびに内容が変わるため、前回の続きからは再開せず作成し直します。
+func removePartialSnapshots(cfg *BackupConfig) {
+	for _, dir := range cfg.BackupDirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !isPartialSnapshotName(e.Name(), e.IsDir()) {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			if err := os.RemoveAll(path); err != nil {
+				log.Printf("作成途中のスナップショットを削除できません: %s: %v", path, err)
+				continue
+			}
+			log.Printf("前回の作成途中のスナップショットを削除しました: %s", path)
+		}
+	}
+}
+
+// syncDir はディレクトリの変更（名前の変更）をディスクに書き込みます。
+// Windows 等ディレクトリを同期できない場合は何もしません。
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	d.Sync()
+}
+
+// latestSnapshotDir は全レベルの中で最も新しいディレクトリのスナップショットを返します。
+// 見つからない場合は空文字列を返します。
+func latestSnapshotDir(cfg *BackupConfig) string {
+	var latest, latestName string
+	for _, dir := range cfg.BackupDirs {
+		names, err := listSnapshots(dir)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			if info, err := os.Stat(path); err != nil || !info.IsDir() {
+				continue
+			}
+			if name > latestName {
+				latest, latestName = path, name
+			}
+		}
+	}
+	return latest
+}
+
+// -----------------------------------------------------------------------------
+// vhdx: VHDX ファイルのコピー
+// -----------------------------------------------------------------------------
+
+// vhdxSnapshot は source_vhdx のファイルをそのままコピーする形式です。
+type vhdxSnapshot struct{}
+
+func (vhdxSnapshot) Name() string { return "vhdx" }
+func (vhdxSnapshot) Ext() string  { return ".vhdx" }
+func (vhdxSnapshot) IsDir() bool  { return false }
+
+// Prepare は VHDX が vhdx_mount_drive にマウントされていることを確認し、未マウントであればマウントします。
+func (vhdxSnapshot) Prepare(cfg *BackupConfig) error {
+	return prepareVHDX(cfg)
+}
+
+func (vhdxSnapshot) Create(cfg *BackupConfig, dst string) error {
+	key, err := snapshotKey(cfg)
+	if err != nil {
+		return err
+	}
+	restore, err := freezeVHDX(cfg)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	p := startProgress(cfg, "VHDX保存")
+	if info, err := os.Stat(cfg.SourceVHDX); err == nil {
+		p.SetTotal(info.Size(), 1, false)
+	}
+	defer p.Finish()
+	return saveBackup(filepath.Dir(dst), filepath.Base(dst), cfg.SourceVHDX, key, cfg.Throttle.newLimiter(), p, cfg.DryRun)
+}
+
+// snapshotKey は暗号化が有効な場合に鍵を返します（無効な場合は nil）。
+func snapshotKey(cfg *BackupConfig) (*encryptionKey, error) {
+	if !cfg.Encryption.Enabled {
+		return nil, nil
+	}
+	return cfg.encryptionKey()
+}
+
+// -----------------------------------------------------------------------------
+// directory: ディレクトリの複製
+// -----------------------------------------------------------------------------
+
+// directorySnapshot は backup_dir をタイムスタンプ付きのディレクトリへ複製する形式です。
+type directorySnapshot struct{}
+
+func (directorySnapshot) Name() string                { return "directory" }
+func (directorySnapshot) Ext() string                 { return "" }
+func (directorySnapshot) IsDir() bool                 { return true }
+func (directorySnapshot) Prepare(*BackupConfig) error { return nil }
+
+func (directorySnapshot) Create(cfg *BackupConfig, dst string) error {
+	if cfg.DryRun {
+		fmt.Printf("ディレクトリのスナップショット保存: %s → %s\n", cfg.BackupDir, dst)
+		return nil
+	}
+	p := startProgress(cfg, "スナップショット保存")
+	if p != nil {
+		bytes, files := treeSize(cfg.BackupDir)
+		p.SetTotal(bytes, files, false)
+	}
+	stats, err := snapshotCopy{Progress: p, Limiter: cfg.Throttle.newLimiter()}.run(cfg.BackupDir, dst)
+	p.Finish()
+	if err != nil {
+		return err
+	}
+	log.Printf("スナップショット保存: %d個のファイル (%d bytes)", stats.Files, stats.Bytes)
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// hardlink: 前回のスナップショットからのハードリンク
+// -----------------------------------------------------------------------------
+
+// hardlinkSnapshot は変更のないファイルを前回のスナップショットからハードリンクし、
+// 変更のあったファイルのみをコピーする形式です（rsync --link-dest 相当）。
+type hardlinkSnapshot struct{}
+
+func (hardlinkSnapshot) Name() string                { return "hardlink" }
+func (hardlinkSnapshot) Ext() string                 { return "" }
+func (hardlinkSnapshot) IsDir() bool                 { return true }
+func (hardlinkSnapshot) Prepare(*BackupConfig) error { return nil }
+
+func (hardlinkSnapshot) Create(cfg *BackupConfig, dst string) error {
+	c := snapshotCopy{
+		Prev:    latestSnapshotDir(cfg),
+		Compare: defaultString(cfg.HardlinkCompare, defaultHardlinkCompare),
+		DryRun:  cfg.DryRun,
+		Limiter: cfg.Throttle.newLimiter(),
+	}
+	// ハードリンクしたファイルも処理済みとして数える
+	c.Progress = startProgress(cfg, "スナップショット保存")
+	if c.Progress != nil {
+		bytes, files := treeSize(cfg.BackupDir)
+		c.Progress.SetTotal(bytes, files, false)
+	}
+	defer c.Progress.Finish()
+	if cfg.DryRun {
+		fmt.Printf("ハードリンクのスナップショット保存: %s → %s\n", cfg.BackupDir, dst)
+		if c.Prev == "" {
+			fmt.Println("  リンク元: なし（すべてコピー）")
+		} else {
+			fmt.Printf("  リンク元: %s (判定: %s)\n", c.Prev, c.Compare)
+		}
+	}
+	stats, err := c.run(cfg.BackupDir, dst)
+	if err != nil {
+		return err
+	}
+	if cfg.DryRun {
+		fmt.Printf("  → リンク %d個, コピー %d個 (%d bytes) 予定\n", stats.Linked, stats.Files-stats.Linked, stats.Bytes)
+		return nil
+	}
+	log.Printf("スナップショット保存: %d個のファイル (うちリンク %d個, コピー %d bytes)", stats.Files, stats.Linked, stats.Bytes)
+	return nil
+}
+
+// 変更の判定方法（hardlink_compare）
+const (
+	hardlinkCompareMtime   = "mtime" // サイズと更新日時
+	hardlinkCompareHash    = "hash"  // サイズと内容のハッシュ
+	defaultHardlinkCompare = hardlinkCompareMtime
+)
+
+// hardlinkCompareMethods は hardlink_compare に指定できる値の一覧です。
+var hardlinkCompareMethods = []string{hardlinkCompareMtime, hardlinkCompareHash}
+
+// snapshotStats はスナップショット作成の集計です。
+type snapshotStats struct {
+	Files  int   // 保存したファイル数
+	Linked int   // ハードリンクしたファイル数
+	Bytes  int64 // コピーしたバイト数
+}
+
+// snapshotCopy はディレクトリのスナップショット作成の設定です。
+type snapshotCopy struct {
+	Prev    string // リンク元の前回のスナップショット（空の場合はすべてコピー）
+	Compare string // 変更の判定方法（mtime / hash）
+	DryRun  bool   // 集計のみ行い、ファイルを作成しない
+
+	Progress *progress    // 処理したバイト数・ファイル数を加算する（nil の場合は加算しない）
+	Limiter  *rateLimiter // コピーの転送速度の上限（nil の場合は制限しない）
+}
+
+// copySnapshotTree は src 以下を dst にすべてコピーします。
+func copySnapshotTree(src, dst string) (snapshotStats, error) {
+	return snapshotCopy{}.run(src, dst)
+}
+
+// run は src 以下を dst に複製します。
+// 前回のスナップショットと変更のないファイルはハードリンクし、それ以外はコピーします。
+// 失敗した場合は作成途中の dst を削除します。
+func (c snapshotCopy) run(src, dst string) (stats snapshotStats, err error) {
+	if _, err := os.Stat(dst); err == nil {
+		return stats, pkgerrors.Errorf("スナップショットが既に存在します: %s", dst)
+	}
+	if !c.DryRun {
+		defer func() {
+			if err != nil {
+				os.RemoveAll(dst)
+			}
+		}()
+	}
+
+	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dst, rel)
+		if info.IsDir() {
+			if c.DryRun {
+				return nil
+			}
+			return os.MkdirAll(dest, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		stats.Files++
+		if c.Prev != "" {
+			old := filepath.Join(c.Prev, rel)
+			// 別ボリューム等でリンクできない場合はコピーする
+			if c.unchanged(old, path, info) && (c.DryRun || os.Link(old, dest) == nil) {
+				stats.Linked++
+				c.Progress.Add(info.Size())
+				c.Progress.AddFile()
+				return nil
+			}
+		}
+		stats.Bytes += info.Size()
+		if c.DryRun {
+			return nil
+		}
+		if err := copyFileWithTimes(path, dest, info, c.Limiter, c.Progress); err != nil {
+			return err
+		}
+		c.Progress.AddFile()
+		return nil
+	})
+	return stats, err
+}
+
+// unchanged は前回のスナップショットのファイル old が path と同じ内容とみなせるかを判定します。
+func (c snapshotCopy) unchanged(old, path string, info os.FileInfo) bool {
+	oldInfo, err := os.Stat(old)
+	if err != nil || !oldInfo.Mode().IsRegular() || oldInfo.Size() != info.Size() {
+		return false
+	}
+	if c.Compare == hardlinkCompareHash {
+		oldSum, err := fileSHA256(old)
+		if err != nil {
+			return false
+		}
+		sum, err := fileSHA256(path)
+		return err == nil && sum == oldSum
+	}
+	return oldInfo.ModTime().Equal(info.ModTime())
+}
+
+// fileSHA256 はファイル内容の SHA-256 を16進文字列で返します。
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyFileWithTimes はファイルをコピーし、更新日時を元のファイルに合わせます。
+// 更新日時は次回のハードリンクの判定に使用します。limiter で転送速度を制限し、p にはコピーしたバイト数を加算します。
+func copyFileWithTimes(src, dst string, info os.FileInfo, limiter *rateLimiter, p *progress) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, limiter.Reader(p.Reader(in))); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// -----------------------------------------------------------------------------
+// archive: 圧縮アーカイブ
+// -----------------------------------------------------------------------------
+
+// archiveSnapshot は work_dir を コピーと同じ規則で絞り込んだファイルを
+// 圧縮アーカイブ（archive_format）に保存する形式です。
+type archiveSnapshot struct {
+	codec archiveCodec // 圧縮形式（nil の場合は既定の形式）
+}
+
+func (archiveSnapshot) Name() string                { return "archive" }
+func (archiveSnapshot) IsDir() bool                 { return false }
+func (archiveSnapshot) Prepare(*BackupConfig) error { return nil }
+
+func (a archiveSnapshot) Ext() string { return a.archiveCodec().Ext() }
+
+func (a archiveSnapshot) archiveCodec() archiveCodec {
+	if a.codec != nil {
+		return a.codec
+	}
+	c, _ := findArchiveCodec(defaultArchiveFormat)
+	return c
+}
+
+func (a archiveSnapshot) Create(cfg *BackupConfig, dst string) error {
+	codec := a.archiveCodec()
+	if cfg.DryRun {
+		fmt.Printf("アーカイブのスナップショット保存 (%s): %s → %s\n", codec.Name(), cfg.WorkDir, dst)
+		return nil
+	}
+	start := time.Now()
+	files, err := writeArchive(cfg, codec, dst)
+	if err != nil {
+		return err
+	}
+	size := int64(0)
+	if info, err := os.Stat(dst); err == nil {
+		size = info.Size()
+	}
+	log.Printf("スナップショット保存: %d個のファイルをアーカイブ (%s, %s, %v)", files, codec.Name(), formatBytes(size), time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// スナップショットの一覧・復元（list / restore）
+// =============================================================================
+
+// snapshotEntry はレベル別ディレクトリ内のスナップショットです。
+type snapshotEntry struct {
+	Job   string // ジョブ名（jobs 未設定の場合は空）
+	Level string
+	Name  string
+	Path  string
+	Cfg   *BackupConfig // スナップショットを作成したジョブの設定（復号の鍵に使用）
+}
+
+// collectSnapshots は各ジョブ・各レベルのスナップショットをレベル順・古い順に返します。
+func collectSnapshots(jobs []*BackupConfig) []snapshotEntry {
+	var entries []snapshotEntry
+	for _, job := range jobs {
+		for _, level := range orderedLevels(job) {
+			dir := job.BackupDirs[level]
+			names, err := listSnapshots(dir)
+			if err != nil {
+				continue
+			}
+			for _, name := range names {
+				entries = append(entries, snapshotEntry{Job: job.jobName, Level: level, Name: name, Path: filepath.Join(dir, name), Cfg: job})
+			}
+		}
+	}
+	return entries
+}
+
+// orderedLevels は backup_dirs のレベルをスケジュール順（未知のレベルは末尾に名前順）で返します。
+func orderedLevels(cfg *BackupConfig) []string {
+	var levels []string
+	for _, level := range scheduledLevels {
+		if _, ok := cfg.BackupDirs[level]; ok {
+			levels = append(levels, level)
+		}
+	}
+	var others []string
+	for level := range cfg.BackupDirs {
+		if !isScheduledLevel(level) {
+			others = append(others, level)
+		}
+	}
+	sort.Strings(others)
+	return append(levels, others...)
+}
+
+// snapshotIDPattern はスナップショット名の先頭の通し番号に一致します。
+var snapshotIDPattern = regexp.MustCompile(`^(\d+)_`)
+
+// findSnapshot は名前・拡張子を除いた名前・通し番号・パスのいずれかでスナップショットを探します。
+func findSnapshot(jobs []*BackupConfig, name string) (snapshotEntry, error) {
+	if info, err := os.Stat(name); err == nil && (info.IsDir() || info.Mode().IsRegular()) && strings.ContainsAny(name, `/\`) {
+		// パスで指定した場合は先頭のジョブの設定（鍵）で読み込む
+		return snapshotEntry{Name: filepath.Base(name), Path: name, Cfg: jobs[0]}, nil
+	}
+
+	id, idErr := strconv.Atoi(name)
+	var found []snapshotEntry
+	for _, e := range collectSnapshots(jobs) {
+		// 暗号化したスナップショットは .enc を除いた名前でも指定できる
+		plain := strings.TrimSuffix(e.Name, encryptedExt)
+		base := plain
+		for _, f := range snapshotVariants() {
+			if f.Ext() != "" && strings.HasSuffix(base, f.Ext()) {
+				base = strings.TrimSuffix(base, f.Ext())
+				break
+			}
+		}
+		match := e.Name == name || plain == name || base == name
+		if m := snapshotIDPattern.FindStringSubmatch(e.Name); idErr == nil && m != nil {
+			if n, _ := strconv.Atoi(m[1]); n == id {
+				match = true
+			}
+		}
+		if match {
+			found = append(found, e)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return snapshotEntry{}, wrapFailure(FailureConfig, pkgerrors.Errorf("スナップショットが見つかりません: %s", name))
+	case 1:
+		return found[0], nil
+	}
+	var paths []string
+	for _, e := range found {
+		paths = append(paths, e.Path)
+	}
+	return snapshotEntry{}, wrapFailure(FailureConfig, pkgerrors.Errorf("スナップショット %s が複数見つかりました（--job またはパスで指定してください）: %s", name, strings.Join(paths, ", ")))
+}
+
+// loadSnapshotJobs は一覧・復元の対象とするジョブの設定を読み込みます。
+func loadSnapshotJobs(configPath string) ([]*BackupConfig, error) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, wrapFailure(FailureConfig, err)
+	}
+	return selectJobs(cfg, args.Jobs)
+}
+
+// runList はスナップショットの一覧、または name を指定した場合はその中のファイル一覧を表示します。
+func runList(configPath, name string, out io.Writer) error {
+	jobs, err := loadSnapshotJobs(configPath)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		entry, err := findSnapshot(jobs, name)
+		if err != nil {
+			return err
+		}
+		return listSnapshotFiles(entry.Cfg, entry.Path, out)
+	}
+
+	entries := collectSnapshots(jobs)
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "スナップショットはありません")
+		return nil
+	}
+	lastGroup := ""
+	for _, e := range entries {
+		group := e.Level
+		if e.Job != "" {
+			group = e.Job + " / " + e.Level
+		}
+		if group != lastGroup {
+			fmt.Fprintf(out, "%s:\n", group)
+			lastGroup = group
+		}
+		size := "ディレクトリ"
+		if info, err := os.Stat(e.Path); err == nil && !info.IsDir() {
+			size = formatBytes(info.Size())
+		}
+		fmt.Fprintf(out, "  %-32s %12s\n", e.Name, size)
+	}
+	return nil
+}
+
+// listSnapshotFiles はスナップショット内のファイルを展開せずに一覧表示します。
+func listSnapshotFiles(cfg *BackupConfig, snapshotPath string, out io.Writer) error {
+	r, err := openSnapshot(cfg, snapshotPath)
+	if err != nil {
+		return wrapFailure(FailureConfig, err)
+	}
+	defer r.Close()
+
+	files, total := 0, int64(0)
+	err = r.Walk(func(f snapshotFile) error {
+		fmt.Fprintf(out, "%s  %12s  %s\n", f.ModTime.Format("2006-01-02 15:04:05"), formatBytes(f.Size), f.Name)
+		files++
+		total += f.Size
+		return nil
+	})
+	if err != nil {
+		return pkgerrors.Errorf("スナップショットの読み込みに失敗: %v", err)
+	}
+	fmt.Fprintf(out, "%d個のファイル (%s)\n", files, formatBytes(total))
+	return nil
+}
+
+// restoreOptions は restore コマンドの指定内容です。
+type restoreOptions struct {
+	To    string // 復元先ディレクトリ
+	Force bool   // 既存のファイルを上書きする
+}
+
+// runRestore はスナップショットから paths（省略時はすべて）のファイルを復元先へ書き出します。
+// paths はスナップショット内のファイルまたはディレクトリの相対パス（スラッシュ区切り）です。
+func runRestore(configPath, name string, paths []string, opts restoreOptions, out io.Writer) error {
+	if opts.To == "" {
+		return wrapFailure(FailureConfig, pkgerrors.New("復元先ディレクトリを --to で指定してください"))
+	}
+	jobs, err := loadSnapshotJobs(configPath)
+	if err != nil {
+		return err
+	}
+	entry, err := findSnapshot(jobs, name)
+	if err != nil {
+		return err
+	}
+	r, err := openSnapshot(entry.Cfg, entry.Path)
+	if err != nil {
+		return wrapFailure(FailureConfig, err)
+	}
+	defer r.Close()
+
+	for i, p := range paths {
+		paths[i] = strings.Trim(path.Clean(filepath.ToSlash(p)), "/")
+	}
+	restored, skipped := 0, 0
+	err = r.Walk(func(f snapshotFile) error {
+		if !matchesRestorePath(f.Name, paths) {
+			return nil
+		}
+		dst, err := restoreTarget(opts.To, f.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(dst); err == nil && !opts.Force {
+			fmt.Fprintf(out, "スキップ（既に存在します。上書きする場合は --force）: %s\n", dst)
+			skipped++
+			return nil
+		}
+		if err := restoreFile(f, dst); err != nil {
+			return pkgerrors.Errorf("%s の復元に失敗: %v", f.Name, err)
+		}
+		restored++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if restored == 0 && skipped == 0 {
+		return wrapFailure(FailureConfig, pkgerrors.Errorf("復元対象のファイルがありません: %s %s", entry.Name, strings.Join(paths, " ")))
+	}
+	fmt.Fprintf(out, "%s から %d個のファイルを復元しました: %s\n", entry.Name, restored, opts.To)
+	if skipped > 0 {
+		fmt.Fprintf(out, "%d個のファイルは既に存在するため復元していません\n", skipped)
+	}
+	return nil
+}
+
+// runVerify はスナップショット（name 省略時はすべて）の内容をすべて読み出して検証します。
+// 暗号化したスナップショットは復号時の認証で改ざん・破損を検出します。
+func runVerify(configPath, name string, out io.Writer) error {
+	jobs, err := loadSnapshotJobs(configPath)
+	if err != nil {
+		return err
+	}
+	var entries []snapshotEntry
+	if name != "" {
+		entry, err := findSnapshot(jobs, name)
+		if err != nil {
+			return err
+		}
+		entries = []snapshotEntry{entry}
+	} else {
+		entries = collectSnapshots(jobs)
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "スナップショットはありません")
+		return nil
+	}
+
+	failed := 0
+	for _, e := range entries {
+		if err := verifySnapshot(e.Cfg, e.Path); err != nil {
+			fmt.Fprintf(out, "NG  %s: %v\n", e.Path, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(out, "OK  %s\n", e.Path)
+	}
+	if failed > 0 {
+		return wrapFailure(FailureSnapshot, pkgerrors.Errorf("%d個のスナップショットの検証に失敗しました", failed))
+	}
+	fmt.Fprintf(out, "%d個のスナップショットを検証しました\n", len(entries))
+	return nil
+}
+
+// verifySnapshot はスナップショットの内容をすべて読み出します。
+// VHDX は中身を解釈できないため、ファイル全体の読み出し（暗号化されている場合は復号）のみを確認します。
+func verifySnapshot(cfg *BackupConfig, snapshotPath string) error {
+	if strings.HasSuffix(strings.TrimSuffix(snapshotPath, encryptedExt), ".vhdx") {
+		data, err := openSnapshotData(cfg, snapshotPath)
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+		_, err = io.Copy(io.Discard, io.NewSectionReader(data, 0, data.Size()))
+		return err
+	}
+	r, err := openSnapshot(cfg, snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.Walk(func(f snapshotFile) error {
+		in, err := f.Open()
+		if err != nil {
+			return pkgerrors.Errorf("%s: %v", f.Name, err)
+		}
+		defer in.Close()
+		if _, err := io.Copy(io.Discard, in); err != nil {
+			return pkgerrors.Errorf("%s: %v", f.Name, err)
+		}
+		return nil
+	})
+}
+
+// matchesRestorePath はファイル名が復元対象のパスのいずれか（またはその配下）に一致するかを判定します。
+func matchesRestorePath(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		if p == "." || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreTarget は復元先のパスを返します。復元先の外を指す名前はエラーにします。
+func restoreTarget(root, name string) (string, error) {
+	clean := path.Clean("/" + name)
+	if clean == "/" || clean != "/"+strings.TrimPrefix(name, "/") {
+		return "", pkgerrors.Errorf("不正なファイル名です: %s", name)
+	}
+	return filepath.Join(root, filepath.FromSlash(clean[1:])), nil
+}
+
+// restoreFile はスナップショット内のファイルを dst に書き出し、更新日時を復元します。
+func restoreFile(f snapshotFile, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	perm := f.Mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, f.ModTime, f.ModTime)
+}
+
+// formatBytes はバイト数を読みやすい単位で返します。
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// スナップショットの一覧・復元のテスト
+// =============================================================================
+
+// writeBrowseFixture はディレクトリ・tar.zst・zip のスナップショットを持つ設定ファイルを作成します。
+func writeBrowseFixture(t *testing.T) (configPath string, cfg *BackupConfig) {
+	cfg = newValidTestConfig(t)
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"src/main.go": "main v1", "src/util.go": "util v1", "docs/a.md": "doc"})
+
+	dir := filepath.Join(cfg.BackupDirs["30m"], "000003_20250701_1000")
+	if _, err := copySnapshotTree(cfg.WorkDir, dir); err != nil {
+		t.Fatalf("スナップショットの作成に失敗: %v", err)
+	}
+	os.MkdirAll(cfg.BackupDirs["3h"], 0755)
+	if _, err := writeArchive(cfg, tarZstdCodec{}, filepath.Join(cfg.BackupDirs["3h"], "000002_20250701_0900.tar.zst")); err != nil {
+		t.Fatalf("アーカイブの作成に失敗: %v", err)
+	}
+	os.MkdirAll(cfg.BackupDirs["1d"], 0755)
+	if _, err := writeArchive(cfg, zipCodec{}, filepath.Join(cfg.BackupDirs["1d"], "000001_20250630_0000.zip")); err != nil {
+		t.Fatalf("アーカイブの作成に失敗: %v", err)
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"dry_run": true, "backup_dirs": cfg.BackupDirs, "keep_versions": cfg.KeepVersions})
+	return writeTestConfig(t, string(data)), cfg
+}
+
+func TestRunList(t *testing.T) {
+	configPath, _ := writeBrowseFixture(t)
+
+	var out bytes.Buffer
+	if err := runList(configPath, "", &out); err != nil {
+		t.Fatalf("一覧の表示に失敗: %v", err)
+	}
+	listing := out.String()
+	for _, want := range []string{"30m:", "000003_20250701_1000", "ディレクトリ", "3h:", "000002_20250701_0900.tar.zst", "1d:", "000001_20250630_0000.zip"} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("一覧に %q が含まれていません:\n%s", want, listing)
+		}
+	}
+	if strings.Index(listing, "30m:") > strings.Index(listing, "1d:") {
+		t.Errorf("レベル順に表示されていません:\n%s", listing)
+	}
+
+	// 通し番号・拡張子なしの名前で中身を一覧
+	for _, name := range []string{"2", "000002_20250701_0900", "000001_20250630_0000.zip", "3"} {
+		out.Reset()
+		if err := runList(configPath, name, &out); err != nil {
+			t.Fatalf("%s の中身の一覧に失敗: %v", name, err)
+		}
+		if !strings.Contains(out.String(), "src/main.go") || !strings.Contains(out.String(), "3個のファイル") {
+			t.Errorf("%s の中身の一覧が違います:\n%s", name, out.String())
+		}
+	}
+
+	if err := runList(configPath, "99", &out); classifyFailure(err) != FailureConfig {
+		t.Errorf("存在しないスナップショットがエラーになりません: %v", err)
+	}
+}
+
+func TestRunRestore(t *testing.T) {
+	configPath, _ := writeBrowseFixture(t)
+
+	for _, name := range []string{"1", "2", "3"} {
+		t.Run(name, func(t *testing.T) {
+			to := t.TempDir()
+			var out bytes.Buffer
+			// 指定したディレクトリのみ復元
+			if err := runRestore(configPath, name, []string{"src/"}, restoreOptions{To: to}, &out); err != nil {
+				t.Fatalf("復元に失敗: %v", err)
+			}
+			if data, _ := os.ReadFile(filepath.Join(to, "src", "main.go")); string(data) != "main v1" {
+				t.Errorf("復元した内容が違います: %q", data)
+			}
+			if _, err := os.Stat(filepath.Join(to, "docs", "a.md")); !os.IsNotExist(err) {
+				t.Errorf("指定外のファイルが復元されています")
+			}
+
+			// 既存ファイルは --force 指定時のみ上書き
+			os.WriteFile(filepath.Join(to, "src", "main.go"), []byte("edited"), 0644)
+			out.Reset()
+			runRestore(configPath, name, []string{"src/main.go"}, restoreOptions{To: to}, &out)
+			if data, _ := os.ReadFile(filepath.Join(to, "src", "main.go")); string(data) != "edited" || !strings.Contains(out.String(), "--force") {
+				t.Errorf("既存のファイルが上書きされました: %q\n%s", data, out.String())
+			}
+			if err := runRestore(configPath, name, []string{"src/main.go"}, restoreOptions{To: to, Force: true}, &out); err != nil {
+				t.Fatalf("--force での復元に失敗: %v", err)
+			}
+			if data, _ := os.ReadFile(filepath.Join(to, "src", "main.go")); string(data) != "main v1" {
+				t.Errorf("--force で上書きされていません: %q", data)
+			}
+
+			if err := runRestore(configPath, name, []string{"missing.txt"}, restoreOptions{To: to}, &out); classifyFailure(err) != FailureConfig {
+				t.Errorf("該当ファイルなしがエラーになりません: %v", err)
+			}
+		})
+	}
+
+	if err := runRestore(configPath, "1", nil, restoreOptions{}, &bytes.Buffer{}); classifyFailure(err) != FailureConfig {
+		t.Errorf("復元先の指定なしがエラーになりません: %v", err)
+	}
+}
+
+func TestRestoreTargetRejectsEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"src/main.go", true},
+		{"../outside.txt", false},
+		{"src/../../outside.txt", false},
+		{"/etc/passwd", true}, // 先頭の / は復元先からの相対パスとして扱う
+	}
+	for _, tt := range tests {
+		_, err := restoreTarget("/restore", tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: 期待=%v, エラー=%v", tt.name, tt.ok, err)
+		}
+	}
+}
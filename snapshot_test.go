@@ -0,0 +1,436 @@
+package main
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// スナップショット形式のテスト
+// =============================================================================
+
+// writeTestFiles は root 以下にテスト用ファイルを作成します。
+func writeTestFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("テスト用ファイルの作成に失敗: %v", err)
+		}
+	}
+}
+
+// readSnapshot はスナップショットの内容をファイル名→内容で返します。
+func readSnapshot(t *testing.T, path string) map[string]string {
+	files := make(map[string]string)
+	if strings.HasSuffix(path, ".zip") {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatalf("アーカイブを開けません: %v", err)
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			r, _ := f.Open()
+			data := make([]byte, f.UncompressedSize64)
+			r.Read(data)
+			r.Close()
+			files[f.Name] = string(data)
+		}
+		return files
+	}
+	if !strings.HasSuffix(path, ".vhdx") {
+		filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(path, p)
+				data, _ := os.ReadFile(p)
+				files[filepath.ToSlash(rel)] = string(data)
+			}
+			return nil
+		})
+		return files
+	}
+	data, _ := os.ReadFile(path)
+	files[filepath.Base(path)] = string(data)
+	return files
+}
+
+func TestSnapshotFormatsCreate(t *testing.T) {
+	mirror := map[string]string{"a.txt": "A", "sub/b.txt": "B"}
+	tests := []struct {
+		format   string
+		name     string
+		expected map[string]string
+	}{
+		{"vhdx", "000001_20250701_0900.vhdx", map[string]string{"000001_20250701_0900.vhdx": "vhdx"}},
+		{"directory", "000001_20250701_0900", mirror},
+		{"hardlink", "000001_20250701_0900", mirror},
+		{"archive", "000001_20250701_0900.zip", mirror},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			cfg := newValidTestConfig(t)
+			cfg.SnapshotFormat = tt.format
+			writeTestFiles(t, cfg.BackupDir, mirror)
+			// archive 形式は work_dir から直接保存する
+			writeTestFiles(t, cfg.WorkDir, mirror)
+			format := cfg.snapshotFormat()
+			if format.Name() != tt.format {
+				t.Fatalf("形式が違います: %s", format.Name())
+			}
+			name := snapshotName(format, 1, "20250701_0900")
+			if name != tt.name {
+				t.Errorf("スナップショット名が違います: %s", name)
+			}
+
+			dir := cfg.BackupDirs["30m"]
+			os.MkdirAll(dir, 0755)
+			if err := format.Create(cfg, filepath.Join(dir, name)); err != nil {
+				t.Fatalf("スナップショットの作成に失敗: %v", err)
+			}
+			got := readSnapshot(t, filepath.Join(dir, name))
+			if len(got) != len(tt.expected) {
+				t.Errorf("スナップショットの内容が違います: %v", got)
+			}
+			for file, content := range tt.expected {
+				if got[file] != content {
+					t.Errorf("%s の内容が違います: 期待=%q, 実際=%q", file, content, got[file])
+				}
+			}
+			if names, _ := listSnapshots(dir); len(names) != 1 || names[0] != name {
+				t.Errorf("ローテーション対象として認識されません: %v", names)
+			}
+		})
+	}
+}
+
+func TestHardlinkSnapshotLinksUnchanged(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.SnapshotFormat = "hardlink"
+	writeTestFiles(t, cfg.BackupDir, map[string]string{"same.txt": "same", "changed.txt": "old"})
+
+	// 前回のスナップショット（別レベル）
+	prev := filepath.Join(cfg.BackupDirs["30m"], "000001_20250701_0900")
+	os.MkdirAll(cfg.BackupDirs["30m"], 0755)
+	if err := cfg.snapshotFormat().Create(cfg, prev); err != nil {
+		t.Fatalf("前回のスナップショットの作成に失敗: %v", err)
+	}
+
+	changed := filepath.Join(cfg.BackupDir, "changed.txt")
+	os.WriteFile(changed, []byte("new"), 0644)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(changed, future, future)
+
+	next := filepath.Join(cfg.BackupDirs["3h"], "000002_20250701_1200")
+	os.MkdirAll(cfg.BackupDirs["3h"], 0755)
+	if got := latestSnapshotDir(cfg); got != prev {
+		t.Fatalf("リンク元が違います: %s", got)
+	}
+	if err := cfg.snapshotFormat().Create(cfg, next); err != nil {
+		t.Fatalf("スナップショットの作成に失敗: %v", err)
+	}
+
+	sameFile := func(name string) bool {
+		a, _ := os.Stat(filepath.Join(prev, name))
+		b, _ := os.Stat(filepath.Join(next, name))
+		return a != nil && b != nil && os.SameFile(a, b)
+	}
+	if !sameFile("same.txt") {
+		t.Errorf("変更のないファイルがハードリンクされていません")
+	}
+	if sameFile("changed.txt") {
+		t.Errorf("変更のあったファイルがハードリンクされています")
+	}
+	if data, _ := os.ReadFile(filepath.Join(prev, "changed.txt")); string(data) != "old" {
+		t.Errorf("前回のスナップショットが変更されています: %s", data)
+	}
+	if data, _ := os.ReadFile(filepath.Join(next, "changed.txt")); string(data) != "new" {
+		t.Errorf("変更内容が保存されていません: %s", data)
+	}
+}
+
+func TestRotateMixedSnapshotFormats(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	dir := cfg.BackupDirs["30m"]
+	os.MkdirAll(dir, 0755)
+	for _, name := range []string{"000001_20250701_0900.vhdx", "000003_20250701_1000.zip", "memo.txt", "000009.vhdx"} {
+		os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+	}
+	for _, name := range []string{"000002_20250701_0930", "000004_20250701_1030", "tmp"} {
+		os.MkdirAll(filepath.Join(dir, name, "sub"), 0755)
+	}
+
+	if err := rotateBackupsWithPromotion(cfg, "30m", false); err != nil {
+		t.Fatalf("ローテーションエラー: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	var remaining []string
+	for _, e := range entries {
+		remaining = append(remaining, e.Name())
+	}
+	expected := "000003_20250701_1000.zip,000004_20250701_1030,000009.vhdx,memo.txt,tmp"
+	if strings.Join(remaining, ",") != expected {
+		t.Errorf("ローテーション結果が違います: %v", remaining)
+	}
+}
+
+// failingSnapshot は途中まで書き込んで失敗するスナップショット形式です。
+type failingSnapshot struct{ vhdxSnapshot }
+
+func (failingSnapshot) Create(cfg *BackupConfig, dst string) error {
+	os.WriteFile(dst, []byte("途中"), 0644)
+	return os.ErrClosed
+}
+
+func TestCreateSnapshotAtomic(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.KeepVersions["30m"] = 1
+	dir, next := cfg.BackupDirs["30m"], cfg.BackupDirs["3h"]
+	os.MkdirAll(dir, 0755)
+	os.MkdirAll(next, 0755)
+
+	// 失敗した場合は最終的な名前・一時名のどちらも残さない
+	dst := filepath.Join(dir, "000001_20250701_0900.vhdx")
+	if err := createSnapshot(cfg, failingSnapshot{}, dst); err == nil {
+		t.Fatal("失敗したスナップショットの作成がエラーになりません")
+	}
+	for _, path := range []string{dst, dst + partialExt} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("失敗したスナップショットが残っています: %s", path)
+		}
+	}
+
+	// 中断した作成途中のスナップショットは昇格・ローテーションの対象にしない
+	for _, name := range []string{"000001_20250701_0900.vhdx", "000002_20250701_0930.vhdx", "000003_20250701_1000.vhdx" + partialExt, "memo" + partialExt} {
+		os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+	}
+	os.MkdirAll(filepath.Join(next, "000004_20250701_1030"+partialExt, "sub"), 0755)
+	promoteBackup(cfg, []string{"30m", "3h"}, false)
+	if err := rotateBackupsWithPromotion(cfg, "30m", false); err != nil {
+		t.Fatalf("ローテーションエラー: %v", err)
+	}
+	names := func(dir string) string {
+		entries, _ := os.ReadDir(dir)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return strings.Join(names, ",")
+	}
+	if got, want := names(dir), "000002_20250701_0930.vhdx,000003_20250701_1000.vhdx.partial,memo.partial"; got != want {
+		t.Errorf("30m の内容が違います: %s, want %s", got, want)
+	}
+	if got, want := names(next), "000001_20250701_0900.vhdx,000004_20250701_1030.partial"; got != want {
+		t.Errorf("3h の内容が違います: %s, want %s", got, want)
+	}
+
+	// 次回の作成時に作成途中のスナップショットを削除する
+	os.WriteFile(cfg.SourceVHDX, []byte("vhdx"), 0644)
+	dst = filepath.Join(dir, "000005_20250701_1100.vhdx")
+	if err := createSnapshot(cfg, vhdxSnapshot{}, dst); err != nil {
+		t.Fatalf("スナップショットの作成に失敗: %v", err)
+	}
+	if data, _ := os.ReadFile(dst); string(data) != "vhdx" {
+		t.Errorf("スナップショットの内容が違います: %q", data)
+	}
+	if got, want := names(dir), "000002_20250701_0930.vhdx,000005_20250701_1100.vhdx,memo.partial"; got != want {
+		t.Errorf("30m の内容が違います: %s, want %s", got, want)
+	}
+	if got, want := names(next), "000001_20250701_0900.vhdx"; got != want {
+		t.Errorf("3h の内容が違います: %s, want %s", got, want)
+	}
+}
+
+func TestValidateSnapshotFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(cfg *BackupConfig)
+		key      string
+		severity string
+	}{
+		{"不明な形式", func(cfg *BackupConfig) { cfg.SnapshotFormat = "tar" }, "snapshot_format", SeverityError},
+		{"VHDX なし", func(cfg *BackupConfig) { cfg.SourceVHDX = "" }, "source_vhdx", SeverityError},
+		{"ディレクトリ形式でマウント", func(cfg *BackupConfig) {
+			cfg.SnapshotFormat = "directory"
+			cfg.MountIfMissing = true
+		}, "mount_vhdx_if_missing", SeverityWarning},
+		{"不明な判定方法", func(cfg *BackupConfig) { cfg.HardlinkCompare = "size" }, "hardlink_compare", SeverityError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newValidTestConfig(t)
+			tt.modify(cfg)
+			p := findProblem(validateConfig(cfg), tt.key)
+			if p == nil || p.Severity != tt.severity {
+				t.Errorf("%s の問題が検出されていません: %v", tt.key, p)
+			}
+		})
+	}
+
+	// VHDX 以外の形式では source_vhdx は不要
+	cfg := newValidTestConfig(t)
+	cfg.SnapshotFormat = "directory"
+	cfg.SourceVHDX = ""
+	if problems := validateConfig(cfg); len(problems) != 0 {
+		t.Errorf("source_vhdx なしのディレクトリ形式で問題が検出されました: %v", problems)
+	}
+}
+
+func TestRunBackupWithDirectorySnapshot(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.SnapshotFormat = "directory"
+	cfg.SourceVHDX = ""
+	cfg.CopyMethodPriority = []string{"native"}
+	cfg.PerfLogPath = filepath.Join(t.TempDir(), "perf.log")
+	os.MkdirAll(filepath.Join(cfg.WorkDir, "src"), 0755)
+	os.WriteFile(filepath.Join(cfg.WorkDir, "src", "main.go"), []byte("package main"), 0644)
+
+	if err := runBackupWithLevel(cfg, "30m"); err != nil {
+		t.Fatalf("バックアップエラー: %v", err)
+	}
+	names, _ := listSnapshots(cfg.BackupDirs["30m"])
+	if len(names) != 1 || !strings.HasPrefix(names[0], "000001_") {
+		t.Fatalf("スナップショットが作成されていません: %v", names)
+	}
+	data, err := os.ReadFile(filepath.Join(cfg.BackupDirs["30m"], names[0], "src", "main.go"))
+	if err != nil || string(data) != "package main" {
+		t.Errorf("スナップショットの内容が違います: %q, %v", data, err)
+	}
+}
+
+func TestRunBackupWithLevelPromotesOldest(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.SnapshotFormat = "directory"
+	cfg.SourceVHDX = ""
+	cfg.CopyMethodPriority = []string{"native"}
+	cfg.PerfLogPath = filepath.Join(t.TempDir(), "perf.log")
+	cfg.KeepVersions["30m"] = 1
+	delete(cfg.BackupDirs, "6h")
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"main.go": "package main"})
+	writeTestFiles(t, cfg.BackupDirs["30m"], map[string]string{"000001_20250701_0900/main.go": "old"})
+	// 3h は昇格を受けると保持数を超えるため、最古のものがさらに上位（6h は未設定なので 12h）へ昇格する
+	writeTestFiles(t, cfg.BackupDirs["3h"], map[string]string{
+		"000000_20250630_0900/main.go": "older",
+		"000000_20250630_1200/main.go": "older",
+	})
+	writeTestFiles(t, cfg.BackupDirs["12h"], map[string]string{
+		"000000_20250629_0000/main.go": "older",
+		"000000_20250629_1200/main.go": "older",
+	})
+	// 昇格を受けた最上位のレベルも保持数を超えた分を削除する
+	cfg.KeepVersions["1d"] = 1
+	writeTestFiles(t, cfg.BackupDirs["1d"], map[string]string{"000000_20250628_0000/main.go": "oldest"})
+	os.WriteFile(cfg.LastIDFile, []byte("1"), 0644)
+
+	if got, want := strings.Join(promotionLevels(cfg, "30m"), ","), "30m,3h,12h,1d"; got != want {
+		t.Errorf("昇格順のレベルが違います: %s, want %s", got, want)
+	}
+	if err := runBackupWithLevel(cfg, "30m"); err != nil {
+		t.Fatalf("バックアップエラー: %v", err)
+	}
+	names := func(level string) string {
+		names, _ := listSnapshots(cfg.BackupDirs[level])
+		return strings.Join(names, ",")
+	}
+	if got := names("30m"); !strings.HasPrefix(got, "000002_") || strings.Contains(got, ",") {
+		t.Errorf("30m には新しいスナップショットだけが残るはずです: %s", got)
+	}
+	if got, want := names("3h"), "000000_20250630_1200,000001_20250701_0900"; got != want {
+		t.Errorf("3h の内容が違います: %s, want %s", got, want)
+	}
+	if got, want := names("12h"), "000000_20250629_1200,000000_20250630_0900"; got != want {
+		t.Errorf("12h の内容が違います: %s, want %s", got, want)
+	}
+	if got, want := names("1d"), "000000_20250629_0000"; got != want {
+		t.Errorf("1d の内容が違います: %s, want %s", got, want)
+	}
+}
+
+func TestHardlinkCompareMethods(t *testing.T) {
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name     string
+		compare  string
+		content  string // 今回の内容（前回は "same"）
+		touch    bool   // 更新日時を変える
+		expected bool   // ハードリンクされる
+	}{
+		{"mtime: 変更なし", "mtime", "same", false, true},
+		{"mtime: 更新日時のみ変更", "mtime", "same", true, false},
+		{"mtime: 同サイズ・同時刻で内容変更", "mtime", "diff", false, true},
+		{"hash: 更新日時のみ変更", "hash", "same", true, true},
+		{"hash: 同サイズ・同時刻で内容変更", "hash", "diff", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			prev, src := filepath.Join(root, "prev"), filepath.Join(root, "src")
+			os.MkdirAll(prev, 0755)
+			os.MkdirAll(src, 0755)
+			os.WriteFile(filepath.Join(prev, "f.txt"), []byte("same"), 0644)
+			os.WriteFile(filepath.Join(src, "f.txt"), []byte(tt.content), 0644)
+			os.Chtimes(filepath.Join(prev, "f.txt"), past, past)
+			if !tt.touch {
+				os.Chtimes(filepath.Join(src, "f.txt"), past, past)
+			}
+
+			c := snapshotCopy{Prev: prev, Compare: tt.compare}
+			stats, err := c.run(src, filepath.Join(root, "next"))
+			if err != nil {
+				t.Fatalf("スナップショットの作成に失敗: %v", err)
+			}
+			if (stats.Linked == 1) != tt.expected {
+				t.Errorf("ハードリンクの判定が違います: 期待=%v, 集計=%+v", tt.expected, stats)
+			}
+		})
+	}
+}
+
+func TestHardlinkSnapshotDryRun(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.SnapshotFormat = "hardlink"
+	writeTestFiles(t, cfg.BackupDir, map[string]string{"a.txt": "A", "b.txt": "BB"})
+	prev := filepath.Join(cfg.BackupDirs["1d"], "000001_20250701_0900")
+	os.MkdirAll(cfg.BackupDirs["1d"], 0755)
+	if _, err := copySnapshotTree(cfg.BackupDir, prev); err != nil {
+		t.Fatalf("前回のスナップショットの作成に失敗: %v", err)
+	}
+	os.WriteFile(filepath.Join(cfg.BackupDir, "b.txt"), []byte("BBB"), 0644)
+
+	cfg.DryRun = true
+	dst := filepath.Join(cfg.BackupDirs["30m"], "000002_20250701_0930")
+	output := captureStdout(t, func() {
+		if err := cfg.snapshotFormat().Create(cfg, dst); err != nil {
+			t.Errorf("dry-run エラー: %v", err)
+		}
+	})
+	if !strings.Contains(output, "リンク 1個, コピー 1個 (3 bytes) 予定") || !strings.Contains(output, prev) {
+		t.Errorf("dry-run の集計が違います:\n%s", output)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("dry-run でスナップショットが作成されています")
+	}
+}
+
+func TestNativeCopyPreservesModTime(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.CopyMethodPriority = []string{"native"}
+	src := filepath.Join(cfg.WorkDir, "a.txt")
+	os.MkdirAll(cfg.WorkDir, 0755)
+	os.WriteFile(src, []byte("A"), 0644)
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	os.Chtimes(src, past, past)
+
+	for i := 0; i < 2; i++ {
+		if err := tryCopy(cfg, cfg.WorkDir, cfg.BackupDir, false); err != nil {
+			t.Fatalf("%d 回目のコピーに失敗: %v", i+1, err)
+		}
+	}
+	info, err := os.Stat(filepath.Join(cfg.BackupDir, "a.txt"))
+	if err != nil || !info.ModTime().Equal(past) {
+		t.Errorf("更新日時が保持されていません: %v, %v", info, err)
+	}
+}
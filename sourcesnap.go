@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// コピー元（work_dir）の固定
+// =============================================================================
+
+// SourceSnapshotConfig はコピー中に work_dir が書き換えられても一貫した内容をミラーへ反映するための設定です。
+type SourceSnapshotConfig struct {
+	Method      string `json:"method"`       // 固定する方法: none / vss / btrfs / lvm / copy_twice（空の場合は none）
+	SnapshotDir string `json:"snapshot_dir"` // btrfs: スナップショットの作成先、lvm: マウント先の親ディレクトリ
+	LVMSize     string `json:"lvm_size"`     // lvm: スナップショットの変更を記録する領域のサイズ（既定 "1G"）
+	MaxRetries  int    `json:"max_retries"`  // copy_twice: 変更を検出した場合にコピーし直す回数（既定 2）
+	OnFailure   string `json:"on_failure"`   // 固定に失敗した場合の動作: "abort"（既定）または "warn"（work_dir から直接コピー）
+}
+
+const (
+	sourceSnapshotNone      = "none"
+	sourceSnapshotCopyTwice = "copy_twice"
+
+	defaultSourceSnapshotRetries = 2
+	defaultLVMSnapshotSize       = "1G"
+)
+
+// sourceSnapshotMethods は source_snapshot.method に指定できる方法です。
+var sourceSnapshotMethods = []string{sourceSnapshotNone, "vss", "btrfs", "lvm", sourceSnapshotCopyTwice}
+
+// SourceSnapshotter はコピー元を固定する方法です。
+type SourceSnapshotter interface {
+	Name() string
+	// Freeze は src を固定し、コピー元として読み取るビューを返します。
+	Freeze(cfg *BackupConfig, src string) (*frozenSource, error)
+}
+
+// frozenSource は固定したコピー元です。コピー後に Release で解放します。
+type frozenSource struct {
+	Path    string   // コピー元として読み取るパス
+	Exclude []string // コピーから除外するビュー内のパス（スナップショットの作成先など）
+
+	release func() (changed bool, err error)
+}
+
+// Release は固定を解放します。changed は固定後に src が変更されたかどうかです（copy_twice のみ検出）。
+func (f *frozenSource) Release() (changed bool, err error) {
+	if f.release == nil {
+		return false, nil
+	}
+	return f.release()
+}
+
+// runSourceSnapshotCommand はスナップショットの作成・削除のコマンドを実行します（テストで差し替えます）。
+var runSourceSnapshotCommand = func(name string, args ...string) ([]byte, error) {
+	log.Printf("実行コマンド: %s %s", name, strings.Join(args, " "))
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// runSnapshotCommand はコマンドを実行し、失敗した場合は出力を含むエラーを返します。
+func runSnapshotCommand(name string, args ...string) (string, error) {
+	out, err := runSourceSnapshotCommand(name, args...)
+	outStr := strings.TrimSpace(convertShiftJISToUTF8(out))
+	if err != nil {
+		return outStr, pkgerrors.Errorf("%s %s: %v\n出力: %s", name, strings.Join(args, " "), err, outStr)
+	}
+	return outStr, nil
+}
+
+// sourceSnapshotters はこの環境で利用できる固定方法を返します。
+func sourceSnapshotters() []SourceSnapshotter {
+	return append([]SourceSnapshotter{copyTwiceSnapshotter{}}, platformSourceSnapshotters()...)
+}
+
+// findSourceSnapshotter は名前に一致する固定方法を返します。
+func findSourceSnapshotter(name string) (SourceSnapshotter, bool) {
+	for _, s := range sourceSnapshotters() {
+		if s.Name() == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+var sourceSnapshotNameInvalid = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// sourceSnapshotName はジョブごとのスナップショット名を返します。
+// 前回の実行で解放できなかったスナップショットを次回の実行で削除できるよう、毎回同じ名前にします。
+func sourceSnapshotName(cfg *BackupConfig) string {
+	return "rotate_backup_" + sourceSnapshotNameInvalid.ReplaceAllString(defaultString(cfg.jobName, "source"), "_")
+}
+
+// withSourceView は src の代わりに view から読み取るための設定を返します。
+// work_dir 配下の exclude_dirs・include_files はビュー内のパスに置き換え、exclude を追加します。
+func (cfg *BackupConfig) withSourceView(src, view string, exclude []string) *BackupConfig {
+	c := *cfg
+	c.ExcludeDirs = nil
+	for _, dir := range cfg.ExcludeDirs {
+		c.ExcludeDirs = append(c.ExcludeDirs, viewPath(src, view, dir))
+	}
+	c.ExcludeDirs = append(c.ExcludeDirs, exclude...)
+	c.IncludeFiles = nil
+	for _, file := range cfg.IncludeFiles {
+		c.IncludeFiles = append(c.IncludeFiles, viewPath(src, view, file))
+	}
+	return &c
+}
+
+// viewPath は src 配下の path を view 内の同じ位置のパスに置き換えます（src 配下でない場合はそのまま）。
+func viewPath(src, view, path string) string {
+	if rel, err := filepath.Rel(src, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.Join(view, rel)
+	}
+	return path
+}
+
+// copySource は source_snapshot の設定に従い、固定した work_dir から dst へコピーします。
+func copySource(cfg *BackupConfig, src, dst string, dryRun bool) error {
+	method := defaultString(cfg.SourceSnapshot.Method, sourceSnapshotNone)
+	if method == sourceSnapshotNone {
+		return tryCopy(cfg, src, dst, dryRun)
+	}
+	if dryRun {
+		fmt.Printf("コピー元の固定: %s\n", method)
+		return tryCopy(cfg, src, dst, dryRun)
+	}
+	s, ok := findSourceSnapshotter(method)
+	if !ok {
+		return sourceSnapshotFailed(cfg, src, dst, method, pkgerrors.Errorf("この環境では利用できません"))
+	}
+	return copyFrozen(cfg, s, src, dst)
+}
+
+// copyFrozen は s で固定した src から dst へコピーします。
+// 固定後に src が変更された場合は max_retries 回までコピーし直します。
+func copyFrozen(cfg *BackupConfig, s SourceSnapshotter, src, dst string) error {
+	retries := cfg.SourceSnapshot.MaxRetries
+	if retries <= 0 {
+		retries = defaultSourceSnapshotRetries
+	}
+	for attempt := 0; ; attempt++ {
+		view, err := s.Freeze(cfg, src)
+		if err != nil {
+			return sourceSnapshotFailed(cfg, src, dst, s.Name(), err)
+		}
+		log.Printf("コピー元を固定しました (%s): %s", s.Name(), view.Path)
+		copyErr := tryCopy(cfg.withSourceView(src, view.Path, view.Exclude), view.Path, dst, false)
+		changed, err := view.Release()
+		if err != nil {
+			log.Printf("コピー元の固定の解放に失敗 (%s): %v", s.Name(), err)
+		}
+		if copyErr != nil || !changed {
+			return copyErr
+		}
+		if attempt >= retries {
+			log.Printf("コピー中に work_dir が変更されました。%d 回コピーし直しても変更が続いたため、このまま続行します", retries)
+			return nil
+		}
+		log.Printf("コピー中に work_dir が変更されたため、コピーし直します (%d/%d)", attempt+1, retries)
+	}
+}
+
+// sourceSnapshotFailed は固定に失敗した場合に on_failure に従い、中止するか src から直接コピーします。
+func sourceSnapshotFailed(cfg *BackupConfig, src, dst, method string, err error) error {
+	if !strings.EqualFold(cfg.SourceSnapshot.OnFailure, "warn") {
+		return pkgerrors.Errorf("コピー元の固定に失敗 (%s): %v", method, err)
+	}
+	log.Printf("コピー元の固定に失敗したため work_dir から直接コピーします (%s): %v", method, err)
+	return tryCopy(cfg, src, dst, false)
+}
+
+// -----------------------------------------------------------------------------
+// copy_twice: コピー前後の比較
+// -----------------------------------------------------------------------------
+
+// copyTwiceSnapshotter はスナップショットを使わず、コピー前後の work_dir のファイル一覧
+// （サイズ・更新日時）を比較して、コピー中の変更を検出します。
+type copyTwiceSnapshotter struct{}
+
+func (copyTwiceSnapshotter) Name() string { return sourceSnapshotCopyTwice }
+
+func (copyTwiceSnapshotter) Freeze(cfg *BackupConfig, src string) (*frozenSource, error) {
+	before, err := sourceFingerprint(cfg, src)
+	if err != nil {
+		return nil, err
+	}
+	return &frozenSource{
+		Path: src,
+		release: func() (bool, error) {
+			after, err := sourceFingerprint(cfg, src)
+			if err != nil {
+				return false, err
+			}
+			for rel, v := range after {
+				if before[rel] != v {
+					log.Printf("コピー中に変更されたファイル: %s", rel)
+					return true, nil
+				}
+			}
+			return len(before) != len(after), nil
+		},
+	}, nil
+}
+
+// fileFingerprint はファイルの変更の検出に使う属性です。
+type fileFingerprint struct {
+	size    int64
+	modTime int64
+}
+
+// sourceFingerprint はコピー対象のファイルごとのサイズ・更新日時を返します。
+func sourceFingerprint(cfg *BackupConfig, src string) (map[string]fileFingerprint, error) {
+	files := make(map[string]fileFingerprint)
+	err := newCopyFilter(cfg).walkFiles(src, func(path, rel string, info os.FileInfo) error {
+		files[rel] = fileFingerprint{info.Size(), info.ModTime().UnixNano()}
+		return nil
+	})
+	return files, err
+}
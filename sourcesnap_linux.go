@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// platformSourceSnapshotters は Linux で利用できる固定方法を返します。
+func platformSourceSnapshotters() []SourceSnapshotter {
+	return []SourceSnapshotter{btrfsSnapshotter{}, lvmSnapshotter{}}
+}
+
+// -----------------------------------------------------------------------------
+// btrfs: 読み取り専用のサブボリュームスナップショット
+// -----------------------------------------------------------------------------
+
+// btrfsSnapshotDirName は snapshot_dir を省略した場合にサブボリューム内に作成するディレクトリです。
+const btrfsSnapshotDirName = ".rotate_backup_snapshots"
+
+// btrfsSubvolumeInode はサブボリュームのルートディレクトリの inode 番号です。
+const btrfsSubvolumeInode = 256
+
+// btrfsSnapshotter は work_dir を含むサブボリュームの読み取り専用スナップショットから読み取ります。
+type btrfsSnapshotter struct{}
+
+func (btrfsSnapshotter) Name() string { return "btrfs" }
+
+func (btrfsSnapshotter) Freeze(cfg *BackupConfig, src string) (*frozenSource, error) {
+	root, err := btrfsSubvolumeRoot(src)
+	if err != nil {
+		return nil, err
+	}
+	dir := cfg.SourceSnapshot.SnapshotDir
+	if dir == "" {
+		dir = filepath.Join(root, btrfsSnapshotDirName)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, pkgerrors.Errorf("スナップショットの作成先を作成できません: %v", err)
+	}
+	snap := filepath.Join(dir, sourceSnapshotName(cfg))
+	if _, err := os.Lstat(snap); err == nil {
+		// 前回の実行で削除できなかったスナップショット
+		if _, err := runSnapshotCommand("btrfs", "subvolume", "delete", snap); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := runSnapshotCommand("btrfs", "subvolume", "snapshot", "-r", root, snap); err != nil {
+		return nil, err
+	}
+
+	rel, _ := filepath.Rel(root, src)
+	f := &frozenSource{
+		Path: filepath.Join(snap, rel),
+		release: func() (bool, error) {
+			_, err := runSnapshotCommand("btrfs", "subvolume", "delete", snap)
+			return false, err
+		},
+	}
+	// 作成先がサブボリューム内の場合、スナップショットには空のディレクトリとして残る
+	if r, err := filepath.Rel(root, dir); err == nil && !strings.HasPrefix(r, "..") {
+		f.Exclude = []string{filepath.Join(snap, r)}
+	}
+	return f, nil
+}
+
+// btrfsSubvolumeRoot は path を含む btrfs のサブボリュームのルートを返します。
+func btrfsSubvolumeRoot(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var fs unix.Statfs_t
+	if err := unix.Statfs(path, &fs); err != nil {
+		return "", err
+	}
+	if fs.Type != unix.BTRFS_SUPER_MAGIC {
+		return "", pkgerrors.Errorf("btrfs ではありません: %s", path)
+	}
+	for {
+		var st unix.Stat_t
+		if err := unix.Stat(path, &st); err != nil {
+			return "", err
+		}
+		if st.Ino == btrfsSubvolumeInode {
+			return path, nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", pkgerrors.Errorf("サブボリュームが見つかりません: %s", path)
+		}
+		path = parent
+	}
+}
+
+// -----------------------------------------------------------------------------
+// lvm: LVM スナップショットを読み取り専用でマウント
+// -----------------------------------------------------------------------------
+
+// mountInfoPath はマウント情報のファイルです（テストで差し替えます）。
+var mountInfoPath = "/proc/self/mountinfo"
+
+// lvmSnapshotter は work_dir を含む論理ボリュームのスナップショットを一時的にマウントして読み取ります。
+type lvmSnapshotter struct{}
+
+func (lvmSnapshotter) Name() string { return "lvm" }
+
+func (lvmSnapshotter) Freeze(cfg *BackupConfig, src string) (*frozenSource, error) {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	m, err := findMount(f, src)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	out, err := runSnapshotCommand("lvs", "--noheadings", "-o", "vg_name,lv_name", m.Source)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return nil, pkgerrors.Errorf("論理ボリュームではありません: %s (%s)", m.Source, out)
+	}
+	vg, lv := fields[0], fields[1]
+
+	name := sourceSnapshotName(cfg)
+	snapLV := vg + "/" + name
+	mnt := filepath.Join(defaultString(cfg.SourceSnapshot.SnapshotDir, os.TempDir()), name)
+	if _, err := os.Stat(filepath.Join("/dev", snapLV)); err == nil {
+		// 前回の実行で削除できなかったスナップショット
+		runSnapshotCommand("umount", mnt)
+		if _, err := runSnapshotCommand("lvremove", "-f", snapLV); err != nil {
+			return nil, err
+		}
+	}
+	size := defaultString(cfg.SourceSnapshot.LVMSize, defaultLVMSnapshotSize)
+	if _, err := runSnapshotCommand("lvcreate", "--snapshot", "--name", name, "--size", size, vg+"/"+lv); err != nil {
+		return nil, err
+	}
+	removeLV := func() error {
+		_, err := runSnapshotCommand("lvremove", "-f", snapLV)
+		return err
+	}
+	if err := os.MkdirAll(mnt, 0755); err != nil {
+		removeLV()
+		return nil, err
+	}
+	options := "ro"
+	if m.FSType == "xfs" {
+		// 元のボリュームと UUID が同じため
+		options += ",nouuid"
+	}
+	if _, err := runSnapshotCommand("mount", "-o", options, filepath.Join("/dev", snapLV), mnt); err != nil {
+		removeLV()
+		return nil, err
+	}
+
+	rel, _ := filepath.Rel(m.MountPoint, src)
+	return &frozenSource{
+		Path: filepath.Join(mnt, rel),
+		release: func() (bool, error) {
+			if _, err := runSnapshotCommand("umount", mnt); err != nil {
+				return false, err
+			}
+			os.Remove(mnt)
+			return false, removeLV()
+		},
+	}, nil
+}
+
+// mountEntry はマウント情報の1行です。
+type mountEntry struct {
+	MountPoint string
+	FSType     string
+	Source     string
+}
+
+// mountInfoUnescape は mountinfo のパスのエスケープを戻します。
+var mountInfoUnescape = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// findMount は mountinfo の形式の r から path を含むマウントを返します（最も深いマウントポイント）。
+func findMount(r io.Reader, path string) (mountEntry, error) {
+	var found mountEntry
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		mountPoint := mountInfoUnescape.Replace(fields[4])
+		rel, err := filepath.Rel(mountPoint, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if len(mountPoint) >= len(found.MountPoint) {
+			found = mountEntry{MountPoint: mountPoint, FSType: fields[sep+1], Source: mountInfoUnescape.Replace(fields[sep+2])}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return mountEntry{}, err
+	}
+	if found.MountPoint == "" {
+		return mountEntry{}, pkgerrors.Errorf("マウントポイントが見つかりません: %s", path)
+	}
+	return found, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeSnapshotCommands はスナップショットのコマンドを実行せずに記録します。
+func fakeSnapshotCommands(t *testing.T, outputs map[string]string) *[]string {
+	var commands []string
+	old := runSourceSnapshotCommand
+	runSourceSnapshotCommand = func(name string, args ...string) ([]byte, error) {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return []byte(outputs[name]), nil
+	}
+	t.Cleanup(func() { runSourceSnapshotCommand = old })
+	return &commands
+}
+
+func TestFindMount(t *testing.T) {
+	mountInfo := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+35 22 253:0 / /home rw,relatime shared:2 - xfs /dev/mapper/vg0-home rw
+36 22 253:1 / /mnt/my\040data rw,relatime - ext4 /dev/mapper/vg0-data rw
+`
+	tests := []struct {
+		path string
+		want mountEntry
+	}{
+		{"/etc/hosts", mountEntry{"/", "ext4", "/dev/sda1"}},
+		{"/home/dev/work", mountEntry{"/home", "xfs", "/dev/mapper/vg0-home"}},
+		{"/home", mountEntry{"/home", "xfs", "/dev/mapper/vg0-home"}},
+		{"/homework", mountEntry{"/", "ext4", "/dev/sda1"}},
+		{"/mnt/my data/src", mountEntry{"/mnt/my data", "ext4", "/dev/mapper/vg0-data"}},
+	}
+	for _, tt := range tests {
+		got, err := findMount(strings.NewReader(mountInfo), tt.path)
+		if err != nil || got != tt.want {
+			t.Errorf("findMount(%s) = %+v, %v, want %+v", tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestLVMSnapshotterCommands(t *testing.T) {
+	captureProgressOutput(t)
+	mountPoint := t.TempDir()
+	infoFile := filepath.Join(t.TempDir(), "mountinfo")
+	os.WriteFile(infoFile, []byte("35 22 253:0 / "+mountPoint+" rw - xfs /dev/mapper/vg0-home rw\n"), 0644)
+	old := mountInfoPath
+	mountInfoPath = infoFile
+	t.Cleanup(func() { mountInfoPath = old })
+	commands := fakeSnapshotCommands(t, map[string]string{"lvs": "  vg0 home\n"})
+
+	cfg := newValidTestConfig(t)
+	cfg.SourceSnapshot = SourceSnapshotConfig{Method: "lvm", SnapshotDir: t.TempDir(), LVMSize: "512M"}
+	view, err := lvmSnapshotter{}.Freeze(cfg, filepath.Join(mountPoint, "dev", "work"))
+	if err != nil {
+		t.Fatalf("Freeze がエラーを返しました: %v", err)
+	}
+	mnt := filepath.Join(cfg.SourceSnapshot.SnapshotDir, "rotate_backup_source")
+	if want := filepath.Join(mnt, "dev", "work"); view.Path != want {
+		t.Errorf("コピー元 = %s, want %s", view.Path, want)
+	}
+	if _, err := view.Release(); err != nil {
+		t.Fatalf("Release がエラーを返しました: %v", err)
+	}
+	want := []string{
+		"lvs --noheadings -o vg_name,lv_name /dev/mapper/vg0-home",
+		"lvcreate --snapshot --name rotate_backup_source --size 512M vg0/home",
+		"mount -o ro,nouuid /dev/vg0/rotate_backup_source " + mnt,
+		"umount " + mnt,
+		"lvremove -f vg0/rotate_backup_source",
+	}
+	if !slices.Equal(*commands, want) {
+		t.Errorf("実行されたコマンドが違います:\ngot:  %q\nwant: %q", *commands, want)
+	}
+}
+
+func TestBtrfsSubvolumeRootRequiresBtrfs(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := btrfsSubvolumeRoot(dir); err == nil && !isBtrfs(dir) {
+		t.Error("btrfs 以外でエラーになりません")
+	}
+}
+
+// isBtrfs は path が btrfs 上にある場合に true を返します。
+func isBtrfs(path string) bool {
+	out, err := exec.Command("stat", "-f", "-c", "%T", path).Output()
+	return err == nil && strings.TrimSpace(string(out)) == "btrfs"
+}
+
+// TestBtrfsSnapshotterLoopback はループバックの btrfs イメージで実際にスナップショットを作成します。
+// root 権限と btrfs-progs が必要です。
+func TestBtrfsSnapshotterLoopback(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("root 権限が必要です")
+	}
+	for _, cmd := range []string{"mkfs.btrfs", "btrfs", "mount", "umount"} {
+		if _, err := exec.LookPath(cmd); err != nil {
+			t.Skipf("%s がありません", cmd)
+		}
+	}
+	captureProgressOutput(t)
+	tmp := t.TempDir()
+	image := filepath.Join(tmp, "btrfs.img")
+	mnt := filepath.Join(tmp, "mnt")
+	os.MkdirAll(mnt, 0755)
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(image, 128*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("mkfs.btrfs", "-q", image).CombinedOutput(); err != nil {
+		t.Skipf("mkfs.btrfs に失敗: %v %s", err, out)
+	}
+	if out, err := exec.Command("mount", "-o", "loop", image, mnt).CombinedOutput(); err != nil {
+		t.Skipf("ループバックマウントに失敗: %v %s", err, out)
+	}
+	t.Cleanup(func() { exec.Command("umount", mnt).Run() })
+
+	subvol := filepath.Join(mnt, "work")
+	if out, err := exec.Command("btrfs", "subvolume", "create", subvol).CombinedOutput(); err != nil {
+		t.Fatalf("サブボリュームを作成できません: %v %s", err, out)
+	}
+	cfg := newValidTestConfig(t)
+	cfg.WorkDir = filepath.Join(subvol, "project")
+	cfg.CopyMethodPriority = []string{"native"}
+	cfg.SourceSnapshot = SourceSnapshotConfig{Method: "btrfs"}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "frozen"})
+
+	if root, err := btrfsSubvolumeRoot(cfg.WorkDir); err != nil || root != subvol {
+		t.Fatalf("btrfsSubvolumeRoot = %s, %v, want %s", root, err, subvol)
+	}
+	view, err := btrfsSnapshotter{}.Freeze(cfg, cfg.WorkDir)
+	if err != nil {
+		t.Fatalf("Freeze がエラーを返しました: %v", err)
+	}
+	// 固定後の変更はビューに反映されない
+	os.WriteFile(filepath.Join(cfg.WorkDir, "a.txt"), []byte("live"), 0644)
+	if data, _ := os.ReadFile(filepath.Join(view.Path, "a.txt")); string(data) != "frozen" {
+		t.Errorf("スナップショットの内容が違います: %q", data)
+	}
+	if _, err := view.Release(); err != nil {
+		t.Fatalf("Release がエラーを返しました: %v", err)
+	}
+	if _, err := os.Stat(view.Path); !os.IsNotExist(err) {
+		t.Errorf("スナップショットが削除されていません: %v", err)
+	}
+
+	// バックアップのコピーでは work_dir の内容がミラーへ反映される
+	if err := copySource(cfg, cfg.WorkDir, cfg.BackupDir, false); err != nil {
+		t.Fatalf("copySource がエラーを返しました: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(cfg.BackupDir, "a.txt")); string(data) != "live" {
+		t.Errorf("ミラーの内容が違います: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, btrfsSnapshotDirName)); !os.IsNotExist(err) {
+		t.Errorf("スナップショットの作成先がミラーにコピーされました: %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package main
+
+// platformSourceSnapshotters は Linux・Windows 以外では copy_twice 以外の固定方法がないため空です。
+func platformSourceSnapshotters() []SourceSnapshotter {
+	return nil
+}
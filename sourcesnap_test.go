@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// コピー元の固定のテスト
+// =============================================================================
+
+// fakeSourceSnapshotter は view をコピー元として返し、最初の changes 回の固定では変更を報告します。
+type fakeSourceSnapshotter struct {
+	view     string
+	exclude  []string
+	changes  int
+	err      error
+	freezes  int
+	releases int
+}
+
+func (f *fakeSourceSnapshotter) Name() string { return "fake" }
+
+func (f *fakeSourceSnapshotter) Freeze(cfg *BackupConfig, src string) (*frozenSource, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	f.freezes++
+	return &frozenSource{
+		Path:    f.view,
+		Exclude: f.exclude,
+		release: func() (bool, error) {
+			f.releases++
+			return f.releases <= f.changes, nil
+		},
+	}, nil
+}
+
+func TestCopyTwiceDetectsChanges(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "A", "sub/b.txt": "B"})
+
+	tests := []struct {
+		name   string
+		change func()
+		want   bool
+	}{
+		{"変更なし", func() {}, false},
+		{"内容の変更", func() { os.WriteFile(filepath.Join(cfg.WorkDir, "a.txt"), []byte("AA"), 0644) }, true},
+		{"ファイルの追加", func() { writeTestFiles(t, cfg.WorkDir, map[string]string{"c.txt": "C"}) }, true},
+		{"ファイルの削除", func() { os.Remove(filepath.Join(cfg.WorkDir, "sub", "b.txt")) }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			view, err := copyTwiceSnapshotter{}.Freeze(cfg, cfg.WorkDir)
+			if err != nil {
+				t.Fatalf("Freeze がエラーを返しました: %v", err)
+			}
+			if view.Path != cfg.WorkDir {
+				t.Errorf("copy_twice のコピー元が work_dir ではありません: %s", view.Path)
+			}
+			tt.change()
+			if changed, err := view.Release(); changed != tt.want || err != nil {
+				t.Errorf("Release = %v, %v, want %v", changed, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyFrozen(t *testing.T) {
+	tests := []struct {
+		name        string
+		changes     int
+		maxRetries  int
+		wantFreezes int
+	}{
+		{"変更なし", 0, 0, 1},
+		{"1回変更", 1, 0, 2},
+		{"変更が続く場合は max_retries で打ち切る", 10, 3, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureProgressOutput(t)
+			cfg := newValidTestConfig(t)
+			cfg.CopyMethodPriority = []string{"native"}
+			cfg.SourceSnapshot.MaxRetries = tt.maxRetries
+			cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "excluded")}
+			view := filepath.Join(t.TempDir(), "view")
+			writeTestFiles(t, view, map[string]string{"a.txt": "frozen", "excluded/b.txt": "B", ".snapshots/c.txt": "C"})
+			writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "live"})
+			s := &fakeSourceSnapshotter{view: view, exclude: []string{filepath.Join(view, ".snapshots")}, changes: tt.changes}
+
+			if err := copyFrozen(cfg, s, cfg.WorkDir, cfg.BackupDir); err != nil {
+				t.Fatalf("copyFrozen がエラーを返しました: %v", err)
+			}
+			if s.freezes != tt.wantFreezes || s.releases != s.freezes {
+				t.Errorf("固定 %d 回・解放 %d 回, want %d 回", s.freezes, s.releases, tt.wantFreezes)
+			}
+			// 固定したビューから読み取り、work_dir の exclude_dirs はビュー内のパスに置き換える
+			if data, _ := os.ReadFile(filepath.Join(cfg.BackupDir, "a.txt")); string(data) != "frozen" {
+				t.Errorf("固定したビューからコピーされていません: %q", data)
+			}
+			for _, name := range []string{"excluded", ".snapshots"} {
+				if _, err := os.Stat(filepath.Join(cfg.BackupDir, name)); !os.IsNotExist(err) {
+					t.Errorf("%s が除外されていません: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyFrozenIncludeFiles(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.CopyMethodPriority = []string{"native"}
+	cfg.Extensions = []string{".txt"}
+	cfg.IncludeFiles = []string{filepath.Join(cfg.WorkDir, "config", "settings.ini")}
+	view := filepath.Join(t.TempDir(), "view")
+	writeTestFiles(t, view, map[string]string{"a.txt": "frozen", "config/settings.ini": "frozen", "config/other.ini": "O"})
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "live", "config/settings.ini": "live"})
+	s := &fakeSourceSnapshotter{view: view}
+
+	if err := copyFrozen(cfg, s, cfg.WorkDir, cfg.BackupDir); err != nil {
+		t.Fatalf("copyFrozen がエラーを返しました: %v", err)
+	}
+	// include_files もビュー内のパスに置き換え、固定したビューからコピーする
+	if data, _ := os.ReadFile(filepath.Join(cfg.BackupDir, "config", "settings.ini")); string(data) != "frozen" {
+		t.Errorf("include_files が固定したビューからコピーされていません: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, "config", "other.ini")); !os.IsNotExist(err) {
+		t.Errorf("extensions の対象外のファイルがコピーされました: %v", err)
+	}
+	if got := newCopyFilter(cfg.withSourceView(cfg.WorkDir, view, nil)).includedFiles(view); len(got) != 1 || got[0] != filepath.Join("config", "settings.ini") {
+		t.Errorf("ビュー内の include_files = %v", got)
+	}
+}
+
+func TestCopySourceOnFailure(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.CopyMethodPriority = []string{"native"}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "live"})
+	s := &fakeSourceSnapshotter{err: errors.New("スナップショットを作成できません")}
+
+	err := copyFrozen(cfg, s, cfg.WorkDir, cfg.BackupDir)
+	if err == nil || !strings.Contains(err.Error(), "コピー元の固定に失敗 (fake)") {
+		t.Errorf("abort で中止されません: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("abort でコピーされました: %v", err)
+	}
+
+	// warn の場合は work_dir から直接コピーする
+	cfg.SourceSnapshot.OnFailure = "warn"
+	if err := copyFrozen(cfg, s, cfg.WorkDir, cfg.BackupDir); err != nil {
+		t.Fatalf("warn でエラーになりました: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(cfg.BackupDir, "a.txt")); string(data) != "live" {
+		t.Errorf("work_dir から直接コピーされていません: %q", data)
+	}
+}
+
+func TestCopySourceMethods(t *testing.T) {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.CopyMethodPriority = []string{"native"}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "A"})
+
+	for _, method := range []string{"", sourceSnapshotNone, sourceSnapshotCopyTwice} {
+		cfg.SourceSnapshot.Method = method
+		if err := copySource(cfg, cfg.WorkDir, cfg.BackupDir, false); err != nil {
+			t.Errorf("method %q でコピーに失敗: %v", method, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, "a.txt")); err != nil {
+		t.Errorf("コピーされていません: %v", err)
+	}
+
+	cfg.SourceSnapshot.Method = "unknown"
+	if err := copySource(cfg, cfg.WorkDir, cfg.BackupDir, false); err == nil {
+		t.Error("利用できない方法でエラーになりません")
+	}
+}
+
+func TestSourceSnapshotName(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	if got := sourceSnapshotName(cfg); got != "rotate_backup_source" {
+		t.Errorf("sourceSnapshotName = %s", got)
+	}
+	cfg.jobName = "docs/プロジェクト 1"
+	if got := sourceSnapshotName(cfg); strings.ContainsAny(got, "/ ") || !strings.HasPrefix(got, "rotate_backup_docs_") {
+		t.Errorf("ジョブ名の記号が置き換えられていません: %s", got)
+	}
+}
+
+func TestValidateSourceSnapshotConfig(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.SourceSnapshot = SourceSnapshotConfig{Method: "zfs", MaxRetries: -1, OnFailure: "ignore"}
+	problems := validateConfig(cfg)
+	for _, key := range []string{"source_snapshot.method", "source_snapshot.max_retries", "source_snapshot.on_failure"} {
+		if findProblem(problems, key) == nil {
+			t.Errorf("%s の問題が検出されません: %+v", key, problems)
+		}
+	}
+
+	cfg.SourceSnapshot = SourceSnapshotConfig{Method: sourceSnapshotCopyTwice, SnapshotDir: filepath.Join(cfg.WorkDir, "snap")}
+	if findProblem(validateConfig(cfg), "source_snapshot.snapshot_dir") == nil {
+		t.Error("work_dir 配下の snapshot_dir が検出されません")
+	}
+	cfg.SourceSnapshot.SnapshotDir = ""
+	if p := findProblem(validateConfig(cfg), "source_snapshot.method"); p != nil {
+		t.Errorf("copy_twice が利用できません: %+v", p)
+	}
+}
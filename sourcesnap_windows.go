@@ -0,0 +1,84 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// platformSourceSnapshotters は Windows で利用できる固定方法を返します。
+func platformSourceSnapshotters() []SourceSnapshotter {
+	return []SourceSnapshotter{vssSnapshotter{}}
+}
+
+// vssSnapshotter は work_dir を含むボリュームのシャドウコピー（VSS）から読み取ります。
+// シャドウコピーの作成には管理者権限が必要です。
+type vssSnapshotter struct{}
+
+func (vssSnapshotter) Name() string { return "vss" }
+
+func (vssSnapshotter) Freeze(cfg *BackupConfig, src string) (*frozenSource, error) {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+	volume, err := volumePathName(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// シャドウコピーを作成し、ID とデバイス名（\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopyN）を取得する
+	ps := fmt.Sprintf(`$r = (Get-WmiObject -List Win32_ShadowCopy).Create(%s, 'ClientAccessible'); `+
+		`if ($r.ReturnValue -ne 0) { throw "Win32_ShadowCopy.Create: $($r.ReturnValue)" }; `+
+		`$s = Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq $r.ShadowID }; `+
+		`Write-Output $s.ID; Write-Output $s.DeviceObject`, psQuote(volume))
+	out, err := runPowerShell(ps)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Fields(out)
+	if len(lines) != 2 {
+		return nil, pkgerrors.Errorf("シャドウコピーの情報を取得できません: %s", out)
+	}
+	id, device := lines[0], lines[1]
+	deleteShadow := func() error {
+		_, err := runPowerShell(fmt.Sprintf(`Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq %s } | ForEach-Object { $_.Delete() }`, psQuote(id)))
+		return err
+	}
+
+	// デバイス名のパスは robocopy 等で扱えないため、シンボリックリンク経由で読み取る
+	link := filepath.Join(defaultString(cfg.SourceSnapshot.SnapshotDir, os.TempDir()), sourceSnapshotName(cfg))
+	os.Remove(link)
+	if err := os.Symlink(device+`\`, link); err != nil {
+		deleteShadow()
+		return nil, pkgerrors.Errorf("シャドウコピーへのリンクを作成できません: %v", err)
+	}
+
+	rel, _ := filepath.Rel(volume, src)
+	return &frozenSource{
+		Path: filepath.Join(link, rel),
+		release: func() (bool, error) {
+			os.Remove(link)
+			return false, deleteShadow()
+		},
+	}, nil
+}
+
+// volumePathName は path を含むボリュームのマウント先（C:\ 等）を返します。
+func volumePathName(path string) (string, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(p, &buf[0], uint32(len(buf))); err != nil {
+		return "", err
+	}
+	return windows.UTF16ToString(buf), nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// スナップショットの保存先（ストレージバックエンド）
+// =============================================================================
+
+// storageObject は保存先のオブジェクト（ファイル）です。
+type storageObject struct {
+	Name    string // スラッシュ区切りのパス（保存先のルートからの相対パス）
+	Size    int64
+	ModTime time.Time
+}
+
+// storageBackend はスナップショットの複製先です。
+// 名前はすべてスラッシュ区切りの相対パス（"<レベル>/<スナップショット名>"）で指定します。
+type storageBackend interface {
+	// List は dir 直下の完了したオブジェクトを名前順に返します（アップロード途中のものは含めません）。
+	// dir が存在しない場合は空の一覧を返します。
+	List(dir string) ([]storageObject, error)
+	// Upload は src（サイズ size）を name に書き込みます。
+	// 前回中断したアップロードがあれば続きから再開し、完了するまで name としては見えません。
+	Upload(name string, src io.ReaderAt, size int64, limiter *rateLimiter) error
+	// Remove は name を削除します。
+	Remove(name string) error
+	Close() error
+	// String はログ表示用の保存先の説明を返します（認証情報は含めません）。
+	String() string
+}
+
+// partialExt はアップロード・作成途中のファイルの拡張子です。
+const partialExt = ".partial"
+
+// -----------------------------------------------------------------------------
+// ファイルシステム型の保存先（ローカル・SFTP）
+// -----------------------------------------------------------------------------
+
+// remoteFS は fsStorage が使用するファイル操作です。パスはスラッシュ区切りです。
+type remoteFS interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	MkdirAll(name string) error
+	// OpenAppend は name を追記用に開きます（存在しない場合は作成）。
+	OpenAppend(name string) (io.WriteCloser, error)
+	// Rename は oldname を newname に置き換えます（newname が存在する場合は上書き）。
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	Close() error
+}
+
+// fsStorage はファイルシステム型の保存先です。
+// アップロード中は "<name>.partial" に書き込み、完了後に name へ名前を変更します。
+// 中断した場合は次回 .partial の末尾から再開します。
+type fsStorage struct {
+	fs   remoteFS
+	root string
+	desc string
+}
+
+func (s *fsStorage) String() string { return s.desc }
+func (s *fsStorage) Close() error   { return s.fs.Close() }
+
+func (s *fsStorage) path(name string) string { return path.Join(s.root, name) }
+
+func (s *fsStorage) List(dir string) ([]storageObject, error) {
+	infos, err := s.fs.ReadDir(s.path(dir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var objects []storageObject
+	for _, info := range infos {
+		if info.IsDir() || strings.HasSuffix(info.Name(), partialExt) {
+			continue
+		}
+		objects = append(objects, storageObject{Name: path.Join(dir, info.Name()), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (s *fsStorage) Upload(name string, src io.ReaderAt, size int64, limiter *rateLimiter) error {
+	dst := s.path(name)
+	if err := s.fs.MkdirAll(path.Dir(dst)); err != nil {
+		return err
+	}
+	partial := dst + partialExt
+
+	// 前回の続きから再開（サイズが合わない場合は最初から）
+	var offset int64
+	if info, err := s.fs.Stat(partial); err == nil {
+		if info.Size() <= size {
+			offset = info.Size()
+		} else if err := s.fs.Remove(partial); err != nil {
+			return err
+		}
+	}
+	if offset > 0 {
+		log.Printf("アップロードを再開します: %s (%d / %d bytes)", name, offset, size)
+	}
+
+	w, err := s.fs.OpenAppend(partial)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, limiter.Reader(io.NewSectionReader(src, offset, size-offset))); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	info, err := s.fs.Stat(partial)
+	if err != nil {
+		return err
+	}
+	if info.Size() != size {
+		return pkgerrors.Errorf("%s: アップロードしたサイズが一致しません (%d / %d bytes)", name, info.Size(), size)
+	}
+	return s.fs.Rename(partial, dst)
+}
+
+func (s *fsStorage) Remove(name string) error {
+	return s.fs.Remove(s.path(name))
+}
+
+// localFS はローカル（またはマウント済みのネットワークドライブ）のファイル操作です。
+type localFS struct{}
+
+func (localFS) Stat(name string) (os.FileInfo, error) { return os.Stat(filepath.FromSlash(name)) }
+
+func (localFS) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(filepath.FromSlash(name))
+	if err != nil {
+		return nil, err
+	}
+	var infos []os.FileInfo
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (localFS) MkdirAll(name string) error { return os.MkdirAll(filepath.FromSlash(name), 0755) }
+
+func (localFS) OpenAppend(name string) (io.WriteCloser, error) {
+	return os.OpenFile(filepath.FromSlash(name), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+}
+
+func (localFS) Rename(oldname, newname string) error {
+	return os.Rename(filepath.FromSlash(oldname), filepath.FromSlash(newname))
+}
+
+func (localFS) Remove(name string) error { return os.Remove(filepath.FromSlash(name)) }
+func (localFS) Close() error             { return nil }
+
+// newLocalStorage はローカルのディレクトリ root を保存先にします。
+func newLocalStorage(root string) *fsStorage {
+	return &fsStorage{fs: localFS{}, root: filepath.ToSlash(root), desc: "local:" + root}
+}
+
+// -----------------------------------------------------------------------------
+// 帯域制限
+// -----------------------------------------------------------------------------
+
+// rateLimiter は転送量を1秒あたり bytesPerSec バイトまでに制限します。
+// 複数の転送で共有した場合は合計の転送量を制限します。nil の場合は制限しません。
+type rateLimiter struct {
+	bytesPerSec int64
+	limit       func(now time.Time) int64 // 時刻により上限を切り替える場合（0 は無制限）
+
+	mu    sync.Mutex
+	rate  int64 // 現在の上限
+	start time.Time
+	total int64
+	now   func() time.Time    // テスト用に差し替え可能
+	sleep func(time.Duration) // テスト用に差し替え可能
+}
+
+// newRateLimiter は帯域制限を作成します。bytesPerSec が 0 以下の場合は nil（制限なし）を返します。
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSec: bytesPerSec, now: time.Now, sleep: time.Sleep}
+}
+
+// currentRate は現在の上限を返します。上限が変わった場合は平均の計算をやり直します（l.mu を保持して呼び出す）。
+func (l *rateLimiter) currentRate(now time.Time) int64 {
+	rate := l.bytesPerSec
+	if l.limit != nil {
+		rate = l.limit(now)
+	}
+	if rate != l.rate || l.start.IsZero() {
+		l.rate, l.start, l.total = rate, now, 0
+	}
+	return rate
+}
+
+// wait は n バイトの転送後、平均の転送速度が上限を超えないように待機します。
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := l.now()
+	rate := l.currentRate(now)
+	if rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.total += int64(n)
+	due := l.start.Add(time.Duration(float64(l.total) / float64(rate) * float64(time.Second)))
+	l.mu.Unlock()
+	if d := due.Sub(now); d > 0 {
+		l.sleep(d)
+	}
+}
+
+// chunkSize は1回の読み込みの上限を返します（転送を平滑化するため約0.1秒分）。
+func (l *rateLimiter) chunkSize() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := l.rate
+	if rate == 0 {
+		rate = l.bytesPerSec
+	}
+	return int(rate/10) + 1
+}
+
+// Reader は読み込みを帯域制限する r を返します。
+func (l *rateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// 1回の読み込みを小さくして転送を平滑化する
+	if max := r.l.chunkSize(); len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.l.wait(n)
+	}
+	return n, err
+}
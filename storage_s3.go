@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// S3 互換オブジェクトストレージの保存先
+// =============================================================================
+
+// S3 の認証情報を指定する環境変数（AWS CLI 等と共通）
+const (
+	s3AccessKeyEnv    = "AWS_ACCESS_KEY_ID"
+	s3SecretKeyEnv    = "AWS_SECRET_ACCESS_KEY"
+	s3SessionTokenEnv = "AWS_SESSION_TOKEN"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	// s3PartSize はマルチパートアップロードの1パートのサイズです（S3 の最小は 5MiB）。
+	// これ以下のファイルは1回の PUT で書き込みます。
+	s3PartSize = 16 << 20
+)
+
+// s3Storage は S3 互換のオブジェクトストレージ（AWS S3・MinIO 等）の保存先です。
+// パス形式の URL（<endpoint>/<bucket>/<key>）と署名 V4 を使用します。
+// 大きなファイルはマルチパートでアップロードし、中断した場合は完了済みのパートを残して次回続きから再開します。
+type s3Storage struct {
+	client   *http.Client
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	partSize int64
+	now      func() time.Time
+}
+
+// newS3Storage は remote の設定で S3 互換の保存先を作成します。認証情報は環境変数から読み込みます。
+func newS3Storage(remote *RemoteConfig) (*s3Storage, error) {
+	region := defaultString(remote.Region, s3DefaultRegion)
+	endpoint := defaultString(remote.Endpoint, "https://s3."+region+".amazonaws.com")
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, pkgerrors.Errorf("remote.endpoint の形式が不正です（例: https://s3.example.com）: %s", endpoint)
+	}
+	s := &s3Storage{
+		client:       &http.Client{},
+		endpoint:     u,
+		bucket:       remote.Bucket,
+		prefix:       strings.Trim(remote.Path, "/"),
+		region:       region,
+		accessKey:    os.Getenv(s3AccessKeyEnv),
+		secretKey:    os.Getenv(s3SecretKeyEnv),
+		sessionToken: os.Getenv(s3SessionTokenEnv),
+		partSize:     s3PartSize,
+		now:          time.Now,
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, pkgerrors.Errorf("S3 の認証情報がありません（環境変数 %s・%s を設定してください）", s3AccessKeyEnv, s3SecretKeyEnv)
+	}
+	return s, nil
+}
+
+func (s *s3Storage) String() string {
+	return "s3:" + s.endpoint.Host + "/" + path.Join(s.bucket, s.prefix)
+}
+
+func (s *s3Storage) Close() error { return nil }
+
+// key は名前に対応するオブジェクトのキーを返します。
+func (s *s3Storage) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, name), "/")
+}
+
+func (s *s3Storage) List(dir string) ([]storageObject, error) {
+	prefix := s.key(dir) + "/"
+	var objects []storageObject
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+		}
+		if err := s.doXML(http.MethodGet, "", query, nil, &result); err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				continue
+			}
+			objects = append(objects, storageObject{Name: path.Join(dir, path.Base(c.Key)), Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (s *s3Storage) Upload(name string, src io.ReaderAt, size int64, limiter *rateLimiter) error {
+	key := s.key(name)
+	if size <= s.partSize {
+		resp, err := s.do(http.MethodPut, key, nil, limiter.Reader(io.NewSectionReader(src, 0, size)), size)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	// 中断したアップロードがあれば完了済みのパートを再利用する
+	uploadID, done := s.findUpload(key)
+	if uploadID == "" {
+		var initiated struct{ UploadId string }
+		if err := s.doXML(http.MethodPost, key, url.Values{"uploads": {""}}, nil, &initiated); err != nil {
+			return err
+		}
+		uploadID = initiated.UploadId
+	} else {
+		log.Printf("アップロードを再開します: %s (完了済み %d パート)", name, len(done))
+	}
+
+	var parts []s3Part
+	for number, offset := 1, int64(0); offset < size; number, offset = number+1, offset+s.partSize {
+		length := min(s.partSize, size-offset)
+		if p, ok := done[number]; ok && p.Size == length {
+			parts = append(parts, p)
+			continue
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+		resp, err := s.do(http.MethodPut, key, query, limiter.Reader(io.NewSectionReader(src, offset, length)), length)
+		if err != nil {
+			return pkgerrors.Errorf("%s: パート %d のアップロードに失敗: %v", name, number, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag"), Size: length})
+	}
+
+	var body bytes.Buffer
+	body.WriteString("<CompleteMultipartUpload>")
+	for _, p := range parts {
+		fmt.Fprintf(&body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", p.PartNumber, xmlEscape(p.ETag))
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+	return s.doXML(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body.Bytes(), nil)
+}
+
+// s3Part はマルチパートアップロードのパートです。
+type s3Part struct {
+	PartNumber int
+	ETag       string
+	Size       int64
+}
+
+// findUpload は key の未完了のマルチパートアップロードと完了済みのパートを返します。
+// 見つからない場合（一覧を取得できない場合を含む）は空の ID を返します。
+func (s *s3Storage) findUpload(key string) (string, map[int]s3Part) {
+	var uploads struct {
+		Upload []struct {
+			Key       string
+			UploadId  string
+			Initiated time.Time
+		}
+	}
+	if err := s.doXML(http.MethodGet, "", url.Values{"uploads": {""}, "prefix": {key}}, nil, &uploads); err != nil {
+		return "", nil
+	}
+	uploadID, initiated := "", time.Time{}
+	for _, u := range uploads.Upload {
+		if u.Key == key && (uploadID == "" || u.Initiated.After(initiated)) {
+			uploadID, initiated = u.UploadId, u.Initiated
+		}
+	}
+	if uploadID == "" {
+		return "", nil
+	}
+
+	done := make(map[int]s3Part)
+	marker := ""
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		var result struct {
+			IsTruncated          bool
+			NextPartNumberMarker string
+			Part                 []s3Part
+		}
+		if err := s.doXML(http.MethodGet, key, query, nil, &result); err != nil {
+			return "", nil
+		}
+		for _, p := range result.Part {
+			done[p.PartNumber] = p
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker == "" {
+			return uploadID, done
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+func (s *s3Storage) Remove(name string) error {
+	resp, err := s.do(http.MethodDelete, s.key(name), nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// doXML はリクエストを送信し、応答の XML を result に読み込みます（result が nil の場合は読み捨て）。
+func (s *s3Storage) doXML(method, key string, query url.Values, body []byte, result interface{}) error {
+	resp, err := s.do(method, key, query, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// CompleteMultipartUpload は 200 でもエラーを返すことがある
+	if e := parseS3Error(resp.StatusCode, data); e != nil {
+		return e
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, result)
+}
+
+// do は署名したリクエストを送信します。応答が成功でない場合はエラーを返します。
+func (s *s3Storage) do(method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket
+	u.RawPath = "/" + s3Escape(s.bucket, false)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + s3Escape(key, false)
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = nil
+	}
+	s.sign(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if e := parseS3Error(resp.StatusCode, data); e != nil {
+			return nil, e
+		}
+		return nil, pkgerrors.Errorf("S3: %s %s: HTTP %d", method, key, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// s3Error は S3 のエラー応答です。
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3: %s: %s (HTTP %d)", e.Code, e.Message, e.Status)
+}
+
+// parseS3Error はエラー応答の XML を解析します。エラーでない場合は nil を返します。
+func parseS3Error(status int, data []byte) *s3Error {
+	var e struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(data, &e) == nil && e.XMLName.Local == "Error" {
+		return &s3Error{Status: status, Code: e.Code, Message: e.Message}
+	}
+	if status >= 300 && len(bytes.TrimSpace(data)) == 0 {
+		return &s3Error{Status: status, Code: http.StatusText(status)}
+	}
+	return nil
+}
+
+// sign はリクエストに署名 V4 を付けます。本文は署名しません（UNSIGNED-PAYLOAD）。
+func (s *s3Storage) sign(req *http.Request) {
+	amzDate := s.now().UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+	if s.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.sessionToken)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape は署名 V4 の規則で URI エンコードします（encodeSlash が false の場合は / をそのまま残します）。
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery はクエリをキー順に並べてエンコードします（値のないキーは "key="）。
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// S3 互換の保存先のテスト（MinIO 相当の最小限の偽サーバを使用）
+// =============================================================================
+
+// fakeS3 は S3 API の一部（オブジェクトの PUT・一覧・削除・マルチパートアップロード）を実装した偽サーバです。
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string][]byte
+	uploads  map[string]*fakeS3Upload
+	nextID   int
+	failPart int // この番号のパートを1回だけ失敗させる
+	parts    int // 成功したパートのアップロード回数
+}
+
+type fakeS3Upload struct {
+	key   string
+	parts map[int][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *s3Storage) {
+	f := &fakeS3{bucket: "backups", objects: map[string][]byte{}, uploads: map[string]*fakeS3Upload{}}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	t.Setenv(s3AccessKeyEnv, "test-access")
+	t.Setenv(s3SecretKeyEnv, "test-secret")
+	t.Setenv(s3SessionTokenEnv, "")
+	s, err := newS3Storage(&RemoteConfig{Type: "s3", Endpoint: server.URL, Bucket: "backups", Path: "/pc1/"})
+	if err != nil {
+		t.Fatalf("保存先の作成に失敗: %v", err)
+	}
+	return f, s
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=test-access/") || !strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date") || r.Header.Get("x-amz-date") == "" {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	q := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && q.Get("list-type") == "2":
+		prefix := q.Get("prefix")
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) && !strings.Contains(k[len(prefix):], "/") {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+		for _, k := range keys {
+			fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2025-07-01T00:00:00.000Z</LastModified></Contents>", k, len(f.objects[k]))
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case r.Method == http.MethodGet && key == "" && q.Has("uploads"):
+		fmt.Fprint(w, "<ListMultipartUploadsResult>")
+		for id, u := range f.uploads {
+			if strings.HasPrefix(u.key, q.Get("prefix")) {
+				fmt.Fprintf(w, "<Upload><Key>%s</Key><UploadId>%s</UploadId><Initiated>2025-07-01T00:00:00.000Z</Initiated></Upload>", u.key, id)
+			}
+		}
+		fmt.Fprint(w, "</ListMultipartUploadsResult>")
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := "upload-" + strconv.Itoa(f.nextID)
+		f.uploads[id] = &fakeS3Upload{key: key, parts: map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		u, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if n == f.failPart {
+			f.failPart = 0
+			f.error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		u.parts[n] = body
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d-%d"`, n, len(body)))
+	case r.Method == http.MethodGet && q.Has("uploadId"):
+		u := f.uploads[q.Get("uploadId")]
+		var numbers []int
+		for n := range u.parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		fmt.Fprint(w, "<ListPartsResult><IsTruncated>false</IsTruncated>")
+		for _, n := range numbers {
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>&quot;etag-%d-%d&quot;</ETag><Size>%d</Size></Part>", n, n, len(u.parts[n]), len(u.parts[n]))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		u := f.uploads[q.Get("uploadId")]
+		var complete struct {
+			Part []struct {
+				PartNumber int
+				ETag       string
+			}
+		}
+		xml.Unmarshal(body, &complete)
+		var data []byte
+		for i, p := range complete.Part {
+			want := fmt.Sprintf(`"etag-%d-%d"`, i+1, len(u.parts[i+1]))
+			if p.PartNumber != i+1 || p.ETag != want {
+				// 実際の S3 と同様に 200 でエラーを返す
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code><Message>invalid part</Message></Error>")
+				return
+			}
+			data = append(data, u.parts[i+1]...)
+		}
+		f.objects[u.key] = data
+		delete(f.uploads, q.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func TestS3StorageUploadListRemove(t *testing.T) {
+	f, s := newFakeS3(t)
+
+	if err := s.Upload("1d/000001_20250701_0000.zip", bytes.NewReader([]byte("small")), 5, nil); err != nil {
+		t.Fatalf("アップロードに失敗: %v", err)
+	}
+	if string(f.objects["pc1/1d/000001_20250701_0000.zip"]) != "small" {
+		t.Errorf("オブジェクトの内容が違います: %v", f.objects)
+	}
+	f.objects["pc1/1d/nested/other.zip"] = []byte("x")
+	f.objects["pc1/1w/000002_20250702_0000.zip"] = []byte("x")
+
+	objects, err := s.List("1d")
+	if err != nil || len(objects) != 1 || objects[0].Name != "1d/000001_20250701_0000.zip" || objects[0].Size != 5 {
+		t.Fatalf("一覧が違います: %+v %v", objects, err)
+	}
+	if !objects[0].ModTime.Equal(time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("更新日時が違います: %v", objects[0].ModTime)
+	}
+
+	if err := s.Remove("1d/000001_20250701_0000.zip"); err != nil {
+		t.Fatalf("削除に失敗: %v", err)
+	}
+	if _, ok := f.objects["pc1/1d/000001_20250701_0000.zip"]; ok {
+		t.Error("削除されていません")
+	}
+
+	s.bucket = "missing"
+	if _, err := s.List("1d"); err == nil || !strings.Contains(err.Error(), "NoSuchBucket") {
+		t.Errorf("存在しないバケットのエラーが違います: %v", err)
+	}
+}
+
+func TestS3StorageMultipartResume(t *testing.T) {
+	f, s := newFakeS3(t)
+	s.partSize = 1024
+	data := bytes.Repeat([]byte("abcdefghij"), 350) // 3500 バイト = 4 パート
+
+	// 3 パート目で失敗すると、完了済みのパートは保存先に残る
+	f.failPart = 3
+	if err := s.Upload("1w/000003_20250701_0000.tar.zst", bytes.NewReader(data), int64(len(data)), nil); err == nil {
+		t.Fatal("失敗したアップロードがエラーになりません")
+	}
+	if len(f.objects) != 0 || len(f.uploads) != 1 || f.parts != 2 {
+		t.Fatalf("中断後の状態が違います: objects=%d uploads=%d parts=%d", len(f.objects), len(f.uploads), f.parts)
+	}
+
+	// 再開時は残りのパートのみアップロードする
+	if err := s.Upload("1w/000003_20250701_0000.tar.zst", bytes.NewReader(data), int64(len(data)), nil); err != nil {
+		t.Fatalf("アップロードの再開に失敗: %v", err)
+	}
+	if f.parts != 4 {
+		t.Errorf("再開時に完了済みのパートもアップロードされました: %d", f.parts)
+	}
+	if !bytes.Equal(f.objects["pc1/1w/000003_20250701_0000.tar.zst"], data) {
+		t.Error("アップロードした内容が一致しません")
+	}
+	if len(f.uploads) != 0 {
+		t.Error("マルチパートアップロードが完了していません")
+	}
+}
+
+func TestS3Signing(t *testing.T) {
+	t.Setenv(s3AccessKeyEnv, "")
+	if _, err := newS3Storage(&RemoteConfig{Type: "s3", Bucket: "b"}); err == nil {
+		t.Error("認証情報がない場合にエラーになりません")
+	}
+	t.Setenv(s3AccessKeyEnv, "AKID")
+	t.Setenv(s3SecretKeyEnv, "secret")
+	t.Setenv(s3SessionTokenEnv, "token")
+	s, err := newS3Storage(&RemoteConfig{Type: "s3", Bucket: "b", Region: "ap-northeast-1"})
+	if err != nil {
+		t.Fatalf("保存先の作成に失敗: %v", err)
+	}
+	if s.endpoint.Host != "s3.ap-northeast-1.amazonaws.com" {
+		t.Errorf("既定のエンドポイントが違います: %s", s.endpoint)
+	}
+	s.now = func() time.Time { return time.Date(2025, 7, 1, 9, 0, 0, 0, time.UTC) }
+
+	req, _ := http.NewRequest(http.MethodGet, "https://s3.ap-northeast-1.amazonaws.com/b/a%20b.zip?uploadId=x%2By", nil)
+	s.sign(req)
+	auth := req.Header.Get("Authorization")
+	for _, want := range []string{
+		"Credential=AKID/20250701/ap-northeast-1/s3/aws4_request",
+		"SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token",
+		"Signature=",
+	} {
+		if !strings.Contains(auth, want) {
+			t.Errorf("署名に %q が含まれていません: %s", want, auth)
+		}
+	}
+	if strings.Contains(auth, "secret") {
+		t.Error("署名に秘密鍵が含まれています")
+	}
+
+	// 同じ内容は同じ署名、異なる内容は異なる署名
+	again, _ := http.NewRequest(http.MethodGet, req.URL.String(), nil)
+	s.sign(again)
+	other, _ := http.NewRequest(http.MethodGet, "https://s3.ap-northeast-1.amazonaws.com/b/a%20c.zip?uploadId=x%2By", nil)
+	s.sign(other)
+	if again.Header.Get("Authorization") != auth || other.Header.Get("Authorization") == auth {
+		t.Error("署名が内容に応じて変わりません")
+	}
+
+	if got := s3Escape("a b/c~d+é", false); got != "a%20b/c~d%2B%C3%A9" {
+		t.Errorf("URI エンコードが違います: %s", got)
+	}
+	if got := s3CanonicalQuery(map[string][]string{"uploads": {""}, "prefix": {"a/b"}}); got != "prefix=a%2Fb&uploads=" {
+		t.Errorf("クエリの正規化が違います: %s", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// =============================================================================
+// SFTP の保存先
+// =============================================================================
+
+// sftpPasswordEnv は SFTP のパスワードを指定する環境変数です（key_file 未設定の場合に使用）。
+const sftpPasswordEnv = "ROTATE_BACKUP_SFTP_PASSWORD"
+
+// sftpFS は SFTP のファイル操作です。
+type sftpFS struct {
+	client *sftp.Client
+	conn   io.Closer // SSH 接続（テストでは nil）
+}
+
+func (f *sftpFS) Stat(name string) (os.FileInfo, error)      { return f.client.Stat(name) }
+func (f *sftpFS) ReadDir(name string) ([]os.FileInfo, error) { return f.client.ReadDir(name) }
+func (f *sftpFS) MkdirAll(name string) error                 { return f.client.MkdirAll(name) }
+func (f *sftpFS) Remove(name string) error                   { return f.client.Remove(name) }
+
+// OpenAppend は name を開いて末尾に移動します。
+// SFTP の書き込みはオフセット指定のため、O_APPEND に頼らず書き込み位置を明示します。
+func (f *sftpFS) OpenAppend(name string) (io.WriteCloser, error) {
+	file, err := f.client.OpenFile(name, os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// Rename は POSIX の rename（上書き）に対応したサーバではそれを使用し、
+// 非対応の場合は既存のファイルを削除してから名前を変更します。
+func (f *sftpFS) Rename(oldname, newname string) error {
+	if err := f.client.PosixRename(oldname, newname); err == nil {
+		return nil
+	}
+	if err := f.client.Remove(newname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return f.client.Rename(oldname, newname)
+}
+
+func (f *sftpFS) Close() error {
+	err := f.client.Close()
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	return err
+}
+
+// dialSFTP は remote の設定で SFTP サーバに接続します。
+// ホスト鍵は known_hosts で検証し、認証は key_file（秘密鍵）または環境変数のパスワードを使用します。
+func dialSFTP(remote *RemoteConfig) (*fsStorage, error) {
+	host := remote.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "22")
+	}
+
+	knownHostsFile := remote.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, pkgerrors.Errorf("known_hosts を読み込めません: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if remote.KeyFile != "" {
+		pem, err := os.ReadFile(remote.KeyFile)
+		if err != nil {
+			// 秘密鍵のパスは出力しない
+			return nil, pkgerrors.Errorf("remote.key_file を読み込めません: %v", errors.Unwrap(err))
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, pkgerrors.Errorf("remote.key_file の秘密鍵を解析できません（パスフレーズ付きの鍵には対応していません）: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password := os.Getenv(sftpPasswordEnv); password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, pkgerrors.Errorf("SFTP の認証情報がありません（remote.key_file または環境変数 %s を設定してください）", sftpPasswordEnv)
+	}
+
+	conn, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            remote.User,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, pkgerrors.Errorf("SFTP サーバ %s に接続できません: %v", host, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, pkgerrors.Errorf("SFTP を開始できません: %v", err)
+	}
+	return newSFTPStorage(client, conn, remote.Path, "sftp:"+remote.User+"@"+host+":"+remote.Path), nil
+}
+
+// newSFTPStorage は接続済みの SFTP クライアントの root を保存先にします。
+func newSFTPStorage(client *sftp.Client, conn io.Closer, root, desc string) *fsStorage {
+	return &fsStorage{fs: &sftpFS{client: client, conn: conn}, root: root, desc: desc}
+}
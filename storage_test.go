@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// =============================================================================
+// 保存先（ローカル・SFTP）のテスト
+// =============================================================================
+
+// newTestSFTPStorage はプロセス内の SFTP サーバに接続した保存先を作成します。
+func newTestSFTPStorage(t *testing.T, root string) *fsStorage {
+	clientRead, serverWrite := io.Pipe()
+	serverRead, clientWrite := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverRead, serverWrite})
+	if err != nil {
+		t.Fatalf("SFTP サーバの起動に失敗: %v", err)
+	}
+	go server.Serve()
+	client, err := sftp.NewClientPipe(clientRead, clientWrite)
+	if err != nil {
+		t.Fatalf("SFTP クライアントの起動に失敗: %v", err)
+	}
+	s := newSFTPStorage(client, nil, filepath.ToSlash(root), "sftp:test")
+	t.Cleanup(func() {
+		server.Close()
+		s.Close()
+	})
+	return s
+}
+
+// failingReaderAt は limit バイト目以降の読み込みでエラーを返します（転送の中断を再現）。
+type failingReaderAt struct {
+	r     io.ReaderAt
+	limit int64
+	read  int64 // 読み込んだバイト数
+}
+
+func (f *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > f.limit {
+		if off >= f.limit {
+			return 0, errors.New("接続が切断されました")
+		}
+		p = p[:f.limit-off]
+	}
+	n, err := f.r.ReadAt(p, off)
+	f.read += int64(n)
+	return n, err
+}
+
+func TestStorageUploadResume(t *testing.T) {
+	backends := map[string]func(t *testing.T, root string) storageBackend{
+		"local": func(t *testing.T, root string) storageBackend { return newLocalStorage(root) },
+		"sftp":  func(t *testing.T, root string) storageBackend { return newTestSFTPStorage(t, root) },
+	}
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			root := t.TempDir()
+			s := open(t, root)
+			data := bytes.Repeat([]byte("0123456789"), 10000)
+
+			// 途中で中断したアップロードは一覧に現れない
+			first := &failingReaderAt{r: bytes.NewReader(data), limit: 40000}
+			if err := s.Upload("1d/000001_20250701_0000.zip", first, int64(len(data)), nil); err == nil {
+				t.Fatal("中断したアップロードがエラーになりません")
+			}
+			if objects, err := s.List("1d"); err != nil || len(objects) != 0 {
+				t.Fatalf("アップロード途中のファイルが一覧に含まれています: %v %v", objects, err)
+			}
+
+			// 続きから再開する
+			second := &failingReaderAt{r: bytes.NewReader(data), limit: int64(len(data))}
+			if err := s.Upload("1d/000001_20250701_0000.zip", second, int64(len(data)), nil); err != nil {
+				t.Fatalf("アップロードの再開に失敗: %v", err)
+			}
+			if second.read != int64(len(data))-40000 {
+				t.Errorf("再開時に読み込んだバイト数が違います: %d", second.read)
+			}
+			got, _ := os.ReadFile(filepath.Join(root, "1d", "000001_20250701_0000.zip"))
+			if !bytes.Equal(got, data) {
+				t.Error("アップロードした内容が一致しません")
+			}
+			if _, err := os.Stat(filepath.Join(root, "1d", "000001_20250701_0000.zip"+partialExt)); !os.IsNotExist(err) {
+				t.Error("アップロード途中のファイルが残っています")
+			}
+
+			objects, err := s.List("1d")
+			if err != nil || len(objects) != 1 || objects[0].Name != "1d/000001_20250701_0000.zip" || objects[0].Size != int64(len(data)) {
+				t.Fatalf("一覧が違います: %+v %v", objects, err)
+			}
+			if objects, err := s.List("missing"); err != nil || len(objects) != 0 {
+				t.Errorf("存在しないディレクトリの一覧が空になりません: %v %v", objects, err)
+			}
+
+			// 元より大きい途中のファイルは破棄して最初から
+			os.WriteFile(filepath.Join(root, "1d", "000002_20250702_0000.zip"+partialExt), bytes.Repeat([]byte("x"), 20), 0644)
+			if err := s.Upload("1d/000002_20250702_0000.zip", bytes.NewReader([]byte("short")), 5, nil); err != nil {
+				t.Fatalf("アップロードに失敗: %v", err)
+			}
+			if got, _ := os.ReadFile(filepath.Join(root, "1d", "000002_20250702_0000.zip")); string(got) != "short" {
+				t.Errorf("アップロードした内容が違います: %q", got)
+			}
+
+			if err := s.Remove("1d/000001_20250701_0000.zip"); err != nil {
+				t.Fatalf("削除に失敗: %v", err)
+			}
+			if objects, _ := s.List("1d"); len(objects) != 1 {
+				t.Errorf("削除されていません: %+v", objects)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0) != nil || newRateLimiter(-1) != nil {
+		t.Error("0 以下の上限で制限されます")
+	}
+	var nilLimiter *rateLimiter
+	if r := bytes.NewReader(nil); nilLimiter.Reader(r) != io.Reader(r) {
+		t.Error("制限なしの場合に元の Reader が返されません")
+	}
+
+	l := newRateLimiter(1000)
+	var longest time.Duration
+	l.sleep = func(d time.Duration) {
+		if d > longest {
+			longest = d
+		}
+	}
+	n, err := io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 5000))))
+	if err != nil || n != 5000 {
+		t.Fatalf("読み込みに失敗: %d %v", n, err)
+	}
+	// 5000 バイトを 1000 B/s で転送すると約5秒
+	if longest < 4900*time.Millisecond || longest > 5*time.Second {
+		t.Errorf("待機時間が違います: %v", longest)
+	}
+}
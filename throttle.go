@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// コピーの帯域・I/O 制限
+// =============================================================================
+
+// ThrottleConfig はコピー・スナップショット保存・複製の転送速度の上限の設定です。
+type ThrottleConfig struct {
+	MaxBytesPerSec          int64    `json:"max_bytes_per_sec"`            // 転送速度の上限（0で無制限）
+	WorkHours               string   `json:"work_hours"`                   // 作業時間帯（例: "09:00-18:00"、空の場合は区別しない）
+	WorkDays                []string `json:"work_days"`                    // 作業時間帯を適用する曜日（mon〜sun、省略時は mon〜fri）
+	WorkHoursMaxBytesPerSec int64    `json:"work_hours_max_bytes_per_sec"` // 作業時間帯の転送速度の上限（0で max_bytes_per_sec と同じ）
+	LowIOPriority           bool     `json:"low_io_priority"`              // プロセスの I/O 優先度を下げる
+}
+
+// weekdayNames は work_days に指定できる曜日です。
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// defaultWorkDays は work_days を省略した場合の曜日です。
+var defaultWorkDays = []string{"mon", "tue", "wed", "thu", "fri"}
+
+// robocopyIPGBlock は robocopy の /IPG の待ち時間を挿入する単位（64KiB）です。
+const robocopyIPGBlock = 64 * 1024
+
+// parseWorkHours は "HH:MM-HH:MM" 形式の時間帯を 0 時からの経過時間で返します。
+// 終了が開始より前の場合は日をまたぐ時間帯です。
+func parseWorkHours(s string) (start, end time.Duration, err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, pkgerrors.Errorf("\"HH:MM-HH:MM\" の形式で指定してください: %s", s)
+	}
+	for i, part := range []string{from, to} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, pkgerrors.Errorf("時刻の形式が不正です: %s", part)
+		}
+		d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if i == 0 {
+			start = d
+		} else {
+			end = d
+		}
+	}
+	if start == end {
+		return 0, 0, pkgerrors.Errorf("開始と終了が同じ時刻です: %s", s)
+	}
+	return start, end, nil
+}
+
+// inWorkHours は now が作業時間帯かどうかを返します。work_hours が空・不正な場合は false です。
+func (t ThrottleConfig) inWorkHours(now time.Time) bool {
+	if t.WorkHours == "" {
+		return false
+	}
+	start, end, err := parseWorkHours(t.WorkHours)
+	if err != nil {
+		return false
+	}
+	days := t.WorkDays
+	if len(days) == 0 {
+		days = defaultWorkDays
+	}
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	day := now.Weekday()
+	if start > end {
+		// 日をまたぐ時間帯の終了側（0時〜終了）は前日の作業時間帯とみなす
+		if offset < end {
+			day = (day + 6) % 7
+		} else if offset < start {
+			return false
+		}
+	} else if offset < start || offset >= end {
+		return false
+	}
+	return slices.Contains(days, weekdayNames[day])
+}
+
+// bytesPerSec は now の時点の転送速度の上限を返します（0 は無制限）。
+func (t ThrottleConfig) bytesPerSec(now time.Time) int64 {
+	if t.WorkHoursMaxBytesPerSec > 0 && t.inWorkHours(now) {
+		return t.WorkHoursMaxBytesPerSec
+	}
+	return t.MaxBytesPerSec
+}
+
+// newLimiter はコピーの帯域制限を作成します。制限しない設定の場合は nil を返します。
+// 作業時間帯を設定した場合は、転送中に時間帯が変わると上限を切り替えます。
+func (t ThrottleConfig) newLimiter() *rateLimiter {
+	if t.MaxBytesPerSec <= 0 && t.WorkHoursMaxBytesPerSec <= 0 {
+		return nil
+	}
+	if t.WorkHours == "" || t.WorkHoursMaxBytesPerSec <= 0 {
+		return newRateLimiter(t.MaxBytesPerSec)
+	}
+	l := newRateLimiter(max(t.MaxBytesPerSec, t.WorkHoursMaxBytesPerSec))
+	l.limit = t.bytesPerSec
+	return l
+}
+
+// robocopyArgs は転送速度の上限に対応する robocopy の /IPG（64KiB ごとの待ち時間[ms]）を返します。
+// copy_args で /IPG を指定している場合・制限しない場合は nil です。
+func (t ThrottleConfig) robocopyArgs(parts []string, now time.Time) []string {
+	for _, p := range parts {
+		if strings.HasPrefix(strings.ToUpper(p), "/IPG") {
+			return nil
+		}
+	}
+	rate := t.bytesPerSec(now)
+	if rate <= 0 {
+		return nil
+	}
+	// 転送自体の時間は無視し、64KiB を 1/rate 秒ごとに送る待ち時間を挿入する
+	ipg := (robocopyIPGBlock*1000 + rate - 1) / rate
+	if ipg <= 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("/IPG:%d", ipg)}
+}
+
+// rsyncArgs は転送速度の上限に対応する rsync の --bwlimit（KiB/秒）を返します。
+// copy_args で --bwlimit を指定している場合・制限しない場合は nil です。
+func (t ThrottleConfig) rsyncArgs(args []string, now time.Time) []string {
+	for _, a := range args {
+		if strings.HasPrefix(a, "--bwlimit") {
+			return nil
+		}
+	}
+	rate := t.bytesPerSec(now)
+	if rate <= 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("--bwlimit=%d", (rate+1023)/1024)}
+}
+
+// lowerIOPriority は low_io_priority が有効な場合にプロセスの I/O 優先度を下げます。
+// 失敗してもバックアップは継続します。
+func lowerIOPriority(cfg *BackupConfig) {
+	enabled := cfg.Throttle.LowIOPriority
+	for _, job := range cfg.jobs {
+		enabled = enabled || job.Throttle.LowIOPriority
+	}
+	if !enabled || cfg.DryRun {
+		return
+	}
+	if err := setLowIOPriority(); err != nil {
+		log.Printf("I/O 優先度の変更に失敗: %v", err)
+		return
+	}
+	log.Printf("I/O 優先度を下げました")
+}
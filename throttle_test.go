@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// コピーの帯域・I/O 制限のテスト
+// =============================================================================
+
+func TestParseWorkHours(t *testing.T) {
+	tests := []struct {
+		value      string
+		start, end time.Duration
+		wantErr    bool
+	}{
+		{"09:00-18:00", 9 * time.Hour, 18 * time.Hour, false},
+		{"22:30 - 06:00", 22*time.Hour + 30*time.Minute, 6 * time.Hour, false},
+		{"09:00", 0, 0, true},
+		{"9時-18時", 0, 0, true},
+		{"25:00-18:00", 0, 0, true},
+		{"09:00-09:00", 0, 0, true},
+	}
+	for _, tt := range tests {
+		start, end, err := parseWorkHours(tt.value)
+		if (err != nil) != tt.wantErr || start != tt.start || end != tt.end {
+			t.Errorf("parseWorkHours(%q) = %v, %v, %v", tt.value, start, end, err)
+		}
+	}
+}
+
+func TestThrottleBytesPerSec(t *testing.T) {
+	day := func(weekday time.Weekday, hour, min int) time.Time {
+		// 2025-07-06 は日曜日
+		return time.Date(2025, 7, 6+int(weekday), hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		name     string
+		throttle ThrottleConfig
+		now      time.Time
+		want     int64
+	}{
+		{"作業時間帯なし", ThrottleConfig{MaxBytesPerSec: 100}, day(time.Monday, 10, 0), 100},
+		{"作業時間帯", ThrottleConfig{MaxBytesPerSec: 100, WorkHours: "09:00-18:00", WorkHoursMaxBytesPerSec: 10}, day(time.Monday, 9, 0), 10},
+		{"作業時間帯の終了", ThrottleConfig{MaxBytesPerSec: 100, WorkHours: "09:00-18:00", WorkHoursMaxBytesPerSec: 10}, day(time.Monday, 18, 0), 100},
+		{"既定では土日は対象外", ThrottleConfig{MaxBytesPerSec: 100, WorkHours: "09:00-18:00", WorkHoursMaxBytesPerSec: 10}, day(time.Saturday, 10, 0), 100},
+		{"曜日の指定", ThrottleConfig{WorkHours: "09:00-18:00", WorkDays: []string{"sat"}, WorkHoursMaxBytesPerSec: 10}, day(time.Saturday, 10, 0), 10},
+		{"日をまたぐ時間帯（開始側）", ThrottleConfig{WorkHours: "22:00-02:00", WorkHoursMaxBytesPerSec: 10}, day(time.Friday, 23, 0), 10},
+		// 土曜 1:00 は金曜の作業時間帯の続き
+		{"日をまたぐ時間帯（終了側）", ThrottleConfig{WorkHours: "22:00-02:00", WorkHoursMaxBytesPerSec: 10}, day(time.Saturday, 1, 0), 10},
+		{"日をまたぐ時間帯（前日が対象外）", ThrottleConfig{WorkHours: "22:00-02:00", WorkHoursMaxBytesPerSec: 10}, day(time.Monday, 1, 0), 0},
+		{"日をまたぐ時間帯の外", ThrottleConfig{WorkHours: "22:00-02:00", WorkHoursMaxBytesPerSec: 10}, day(time.Friday, 12, 0), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.throttle.bytesPerSec(tt.now); got != tt.want {
+				t.Errorf("bytesPerSec = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottleRobocopyArgs(t *testing.T) {
+	now := time.Date(2025, 7, 7, 10, 0, 0, 0, time.Local) // 月曜日
+	tests := []struct {
+		name     string
+		throttle ThrottleConfig
+		parts    []string
+		want     []string
+	}{
+		{"無制限", ThrottleConfig{}, nil, nil},
+		// 64KiB を 1MiB/s で送ると 62.5ms
+		{"1MiB/s", ThrottleConfig{MaxBytesPerSec: 1024 * 1024}, []string{"/MIR"}, []string{"/IPG:63"}},
+		{"作業時間帯", ThrottleConfig{MaxBytesPerSec: 1024 * 1024, WorkHours: "09:00-18:00", WorkHoursMaxBytesPerSec: 64 * 1024}, nil, []string{"/IPG:1000"}},
+		{"copy_args で指定済み", ThrottleConfig{MaxBytesPerSec: 1024}, []string{"/MIR", "/ipg:50"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.throttle.robocopyArgs(tt.parts, now); !slices.Equal(got, tt.want) {
+				t.Errorf("robocopyArgs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottleRsyncArgs(t *testing.T) {
+	now := time.Date(2025, 7, 7, 10, 0, 0, 0, time.Local) // 月曜日
+	tests := []struct {
+		name     string
+		throttle ThrottleConfig
+		args     []string
+		want     []string
+	}{
+		{"無制限", ThrottleConfig{}, nil, nil},
+		{"1MiB/s", ThrottleConfig{MaxBytesPerSec: 1024 * 1024}, []string{"-a"}, []string{"--bwlimit=1024"}},
+		// KiB 未満は切り上げる
+		{"1KiB/s 未満", ThrottleConfig{MaxBytesPerSec: 100}, nil, []string{"--bwlimit=1"}},
+		{"作業時間帯", ThrottleConfig{MaxBytesPerSec: 1024 * 1024, WorkHours: "09:00-18:00", WorkHoursMaxBytesPerSec: 64 * 1024}, nil, []string{"--bwlimit=64"}},
+		{"copy_args で指定済み", ThrottleConfig{MaxBytesPerSec: 1024}, []string{"-a", "--bwlimit=50"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.throttle.rsyncArgs(tt.args, now); !slices.Equal(got, tt.want) {
+				t.Errorf("rsyncArgs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThrottleLimiterSwitchesRate(t *testing.T) {
+	if (ThrottleConfig{}).newLimiter() != nil {
+		t.Error("無制限の設定で帯域制限が作成されました")
+	}
+
+	// 作業時間帯は 1000 B/s、それ以外は無制限
+	now := time.Date(2025, 7, 7, 17, 59, 0, 0, time.Local) // 月曜日
+	l := ThrottleConfig{WorkHours: "09:00-18:00", WorkHoursMaxBytesPerSec: 1000}.newLimiter()
+	var slept time.Duration
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+	if _, err := io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 3000)))); err != nil {
+		t.Fatalf("読み込みに失敗: %v", err)
+	}
+	if slept < 2900*time.Millisecond || slept > 3*time.Second {
+		t.Errorf("作業時間帯の待機時間が違います: %v", slept)
+	}
+
+	now = now.Add(time.Minute) // 18:00 以降
+	slept = 0
+	if _, err := io.Copy(io.Discard, l.Reader(bytes.NewReader(make([]byte, 100000)))); err != nil {
+		t.Fatalf("読み込みに失敗: %v", err)
+	}
+	if slept != 0 {
+		t.Errorf("作業時間帯の外で待機しました: %v", slept)
+	}
+}
+
+func TestValidateThrottleConfig(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.Throttle = ThrottleConfig{MaxBytesPerSec: -1, WorkHours: "9-18", WorkDays: []string{"monday"}}
+	problems := validateConfig(cfg)
+	for _, key := range []string{"throttle.max_bytes_per_sec", "throttle.work_hours", "throttle.work_days"} {
+		if findProblem(problems, key) == nil {
+			t.Errorf("%s の問題が検出されません: %+v", key, problems)
+		}
+	}
+
+	cfg.Throttle = ThrottleConfig{WorkHoursMaxBytesPerSec: 1000}
+	if p := findProblem(validateConfig(cfg), "throttle.work_hours_max_bytes_per_sec"); p == nil || p.Severity != SeverityWarning {
+		t.Errorf("work_hours 未設定の警告がありません: %+v", p)
+	}
+}
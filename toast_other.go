@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "log"
+
+// sendToastNotification は Windows 以外ではトースト通知を送信できないため、ログへの出力のみ行います。
+func sendToastNotification(message string) {
+	log.Printf("通知メッセージ (トースト通知は Windows のみ対応): %s", message)
+}
@@ -0,0 +1,56 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+
+	"github.com/go-toast/toast"
+)
+
+// sendToastNotification は Windows トースト通知を送信します。
+func sendToastNotification(message string) {
+	log.Printf("トースト通知を送信中: %s", message)
+
+	// go-toast ライブラリを使用してトースト通知を送信
+	notification := toast.Notification{
+		AppID:   "Backup Rotation Tool",
+		Title:   "Backup Notification",
+		Message: message,
+		Icon:    "", // アイコンファイルのパス（オプション）
+		Actions: []toast.Action{
+			{
+				Type:      "protocol",
+				Label:     "OK",
+				Arguments: "",
+			},
+		},
+	}
+
+	err := notification.Push()
+	if err != nil {
+		log.Printf("go-toast トースト通知エラー: %v", err)
+
+		// フォールバック: PowerShell経由で試行
+		sendFallbackNotification(message)
+	} else {
+		log.Printf("go-toast でトースト通知を送信しました: %s", message)
+	}
+}
+
+// sendFallbackNotification はフォールバック通知を送信します。
+func sendFallbackNotification(message string) {
+	log.Printf("フォールバック通知を試行中: %s", message)
+
+	// msg.exe を使用したシンプルな通知
+	cmd := exec.Command("msg", "*", fmt.Sprintf("Backup Notification: %s", message))
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("msg.exe 通知失敗: %v", err)
+		log.Printf("通知メッセージ (フォールバック): %s", message)
+	} else {
+		log.Printf("msg.exe で通知を送信しました: %s", message)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// VHDX のマウント管理
+// =============================================================================
+
+// powerShellRunner は PowerShell のスクリプトを実行し、出力（UTF-8）を返します。
+type powerShellRunner func(script string) (string, error)
+
+// runPowerShell は PowerShell を実行します（テストで差し替えます）。
+var runPowerShell powerShellRunner = func(script string) (string, error) {
+	log.Printf("実行コマンド: powershell -NoProfile -NonInteractive -Command %s", script)
+	out, err := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+	// PowerShellの出力を文字エンコーディング変換
+	outStr := strings.TrimSpace(convertShiftJISToUTF8(out))
+	if err != nil {
+		return outStr, pkgerrors.Errorf("%v\n出力: %s", err, outStr)
+	}
+	return outStr, nil
+}
+
+// psQuote は PowerShell の単一引用符の文字列リテラルを返します。
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// psStringList は PowerShell の ConvertTo-Json が出力する文字列の配列です。
+// 要素が1つの場合・ない場合に文字列・null で出力されることがあるため、いずれも受け付けます。
+type psStringList []string
+
+func (l *psStringList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var s *string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	*l = nil
+	if s != nil && *s != "" {
+		*l = psStringList{*s}
+	}
+	return nil
+}
+
+// diskImageStatus は VHDX とマウント先ドライブの状態です。
+type diskImageStatus struct {
+	Attached      bool         `json:"Attached"`      // VHDX がマウントされている
+	ReadOnly      bool         `json:"ReadOnly"`      // 読み取り専用でマウントされている
+	DriveLetters  psStringList `json:"DriveLetters"`  // VHDX のパーティションのドライブレター
+	DriveLocation string       `json:"DriveLocation"` // vhdx_mount_drive のディスクの場所（VHDX の場合はイメージのパス、未使用の場合は空）
+}
+
+// diskImageManager は source_vhdx のマウント・マウント解除と、マウント先の確認を行います。
+type diskImageManager struct {
+	run      powerShellRunner
+	image    string // VHDX の絶対パス
+	drive    string // マウント先のドライブレター（"Q"）
+	mounted  bool   // このプロセスでマウントした
+	readOnly bool   // 読み取り専用でマウントしている
+	attached bool   // マウントされている
+}
+
+// newDiskImageManager は cfg の VHDX を管理します。
+func newDiskImageManager(cfg *BackupConfig, run powerShellRunner) *diskImageManager {
+	image, err := filepath.Abs(cfg.SourceVHDX)
+	if err != nil {
+		image = cfg.SourceVHDX
+	}
+	drive := strings.ToUpper(strings.TrimRight(cfg.VHDXMountDrive, `:\/`))
+	return &diskImageManager{run: run, image: filepath.FromSlash(image), drive: drive}
+}
+
+// status は VHDX のマウント状態と、マウント先ドライブを使用しているディスクを取得します。
+func (m *diskImageManager) status() (diskImageStatus, error) {
+	script := fmt.Sprintf(`$ErrorActionPreference = 'Stop'; `+
+		`$img = Get-DiskImage -ImagePath %s; $letters = @(); $ro = $false; `+
+		`if ($img.Attached) { $disk = $img | Get-Disk; $ro = [bool]$disk.IsReadOnly; `+
+		`$letters = @($disk | Get-Partition | Where-Object { $_.DriveLetter } | ForEach-Object { [string]$_.DriveLetter }) }; `+
+		`$drive = Get-Partition -DriveLetter %s -ErrorAction SilentlyContinue | Get-Disk; `+
+		`[pscustomobject]@{ Attached = [bool]$img.Attached; ReadOnly = $ro; DriveLetters = $letters; `+
+		`DriveLocation = $(if ($drive) { [string]$drive.Location } else { '' }) } | ConvertTo-Json -Compress`,
+		psQuote(m.image), psQuote(m.drive))
+	out, err := m.run(script)
+	if err != nil {
+		return diskImageStatus{}, pkgerrors.Errorf("VHDX の状態を取得できません: %v", err)
+	}
+	var st diskImageStatus
+	if err := json.Unmarshal([]byte(out), &st); err != nil {
+		return diskImageStatus{}, pkgerrors.Errorf("VHDX の状態の形式が不正です: %v\n出力: %s", err, out)
+	}
+	m.attached, m.readOnly = st.Attached, st.ReadOnly
+	return st, nil
+}
+
+// verify は VHDX が vhdx_mount_drive にマウントされているか、マウント先が他のディスクに使われていないかを確認します。
+func (m *diskImageManager) verify(st diskImageStatus) error {
+	if st.Attached {
+		if !slices.ContainsFunc(st.DriveLetters, func(l string) bool { return strings.EqualFold(l, m.drive) }) {
+			return pkgerrors.Errorf("VHDX は %s にマウントされています（vhdx_mount_drive: %s:）: %s",
+				formatDriveLetters(st.DriveLetters), m.drive, m.image)
+		}
+		return nil
+	}
+	if st.DriveLocation != "" {
+		return pkgerrors.Errorf("%s: には別のディスクがマウントされています: %s", m.drive, st.DriveLocation)
+	}
+	return nil
+}
+
+// formatDriveLetters はドライブレターの一覧を表示用に返します。
+func formatDriveLetters(letters []string) string {
+	if len(letters) == 0 {
+		return "ドライブレターなし"
+	}
+	var drives []string
+	for _, l := range letters {
+		drives = append(drives, l+":")
+	}
+	return strings.Join(drives, ", ")
+}
+
+// mount は VHDX をマウントし、ドライブレターが vhdx_mount_drive と異なる場合は変更します。
+func (m *diskImageManager) mount(readOnly bool) error {
+	access := "ReadWrite"
+	if readOnly {
+		access = "ReadOnly"
+	}
+	script := fmt.Sprintf(`$ErrorActionPreference = 'Stop'; `+
+		`Mount-DiskImage -ImagePath %s -Access %s | Out-Null; `+
+		`$p = Get-DiskImage -ImagePath %s | Get-Disk | Get-Partition | Where-Object { $_.Type -ne 'Reserved' } | Sort-Object Size -Descending | Select-Object -First 1; `+
+		`if ($p -and [string]$p.DriveLetter -ne %s) { $p | Set-Partition -NewDriveLetter %s }`,
+		psQuote(m.image), access, psQuote(m.image), psQuote(m.drive), psQuote(m.drive))
+	if out, err := m.run(script); err != nil {
+		return pkgerrors.Errorf("VHDX をマウントできません: %v", err)
+	} else if out != "" {
+		log.Printf("VHDX マウント出力:\n%s", out)
+	}
+	m.mounted = true
+	st, err := m.status()
+	if err == nil {
+		err = m.verify(st)
+	}
+	if err == nil && st.ReadOnly != readOnly {
+		err = pkgerrors.Errorf("VHDX のアクセスモードが違います（読み取り専用: %v）", st.ReadOnly)
+	}
+	if err != nil {
+		m.dismount()
+		return err
+	}
+	log.Printf("VHDX をマウントしました (%s): %s → %s:", access, m.image, m.drive)
+	return nil
+}
+
+// dismount は VHDX のマウントを解除します。
+func (m *diskImageManager) dismount() error {
+	if _, err := m.run(fmt.Sprintf(`Dismount-DiskImage -ImagePath %s | Out-Null`, psQuote(m.image))); err != nil {
+		return pkgerrors.Errorf("VHDX のマウントを解除できません: %v", err)
+	}
+	log.Printf("VHDX のマウントを解除しました: %s", m.image)
+	m.mounted, m.attached, m.readOnly = false, false, false
+	return nil
+}
+
+// prepare はコピー前に VHDX が vhdx_mount_drive に書き込み可能な状態でマウントされていることを確認します。
+// マウントされていない場合は mountIfMissing が有効であればマウントします。
+func (m *diskImageManager) prepare(mountIfMissing bool) error {
+	st, err := m.status()
+	if err != nil {
+		return err
+	}
+	if err := m.verify(st); err != nil {
+		return err
+	}
+	switch {
+	case st.Attached && !st.ReadOnly:
+		log.Printf("VHDX は %s: にマウント済みです: %s", m.drive, m.image)
+		return nil
+	case st.Attached:
+		// 読み取り専用でのスナップショット作成中に中断した場合など
+		log.Printf("VHDX が読み取り専用でマウントされているため、書き込み可能でマウントし直します: %s", m.image)
+		if err := m.dismount(); err != nil {
+			return err
+		}
+	case !mountIfMissing:
+		return pkgerrors.Errorf("VHDX がマウントされていません（mount_vhdx_if_missing が無効です）: %s", m.image)
+	}
+	return m.mount(false)
+}
+
+// remount はアクセスモードを変えて VHDX をマウントし直します。
+// 元からマウントされていた VHDX をマウントし直した場合も、終了時の解除の対象にはしません。
+func (m *diskImageManager) remount(readOnly bool) error {
+	mounted := m.mounted
+	if err := m.dismount(); err != nil {
+		return err
+	}
+	err := m.mount(readOnly)
+	m.mounted = mounted && err == nil
+	return err
+}
+
+// -----------------------------------------------------------------------------
+// スナップショット作成時の処理
+// -----------------------------------------------------------------------------
+
+// imageLocked はファイルが他のプロセスに書き込み用に開かれている場合に true を返します（テストで差し替えます）。
+var imageLocked = platformImageLocked
+
+// diskImage は VHDX のマウント管理を返します。vhdx_mount_drive が未設定の場合は管理しないため nil です。
+func (cfg *BackupConfig) diskImage() *diskImageManager {
+	if cfg.VHDXMountDrive == "" {
+		return nil
+	}
+	if cfg.vhdx == nil {
+		cfg.vhdx = newDiskImageManager(cfg, runPowerShell)
+	}
+	return cfg.vhdx
+}
+
+// prepareVHDX はコピー前に VHDX のマウント先を確認し、未マウントの場合はマウントします。
+func prepareVHDX(cfg *BackupConfig) error {
+	m := cfg.diskImage()
+	if m == nil {
+		return nil
+	}
+	if cfg.DryRun {
+		if cfg.MountIfMissing {
+			fmt.Printf("VHDXマウント確認: %s → %s:（未マウントの場合はマウント予定）\n", m.image, m.drive)
+		} else {
+			fmt.Printf("VHDXマウント確認: %s → %s:\n", m.image, m.drive)
+		}
+		return nil
+	}
+	if err := m.prepare(cfg.MountIfMissing); err != nil {
+		log.Printf("VHDXマウント失敗: %v", err)
+		return wrapFailure(FailureMount, pkgerrors.Errorf("VHDXマウント失敗: %v", err))
+	}
+	return nil
+}
+
+// freezeVHDX はスナップショットのコピー前に、vhdx_read_only_snapshot が有効であれば VHDX を読み取り専用でマウントし直し、
+// VHDX が他のプロセス（仮想マシン等）に書き込み用に開かれていないかを確認します。返す関数でマウントを元に戻します。
+// vhdx_mount_drive が未設定の場合はマウント状態が分からないため確認しません。
+func freezeVHDX(cfg *BackupConfig) (restore func(), err error) {
+	restore = func() {}
+	m := cfg.diskImage()
+	if cfg.DryRun {
+		if m != nil && cfg.VHDXReadOnlySnapshot {
+			fmt.Printf("VHDX を読み取り専用でマウントし直して保存予定: %s\n", m.image)
+		}
+		return restore, nil
+	}
+	if m != nil && cfg.VHDXReadOnlySnapshot && !m.readOnly {
+		if err := m.remount(true); err != nil {
+			return restore, pkgerrors.Errorf("VHDX を読み取り専用でマウントできません: %v", err)
+		}
+		// 終了時にマウントを解除する場合は書き込み可能に戻さない
+		if !m.mounted || cfg.KeepVHDXMounted {
+			restore = func() {
+				if err := m.remount(false); err != nil {
+					log.Printf("VHDX を書き込み可能でマウントし直せません: %v", err)
+				}
+			}
+		}
+	}
+
+	// マウント状態が不明な場合・書き込み可能でマウントしている場合は VHDX のドライバが書き込み用に開いている
+	if m == nil || m.attached && !m.readOnly {
+		return restore, nil
+	}
+	locked, err := imageLocked(cfg.SourceVHDX)
+	if err != nil {
+		log.Printf("VHDX の使用状況を確認できません: %v", err)
+	} else if locked {
+		restore()
+		return func() {}, pkgerrors.Errorf("VHDX が他のプロセスで書き込み中です（仮想マシン等で使用していないか確認してください）: %s", cfg.SourceVHDX)
+	}
+	return restore, nil
+}
+
+// releaseVHDX はバックアップの終了時に、このプロセスでマウントした VHDX のマウントを解除します
+// （keep_vhdx_mounted が有効な場合はマウントしたままにします）。
+func releaseVHDX(cfg *BackupConfig) {
+	m := cfg.vhdx
+	if m == nil || !m.mounted || cfg.KeepVHDXMounted || cfg.DryRun {
+		return
+	}
+	if err := m.dismount(); err != nil {
+		log.Printf("VHDX のマウント解除に失敗: %v", err)
+	}
+}
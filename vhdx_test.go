@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// =============================================================================
+// VHDX のマウント管理のテスト
+// =============================================================================
+
+// fakeDiskImage は PowerShell の代わりに VHDX のマウント状態を模擬します。
+type fakeDiskImage struct {
+	attached bool
+	readOnly bool
+	letters  []string
+	location string // マウント先ドライブを使用している別のディスク
+	letter   string // マウント時に割り当てるドライブレター（空の場合は Set-Partition の指定どおり）
+	scripts  []string
+}
+
+func (f *fakeDiskImage) run(script string) (string, error) {
+	f.scripts = append(f.scripts, script)
+	switch {
+	case strings.HasPrefix(script, "Dismount-DiskImage"):
+		f.attached, f.readOnly, f.letters = false, false, nil
+	case strings.Contains(script, "Mount-DiskImage"):
+		if f.attached {
+			return "", fmt.Errorf("既にマウントされています")
+		}
+		f.attached = true
+		f.readOnly = strings.Contains(script, "-Access ReadOnly")
+		f.letters = []string{f.letter}
+		if f.letter == "" {
+			f.letters = []string{"Q"}
+		}
+	case strings.Contains(script, "ConvertTo-Json"):
+		data, _ := json.Marshal(map[string]any{"Attached": f.attached, "ReadOnly": f.readOnly, "DriveLetters": f.letters, "DriveLocation": f.location})
+		return string(data), nil
+	}
+	return "", nil
+}
+
+// commands は実行したコマンド（Get-DiskImage による状態の取得を除く）を返します。
+func (f *fakeDiskImage) commands() []string {
+	var commands []string
+	for _, s := range f.scripts {
+		switch {
+		case strings.HasPrefix(s, "Dismount-DiskImage"):
+			commands = append(commands, "dismount")
+		case strings.Contains(s, "-Access ReadOnly"):
+			commands = append(commands, "mount ro")
+		case strings.Contains(s, "-Access ReadWrite"):
+			commands = append(commands, "mount rw")
+		}
+	}
+	return commands
+}
+
+// newFakeVHDXConfig は VHDX を Q: にマウントする設定と、模擬した PowerShell を返します。
+func newFakeVHDXConfig(t *testing.T, image *fakeDiskImage) *BackupConfig {
+	captureProgressOutput(t)
+	cfg := newValidTestConfig(t)
+	cfg.VHDXMountDrive = "Q:"
+	cfg.MountIfMissing = true
+	cfg.vhdx = newDiskImageManager(cfg, image.run)
+	return cfg
+}
+
+func TestPSStringList(t *testing.T) {
+	tests := []struct {
+		json string
+		want []string
+	}{
+		{`["Q","R"]`, []string{"Q", "R"}},
+		{`"Q"`, []string{"Q"}},
+		{`null`, nil},
+		{`[]`, []string{}},
+		{`""`, nil},
+	}
+	for _, tt := range tests {
+		var got psStringList
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%s → %q, %v, want %q", tt.json, got, err, tt.want)
+		}
+	}
+	if got := psQuote(`C:\it's\backup.vhdx`); got != `'C:\it''s\backup.vhdx'` {
+		t.Errorf("psQuote = %s", got)
+	}
+}
+
+func TestDiskImagePrepare(t *testing.T) {
+	tests := []struct {
+		name           string
+		image          fakeDiskImage
+		mountIfMissing bool
+		wantErr        string
+		wantCommands   []string
+		wantMounted    bool
+	}{
+		{"未マウントの場合はマウントする", fakeDiskImage{}, true, "", []string{"mount rw"}, true},
+		{"マウント済み", fakeDiskImage{attached: true, letters: []string{"Q"}}, true, "", nil, false},
+		{"小文字のドライブレター", fakeDiskImage{attached: true, letters: []string{"q"}}, true, "", nil, false},
+		{"別のドライブにマウント済み", fakeDiskImage{attached: true, letters: []string{"E"}}, true, "VHDX は E: にマウントされています", nil, false},
+		{"マウント先を別のディスクが使用", fakeDiskImage{location: `D:\other.vhdx`}, true, `Q: には別のディスクがマウントされています: D:\other.vhdx`, nil, false},
+		{"自動マウントが無効", fakeDiskImage{}, false, "VHDX がマウントされていません", nil, false},
+		{"読み取り専用でマウント済み", fakeDiskImage{attached: true, readOnly: true, letters: []string{"Q"}}, true, "", []string{"dismount", "mount rw"}, true},
+		{"ドライブレターを変更できない", fakeDiskImage{letter: "E"}, true, "VHDX は E: にマウントされています", []string{"mount rw", "dismount"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := tt.image
+			cfg := newFakeVHDXConfig(t, &image)
+			cfg.MountIfMissing = tt.mountIfMissing
+			err := prepareVHDX(cfg)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("prepareVHDX がエラーを返しました: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr) || classifyFailure(err) != FailureMount) {
+				t.Fatalf("prepareVHDX = %v, want %q", err, tt.wantErr)
+			}
+			if got := image.commands(); !slices.Equal(got, tt.wantCommands) {
+				t.Errorf("実行したコマンド = %v, want %v", got, tt.wantCommands)
+			}
+			if cfg.vhdx.mounted != tt.wantMounted {
+				t.Errorf("mounted = %v, want %v", cfg.vhdx.mounted, tt.wantMounted)
+			}
+		})
+	}
+}
+
+func TestDiskImageMountScript(t *testing.T) {
+	image := &fakeDiskImage{}
+	cfg := newFakeVHDXConfig(t, image)
+	cfg.SourceVHDX = `C:\Backups\backup.vhdx`
+	cfg.vhdx = newDiskImageManager(cfg, image.run)
+	if err := cfg.vhdx.mount(true); err != nil {
+		t.Fatalf("mount がエラーを返しました: %v", err)
+	}
+	script := image.scripts[0]
+	for _, want := range []string{"Mount-DiskImage -ImagePath '", `backup.vhdx' -Access ReadOnly`, "Set-Partition -NewDriveLetter 'Q'"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("マウントのスクリプトに %q がありません: %s", want, script)
+		}
+	}
+}
+
+func TestVHDXLifecycle(t *testing.T) {
+	tests := []struct {
+		name         string
+		image        fakeDiskImage
+		readOnly     bool
+		keepMounted  bool
+		wantCommands []string
+	}{
+		{"マウントして終了時に解除", fakeDiskImage{}, false, false, []string{"mount rw", "dismount"}},
+		{"マウントしたままにする", fakeDiskImage{}, false, true, []string{"mount rw"}},
+		{"マウント済みの VHDX は解除しない", fakeDiskImage{attached: true, letters: []string{"Q"}}, false, false, nil},
+		// 終了時に解除するため書き込み可能には戻さない
+		{"読み取り専用で保存", fakeDiskImage{}, true, false, []string{"mount rw", "dismount", "mount ro", "dismount"}},
+		{"読み取り専用で保存後に書き込み可能に戻す", fakeDiskImage{attached: true, letters: []string{"Q"}}, true, false,
+			[]string{"dismount", "mount ro", "dismount", "mount rw"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := tt.image
+			cfg := newFakeVHDXConfig(t, &image)
+			cfg.VHDXReadOnlySnapshot = tt.readOnly
+			cfg.KeepVHDXMounted = tt.keepMounted
+
+			if err := prepareVHDX(cfg); err != nil {
+				t.Fatalf("prepareVHDX がエラーを返しました: %v", err)
+			}
+			restore, err := freezeVHDX(cfg)
+			if err != nil {
+				t.Fatalf("freezeVHDX がエラーを返しました: %v", err)
+			}
+			if image.readOnly != tt.readOnly {
+				t.Errorf("保存中の読み取り専用 = %v, want %v", image.readOnly, tt.readOnly)
+			}
+			restore()
+			releaseVHDX(cfg)
+			if got := image.commands(); !slices.Equal(got, tt.wantCommands) {
+				t.Errorf("実行したコマンド = %v, want %v", got, tt.wantCommands)
+			}
+		})
+	}
+}
+
+func TestFreezeVHDXDetectsLock(t *testing.T) {
+	old := imageLocked
+	imageLocked = func(string) (bool, error) { return true, nil }
+	t.Cleanup(func() { imageLocked = old })
+
+	// 書き込み可能でマウントしている場合はドライバが開いているため確認しない
+	image := &fakeDiskImage{attached: true, letters: []string{"Q"}}
+	cfg := newFakeVHDXConfig(t, image)
+	if err := prepareVHDX(cfg); err != nil {
+		t.Fatalf("prepareVHDX がエラーを返しました: %v", err)
+	}
+	if _, err := freezeVHDX(cfg); err != nil {
+		t.Errorf("書き込み可能でマウント中にロックを検出しました: %v", err)
+	}
+
+	// 読み取り専用でマウントし直した後も書き込み用に開かれている
+	cfg.VHDXReadOnlySnapshot = true
+	_, err := freezeVHDX(cfg)
+	if err == nil || !strings.Contains(err.Error(), "他のプロセスで書き込み中") {
+		t.Fatalf("ロックを検出しません: %v", err)
+	}
+	// 書き込み可能に戻している
+	if !image.attached || image.readOnly {
+		t.Errorf("ロック検出後にマウント状態が戻っていません: %+v", image)
+	}
+
+	// vhdx_mount_drive を使用しない場合はマウント状態が分からないため確認しない
+	if _, err := freezeVHDX(newValidTestConfig(t)); err != nil {
+		t.Errorf("マウントを管理しない場合にエラーになりました: %v", err)
+	}
+
+	// マウントしていない VHDX が書き込み用に開かれている
+	image = &fakeDiskImage{}
+	cfg = newFakeVHDXConfig(t, image)
+	cfg.vhdx.status()
+	if _, err := freezeVHDX(cfg); err == nil {
+		t.Error("未マウントの VHDX のロックを検出しません")
+	}
+}
+
+func TestValidateVHDXMountConfig(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.VHDXReadOnlySnapshot = true
+	if findProblem(validateConfig(cfg), "vhdx_mount_drive") == nil {
+		t.Error("vhdx_read_only_snapshot でドライブ未設定が検出されません")
+	}
+	cfg.VHDXMountDrive = "QQ:"
+	if p := findProblem(validateConfig(cfg), "vhdx_mount_drive"); p == nil || !strings.Contains(p.Message, "ドライブレター") {
+		t.Errorf("不正なドライブレターが検出されません: %+v", p)
+	}
+	cfg.VHDXMountDrive = `Q:\`
+	if p := findProblem(validateConfig(cfg), "vhdx_mount_drive"); p != nil {
+		t.Errorf("正しいドライブレターでエラーになりました: %+v", p)
+	}
+	cfg.SnapshotFormat = "directory"
+	if findProblem(validateConfig(cfg), "vhdx_read_only_snapshot") == nil {
+		t.Error("directory 形式での vhdx_read_only_snapshot の警告がありません")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// platformImageLocked は Windows 以外ではファイルの共有モードによるロックがないため常に false を返します。
+func platformImageLocked(path string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// =============================================================================
+// 変更監視による update-backup（watch）
+// =============================================================================
+
+// WatchConfig は watch コマンドの設定です。
+type WatchConfig struct {
+	Debounce          string `json:"debounce"`           // 最後の変更から同期するまでの待ち時間（省略時は 2s）
+	ReconcileInterval string `json:"reconcile_interval"` // 取りこぼしを補うため全体を照合する間隔（省略時は 30m）
+}
+
+const (
+	defaultWatchDebounce  = 2 * time.Second
+	defaultWatchReconcile = 30 * time.Minute
+	// watchMaxDelayFactor は変更が続く場合でも debounce のこの倍数の時間で同期します。
+	watchMaxDelayFactor = 10
+)
+
+// errWatchOverflow は変更通知を取りこぼした（OS のバッファがあふれた）ことを表します。
+var errWatchOverflow = errors.New("変更通知があふれました")
+
+// fsWatcher はディレクトリ以下の変更を再帰的に通知します（OS ごとに実装）。
+type fsWatcher interface {
+	// Events は変更・作成・削除されたパス（ファイル・ディレクトリ）を通知します。
+	Events() <-chan string
+	// Errors は監視のエラーを通知します。errWatchOverflow の場合は全体の照合が必要です。
+	Errors() <-chan error
+	Close() error
+}
+
+// newFSWatcher は root 以下を監視する fsWatcher を作成します（テストで差し替え可能）。
+// watch が false を返すディレクトリは監視しない場合があります（OS による）。
+var newFSWatcher func(root string, watch func(dir string) bool) (fsWatcher, error) = newPlatformWatcher
+
+// durations は debounce と reconcile_interval を返します。不正な値は既定値を使用します。
+func (w WatchConfig) durations() (debounce, reconcile time.Duration) {
+	debounce, reconcile = defaultWatchDebounce, defaultWatchReconcile
+	if d, err := time.ParseDuration(w.Debounce); err == nil && d > 0 {
+		debounce = d
+	}
+	if d, err := time.ParseDuration(w.ReconcileInterval); err == nil && d > 0 {
+		reconcile = d
+	}
+	return debounce, reconcile
+}
+
+// mirrorWatch は1つのジョブの work_dir を監視し、変更を backup_dir へ反映します。
+type mirrorWatch struct {
+	cfg       *BackupConfig
+	watcher   fsWatcher
+	debounce  time.Duration
+	reconcile time.Duration
+	out       io.Writer // ドライランの出力先
+
+	pending      map[string]bool // 同期待ちのパス
+	pendingSince time.Time       // 最も古い同期待ちの変更の時刻
+	fullSync     bool            // 次回の同期で全体を照合する
+}
+
+// run は ctx が終了するまで監視を続けます。開始時に全体を照合します。
+func (m *mirrorWatch) run(ctx context.Context) error {
+	m.pending = make(map[string]bool)
+	if !m.reconcileAll() {
+		m.fullSync = true
+	}
+
+	timer := time.NewTimer(m.debounce)
+	if !m.fullSync {
+		timer.Stop()
+	}
+	defer timer.Stop()
+	ticker := time.NewTicker(m.reconcile)
+	defer ticker.Stop()
+
+	// schedule は変更が落ち着いてから同期するようにタイマーを再設定します。
+	schedule := func() {
+		now := time.Now()
+		if m.pendingSince.IsZero() {
+			m.pendingSince = now
+		}
+		delay := m.debounce
+		if limit := m.pendingSince.Add(watchMaxDelayFactor * m.debounce).Sub(now); limit < delay {
+			delay = max(limit, 0)
+		}
+		timer.Reset(delay)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case path, ok := <-m.watcher.Events():
+			if !ok {
+				return wrapFailure(FailureCopy, pkgerrors.New("変更の監視が終了しました"))
+			}
+			if m.cfg.isWatchTarget(path) {
+				m.pending[path] = true
+				schedule()
+			}
+		case err, ok := <-m.watcher.Errors():
+			if !ok {
+				return wrapFailure(FailureCopy, pkgerrors.New("変更の監視が終了しました"))
+			}
+			if !errors.Is(err, errWatchOverflow) {
+				return wrapFailure(FailureCopy, pkgerrors.Errorf("変更の監視に失敗: %v", err))
+			}
+			log.Printf("変更通知を取りこぼしたため全体を照合します: %s", m.cfg.WorkDir)
+			m.fullSync = true
+			schedule()
+		case <-timer.C:
+			if !m.flush() {
+				// ロック中のため延期（同期待ちのパスは保持）
+				m.pendingSince = time.Time{}
+				schedule()
+			}
+		case <-ticker.C:
+			m.fullSync = true
+			if !m.flush() {
+				schedule()
+			}
+		}
+	}
+}
+
+// isWatchTarget は監視対象（保護されたフォルダ・exclude_dirs の外）の work_dir 以下のパスの場合に true を返します。
+// 拡張子は削除・ディレクトリの判定ができないため同期時に判定します。
+func (cfg *BackupConfig) isWatchTarget(path string) bool {
+	rel, err := filepath.Rel(cfg.WorkDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if isProtectedSystemDir(name) {
+			return false
+		}
+	}
+	return !cfg.isExcludedPath(path)
+}
+
+// flush は同期待ちの変更を反映します。ロックを取得できなかった場合は false を返します。
+func (m *mirrorWatch) flush() bool {
+	if m.fullSync {
+		if !m.reconcileAll() {
+			return false
+		}
+		m.fullSync = false
+		m.pending = make(map[string]bool)
+		m.pendingSince = time.Time{}
+		return true
+	}
+	if len(m.pending) == 0 {
+		return true
+	}
+
+	unlock, ok := m.lock()
+	if !ok {
+		return false
+	}
+	defer unlock()
+
+	paths := make([]string, 0, len(m.pending))
+	for path := range m.pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	m.pending = make(map[string]bool)
+	m.pendingSince = time.Time{}
+
+	copied, removed := 0, 0
+	var failed []string
+	for _, path := range paths {
+		c, r, err := m.syncPath(path)
+		copied += c
+		removed += r
+		if err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if copied > 0 || removed > 0 {
+		log.Printf("変更を反映しました: %d個のファイルをコピー、%d個を削除", copied, removed)
+	}
+	if len(failed) > 0 {
+		// 失敗したパスは次回の全体の照合で反映する
+		reportFailure(m.cfg, "", wrapFailure(FailureCopy, pkgerrors.Errorf("変更の反映に失敗: %s", strings.Join(failed, "; "))))
+	}
+	return true
+}
+
+// reconcileAll は tryCopy で work_dir 全体を backup_dir に照合します。
+// ロックを取得できなかった場合は false を返します。
+func (m *mirrorWatch) reconcileAll() bool {
+	unlock, ok := m.lock()
+	if !ok {
+		return false
+	}
+	defer unlock()
+	log.Printf("全体を照合します: %s → %s", m.cfg.WorkDir, m.cfg.BackupDir)
+	if err := tryCopy(m.cfg, m.cfg.WorkDir, m.cfg.BackupDir, m.cfg.DryRun); err != nil {
+		reportFailure(m.cfg, "", wrapFailure(FailureCopy, pkgerrors.Errorf("コピー失敗: %v", err)))
+	}
+	return true
+}
+
+// lock はスケジュール実行のバックアップと同時に backup_dir を更新しないようにロックを取得します。
+func (m *mirrorWatch) lock() (unlock func(), ok bool) {
+	if !m.cfg.EnableLock || m.cfg.DryRun {
+		return func() {}, true
+	}
+	f, err := acquireFileLock(m.cfg.LockFilePath)
+	if err != nil {
+		log.Printf("ロックを取得できないため同期を延期します: %v", err)
+		return nil, false
+	}
+	return func() { releaseFileLock(f) }, true
+}
+
+// syncPath は1つのパスの変更を backup_dir に反映し、コピー・削除したファイル数を返します。
+// ディレクトリの場合は配下のファイルを、削除された場合は backup_dir 側を削除します。
+func (m *mirrorWatch) syncPath(path string) (copied, removed int, err error) {
+	rel, err := filepath.Rel(m.cfg.WorkDir, path)
+	if err != nil {
+		return 0, 0, err
+	}
+	dst := filepath.Join(m.cfg.BackupDir, rel)
+
+	info, err := os.Lstat(path)
+	switch {
+	case os.IsNotExist(err):
+		if _, err := os.Lstat(dst); err != nil || rel == "." {
+			return 0, 0, nil
+		}
+		if m.cfg.DryRun {
+			fmt.Fprintf(m.out, "[DRY-RUN] 削除予定: %s\n", filepath.ToSlash(rel))
+			return 0, 1, nil
+		}
+		if err := os.RemoveAll(dst); err != nil {
+			return 0, 0, pkgerrors.Errorf("%s の削除に失敗: %v", dst, err)
+		}
+		return 0, 1, nil
+	case err != nil:
+		return 0, 0, err
+	case info.IsDir():
+		err := newCopyFilter(m.cfg).walkFiles(path, func(src, sub string, info os.FileInfo) error {
+			c, err := m.mirrorFile(src, filepath.Join(dst, filepath.FromSlash(sub)), info)
+			if c {
+				copied++
+			}
+			return err
+		})
+		return copied, 0, err
+	case info.Mode().IsRegular() && newCopyFilter(m.cfg).matches(path):
+		c, err := m.mirrorFile(path, dst, info)
+		if c {
+			copied++
+		}
+		return copied, 0, err
+	}
+	return 0, 0, nil
+}
+
+// mirrorFile は src を dst にコピーし、更新日時を合わせます。
+// サイズと更新日時が同じ場合はコピーしません（native コピーと同じ判定）。
+func (m *mirrorWatch) mirrorFile(src, dst string, info os.FileInfo) (bool, error) {
+	if d, err := os.Stat(dst); err == nil && d.Mode().IsRegular() && d.Size() == info.Size() && d.ModTime().Equal(info.ModTime()) {
+		return false, nil
+	}
+	if m.cfg.DryRun {
+		rel, _ := filepath.Rel(m.cfg.BackupDir, dst)
+		fmt.Fprintf(m.out, "[DRY-RUN] コピー予定: %s (%s)\n", filepath.ToSlash(rel), formatBytes(info.Size()))
+		return true, nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil // 同期までに削除された
+		}
+		return false, pkgerrors.Errorf("%s を開けません: %v", src, err)
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return false, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(out, m.cfg.Throttle.newLimiter().Reader(in)); err != nil {
+		out.Close()
+		return false, pkgerrors.Errorf("%s のコピーに失敗: %v", src, err)
+	}
+	if err := out.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		log.Printf("更新日時の設定に失敗: %s: %v", dst, err)
+	}
+	return true, nil
+}
+
+// runWatch は各ジョブの work_dir を監視し、変更されたファイルのみを backup_dir に反映し続けます。
+// Ctrl+C・SIGTERM で終了します。
+func runWatch(configPath string) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return wrapFailure(FailureConfig, err)
+	}
+	if err := setupLogOutput(cfg); err != nil {
+		return wrapFailure(FailureConfig, fmt.Errorf("ログ出力設定エラー: %v", err))
+	}
+	jobs, err := prepareJobs(cfg)
+	if err != nil {
+		return err
+	}
+
+	// throttle.low_io_priority が有効な場合はプロセスの I/O 優先度を下げる
+	lowerIOPriority(cfg)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return watchJobs(ctx, jobs, os.Stdout)
+}
+
+// watchJobs はジョブごとに監視を開始し、ctx が終了するかいずれかの監視が失敗するまで待ちます。
+// 常駐するため max_concurrent_jobs に関係なくすべてのジョブを同時に監視します。
+func watchJobs(ctx context.Context, jobs []*BackupConfig, out io.Writer) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		if err := job.snapshotFormat().Prepare(job); err != nil {
+			cancel()
+			errs[i] = err
+			break
+		}
+		watcher, err := newFSWatcher(job.WorkDir, job.isWatchTarget)
+		if err != nil {
+			cancel()
+			errs[i] = wrapFailure(FailureCopy, pkgerrors.Errorf("%s の監視を開始できません: %v", job.WorkDir, err))
+			break
+		}
+		debounce, reconcile := job.Watch.durations()
+		m := &mirrorWatch{cfg: job, watcher: watcher, debounce: debounce, reconcile: reconcile, out: out}
+		log.Printf("変更の監視を開始します: %s → %s (debounce %v, 全体の照合 %v ごと)", job.WorkDir, job.BackupDir, debounce, reconcile)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer watcher.Close()
+			if err := m.run(ctx); err != nil {
+				errs[i] = reportFailure(m.cfg, "", err)
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	log.Printf("変更の監視を終了しました")
+	return errors.Join(errs...)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// 変更監視による update-backup（watch）のテスト
+// =============================================================================
+
+// fakeWatcher はテストから変更を通知する fsWatcher です。
+type fakeWatcher struct {
+	events chan string
+	errors chan error
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{events: make(chan string, 16), errors: make(chan error, 1)}
+}
+
+func (w *fakeWatcher) Events() <-chan string { return w.events }
+func (w *fakeWatcher) Errors() <-chan error  { return w.errors }
+func (w *fakeWatcher) Close() error          { return nil }
+
+// waitFor は cond が true になるまで待ちます。
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s を待機中にタイムアウトしました", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// fileContent はファイルの内容を返します（存在しない場合は空文字列）。
+func fileContent(path string) string {
+	data, _ := os.ReadFile(path)
+	return string(data)
+}
+
+// startMirrorWatch は fakeWatcher で監視を開始します。stop は監視の終了を待ちます（テスト終了時にも呼ばれます）。
+func startMirrorWatch(t *testing.T, cfg *BackupConfig, reconcile time.Duration) (w *fakeWatcher, out *bytes.Buffer, stop func()) {
+	w = newFakeWatcher()
+	out = &bytes.Buffer{}
+	m := &mirrorWatch{cfg: cfg, watcher: w, debounce: 10 * time.Millisecond, reconcile: reconcile, out: out}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- m.run(ctx) }()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			if err := <-done; err != nil {
+				t.Errorf("監視がエラーで終了しました: %v", err)
+			}
+		})
+	}
+	t.Cleanup(stop)
+	return w, out, stop
+}
+
+// newWatchTestConfig は native コピーで work_dir を backup_dir へ反映する設定を作成します。
+func newWatchTestConfig(t *testing.T) *BackupConfig {
+	cfg := newValidTestConfig(t)
+	cfg.CopyMethodPriority = []string{"native"}
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "a"})
+	return cfg
+}
+
+func TestMirrorWatchSyncsChangedPaths(t *testing.T) {
+	cfg := newWatchTestConfig(t)
+	cfg.Extensions = []string{".txt"}
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "skip")}
+	w, _, _ := startMirrorWatch(t, cfg, time.Hour)
+	mirror := func(rel string) string { return fileContent(filepath.Join(cfg.BackupDir, filepath.FromSlash(rel))) }
+
+	// 開始時に全体を照合する
+	waitFor(t, "初回の照合", func() bool { return mirror("a.txt") == "a" })
+
+	// 新しいディレクトリは配下のファイルもコピーする
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"sub/b.txt": "b", "sub/deep/c.txt": "c"})
+	w.events <- filepath.Join(cfg.WorkDir, "sub")
+	waitFor(t, "ディレクトリのコピー", func() bool { return mirror("sub/b.txt") == "b" && mirror("sub/deep/c.txt") == "c" })
+
+	// 変更・削除を反映し、除外ディレクトリ・対象外の拡張子は無視する
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"a.txt": "a2", "skip/x.txt": "x", "y.log": "y", "z.txt": "z"})
+	os.Remove(filepath.Join(cfg.WorkDir, "sub", "b.txt"))
+	for _, rel := range []string{"a.txt", "skip/x.txt", "y.log", "sub/b.txt", "z.txt"} {
+		w.events <- filepath.Join(cfg.WorkDir, filepath.FromSlash(rel))
+	}
+	waitFor(t, "変更の反映", func() bool { return mirror("a.txt") == "a2" && mirror("z.txt") == "z" })
+	if _, err := os.Stat(filepath.Join(cfg.BackupDir, "sub", "b.txt")); !os.IsNotExist(err) {
+		t.Error("削除したファイルが残っています")
+	}
+	if mirror("skip/x.txt") != "" || mirror("y.log") != "" {
+		t.Error("除外対象のファイルがコピーされました")
+	}
+
+	// ディレクトリの削除
+	os.RemoveAll(filepath.Join(cfg.WorkDir, "sub"))
+	w.events <- filepath.Join(cfg.WorkDir, "sub")
+	waitFor(t, "ディレクトリの削除", func() bool {
+		_, err := os.Stat(filepath.Join(cfg.BackupDir, "sub"))
+		return os.IsNotExist(err)
+	})
+}
+
+func TestMirrorWatchReconcile(t *testing.T) {
+	t.Run("通知のあふれ", func(t *testing.T) {
+		cfg := newWatchTestConfig(t)
+		w, _, _ := startMirrorWatch(t, cfg, time.Hour)
+		waitFor(t, "初回の照合", func() bool { return fileContent(filepath.Join(cfg.BackupDir, "a.txt")) == "a" })
+
+		writeTestFiles(t, cfg.WorkDir, map[string]string{"missed.txt": "m"})
+		w.errors <- errWatchOverflow
+		waitFor(t, "全体の照合", func() bool { return fileContent(filepath.Join(cfg.BackupDir, "missed.txt")) == "m" })
+	})
+
+	t.Run("定期的な照合", func(t *testing.T) {
+		cfg := newWatchTestConfig(t)
+		startMirrorWatch(t, cfg, 50*time.Millisecond)
+		waitFor(t, "初回の照合", func() bool { return fileContent(filepath.Join(cfg.BackupDir, "a.txt")) == "a" })
+
+		writeTestFiles(t, cfg.WorkDir, map[string]string{"missed.txt": "m"})
+		waitFor(t, "定期的な照合", func() bool { return fileContent(filepath.Join(cfg.BackupDir, "missed.txt")) == "m" })
+	})
+}
+
+func TestMirrorWatchWaitsForLock(t *testing.T) {
+	cfg := newWatchTestConfig(t)
+	cfg.EnableLock = true
+	cfg.LockFilePath = filepath.Join(t.TempDir(), "backup.lock")
+
+	// スケジュール実行のバックアップがロックを保持している間は反映しない
+	lock, err := acquireFileLock(cfg.LockFilePath)
+	if err != nil {
+		t.Fatalf("ロックの取得に失敗: %v", err)
+	}
+	w, _, _ := startMirrorWatch(t, cfg, time.Hour)
+	writeTestFiles(t, cfg.WorkDir, map[string]string{"b.txt": "b"})
+	w.events <- filepath.Join(cfg.WorkDir, "b.txt")
+	time.Sleep(100 * time.Millisecond)
+	if fileContent(filepath.Join(cfg.BackupDir, "a.txt")) != "" || fileContent(filepath.Join(cfg.BackupDir, "b.txt")) != "" {
+		t.Fatal("ロック中に backup_dir が更新されました")
+	}
+
+	releaseFileLock(lock)
+	waitFor(t, "ロック解放後の反映", func() bool {
+		return fileContent(filepath.Join(cfg.BackupDir, "a.txt")) == "a" && fileContent(filepath.Join(cfg.BackupDir, "b.txt")) == "b"
+	})
+	waitFor(t, "ロックの解放", func() bool {
+		_, err := os.Stat(cfg.LockFilePath)
+		return os.IsNotExist(err)
+	})
+}
+
+func TestMirrorWatchDryRun(t *testing.T) {
+	cfg := newWatchTestConfig(t)
+	cfg.DryRun = true
+	writeTestFiles(t, cfg.BackupDir, map[string]string{"old.txt": "old"})
+	var out *bytes.Buffer
+	captureStdout(t, func() {
+		var w *fakeWatcher
+		var stop func()
+		w, out, stop = startMirrorWatch(t, cfg, time.Hour)
+		writeTestFiles(t, cfg.WorkDir, map[string]string{"b.txt": "b"})
+		w.events <- filepath.Join(cfg.WorkDir, "b.txt")
+		w.events <- filepath.Join(cfg.WorkDir, "old.txt")
+		time.Sleep(100 * time.Millisecond)
+		stop()
+	})
+	for _, want := range []string{"[DRY-RUN] コピー予定: b.txt", "[DRY-RUN] 削除予定: old.txt"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("出力に %q が含まれていません: %s", want, out)
+		}
+	}
+	if fileContent(filepath.Join(cfg.BackupDir, "b.txt")) != "" || fileContent(filepath.Join(cfg.BackupDir, "old.txt")) != "old" {
+		t.Error("ドライランで backup_dir が変更されました")
+	}
+}
+
+func TestIsWatchTarget(t *testing.T) {
+	cfg := newValidTestConfig(t)
+	cfg.ExcludeDirs = []string{filepath.Join(cfg.WorkDir, "node_modules")}
+	tests := []struct {
+		rel  string
+		want bool
+	}{
+		{"src/main.go", true},
+		{"node_modules/x/index.js", false},
+		{"$RECYCLE.BIN/file", false},
+		{"System Volume Information", false},
+		{"../outside.txt", false},
+	}
+	for _, tt := range tests {
+		if got := cfg.isWatchTarget(filepath.Join(cfg.WorkDir, filepath.FromSlash(tt.rel))); got != tt.want {
+			t.Errorf("isWatchTarget(%s) = %v, want %v", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestWatchConfigDurations(t *testing.T) {
+	d, r := WatchConfig{}.durations()
+	if d != defaultWatchDebounce || r != defaultWatchReconcile {
+		t.Errorf("既定値が違います: %v %v", d, r)
+	}
+	d, r = WatchConfig{Debounce: "500ms", ReconcileInterval: "5m"}.durations()
+	if d != 500*time.Millisecond || r != 5*time.Minute {
+		t.Errorf("設定値が反映されていません: %v %v", d, r)
+	}
+
+	cfg := newValidTestConfig(t)
+	cfg.Watch = WatchConfig{Debounce: "2", ReconcileInterval: "-1m"}
+	problems := validateConfig(cfg)
+	if findProblem(problems, "watch.debounce") == nil || findProblem(problems, "watch.reconcile_interval") == nil {
+		t.Errorf("不正な期間が検出されません: %+v", problems)
+	}
+}
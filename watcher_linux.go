@@ -0,0 +1,163 @@
+//go:build linux
+
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// inotifyMask は監視する inotify のイベントです。
+const inotifyMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_CLOSE_WRITE | unix.IN_ATTRIB |
+	unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF
+
+// inotifyWatcher は inotify による fsWatcher です。
+// inotify はディレクトリ単位のため、作成・移動されたディレクトリにも監視を追加します。
+type inotifyWatcher struct {
+	file  *os.File // ノンブロッキングの inotify（Close で読み込みを中断できる）
+	fd    int
+	watch func(dir string) bool
+
+	mu      sync.Mutex
+	watches map[int]string // 監視記述子 → ディレクトリ
+
+	events    chan string
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPlatformWatcher(root string, watch func(dir string) bool) (fsWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, pkgerrors.Errorf("inotify を初期化できません: %v", err)
+	}
+	w := &inotifyWatcher{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		watch:   watch,
+		watches: make(map[int]string),
+		events:  make(chan string, 256),
+		errors:  make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+	if err := w.addTree(root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.readLoop()
+	return w, nil
+}
+
+// addTree は dir 以下のディレクトリを監視に追加します（監視対象外のディレクトリは除く）。
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil // 途中で削除された・アクセスできないディレクトリ
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != dir && !w.watch(path) {
+			return filepath.SkipDir
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			if err == unix.ENOSPC {
+				return pkgerrors.Errorf("inotify の監視数の上限に達しました（fs.inotify.max_user_watches を増やしてください）: %s", path)
+			}
+			if path == dir {
+				return pkgerrors.Errorf("%s を監視できません: %v", path, err)
+			}
+			return nil
+		}
+		// 移動したディレクトリは同じ監視記述子が返るため、パスを更新する
+		w.mu.Lock()
+		w.watches[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) readLoop() {
+	defer close(w.events)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				w.sendError(pkgerrors.Errorf("inotify の読み込みに失敗: %v", err))
+			}
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+			offset = nameStart + int(raw.Len)
+
+			if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+				w.sendError(errWatchOverflow)
+				continue
+			}
+			w.mu.Lock()
+			dir, ok := w.watches[int(raw.Wd)]
+			if raw.Mask&unix.IN_IGNORED != 0 {
+				delete(w.watches, int(raw.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || raw.Mask&unix.IN_IGNORED != 0 {
+				continue
+			}
+
+			path := dir
+			if name != "" {
+				path = filepath.Join(dir, name)
+			}
+			if raw.Mask&unix.IN_ISDIR != 0 && raw.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 && w.watch(path) {
+				if err := w.addTree(path); err != nil {
+					log.Printf("監視の追加に失敗: %v", err)
+					w.sendError(errWatchOverflow)
+				}
+			}
+			select {
+			case w.events <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// sendError はエラーを通知します。未処理のエラーがある場合は破棄します（取りこぼしは全体の照合で補う）。
+func (w *inotifyWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}
+
+func (w *inotifyWatcher) Events() <-chan string { return w.events }
+func (w *inotifyWatcher) Errors() <-chan error  { return w.errors }
+
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	return err
+}
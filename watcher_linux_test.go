@@ -0,0 +1,81 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextWatchEvent は want のパスが通知されるまで待ちます。
+func nextWatchEvent(t *testing.T, w fsWatcher, want string) {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case path := <-w.Events():
+			if path == want {
+				return
+			}
+		case err := <-w.Errors():
+			t.Fatalf("監視のエラー: %v", err)
+		case <-timeout:
+			t.Fatalf("%s の変更が通知されません", want)
+		}
+	}
+}
+
+func TestInotifyWatcher(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "skip"), 0755)
+	w, err := newPlatformWatcher(root, func(dir string) bool { return filepath.Base(dir) != "skip" })
+	if err != nil {
+		t.Fatalf("監視の開始に失敗: %v", err)
+	}
+	defer w.Close()
+
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	nextWatchEvent(t, w, filepath.Join(root, "a.txt"))
+
+	// 作成したディレクトリにも監視を追加する
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	nextWatchEvent(t, w, filepath.Join(root, "sub"))
+	os.WriteFile(filepath.Join(root, "sub", "b.txt"), []byte("b"), 0644)
+	nextWatchEvent(t, w, filepath.Join(root, "sub", "b.txt"))
+
+	// 移動したディレクトリは移動先のパスで通知する
+	os.Rename(filepath.Join(root, "sub"), filepath.Join(root, "moved"))
+	nextWatchEvent(t, w, filepath.Join(root, "moved"))
+	os.Remove(filepath.Join(root, "moved", "b.txt"))
+	nextWatchEvent(t, w, filepath.Join(root, "moved", "b.txt"))
+
+	// 監視対象外のディレクトリの変更は通知しない
+	os.WriteFile(filepath.Join(root, "skip", "x.txt"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(root, "c.txt"), []byte("c"), 0644)
+	for {
+		path := <-w.Events()
+		if path == filepath.Join(root, "skip", "x.txt") {
+			t.Fatal("監視対象外のディレクトリの変更が通知されました")
+		}
+		if path == filepath.Join(root, "c.txt") {
+			break
+		}
+	}
+
+	// Close すると通知が終了する
+	if err := w.Close(); err != nil {
+		t.Fatalf("監視の終了に失敗: %v", err)
+	}
+	for range w.Events() {
+	}
+	select {
+	case err := <-w.Errors():
+		if err != nil && !errors.Is(err, errWatchOverflow) {
+			t.Errorf("終了時にエラーが通知されました: %v", err)
+		}
+	default:
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package main
+
+import pkgerrors "github.com/pkg/errors"
+
+// newPlatformWatcher は Linux・Windows 以外では変更の監視に対応していないためエラーを返します。
+func newPlatformWatcher(root string, watch func(dir string) bool) (fsWatcher, error) {
+	return nil, pkgerrors.New("この OS では変更の監視に対応していません（Linux・Windows のみ）")
+}
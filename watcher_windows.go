@@ -0,0 +1,109 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"unsafe"
+
+	pkgerrors "github.com/pkg/errors"
+	"golang.org/x/sys/windows"
+)
+
+// windowsNotifyFilter は ReadDirectoryChangesW で監視する変更です。
+const windowsNotifyFilter = windows.FILE_NOTIFY_CHANGE_FILE_NAME | windows.FILE_NOTIFY_CHANGE_DIR_NAME |
+	windows.FILE_NOTIFY_CHANGE_SIZE | windows.FILE_NOTIFY_CHANGE_LAST_WRITE | windows.FILE_NOTIFY_CHANGE_ATTRIBUTES
+
+// windowsWatcher は ReadDirectoryChangesW による fsWatcher です。
+// サブツリー全体を1つのハンドルで監視するため、除外ディレクトリの変更も通知されます（同期時に除外）。
+type windowsWatcher struct {
+	root   string
+	handle windows.Handle
+
+	events    chan string
+	errors    chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPlatformWatcher(root string, watch func(dir string) bool) (fsWatcher, error) {
+	p, err := windows.UTF16PtrFromString(root)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(p, windows.FILE_LIST_DIRECTORY,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.OPEN_EXISTING, windows.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return nil, pkgerrors.Errorf("%s を監視できません: %v", root, err)
+	}
+	w := &windowsWatcher{
+		root:   root,
+		handle: h,
+		events: make(chan string, 256),
+		errors: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+	go w.readLoop()
+	return w, nil
+}
+
+func (w *windowsWatcher) readLoop() {
+	defer close(w.events)
+	// ネットワーク共有では 64KiB を超えるバッファは使用できない
+	buf := make([]byte, 64*1024)
+	for {
+		var n uint32
+		err := windows.ReadDirectoryChanges(w.handle, &buf[0], uint32(len(buf)), true, windowsNotifyFilter, &n, nil, 0)
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		if err == windows.ERROR_NOTIFY_ENUM_DIR || (err == nil && n == 0) {
+			// 変更が多くバッファがあふれた
+			w.sendError(errWatchOverflow)
+			continue
+		}
+		if err != nil {
+			w.sendError(pkgerrors.Errorf("ReadDirectoryChangesW に失敗: %v", err))
+			return
+		}
+		for offset := uint32(0); ; {
+			info := (*windows.FileNotifyInformation)(unsafe.Pointer(&buf[offset]))
+			name := windows.UTF16ToString(unsafe.Slice(&info.FileName, info.FileNameLength/2))
+			select {
+			case w.events <- filepath.Join(w.root, name):
+			case <-w.done:
+				return
+			}
+			if info.NextEntryOffset == 0 {
+				break
+			}
+			offset += info.NextEntryOffset
+		}
+	}
+}
+
+// sendError はエラーを通知します。未処理のエラーがある場合は破棄します（取りこぼしは全体の照合で補う）。
+func (w *windowsWatcher) sendError(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}
+
+func (w *windowsWatcher) Events() <-chan string { return w.events }
+func (w *windowsWatcher) Errors() <-chan error  { return w.errors }
+
+func (w *windowsWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		// 待機中の ReadDirectoryChangesW を中断してからハンドルを閉じる
+		windows.CancelIoEx(w.handle, nil)
+		err = windows.CloseHandle(w.handle)
+	})
+	return err
+}